@@ -2,19 +2,24 @@ package cmds
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/mattn/go-mastodon"
+	"google.golang.org/protobuf/encoding/protojson"
 
 	"github.com/Palats/mastopoof/backend/server"
 	"github.com/Palats/mastopoof/backend/storage"
 	"github.com/Palats/mastopoof/backend/types"
+	stpb "github.com/Palats/mastopoof/proto/gen/mastopoof/storage"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func CmdUsers(ctx context.Context, st *storage.Storage) error {
+func CmdUsers(ctx context.Context, st storage.Store) error {
 	userList, err := st.ListUsers(ctx)
 	if err != nil {
 		return err
@@ -27,11 +32,14 @@ func CmdUsers(ctx context.Context, st *storage.Storage) error {
 			userEntry.AccountState.AccountId,
 			userEntry.AccountState.ServerAddr,
 			userEntry.UserState.DefaultStid)
+		if userEntry.UserState.Disabled {
+			fmt.Println("  disabled")
+		}
 	}
 	return nil
 }
 
-func CmdMe(ctx context.Context, st *storage.Storage, uid types.UID, showAccount bool) error {
+func CmdMe(ctx context.Context, st storage.Store, uid types.UID, showAccount bool) error {
 	fmt.Println("# User ID:", uid)
 
 	userState, err := st.UserState(ctx, nil, uid)
@@ -86,7 +94,7 @@ func CmdMe(ctx context.Context, st *storage.Storage, uid types.UID, showAccount
 	return nil
 }
 
-func CmdCheckStreamState(ctx context.Context, st *storage.Storage, stid types.StID, doFix bool) error {
+func CmdCheckStreamState(ctx context.Context, st storage.Store, stid types.StID, doFix bool) error {
 	return st.InTxnRW(ctx, func(ctx context.Context, txn storage.SQLReadWrite) error {
 		// Stream content - check for duplicates
 		fmt.Println("### Duplicate statuses in stream")
@@ -147,3 +155,268 @@ func CmdCheckStreamState(ctx context.Context, st *storage.Storage, stid types.St
 		return storage.ErrCleanAbortTxn
 	})
 }
+
+func CmdRecomputeMeta(ctx context.Context, st storage.Store, uid types.UID, includePositioned bool) error {
+	// Filters are not fetched again from Mastodon; the version recorded on
+	// each account is used.
+	result, err := st.RecomputeMeta(ctx, uid, includePositioned, func(p *storage.RecomputeMetaProgress) error {
+		fmt.Printf("Processed %d/%d statuses, %d updated\n", p.Processed, p.Total, p.Updated)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Done: %d statuses updated.\n", result.Updated)
+	return nil
+}
+
+func CmdGC(ctx context.Context, st storage.Store, uid types.UID, policy storage.RetentionPolicy, dryRun bool, vacuum bool) error {
+	result, err := st.GC(ctx, uid, policy, dryRun)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		fmt.Println("### Dry run, nothing modified")
+	}
+	fmt.Println("Pruned statuses:", result.Pruned)
+	fmt.Println("Pruned bytes:", result.PrunedBytes)
+	fmt.Println("Kept as favourited or bookmarked:", result.Kept)
+
+	if vacuum && !dryRun {
+		fmt.Println("Vacuuming database...")
+		return st.Vacuum(ctx)
+	}
+	return nil
+}
+
+func CmdExportUser(ctx context.Context, st storage.Store, uid types.UID, output string, withTokens bool) error {
+	archive, err := st.ExportUser(ctx, uid, withTokens)
+	if err != nil {
+		return err
+	}
+	data, err := protojson.Marshal(archive)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(output, data, 0o600); err != nil {
+		return err
+	}
+	fmt.Printf("Exported uid=%d: %d accounts, %d streams, %d statuses.\n", uid, len(archive.AccountStates), len(archive.StreamStates), len(archive.Statuses))
+	return nil
+}
+
+func CmdImportUser(ctx context.Context, st storage.Store, input string) error {
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return err
+	}
+	archive := &stpb.UserArchive{}
+	if err := protojson.Unmarshal(data, archive); err != nil {
+		return fmt.Errorf("unable to parse archive %s: %w", input, err)
+	}
+	userState, err := st.ImportUser(ctx, archive)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported as uid=%d (default stream %d).\n", userState.Uid, userState.DefaultStid)
+	for _, accountState := range archive.AccountStates {
+		if accountState.AccessToken == "" {
+			fmt.Printf("Account %s@%s has no access token; the user must log in again with it.\n", accountState.Username, accountState.ServerAddr)
+		}
+	}
+	return nil
+}
+
+func CmdBackup(ctx context.Context, st storage.Store, output string, snapshotDir string, snapshotKeep int) error {
+	if (output == "") == (snapshotDir == "") {
+		return errors.New("exactly one of --output or --snapshot_dir must be set")
+	}
+	if output != "" {
+		if err := st.Backup(ctx, output); err != nil {
+			return err
+		}
+		fmt.Println("Backup written to", output)
+		return nil
+	}
+	path, err := st.Snapshot(ctx, snapshotDir, snapshotKeep)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Snapshot written to", path)
+	return nil
+}
+
+func CmdRestore(ctx context.Context, input string, dbFilename string) error {
+	version, err := storage.CheckBackup(ctx, input)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backup %s has schema version %d.\n", input, version)
+	keptPath, err := storage.Restore(ctx, input, dbFilename)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored to %s.\n", dbFilename)
+	if keptPath != "" {
+		fmt.Printf("Previous database was kept as %s.\n", keptPath)
+	}
+	return nil
+}
+
+func CmdMigrateStatus(ctx context.Context, st storage.Store, target int) error {
+	status, err := st.SchemaStatus(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Engine: %s\n", status.Engine)
+	fmt.Printf("Current version: %d\n", status.Current)
+	fmt.Printf("Latest version: %d\n", status.Latest)
+	if target < 0 {
+		target = status.Latest
+	}
+	fmt.Printf("Target version: %d\n", target)
+	if status.Current > status.Latest {
+		return fmt.Errorf("%w: this binary only supports up to version %d", storage.ErrSchemaTooNew, status.Latest)
+	}
+	return nil
+}
+
+func CmdMigratePlan(ctx context.Context, st storage.Store, target int) error {
+	plan, err := migrationPlan(ctx, st, target)
+	if err != nil {
+		return err
+	}
+	if len(plan) == 0 {
+		fmt.Println("Schema is up to date; nothing to do.")
+		return nil
+	}
+	for _, step := range plan {
+		extra := ""
+		if step.DisableForeignKeys {
+			extra += " (foreign keys disabled)"
+		}
+		if step.To > step.From && !step.Reversible {
+			extra += " (irreversible)"
+		}
+		fmt.Printf("%d -> %d: %s%s\n", step.From, step.To, step.Name, extra)
+	}
+	return nil
+}
+
+func CmdMigrate(ctx context.Context, st storage.Store, target int) error {
+	plan, err := migrationPlan(ctx, st, target)
+	if err != nil {
+		return err
+	}
+	if len(plan) == 0 {
+		fmt.Println("Schema is up to date; nothing to do.")
+		return nil
+	}
+	target = plan[len(plan)-1].To
+	if err := st.Migrate(ctx, target); err != nil {
+		return err
+	}
+	fmt.Printf("Schema migrated from version %d to version %d.\n", plan[0].From, target)
+	return nil
+}
+
+// migrationPlan returns the steps to reach `target`; a negative target means
+// the latest version.
+func migrationPlan(ctx context.Context, st storage.Store, target int) ([]*storage.MigrationStep, error) {
+	if target < 0 {
+		status, err := st.SchemaStatus(ctx)
+		if err != nil {
+			return nil, err
+		}
+		target = status.Latest
+	}
+	return st.MigrationPlan(ctx, target)
+}
+
+func CmdDeleteUser(ctx context.Context, st storage.Store, uid types.UID) error {
+	if uid == 0 {
+		return errors.New("missing --uid")
+	}
+	if err := st.DeleteUser(ctx, uid); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted uid=%d.\n", uid)
+	return nil
+}
+
+func CmdSetUserDisabled(ctx context.Context, st storage.Store, uid types.UID, disabled bool) error {
+	if uid == 0 {
+		return errors.New("missing --uid")
+	}
+	if err := st.SetUserDisabled(ctx, uid, disabled); err != nil {
+		return err
+	}
+	if disabled {
+		fmt.Printf("Disabled uid=%d; its sessions were revoked.\n", uid)
+	} else {
+		fmt.Printf("Enabled uid=%d.\n", uid)
+	}
+	return nil
+}
+
+func CmdRevokeSessions(ctx context.Context, st storage.Store, uid types.UID) error {
+	if uid == 0 {
+		return errors.New("missing --uid")
+	}
+	count, err := st.RevokeSessions(ctx, uid)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Revoked %d sessions of uid=%d.\n", count, uid)
+	return nil
+}
+
+func CmdCreateInviteCode(ctx context.Context, st storage.Store, code string, maxUses int64, expiresIn time.Duration) error {
+	inviteCode := &stpb.InviteCode{
+		Code:    code,
+		MaxUses: maxUses,
+	}
+	if expiresIn > 0 {
+		inviteCode.ExpiresAtSecs = time.Now().Add(expiresIn).Unix()
+	}
+	if err := st.CreateInviteCode(ctx, nil, inviteCode); err != nil {
+		return err
+	}
+	fmt.Println(inviteCode.Code)
+	return nil
+}
+
+func CmdListInviteCodes(ctx context.Context, st storage.Store) error {
+	inviteCodes, err := st.ListInviteCodes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, inviteCode := range inviteCodes {
+		maxUses := "unlimited"
+		if inviteCode.MaxUses != 0 {
+			maxUses = fmt.Sprint(inviteCode.MaxUses)
+		}
+		expires := "never"
+		if inviteCode.ExpiresAtSecs != 0 {
+			expires = time.Unix(inviteCode.ExpiresAtSecs, 0).Format(time.RFC3339)
+		}
+		fmt.Printf("code=%s uses=%d max_uses=%s expires=%s created=%s\n",
+			inviteCode.Code,
+			inviteCode.Uses,
+			maxUses,
+			expires,
+			time.Unix(inviteCode.CreatedSecs, 0).Format(time.RFC3339))
+	}
+	return nil
+}
+
+func CmdDeleteInviteCode(ctx context.Context, st storage.Store, code string) error {
+	if code == "" {
+		return errors.New("missing --code")
+	}
+	if err := st.DeleteInviteCode(ctx, code); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted invite code %s.\n", code)
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -21,6 +22,7 @@ import (
 	"github.com/Palats/mastopoof/backend/storage"
 	"github.com/Palats/mastopoof/backend/types"
 	"github.com/Palats/mastopoof/frontend"
+	stpb "github.com/Palats/mastopoof/proto/gen/mastopoof/storage"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -38,20 +40,56 @@ func FlagStreamID(fs *pflag.FlagSet) *types.StID {
 }
 
 func FlagDBFilename(fs *pflag.FlagSet) *string {
-	return fs.String("db", "", "SQLite file")
+	return fs.String("db", "", "SQLite file, or PostgreSQL URL (postgres://...).")
 }
 
 func FlagSelfURL(fs *pflag.FlagSet) *string {
 	return fs.String("self_url", "", "URL to use for authentication redirection on the frontend. When empty, uses out-of-band auth.")
 }
-func FlagInviteCode(fs *pflag.FlagSet) *string {
-	return fs.String("invite_code", "", "If not empty, users can only be created by providing this code.")
+func FlagRequireInvite(fs *pflag.FlagSet) *bool {
+	return fs.Bool("require_invite", false, "If true, users can only be created with an invite code; see 'invite create'.")
 }
 func FlagInsecure(fs *pflag.FlagSet) *bool {
 	return fs.Bool("insecure", false, "If true, mark cookies as insecure, allowing serving without https")
 }
+func FlagFetchInterval(fs *pflag.FlagSet) *time.Duration {
+	return fs.Duration("fetch_interval", 0, "If not zero, regularly fetch statuses from Mastodon for all users, in the background.")
+}
+func FlagFetchJitter(fs *pflag.FlagSet) *time.Duration {
+	return fs.Duration("fetch_jitter", 30*time.Second, "Maximum random delay added to fetch_interval.")
+}
+func FlagFetchMaxBackoff(fs *pflag.FlagSet) *time.Duration {
+	return fs.Duration("fetch_max_backoff", time.Hour, "Maximum delay before background fetch tries again a failing Mastodon server.")
+}
+func FlagFetchRevalidate(fs *pflag.FlagSet) *int {
+	return fs.Int("fetch_revalidate", 20, "Number of statuses of each account to check again for edits and deletions on each background fetch. Successive fetches go through all the statuses in the stream.")
+}
+func FlagStreaming(fs *pflag.FlagSet) *bool {
+	return fs.Bool("streaming", false, "If true, get new statuses through the Mastodon streaming API for all users.")
+}
+
+func FlagRetentionDays(fs *pflag.FlagSet) *int {
+	return fs.Int("retention_days", 0, "If not zero, drop the content of statuses created more than that many days ago.")
+}
+func FlagRetentionPositions(fs *pflag.FlagSet) *int64 {
+	return fs.Int64("retention_positions", 0, "If not zero, drop the content of statuses at least that many positions before the last read position.")
+}
+
+func FlagSnapshotDir(fs *pflag.FlagSet) *string {
+	return fs.String("snapshot_dir", "", "Directory where timestamped backups of the database are written.")
+}
+func FlagSnapshotKeep(fs *pflag.FlagSet) *int {
+	return fs.Int("snapshot_keep", 7, "Number of backups to keep in snapshot_dir; older ones are removed.")
+}
 
-func getStreamID(ctx context.Context, st *storage.Storage, streamID types.StID, userID types.UID) (types.StID, error) {
+func retentionPolicy(days int, positions int64) storage.RetentionPolicy {
+	return storage.RetentionPolicy{
+		MaxAge:            time.Duration(days) * 24 * time.Hour,
+		MaxBehindLastRead: positions,
+	}
+}
+
+func getStreamID(ctx context.Context, st storage.Store, streamID types.StID, userID types.UID) (types.StID, error) {
 	if streamID != 0 {
 		return streamID, nil
 	}
@@ -79,7 +117,7 @@ func getMux(s *server.Server) (*http.ServeMux, error) {
 	return mux, nil
 }
 
-func getServer(st *storage.Storage, autoLogin types.UID, inviteCode string, insecure bool, selfURL string) (*server.Server, error) {
+func getServer(st storage.Store, autoLogin types.UID, requireInvite bool, insecure bool, selfURL string) (*server.Server, error) {
 	// Run the backend RPC server.
 	sessionManager := server.NewSessionManager(st)
 	if insecure {
@@ -96,7 +134,7 @@ func getServer(st *storage.Storage, autoLogin types.UID, inviteCode string, inse
 	}
 
 	appRegistry := server.NewAppRegistry(st)
-	return server.New(st, sessionManager, inviteCode, autoLogin, u, appRegistry), nil
+	return server.New(st, sessionManager, requireInvite, autoLogin, u, appRegistry), nil
 }
 
 func cmdUsers() *cobra.Command {
@@ -119,6 +157,121 @@ func cmdUsers() *cobra.Command {
 	return c
 }
 
+func cmdUser() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "user",
+		Short: "Administration of a user.",
+		Args:  cobra.NoArgs,
+	}
+	dbFilename := FlagDBFilename(c.PersistentFlags())
+	c.MarkPersistentFlagRequired("db")
+	userID := FlagUserID(c.PersistentFlags())
+
+	run := func(f func(ctx context.Context, st storage.Store, uid types.UID) error) func(cmd *cobra.Command, args []string) error {
+		return func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			st, err := storage.NewStorage(ctx, *dbFilename)
+			if err != nil {
+				return err
+			}
+			defer st.Close()
+			return f(ctx, st, *userID)
+		}
+	}
+
+	c.AddCommand(&cobra.Command{
+		Use:   "delete",
+		Short: "Remove a user, along with its accounts, streams, statuses and sessions.",
+		Args:  cobra.NoArgs,
+		RunE:  run(cmds.CmdDeleteUser),
+	})
+	c.AddCommand(&cobra.Command{
+		Use:   "disable",
+		Short: "Prevent a user from logging in, and stop fetching its statuses in the background.",
+		Args:  cobra.NoArgs,
+		RunE: run(func(ctx context.Context, st storage.Store, uid types.UID) error {
+			return cmds.CmdSetUserDisabled(ctx, st, uid, true)
+		}),
+	})
+	c.AddCommand(&cobra.Command{
+		Use:   "enable",
+		Short: "Undo 'user disable'.",
+		Args:  cobra.NoArgs,
+		RunE: run(func(ctx context.Context, st storage.Store, uid types.UID) error {
+			return cmds.CmdSetUserDisabled(ctx, st, uid, false)
+		}),
+	})
+
+	sessions := &cobra.Command{
+		Use:   "sessions",
+		Short: "Management of the HTTP sessions of a user.",
+		Args:  cobra.NoArgs,
+	}
+	sessions.AddCommand(&cobra.Command{
+		Use:   "revoke",
+		Short: "Log out the user from all its browsers.",
+		Args:  cobra.NoArgs,
+		RunE:  run(cmds.CmdRevokeSessions),
+	})
+	c.AddCommand(sessions)
+	return c
+}
+
+func cmdInvite() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "invite",
+		Short: "Management of the invite codes, required to create users with 'serve --require_invite'.",
+		Args:  cobra.NoArgs,
+	}
+	dbFilename := FlagDBFilename(c.PersistentFlags())
+	c.MarkPersistentFlagRequired("db")
+
+	run := func(f func(ctx context.Context, st storage.Store) error) func(cmd *cobra.Command, args []string) error {
+		return func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			st, err := storage.NewStorage(ctx, *dbFilename)
+			if err != nil {
+				return err
+			}
+			defer st.Close()
+			return f(ctx, st)
+		}
+	}
+
+	create := &cobra.Command{
+		Use:   "create",
+		Short: "Create an invite code and print it.",
+		Args:  cobra.NoArgs,
+	}
+	createCode := create.Flags().String("code", "", "Code to create. If empty, a random one is picked.")
+	maxUses := create.Flags().Int64("max_uses", 1, "Number of users which can be created with the code. 0 means no limit.")
+	expiresIn := create.Flags().Duration("expires_in", 7*24*time.Hour, "How long the code can be used. 0 means forever.")
+	create.RunE = run(func(ctx context.Context, st storage.Store) error {
+		return cmds.CmdCreateInviteCode(ctx, st, *createCode, *maxUses, *expiresIn)
+	})
+	c.AddCommand(create)
+
+	c.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List invite codes, including expired and used up ones.",
+		Args:  cobra.NoArgs,
+		RunE:  run(cmds.CmdListInviteCodes),
+	})
+
+	deleteCmd := &cobra.Command{
+		Use:   "delete",
+		Short: "Remove an invite code. Users created with it are kept.",
+		Args:  cobra.NoArgs,
+	}
+	deleteCode := deleteCmd.Flags().String("code", "", "Code to delete.")
+	deleteCmd.MarkFlagRequired("code")
+	deleteCmd.RunE = run(func(ctx context.Context, st storage.Store) error {
+		return cmds.CmdDeleteInviteCode(ctx, st, *deleteCode)
+	})
+	c.AddCommand(deleteCmd)
+	return c
+}
+
 func cmdClearApp() *cobra.Command {
 	c := &cobra.Command{
 		Use:   "clear-app",
@@ -223,8 +376,19 @@ func cmdServe() *cobra.Command {
 	selfURL := FlagSelfURL(c.PersistentFlags())
 	port := FlagPort(c.PersistentFlags())
 	userID := FlagUserID(c.PersistentFlags())
-	inviteCode := FlagInviteCode(c.PersistentFlags())
+	requireInvite := FlagRequireInvite(c.PersistentFlags())
 	insecure := FlagInsecure(c.PersistentFlags())
+	fetchInterval := FlagFetchInterval(c.PersistentFlags())
+	fetchJitter := FlagFetchJitter(c.PersistentFlags())
+	fetchMaxBackoff := FlagFetchMaxBackoff(c.PersistentFlags())
+	fetchRevalidate := FlagFetchRevalidate(c.PersistentFlags())
+	streaming := FlagStreaming(c.PersistentFlags())
+	gcInterval := c.PersistentFlags().Duration("gc_interval", 0, "If not zero, regularly drop the content of old statuses, following retention_days and retention_positions.")
+	retentionDays := FlagRetentionDays(c.PersistentFlags())
+	retentionPositions := FlagRetentionPositions(c.PersistentFlags())
+	snapshotInterval := c.PersistentFlags().Duration("snapshot_interval", 0, "If not zero, regularly write a backup of the database in snapshot_dir.")
+	snapshotDir := FlagSnapshotDir(c.PersistentFlags())
+	snapshotKeep := FlagSnapshotKeep(c.PersistentFlags())
 
 	c.RunE = func(cmd *cobra.Command, args []string) error {
 		ctx := cmd.Context()
@@ -234,10 +398,50 @@ func cmdServe() *cobra.Command {
 		}
 		defer st.Close()
 
-		s, err := getServer(st, *userID, *inviteCode, *insecure, *selfURL)
+		s, err := getServer(st, *userID, *requireInvite, *insecure, *selfURL)
 		if err != nil {
 			return err
 		}
+
+		if *fetchInterval > 0 {
+			fetcher := server.NewFetcher(s, *fetchInterval, *fetchJitter, *fetchMaxBackoff, *fetchRevalidate)
+			go func() {
+				if err := fetcher.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+					glog.Errorf("background fetch stopped: %v", err)
+				}
+			}()
+		}
+		if *streaming {
+			streamer := server.NewStreamer(s, time.Minute)
+			go func() {
+				if err := streamer.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+					glog.Errorf("streaming stopped: %v", err)
+				}
+			}()
+		}
+		if *gcInterval > 0 {
+			policy := retentionPolicy(*retentionDays, *retentionPositions)
+			if policy.MaxAge == 0 && policy.MaxBehindLastRead == 0 {
+				return errors.New("gc_interval requires retention_days or retention_positions")
+			}
+			collector := server.NewCollector(st, *gcInterval, policy)
+			go func() {
+				if err := collector.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+					glog.Errorf("background GC stopped: %v", err)
+				}
+			}()
+		}
+		if *snapshotInterval > 0 {
+			if *snapshotDir == "" {
+				return errors.New("snapshot_interval requires snapshot_dir")
+			}
+			snapshotter := server.NewSnapshotter(st, *snapshotInterval, *snapshotDir, *snapshotKeep)
+			go func() {
+				if err := snapshotter.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+					glog.Errorf("background snapshots stopped: %v", err)
+				}
+			}()
+		}
 		mux, err := getMux(s)
 		if err != nil {
 			return err
@@ -258,7 +462,7 @@ func cmdTestServe() *cobra.Command {
 	selfURL := FlagSelfURL(c.PersistentFlags())
 	port := FlagPort(c.PersistentFlags())
 	autoLogin := c.PersistentFlags().Bool("autologin", true, "If true, bypass auth screen")
-	inviteCode := FlagInviteCode(c.PersistentFlags())
+	inviteCode := c.PersistentFlags().String("invite_code", "", "If not empty, users can only be created by providing this code.")
 	insecure := FlagInsecure(c.PersistentFlags())
 	testData := c.PersistentFlags().String("testdata", "localtestdata", "Directory with backend testdata, for testserve")
 
@@ -282,7 +486,13 @@ func cmdTestServe() *cobra.Command {
 			uid = types.UID(userState.Uid)
 		}
 
-		s, err := getServer(st, uid, *inviteCode, *insecure, *selfURL)
+		if *inviteCode != "" {
+			if err := st.CreateInviteCode(ctx, nil, &stpb.InviteCode{Code: *inviteCode}); err != nil {
+				return err
+			}
+		}
+
+		s, err := getServer(st, uid, *inviteCode != "", *insecure, *selfURL)
 		if err != nil {
 			return err
 		}
@@ -330,6 +540,204 @@ func CmdCheckStreamState() *cobra.Command {
 	return c
 }
 
+func cmdRecomputeMeta() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "recompute-meta",
+		Short: "Apply again the Mastodon filters recorded for the user to statuses already fetched.",
+		Args:  cobra.NoArgs,
+	}
+	dbFilename := FlagDBFilename(c.PersistentFlags())
+	c.MarkPersistentFlagRequired("db")
+	userID := FlagUserID(c.PersistentFlags())
+	c.MarkPersistentFlagRequired("uid")
+	includePositioned := c.PersistentFlags().Bool("include_positioned", false, "If set, also update statuses already in the streams, not only the ones in the pools.")
+
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		st, err := storage.NewStorage(ctx, *dbFilename)
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+
+		return cmds.CmdRecomputeMeta(ctx, st, *userID, *includePositioned)
+	}
+	return c
+}
+
+func cmdGC() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "gc",
+		Short: "Drop the content of old statuses, keeping their position in streams.",
+		Args:  cobra.NoArgs,
+	}
+	dbFilename := FlagDBFilename(c.PersistentFlags())
+	c.MarkPersistentFlagRequired("db")
+	userID := FlagUserID(c.PersistentFlags())
+	retentionDays := FlagRetentionDays(c.PersistentFlags())
+	retentionPositions := FlagRetentionPositions(c.PersistentFlags())
+	dryRun := c.PersistentFlags().Bool("dry_run", false, "If set, only report what would be dropped.")
+	vacuum := c.PersistentFlags().Bool("vacuum", false, "If set, vacuum the database afterward to reduce its size on disk.")
+
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		st, err := storage.NewStorage(ctx, *dbFilename)
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+
+		return cmds.CmdGC(ctx, st, *userID, retentionPolicy(*retentionDays, *retentionPositions), *dryRun, *vacuum)
+	}
+	return c
+}
+
+func cmdExportUser() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "export-user",
+		Short: "Write all the state of a user to a file, to be used with import-user.",
+		Args:  cobra.NoArgs,
+	}
+	dbFilename := FlagDBFilename(c.PersistentFlags())
+	c.MarkPersistentFlagRequired("db")
+	userID := FlagUserID(c.PersistentFlags())
+	c.MarkPersistentFlagRequired("uid")
+	output := c.PersistentFlags().String("output", "", "File to write the archive to.")
+	c.MarkPersistentFlagRequired("output")
+	withTokens := c.PersistentFlags().Bool("include_tokens", false, "If set, include the Mastodon access tokens. The archive must then be kept private.")
+
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		st, err := storage.NewStorage(ctx, *dbFilename)
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+
+		return cmds.CmdExportUser(ctx, st, *userID, *output, *withTokens)
+	}
+	return c
+}
+
+func cmdImportUser() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "import-user",
+		Short: "Create a new user from a file written by export-user.",
+		Long: `Create a new user from a file written by export-user.
+Archives written without --include_tokens have no Mastodon access tokens: the
+accounts are not fetched nor streamed in the background until the user logs in
+again with each of them.`,
+		Args: cobra.NoArgs,
+	}
+	dbFilename := FlagDBFilename(c.PersistentFlags())
+	c.MarkPersistentFlagRequired("db")
+	input := c.PersistentFlags().String("input", "", "Archive file to read.")
+	c.MarkPersistentFlagRequired("input")
+
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		st, err := storage.NewStorage(ctx, *dbFilename)
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+
+		return cmds.CmdImportUser(ctx, st, *input)
+	}
+	return c
+}
+
+func cmdBackup() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "backup",
+		Short: "Write a copy of the database, while it is in use.",
+		Long: `Write a copy of the database, while it is in use.
+Either --output is set, to write a single backup file, or --snapshot_dir, to
+write a timestamped backup in that directory and remove older ones.`,
+		Args: cobra.NoArgs,
+	}
+	dbFilename := FlagDBFilename(c.PersistentFlags())
+	c.MarkPersistentFlagRequired("db")
+	output := c.PersistentFlags().String("output", "", "File to write the backup to. It must not exist.")
+	snapshotDir := FlagSnapshotDir(c.PersistentFlags())
+	snapshotKeep := FlagSnapshotKeep(c.PersistentFlags())
+
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		st, err := storage.NewStorage(ctx, *dbFilename)
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+
+		return cmds.CmdBackup(ctx, st, *output, *snapshotDir, *snapshotKeep)
+	}
+	return c
+}
+
+func cmdRestore() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "restore",
+		Short: "Replace the database by a backup. The server must not be running.",
+		Args:  cobra.NoArgs,
+	}
+	dbFilename := FlagDBFilename(c.PersistentFlags())
+	c.MarkPersistentFlagRequired("db")
+	input := c.PersistentFlags().String("input", "", "Backup file to restore.")
+	c.MarkPersistentFlagRequired("input")
+
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		// The database is not opened: it is about to be replaced, and might
+		// not even exist.
+		return cmds.CmdRestore(cmd.Context(), *input, *dbFilename)
+	}
+	return c
+}
+
+func cmdMigrate() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "migrate",
+		Short: "Update the database schema.",
+		Long: `Update the database schema, up to --to, or to the latest version when not set.
+When --to is older than the current version, steps are reverted - this is only
+possible if all of them support it. Other commands update the schema
+automatically to the latest version.`,
+		Args: cobra.NoArgs,
+	}
+	dbFilename := FlagDBFilename(c.PersistentFlags())
+	c.MarkPersistentFlagRequired("db")
+	target := c.PersistentFlags().Int("to", -1, "Schema version to reach. If negative, the latest version.")
+
+	// The database is opened without updating the schema, which is the point
+	// of those commands.
+	run := func(f func(ctx context.Context, st storage.Store, target int) error) func(cmd *cobra.Command, args []string) error {
+		return func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			st, err := storage.OpenForMigration(ctx, *dbFilename)
+			if err != nil {
+				return err
+			}
+			defer st.Close()
+			return f(ctx, st, *target)
+		}
+	}
+	c.RunE = run(cmds.CmdMigrate)
+
+	c.AddCommand(&cobra.Command{
+		Use:   "status",
+		Short: "Show the current and target schema versions.",
+		Args:  cobra.NoArgs,
+		RunE:  run(cmds.CmdMigrateStatus),
+	})
+	c.AddCommand(&cobra.Command{
+		Use:   "plan",
+		Short: "List the steps to reach the target schema version, without applying them.",
+		Args:  cobra.NoArgs,
+		RunE:  run(cmds.CmdMigratePlan),
+	})
+	return c
+}
+
 func main() {
 	ctx := context.Background()
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
@@ -347,6 +755,8 @@ func main() {
 	}
 
 	rootCmd.AddCommand(cmdUsers())
+	rootCmd.AddCommand(cmdUser())
+	rootCmd.AddCommand(cmdInvite())
 	rootCmd.AddCommand(cmdClearApp())
 	rootCmd.AddCommand(cmdClearStream())
 	rootCmd.AddCommand(cmdClearPoolStream())
@@ -354,6 +764,13 @@ func main() {
 	rootCmd.AddCommand(cmdServe())
 	rootCmd.AddCommand(cmdTestServe())
 	rootCmd.AddCommand(CmdCheckStreamState())
+	rootCmd.AddCommand(cmdRecomputeMeta())
+	rootCmd.AddCommand(cmdGC())
+	rootCmd.AddCommand(cmdExportUser())
+	rootCmd.AddCommand(cmdImportUser())
+	rootCmd.AddCommand(cmdBackup())
+	rootCmd.AddCommand(cmdRestore())
+	rootCmd.AddCommand(cmdMigrate())
 
 	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		glog.Exit(err)
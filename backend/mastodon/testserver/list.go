@@ -86,6 +86,19 @@ func (list *EntityList[T]) idx(id string) (int, error) {
 	return idx, nil
 }
 
+// Delete removes an entity from the list.
+func (list *EntityList[T]) Delete(id string) error {
+	idx, err := list.idx(id)
+	if err != nil {
+		return err
+	}
+	if idx < 0 {
+		return fmt.Errorf("cannot delete: status %s not found", id)
+	}
+	list.entities = slices.Delete(list.entities, idx, idx+1)
+	return nil
+}
+
 func (list *EntityList[T]) Clear() {
 	list.entities = nil
 }
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -123,6 +124,27 @@ type Server struct {
 	listDelay time.Duration
 
 	notifications EntityList[*mastodon.Notification]
+	// Read markers, indexed by timeline - i.e., `home` or `notifications`.
+	markers map[string]*mastodon.Marker
+	// Filters served by the v2 filters API.
+	filters []map[string]any
+	// Accounts followed by the test user.
+	following []*mastodon.Account
+
+	// Extra accounts, indexed by the oauth authorization code giving access to
+	// them. Any other authorization code gives access to the default account.
+	accounts map[string]*mastodon.Account
+
+	// Clients of the streaming API.
+	subscribers map[chan streamEvent]struct{}
+}
+
+// streamEvent is a message sent on the streaming API.
+type streamEvent struct {
+	// Type of event - e.g., `update`.
+	event string
+	// Content of the event, already encoded.
+	payload string
 }
 
 func New() *Server {
@@ -173,7 +195,31 @@ func (s *Server) AddFakeStatus() (*mastodon.Status, error) {
 	defer s.m.Unlock()
 
 	status := s.newStatusWhileLocked()
-	return status, s.statuses.Insert(status, string(status.ID))
+	if err := s.statuses.Insert(status, string(status.ID)); err != nil {
+		return nil, err
+	}
+	return status, s.publishWhileLocked("update", status)
+}
+
+// AddReply creates a status replying to the provided status ID.
+func (s *Server) AddReply(parentID mastodon.ID) (*mastodon.Status, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	parent, err := s.statuses.ByID(string(parentID))
+	if err != nil {
+		return nil, err
+	}
+	if parent == nil {
+		return nil, fmt.Errorf("status %q not found", parentID)
+	}
+	status := s.newStatusWhileLocked()
+	status.InReplyToID = string(parent.ID)
+	status.InReplyToAccountID = string(parent.Account.ID)
+	if err := s.statuses.Insert(status, string(status.ID)); err != nil {
+		return nil, err
+	}
+	return status, s.publishWhileLocked("update", status)
 }
 
 // AddReblog creates a reblog of the provided status ID.
@@ -192,14 +238,31 @@ func (s *Server) AddReblog(idToReblog mastodon.ID) (*mastodon.Status, error) {
 
 	reblog := s.newStatusWhileLocked()
 	reblog.Reblog = rebloggedStatus
-	return reblog, s.statuses.Insert(reblog, string(reblog.ID))
+	if err := s.statuses.Insert(reblog, string(reblog.ID)); err != nil {
+		return nil, err
+	}
+	return reblog, s.publishWhileLocked("update", reblog)
 }
 
 func (s *Server) UpdateStatus(status *mastodon.Status) error {
 	s.m.Lock()
 	defer s.m.Unlock()
 
-	return s.statuses.Update(string(status.ID), status)
+	if err := s.statuses.Update(string(status.ID), status); err != nil {
+		return err
+	}
+	return s.publishWhileLocked("status.update", status)
+}
+
+// DeleteStatus removes a status from the server.
+func (s *Server) DeleteStatus(id mastodon.ID) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if err := s.statuses.Delete(string(id)); err != nil {
+		return err
+	}
+	return s.publishWhileLocked("delete", id)
 }
 
 func (s *Server) SetStatusFavourite(id mastodon.ID) error {
@@ -241,20 +304,81 @@ func (s *Server) SetStatusContent(id mastodon.ID, content string) error {
 		return fmt.Errorf("status %q not found", id)
 	}
 	status.Content = content
-	return nil
+	return s.publishWhileLocked("status.update", status)
 }
 
+// AddFakeNotification adds a `favourite` notification on the most recent
+// status.
 func (s *Server) AddFakeNotification() error {
+	_, err := s.AddNotification("favourite")
+	return err
+}
+
+// AddNotification adds a notification of the given type. Notifications types
+// which are about a status refer to the most recent status.
+func (s *Server) AddNotification(notifType string) (*mastodon.Notification, error) {
 	s.m.Lock()
 	defer s.m.Unlock()
 
-	if len(s.statuses.entities) == 0 {
-		return errors.New("no status to notify about")
+	var status *mastodon.Status
+	switch notifType {
+	case "follow", "follow_request":
+	default:
+		if len(s.statuses.entities) == 0 {
+			return nil, errors.New("no status to notify about")
+		}
+		status = s.statuses.entities[len(s.statuses.entities)-1].Value
 	}
-	status := s.statuses.entities[len(s.statuses.entities)-1].Value
 	id := s.notifications.CreateNextID()
-	notif := NewFakeNotification(mastodon.ID(id), "favourite", "987", status)
-	return s.notifications.Insert(notif, string(notif.ID))
+	notif := NewFakeNotification(mastodon.ID(id), notifType, "987", status)
+	if err := s.notifications.Insert(notif, string(notif.ID)); err != nil {
+		return nil, err
+	}
+	return notif, s.publishWhileLocked("notification", notif)
+}
+
+// publishWhileLocked sends an event to all clients of the streaming API.
+func (s *Server) publishWhileLocked(event string, payload any) error {
+	ev := streamEvent{event: event}
+	if id, ok := payload.(mastodon.ID); ok {
+		// Deletion events only contain the ID, without JSON encoding.
+		ev.payload = string(id)
+	} else {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		ev.payload = string(raw)
+	}
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			glog.Errorf("testserver: streaming client too slow, dropping %s event", event)
+		}
+	}
+	return nil
+}
+
+// StreamingClients returns the number of clients currently connected to the
+// streaming API.
+func (s *Server) StreamingClients() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return len(s.subscribers)
+}
+
+// AddAccount makes a new account available, to be obtained through the
+// provided oauth authorization code.
+func (s *Server) AddAccount(authCode string, accountID mastodon.ID, username string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.accounts == nil {
+		s.accounts = map[string]*mastodon.Account{}
+	}
+	account := NewFakeAccount(accountID, username)
+	s.accounts[authCode] = &account
 }
 
 func (s *Server) ClearNotifications() {
@@ -268,13 +392,28 @@ func (s *Server) RegisterOn(mux *http.ServeMux) {
 	mux.Handle("/oauth/authorize", http.HandlerFunc(s.serveOAuthAuthorize))
 	mux.Handle("/api/v1/apps", JSONHandler(s.serveAPIApps))
 	mux.Handle("/api/v1/accounts/verify_credentials", JSONHandler(s.serverAPIAccountsVerifyCredentials))
+	mux.Handle("/api/v1/accounts/{id}/following", JSONHandler(s.serveAPIAccountsFollowing))
 	mux.Handle("/api/v1/timelines/home", JSONHandler(s.serveAPITimelinesHome))
+	mux.Handle("/api/v1/timelines/list/{id}", JSONHandler(s.serveAPITimelinesList))
+	mux.Handle("/api/v1/timelines/tag/{hashtag}", JSONHandler(s.serveAPITimelinesTag))
 	mux.Handle("/api/v1/filters", JSONHandler(s.serveAPIFilters))
+	mux.Handle("/api/v2/filters", JSONHandler(s.serveAPIFiltersV2))
 	mux.Handle("/api/v1/notifications", JSONHandler(s.serveAPINotifications))
 	mux.Handle("/api/v1/markers", JSONHandler(s.serverAPIMarkers))
+	mux.Handle("POST /api/v1/statuses", JSONHandler(s.serveAPIStatusesCreate))
 	mux.Handle("/api/v1/statuses/{id}", JSONHandler(s.serverAPIStatus))
-	mux.Handle("/api/v1/statuses/{id}/favourite", JSONHandler(s.serverAPIStatusFavourite))
-	mux.Handle("/api/v1/statuses/{id}/unfavourite", JSONHandler(s.serverAPIStatusUnfavourite))
+	mux.Handle("/api/v1/statuses/{id}/context", JSONHandler(s.serveAPIStatusContext))
+	mux.Handle("/api/v1/statuses/{id}/favourite", s.serveStatusAction(s.serverAPIStatusFavourite))
+	mux.Handle("/api/v1/statuses/{id}/unfavourite", s.serveStatusAction(s.serverAPIStatusUnfavourite))
+	mux.Handle("/api/v1/statuses/{id}/reblog", s.serveStatusAction(s.serverAPIStatusReblog))
+	mux.Handle("/api/v1/statuses/{id}/unreblog", s.serveStatusAction(s.serverAPIStatusUnreblog))
+	mux.Handle("/api/v1/statuses/{id}/bookmark", s.serveStatusAction(s.serverAPIStatusBookmark))
+	mux.Handle("/api/v1/statuses/{id}/unbookmark", s.serveStatusAction(s.serverAPIStatusUnbookmark))
+	mux.Handle("/api/v1/statuses/{id}/mute", s.serveStatusAction(s.serverAPIStatusMute))
+	mux.Handle("/api/v1/statuses/{id}/unmute", s.serveStatusAction(s.serverAPIStatusUnmute))
+	mux.Handle("/api/v1/statuses/{id}/pin", s.serveStatusAction(s.serverAPIStatusPin))
+	mux.Handle("/api/v1/statuses/{id}/unpin", s.serveStatusAction(s.serverAPIStatusUnpin))
+	mux.Handle("/api/v1/streaming/user", http.HandlerFunc(s.serveAPIStreamingUser))
 }
 
 // https://docs.joinmastodon.org/methods/oauth/#token
@@ -282,8 +421,13 @@ func (s *Server) serveOAuthToken(w http.ResponseWriter, req *http.Request) (any,
 	s.m.Lock()
 	defer s.m.Unlock()
 
+	accessToken := "ZA-Yj3aBD8U8Cm7lKUp-lm9O9BmDgdhHzDeqsY8tlL0"
+	if code := req.FormValue("code"); s.accounts[code] != nil {
+		accessToken = accountTokenPrefix + code
+	}
+
 	return map[string]any{
-		"access_token": "ZA-Yj3aBD8U8Cm7lKUp-lm9O9BmDgdhHzDeqsY8tlL0",
+		"access_token": accessToken,
 		"token_type":   "Bearer",
 		"scope":        "read write follow push",
 		"created_at":   1573979017,
@@ -354,11 +498,28 @@ func (s *Server) serveAPIApps(w http.ResponseWriter, req *http.Request) (any, er
 	}, nil
 }
 
+// accountTokenPrefix is used to build access tokens for extra accounts.
+const accountTokenPrefix = "testaccount-"
+
+// extraAccountWhileLocked returns the extra account the request is
+// authenticated as - or nil for the default account.
+func (s *Server) extraAccountWhileLocked(req *http.Request) *mastodon.Account {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if code, ok := strings.CutPrefix(token, accountTokenPrefix); ok {
+		return s.accounts[code]
+	}
+	return nil
+}
+
 // https://docs.joinmastodon.org/methods/accounts/#verify_credentials
 func (s *Server) serverAPIAccountsVerifyCredentials(w http.ResponseWriter, req *http.Request) (any, error) {
 	s.m.Lock()
 	defer s.m.Unlock()
 
+	if account := s.extraAccountWhileLocked(req); account != nil {
+		return account, nil
+	}
+
 	return map[string]any{
 		"id":              "14715",
 		"username":        "testuser1",
@@ -408,6 +569,62 @@ func (s *Server) serveAPIFilters(w http.ResponseWriter, req *http.Request) (any,
 		}}, nil
 }
 
+// AddFilter creates a filter on the home timeline, matching any of the
+// keywords. `action` is either `warn` or `hide`. It returns the ID of the
+// filter.
+func (s *Server) AddFilter(title string, action string, keywords ...string) string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	id := strconv.Itoa(len(s.filters) + 1)
+	var kws []map[string]any
+	for i, keyword := range keywords {
+		kws = append(kws, map[string]any{
+			"id":         fmt.Sprintf("%s%d", id, i),
+			"keyword":    keyword,
+			"whole_word": false,
+		})
+	}
+	s.filters = append(s.filters, map[string]any{
+		"id":            id,
+		"title":         title,
+		"context":       []string{"home"},
+		"expires_at":    nil,
+		"filter_action": action,
+		"keywords":      kws,
+		"statuses":      []any{},
+	})
+	return id
+}
+
+// AddFollowing makes the test user follow the provided account.
+func (s *Server) AddFollowing(account *mastodon.Account) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.following = append(s.following, account)
+}
+
+// https://docs.joinmastodon.org/methods/accounts/#following
+// All accounts are returned at once, without pagination.
+func (s *Server) serveAPIAccountsFollowing(w http.ResponseWriter, req *http.Request) (any, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	following := []*mastodon.Account{}
+	following = append(following, s.following...)
+	return following, nil
+}
+
+// https://docs.joinmastodon.org/methods/filters/#get
+func (s *Server) serveAPIFiltersV2(w http.ResponseWriter, req *http.Request) (any, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	filters := []map[string]any{}
+	filters = append(filters, s.filters...)
+	return filters, nil
+}
+
 // https://docs.joinmastodon.org/methods/timelines/#home
 func (s *Server) serveAPITimelinesHome(w http.ResponseWriter, req *http.Request) (any, error) {
 	ctx := req.Context()
@@ -451,6 +668,38 @@ func (s *Server) serveAPITimelinesHome(w http.ResponseWriter, req *http.Request)
 	return statuses, nil
 }
 
+// https://docs.joinmastodon.org/methods/timelines/#list
+// The fake server does not track lists; any list contains all the statuses.
+func (s *Server) serveAPITimelinesList(w http.ResponseWriter, req *http.Request) (any, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	statuses, link, err := s.statuses.List(req, "/api/v1/timelines/list/"+req.PathValue("id"))
+	if err != nil {
+		return nil, err
+	}
+	if link != "" {
+		w.Header().Set("Link", link)
+	}
+	return statuses, nil
+}
+
+// https://docs.joinmastodon.org/methods/timelines/#tag
+// The fake server does not track hashtags; any hashtag matches all the statuses.
+func (s *Server) serveAPITimelinesTag(w http.ResponseWriter, req *http.Request) (any, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	statuses, link, err := s.statuses.List(req, "/api/v1/timelines/tag/"+req.PathValue("hashtag"))
+	if err != nil {
+		return nil, err
+	}
+	if link != "" {
+		w.Header().Set("Link", link)
+	}
+	return statuses, nil
+}
+
 // https://docs.joinmastodon.org/methods/notifications/#get
 func (s *Server) serveAPINotifications(w http.ResponseWriter, req *http.Request) (any, error) {
 	s.m.Lock()
@@ -467,12 +716,69 @@ func (s *Server) serveAPINotifications(w http.ResponseWriter, req *http.Request)
 	return notifs, nil
 }
 
+// Marker returns the read marker of the timeline - `home` or `notifications`.
+func (s *Server) Marker(timeline string) *mastodon.Marker {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.markerWhileLocked(timeline)
+}
+
+// SetMarker moves the read marker of the timeline, as another Mastodon client
+// would do.
+func (s *Server) SetMarker(timeline string, lastReadID mastodon.ID) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.setMarkerWhileLocked(timeline, lastReadID)
+}
+
+func (s *Server) setMarkerWhileLocked(timeline string, lastReadID mastodon.ID) *mastodon.Marker {
+	marker := &mastodon.Marker{
+		LastReadID: lastReadID,
+		Version:    s.markerWhileLocked(timeline).Version + 1,
+		UpdatedAt:  time.Now(),
+	}
+	if s.markers == nil {
+		s.markers = map[string]*mastodon.Marker{}
+	}
+	s.markers[timeline] = marker
+	return marker
+}
+
+func (s *Server) markerWhileLocked(timeline string) *mastodon.Marker {
+	if marker := s.markers[timeline]; marker != nil {
+		return marker
+	}
+	return &mastodon.Marker{
+		LastReadID: "",
+		Version:    1,
+		UpdatedAt:  time.Now(),
+	}
+}
+
 // https://docs.joinmastodon.org/methods/markers/#get
+// https://docs.joinmastodon.org/methods/markers/#create
 func (s *Server) serverAPIMarkers(w http.ResponseWriter, req *http.Request) (any, error) {
 	s.m.Lock()
 	defer s.m.Unlock()
 
 	markers := map[string]*mastodon.Marker{}
+	if req.Method == http.MethodPost {
+		if err := req.ParseForm(); err != nil {
+			return nil, NewHTTPErrorf(http.StatusBadRequest, "unable to parse form: %v", err)
+		}
+		for _, timeline := range []string{"home", "notifications"} {
+			lastReadID := req.Form.Get(timeline + "[last_read_id]")
+			if lastReadID == "" {
+				continue
+			}
+			markers[timeline] = s.setMarkerWhileLocked(timeline, mastodon.ID(lastReadID))
+		}
+		if len(markers) == 0 {
+			return nil, NewHTTPErrorf(http.StatusBadRequest, "no marker specified")
+		}
+		return markers, nil
+	}
+
 	v, err := url.ParseQuery(req.URL.RawQuery)
 	if err != nil {
 		return nil, NewHTTPErrorf(http.StatusBadRequest, "unable to parse query; got: %s", req.URL.RawQuery)
@@ -482,15 +788,10 @@ func (s *Server) serverAPIMarkers(w http.ResponseWriter, req *http.Request) (any
 		return nil, NewHTTPErrorf(http.StatusBadRequest, "no timeline specified; request: %s", req.URL.String())
 	}
 	for _, timeline := range timelines {
-		if timeline != "notifications" {
+		if timeline != "home" && timeline != "notifications" {
 			return nil, NewHTTPErrorf(http.StatusBadRequest, "unsupported timeline %q", timeline)
 		}
-
-		markers[timeline] = &mastodon.Marker{
-			LastReadID: "",
-			Version:    1,
-			UpdatedAt:  time.Now(),
-		}
+		markers[timeline] = s.markerWhileLocked(timeline)
 	}
 
 	return markers, nil
@@ -515,15 +816,12 @@ func (s *Server) serverAPIStatus(w http.ResponseWriter, req *http.Request) (any,
 	return status, nil
 }
 
-// https://docs.joinmastodon.org/methods/statuses/#favourite
-func (s *Server) serverAPIStatusFavourite(w http.ResponseWriter, req *http.Request) (any, error) {
+// https://docs.joinmastodon.org/methods/statuses/#context
+func (s *Server) serveAPIStatusContext(w http.ResponseWriter, req *http.Request) (any, error) {
 	s.m.Lock()
 	defer s.m.Unlock()
 
 	statusID := req.PathValue("id")
-	if statusID == "" {
-		return nil, NewHTTPErrorf(http.StatusBadRequest, "missing status ID")
-	}
 	status, err := s.statuses.ByID(statusID)
 	if err != nil {
 		return nil, NewHTTPErrorf(http.StatusBadRequest, "invalid status %q: %v", statusID, err)
@@ -531,26 +829,233 @@ func (s *Server) serverAPIStatusFavourite(w http.ResponseWriter, req *http.Reque
 	if status == nil {
 		return nil, NewHTTPErrorf(http.StatusNotFound, "status %q does not exists", statusID)
 	}
-	status.Favourited = true
-	return status, nil
+
+	result := &mastodon.Context{
+		Ancestors:   []*mastodon.Status{},
+		Descendants: []*mastodon.Status{},
+	}
+	parentID, _ := status.InReplyToID.(string)
+	for parentID != "" {
+		parent, err := s.statuses.ByID(parentID)
+		if err != nil {
+			return nil, err
+		}
+		if parent == nil {
+			break
+		}
+		result.Ancestors = append([]*mastodon.Status{parent}, result.Ancestors...)
+		parentID, _ = parent.InReplyToID.(string)
+	}
+
+	// Statuses are ordered by ID, so replies always come after what they
+	// reply to.
+	inThread := map[string]bool{statusID: true}
+	for _, entity := range s.statuses.entities {
+		parentID, _ := entity.Value.InReplyToID.(string)
+		if inThread[parentID] {
+			inThread[string(entity.Value.ID)] = true
+			result.Descendants = append(result.Descendants, entity.Value)
+		}
+	}
+	return result, nil
 }
 
-// https://docs.joinmastodon.org/methods/statuses/#unfavourite
-func (s *Server) serverAPIStatusUnfavourite(w http.ResponseWriter, req *http.Request) (any, error) {
+// https://docs.joinmastodon.org/methods/statuses/#create
+func (s *Server) serveAPIStatusesCreate(w http.ResponseWriter, req *http.Request) (any, error) {
 	s.m.Lock()
 	defer s.m.Unlock()
 
-	statusID := req.PathValue("id")
-	if statusID == "" {
-		return nil, NewHTTPErrorf(http.StatusBadRequest, "missing status ID")
+	if err := req.ParseForm(); err != nil {
+		return nil, NewHTTPErrorf(http.StatusBadRequest, "unable to parse form: %v", err)
 	}
-	status, err := s.statuses.ByID(statusID)
-	if err != nil {
-		return nil, NewHTTPErrorf(http.StatusBadRequest, "invalid status %q: %v", statusID, err)
+	text := req.PostForm.Get("status")
+	if text == "" {
+		return nil, NewHTTPErrorf(http.StatusUnprocessableEntity, "status content can't be blank")
 	}
-	if status == nil {
-		return nil, NewHTTPErrorf(http.StatusNotFound, "status %q does not exists", statusID)
+	visibility := req.PostForm.Get("visibility")
+	switch visibility {
+	case "":
+		visibility = "public"
+	case "public", "unlisted", "private", "direct":
+	default:
+		return nil, NewHTTPErrorf(http.StatusUnprocessableEntity, "invalid visibility %q", visibility)
+	}
+
+	account := NewFakeAccount("14715", "testuser1")
+	account.Acct = "testuser1"
+	if extra := s.extraAccountWhileLocked(req); extra != nil {
+		account = *extra
+	}
+
+	id := s.statuses.CreateNextID()
+	status := &mastodon.Status{
+		ID:          mastodon.ID(id),
+		URI:         fmt.Sprintf("https://example.com/users/%s/statuses/%s", account.Username, id),
+		URL:         fmt.Sprintf("https://example.com/@%s/%s", account.Username, id),
+		Account:     account,
+		CreatedAt:   time.Now(),
+		Content:     "<p>" + template.HTMLEscapeString(text) + "</p>",
+		SpoilerText: req.PostForm.Get("spoiler_text"),
+		Sensitive:   req.PostForm.Get("spoiler_text") != "",
+		Visibility:  visibility,
+		Language:    req.PostForm.Get("language"),
+	}
+	if inReplyToID := req.PostForm.Get("in_reply_to_id"); inReplyToID != "" {
+		parent, err := s.statuses.ByID(inReplyToID)
+		if err != nil {
+			return nil, NewHTTPErrorf(http.StatusBadRequest, "invalid status %q: %v", inReplyToID, err)
+		}
+		if parent == nil {
+			return nil, NewHTTPErrorf(http.StatusNotFound, "status %q does not exists", inReplyToID)
+		}
+		status.InReplyToID = inReplyToID
+		status.InReplyToAccountID = string(parent.Account.ID)
+	}
+
+	if err := s.statuses.Insert(status, id); err != nil {
+		return nil, err
+	}
+	return status, s.publishWhileLocked("update", status)
+}
+
+// serveStatusAction builds a handler for the `/api/v1/statuses/{id}/...`
+// actions. The provided function modifies the status and returns the value to
+// send back to the client.
+func (s *Server) serveStatusAction(action func(status *mastodon.Status) (any, error)) JSONHandler {
+	return func(w http.ResponseWriter, req *http.Request) (any, error) {
+		s.m.Lock()
+		defer s.m.Unlock()
+
+		statusID := req.PathValue("id")
+		if statusID == "" {
+			return nil, NewHTTPErrorf(http.StatusBadRequest, "missing status ID")
+		}
+		status, err := s.statuses.ByID(statusID)
+		if err != nil {
+			return nil, NewHTTPErrorf(http.StatusBadRequest, "invalid status %q: %v", statusID, err)
+		}
+		if status == nil {
+			return nil, NewHTTPErrorf(http.StatusNotFound, "status %q does not exists", statusID)
+		}
+		return action(status)
 	}
+}
+
+// https://docs.joinmastodon.org/methods/statuses/#favourite
+func (s *Server) serverAPIStatusFavourite(status *mastodon.Status) (any, error) {
+	status.Favourited = true
+	return status, nil
+}
+
+// https://docs.joinmastodon.org/methods/statuses/#unfavourite
+func (s *Server) serverAPIStatusUnfavourite(status *mastodon.Status) (any, error) {
 	status.Favourited = false
 	return status, nil
 }
+
+// https://docs.joinmastodon.org/methods/statuses/#boost
+// Returns the new status wrapping the reblogged one.
+func (s *Server) serverAPIStatusReblog(status *mastodon.Status) (any, error) {
+	if reblogged, _ := status.Reblogged.(bool); reblogged {
+		return nil, NewHTTPErrorf(http.StatusUnprocessableEntity, "status %q already reblogged", status.ID)
+	}
+	status.Reblogged = true
+	status.ReblogsCount++
+
+	reblog := s.newStatusWhileLocked()
+	reblog.Account = NewFakeAccount("14715", "testuser1")
+	reblog.Content = ""
+	reblog.Reblog = status
+	if err := s.statuses.Insert(reblog, string(reblog.ID)); err != nil {
+		return nil, err
+	}
+	return reblog, s.publishWhileLocked("update", reblog)
+}
+
+// https://docs.joinmastodon.org/methods/statuses/#unreblog
+// Returns the original status.
+func (s *Server) serverAPIStatusUnreblog(status *mastodon.Status) (any, error) {
+	if reblogged, _ := status.Reblogged.(bool); reblogged {
+		status.Reblogged = false
+		status.ReblogsCount--
+	}
+	return status, nil
+}
+
+// https://docs.joinmastodon.org/methods/statuses/#bookmark
+func (s *Server) serverAPIStatusBookmark(status *mastodon.Status) (any, error) {
+	status.Bookmarked = true
+	return status, nil
+}
+
+// https://docs.joinmastodon.org/methods/statuses/#unbookmark
+func (s *Server) serverAPIStatusUnbookmark(status *mastodon.Status) (any, error) {
+	status.Bookmarked = false
+	return status, nil
+}
+
+// https://docs.joinmastodon.org/methods/statuses/#mute
+func (s *Server) serverAPIStatusMute(status *mastodon.Status) (any, error) {
+	status.Muted = true
+	return status, nil
+}
+
+// https://docs.joinmastodon.org/methods/statuses/#unmute
+func (s *Server) serverAPIStatusUnmute(status *mastodon.Status) (any, error) {
+	status.Muted = false
+	return status, nil
+}
+
+// https://docs.joinmastodon.org/methods/statuses/#pin
+// The fake server does not verify that the status belongs to the account.
+func (s *Server) serverAPIStatusPin(status *mastodon.Status) (any, error) {
+	status.Pinned = true
+	return status, nil
+}
+
+// https://docs.joinmastodon.org/methods/statuses/#unpin
+func (s *Server) serverAPIStatusUnpin(status *mastodon.Status) (any, error) {
+	status.Pinned = false
+	return status, nil
+}
+
+// https://docs.joinmastodon.org/methods/streaming/#user
+// Events are sent using server-sent events, until the client disconnects.
+func (s *Server) serveAPIStreamingUser(w http.ResponseWriter, req *http.Request) {
+	ch := make(chan streamEvent, 100)
+	s.m.Lock()
+	if s.subscribers == nil {
+		s.subscribers = map[chan streamEvent]struct{}{}
+	}
+	s.subscribers[ch] = struct{}{}
+	s.m.Unlock()
+
+	defer func() {
+		s.m.Lock()
+		delete(s.subscribers, ch)
+		s.m.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		glog.Errorf("testserver: unable to flush streaming response: %v", err)
+		return
+	}
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case ev := <-ch:
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.event, ev.payload); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/mattn/go-mastodon"
@@ -123,3 +124,92 @@ func TestFavourite(t *testing.T) {
 		t.Errorf("got favourited %v, wanted %v", got, want)
 	}
 }
+
+func TestPostStatus(t *testing.T) {
+	env := (&TestEnv{}).Init(t)
+
+	parent, err := env.mastodonServer.AddFakeStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpResp, err := env.client.PostForm(env.httpServer.URL+"/api/v1/statuses", url.Values{
+		"status":         {"Hello <world>"},
+		"in_reply_to_id": {string(parent.ID)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(httpResp.Body)
+	httpResp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := httpResp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("got status %v [%s], want %v; body=%s", got, httpResp.Status, want, string(body))
+	}
+	var gotStatus mastodon.Status
+	if err := json.Unmarshal(body, &gotStatus); err != nil {
+		t.Fatalf("unable to decode json: %v", err)
+	}
+	if got, want := gotStatus.Content, "<p>Hello &lt;world&gt;</p>"; got != want {
+		t.Errorf("got content %q, wanted %q", got, want)
+	}
+	if got, want := gotStatus.InReplyToID, any(string(parent.ID)); got != want {
+		t.Errorf("got in_reply_to_id %v, wanted %v", got, want)
+	}
+
+	// The status can then be fetched.
+	httpResp, body = env.EmptyPost(t, fmt.Sprintf("/api/v1/statuses/%s", gotStatus.ID))
+	if got, want := httpResp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("got status %v [%s], want %v; body=%s", got, httpResp.Status, want, string(body))
+	}
+
+	// Content is mandatory.
+	httpResp, err = env.client.PostForm(env.httpServer.URL+"/api/v1/statuses", url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpResp.Body.Close()
+	if got, want := httpResp.StatusCode, http.StatusUnprocessableEntity; got != want {
+		t.Errorf("got status %v [%s], want %v", got, httpResp.Status, want)
+	}
+}
+
+func TestMarkers(t *testing.T) {
+	env := (&TestEnv{}).Init(t)
+
+	httpResp, err := env.client.PostForm(env.httpServer.URL+"/api/v1/markers", url.Values{
+		"notifications[last_read_id]": {"12"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpResp.Body.Close()
+	if got, want := httpResp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("got status %v [%s], want %v", got, httpResp.Status, want)
+	}
+
+	httpResp, err = env.client.Get(env.httpServer.URL + "/api/v1/markers?timeline[]=notifications&timeline[]=home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(httpResp.Body)
+	httpResp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := httpResp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("got status %v [%s], want %v; body=%s", got, httpResp.Status, want, string(body))
+	}
+	markers := map[string]*mastodon.Marker{}
+	if err := json.Unmarshal(body, &markers); err != nil {
+		t.Fatalf("unable to decode json: %v", err)
+	}
+	if got, want := markers["notifications"].LastReadID, mastodon.ID("12"); got != want {
+		t.Errorf("got notifications marker %q, wanted %q", got, want)
+	}
+	if got, want := markers["home"].LastReadID, mastodon.ID(""); got != want {
+		t.Errorf("got home marker %q, wanted %q", got, want)
+	}
+}
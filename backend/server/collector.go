@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/Palats/mastopoof/backend/storage"
+	"github.com/golang/glog"
+)
+
+// Collector regularly drops the content of old statuses of all users,
+// following the retention policy.
+type Collector struct {
+	st storage.Store
+	// Delay between two collections.
+	interval time.Duration
+	policy   storage.RetentionPolicy
+}
+
+func NewCollector(st storage.Store, interval time.Duration, policy storage.RetentionPolicy) *Collector {
+	return &Collector{
+		st:       st,
+		interval: interval,
+		policy:   policy,
+	}
+}
+
+// Run collects regularly, until the context is cancelled. The first
+// collection happens after one interval, to not slow down startup.
+func (c *Collector) Run(ctx context.Context) error {
+	glog.Infof("Background GC every %v (max age: %v, max behind last read: %d)", c.interval, c.policy.MaxAge, c.policy.MaxBehindLastRead)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.interval):
+		}
+		c.RunOnce(ctx)
+	}
+}
+
+// RunOnce does a single collection for all users.
+func (c *Collector) RunOnce(ctx context.Context) {
+	result, err := c.st.GC(ctx, 0 /* all users */, c.policy, false /* dryRun */)
+	if err != nil {
+		glog.Errorf("background GC failed: %v", err)
+		return
+	}
+	glog.Infof("Background GC: pruned %d statuses (%d bytes), kept %d favourited or bookmarked", result.Pruned, result.PrunedBytes, result.Kept)
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/Palats/mastopoof/backend/types"
+	"github.com/golang/glog"
+
+	pb "github.com/Palats/mastopoof/proto/gen/mastopoof"
+	stpb "github.com/Palats/mastopoof/proto/gen/mastopoof/storage"
+)
+
+// Maximum number of fetch calls done for a stream in a single round. This
+// avoids spending too much time on a single stream when a large backlog
+// of statuses is available.
+const maxFetchRounds = 10
+
+// serverError indicates that an error came from interacting with
+// a Mastodon server.
+type serverError struct {
+	serverAddr string
+	err        error
+}
+
+func (e *serverError) Error() string {
+	return fmt.Sprintf("mastodon server %s: %v", e.serverAddr, e.err)
+}
+
+func (e *serverError) Unwrap() error {
+	return e.err
+}
+
+// backoff tracks failures of a Mastodon server.
+type backoff struct {
+	// Number of consecutive failures.
+	failures int
+	// Do not contact the server before that time.
+	until time.Time
+}
+
+// Fetcher regularly gets new statuses from Mastodon for all streams of all
+// users, without waiting for the frontend to ask for it. It uses the same
+// logic as the `Fetch` RPC - including its detection of concurrent fetches.
+type Fetcher struct {
+	s *Server
+	// Delay between two rounds of fetching.
+	interval time.Duration
+	// Maximum random extra delay added to the interval.
+	jitter time.Duration
+	// Maximum delay before trying again a failing Mastodon server.
+	maxBackoff time.Duration
+	// Number of statuses of each account to check for edits and deletions on
+	// each round.
+	revalidateCount int
+	// Per account, sid of the last status checked for edits and deletions.
+	// Each round continues from there, so all statuses get checked over time.
+	revalidateCursors map[types.ASID]types.SID
+
+	// Failures per Mastodon server address.
+	backoffs map[string]*backoff
+	// Current time; can be overridden for testing.
+	now func() time.Time
+}
+
+func NewFetcher(s *Server, interval time.Duration, jitter time.Duration, maxBackoff time.Duration, revalidateCount int) *Fetcher {
+	return &Fetcher{
+		s:                 s,
+		interval:          interval,
+		jitter:            jitter,
+		maxBackoff:        maxBackoff,
+		revalidateCount:   revalidateCount,
+		revalidateCursors: map[types.ASID]types.SID{},
+		backoffs:          map[string]*backoff{},
+		now:               time.Now,
+	}
+}
+
+// Run fetches statuses regularly, until the context is cancelled.
+func (f *Fetcher) Run(ctx context.Context) error {
+	glog.Infof("Background fetch every %v (jitter: %v, max backoff: %v)", f.interval, f.jitter, f.maxBackoff)
+	for {
+		f.RunOnce(ctx)
+
+		delay := f.interval
+		if f.jitter > 0 {
+			delay += rand.N(f.jitter)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// RunOnce does a single round of fetching for all streams.
+func (f *Fetcher) RunOnce(ctx context.Context) {
+	userEntries, err := f.s.st.ListUsers(ctx)
+	if err != nil {
+		glog.Errorf("background fetch: unable to list users: %v", err)
+		return
+	}
+	for _, userEntry := range userEntries {
+		if userEntry.UserState.Disabled {
+			continue
+		}
+		uid := types.UID(userEntry.UserState.Uid)
+		streamStates, err := f.s.st.StreamStatesByUID(ctx, nil, uid)
+		if err != nil {
+			glog.Errorf("background fetch: unable to list streams of user %d: %v", uid, err)
+			continue
+		}
+		for _, streamState := range streamStates {
+			if ctx.Err() != nil {
+				return
+			}
+			f.fetchStream(ctx, streamState)
+		}
+		if f.revalidateCount > 0 {
+			f.revalidate(ctx, uid)
+		}
+	}
+}
+
+// revalidate checks some statuses of all accounts of the user, to pick up
+// edits and deletions done on Mastodon.
+func (f *Fetcher) revalidate(ctx context.Context, uid types.UID) {
+	accountStates, err := f.s.st.AllAccountStateByUID(ctx, nil, uid)
+	if err != nil {
+		glog.Errorf("background fetch: unable to list accounts of user %d: %v", uid, err)
+		return
+	}
+	for _, accountState := range accountStates {
+		if accountState.AccessToken == "" || f.inBackoff(accountState.ServerAddr) {
+			continue
+		}
+		asid := types.ASID(accountState.Asid)
+		cursor, err := f.s.revalidateStatuses(ctx, accountState, f.revalidateCursors[asid], f.revalidateCount)
+		if err != nil {
+			glog.Errorf("background fetch: unable to revalidate statuses of asid=%d: %v", asid, err)
+		}
+		f.revalidateCursors[asid] = cursor
+	}
+}
+
+// fetchStream gets all available statuses for a stream, up to maxFetchRounds.
+func (f *Fetcher) fetchStream(ctx context.Context, streamState *stpb.StreamState) {
+	stid := types.StID(streamState.Stid)
+	// Only the accounts the stream fetches from matter for backoff - e.g.,
+	// lists only contact the first account of the user.
+	accountStates, err := f.s.streamAccounts(ctx, nil, streamState)
+	if err != nil {
+		glog.Errorf("background fetch: unable to list accounts of stream %d: %v", stid, err)
+		return
+	}
+	// A fetch is done in a single transaction for all accounts of the stream,
+	// so skip the stream entirely if any of its servers is failing.
+	for _, accountState := range accountStates {
+		// E.g., imported without tokens; the user must log in again.
+		if accountState.AccessToken == "" {
+			glog.Infof("background fetch: skipping stream %d, as asid=%d has no access token", stid, accountState.Asid)
+			return
+		}
+		if f.inBackoff(accountState.ServerAddr) {
+			glog.Infof("background fetch: skipping stream %d, as server %s is backing off", stid, accountState.ServerAddr)
+			return
+		}
+	}
+
+	for round := 0; round < maxFetchRounds; round++ {
+		resp, err := f.s.fetchStream(ctx, stid)
+		var srvErr *serverError
+		if errors.As(err, &srvErr) {
+			f.recordFailure(srvErr.serverAddr)
+			glog.Errorf("background fetch of stream %d failed: %v", stid, err)
+			return
+		}
+		if err != nil {
+			// This includes concurrent fetches - e.g., triggered from the frontend.
+			// Next round will take care of it.
+			glog.Errorf("background fetch of stream %d failed: %v", stid, err)
+			return
+		}
+		for _, accountState := range accountStates {
+			f.recordSuccess(accountState.ServerAddr)
+		}
+		glog.Infof("background fetch: got %d statuses for stream %d", resp.FetchedCount, stid)
+		if resp.Status != pb.FetchResponse_MORE {
+			return
+		}
+	}
+}
+
+// inBackoff indicates whether the server should not be contacted for now.
+func (f *Fetcher) inBackoff(serverAddr string) bool {
+	b := f.backoffs[serverAddr]
+	return b != nil && f.now().Before(b.until)
+}
+
+// recordFailure registers that the server failed, doubling the delay before
+// trying it again.
+func (f *Fetcher) recordFailure(serverAddr string) {
+	b := f.backoffs[serverAddr]
+	if b == nil {
+		b = &backoff{}
+		f.backoffs[serverAddr] = b
+	}
+	b.failures++
+	delay := f.maxBackoff
+	// Avoid overflows - after a few failures, maxBackoff is reached anyway.
+	if b.failures < 30 {
+		delay = min(f.interval*time.Duration(1<<(b.failures-1)), f.maxBackoff)
+	}
+	b.until = f.now().Add(delay)
+}
+
+// recordSuccess resets the backoff of the server.
+func (f *Fetcher) recordSuccess(serverAddr string) {
+	delete(f.backoffs, serverAddr)
+}
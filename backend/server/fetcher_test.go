@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Palats/mastopoof/backend/types"
+	"github.com/mattn/go-mastodon"
+
+	pb "github.com/Palats/mastopoof/proto/gen/mastopoof"
+)
+
+func TestFetcherRunOnce(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t:             t,
+		StatusesCount: 5,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	fetcher := NewFetcher(env.server, time.Minute, 0 /* jitter */, time.Hour, 0 /* revalidateCount */)
+	fetcher.RunOnce(ctx)
+
+	// Statuses are available without any call to Fetch.
+	listResp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_FORWARD,
+	})
+	if got, want := len(listResp.Items), 5; got != want {
+		t.Errorf("Got %d statuses, wanted %d", got, want)
+	}
+
+	// New statuses are picked up on the next round.
+	if _, err := env.mastodonServer.AddFakeStatus(); err != nil {
+		t.Fatal(err)
+	}
+	fetcher.RunOnce(ctx)
+	listResp = MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_FORWARD,
+		Position:  listResp.ForwardPosition,
+	})
+	if got, want := len(listResp.Items), 1; got != want {
+		t.Errorf("Got %d statuses, wanted %d", got, want)
+	}
+}
+
+func TestFetcherNoToken(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t:             t,
+		StatusesCount: 5,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	// As when imported from an archive without tokens.
+	streamState, err := env.server.st.StreamState(ctx, nil, types.StID(userInfo.DefaultStid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountState, err := env.server.st.FirstAccountStateByUID(ctx, nil, types.UID(streamState.Uid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountState.AccessToken = ""
+	if err := env.server.st.SetAccountState(ctx, nil, accountState); err != nil {
+		t.Fatal(err)
+	}
+
+	fetcher := NewFetcher(env.server, time.Minute, 0 /* jitter */, time.Hour, 10 /* revalidateCount */)
+	fetcher.RunOnce(ctx)
+
+	// The account is skipped, without failures.
+	listResp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_FORWARD,
+	})
+	if got, want := len(listResp.Items), 0; got != want {
+		t.Errorf("Got %d statuses, wanted %d", got, want)
+	}
+	if fetcher.inBackoff(accountState.ServerAddr) {
+		t.Errorf("Unexpected backoff for an account without token")
+	}
+}
+
+func TestFetcherRevalidate(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t:             t,
+		StatusesCount: 5,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	fetcher := NewFetcher(env.server, time.Minute, 0 /* jitter */, time.Hour, 10 /* revalidateCount */)
+	fetcher.RunOnce(ctx)
+	listResp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_FORWARD,
+	})
+	if got, want := len(listResp.Items), 5; got != want {
+		t.Fatalf("Got %d statuses, wanted %d", got, want)
+	}
+	status1 := MustUnmarshal[mastodon.Status](t, []byte(listResp.Items[1].Status.Content))
+	status2 := MustUnmarshal[mastodon.Status](t, []byte(listResp.Items[2].Status.Content))
+
+	// Modify statuses on Mastodon side.
+	if err := env.mastodonServer.DeleteStatus(status1.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.mastodonServer.SetStatusContent(status2.ID, "edited content"); err != nil {
+		t.Fatal(err)
+	}
+	fetcher.RunOnce(ctx)
+
+	// Positions are not changed, but statuses are flagged.
+	listResp = MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_INITIAL,
+	})
+	if got, want := len(listResp.Items), 5; got != want {
+		t.Fatalf("Got %d statuses, wanted %d", got, want)
+	}
+	for _, item := range listResp.Items {
+		status := MustUnmarshal[mastodon.Status](t, []byte(item.Status.Content))
+		if got, want := item.Deleted, status.ID == status1.ID; got != want {
+			t.Errorf("Status %s: got deleted=%v, wanted %v", status.ID, got, want)
+		}
+		if got, want := item.Edited, status.ID == status2.ID; got != want {
+			t.Errorf("Status %s: got edited=%v, wanted %v", status.ID, got, want)
+		}
+	}
+}
+
+func TestFetcherRevalidateRotates(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t:             t,
+		StatusesCount: 5,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	fetcher := NewFetcher(env.server, time.Minute, 0 /* jitter */, time.Hour, 2 /* revalidateCount */)
+	fetcher.RunOnce(ctx)
+	listResp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_FORWARD,
+	})
+	for _, item := range listResp.Items {
+		status := MustUnmarshal[mastodon.Status](t, []byte(item.Status.Content))
+		if err := env.mastodonServer.DeleteStatus(status.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	countDeleted := func() int {
+		listResp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+			Stid:      userInfo.DefaultStid,
+			Direction: pb.ListRequest_INITIAL,
+		})
+		count := 0
+		for _, item := range listResp.Items {
+			if item.Deleted {
+				count++
+			}
+		}
+		return count
+	}
+
+	// Each round checks different statuses, until all of them are checked.
+	for _, want := range []int{2, 4, 5} {
+		fetcher.RunOnce(ctx)
+		if got := countDeleted(); got != want {
+			t.Errorf("Got %d deleted statuses, wanted %d", got, want)
+		}
+	}
+}
+
+func TestFetcherBackoff(t *testing.T) {
+	now := time.Unix(1000, 0)
+	fetcher := NewFetcher(nil, time.Minute, 0 /* jitter */, 3*time.Minute, 0 /* revalidateCount */)
+	fetcher.now = func() time.Time { return now }
+
+	if fetcher.inBackoff("server1") {
+		t.Errorf("Unexpected backoff before any failure")
+	}
+
+	// First failure waits for one interval.
+	fetcher.recordFailure("server1")
+	if !fetcher.inBackoff("server1") {
+		t.Errorf("Expected backoff after failure")
+	}
+	if fetcher.inBackoff("server2") {
+		t.Errorf("Backoff should be per server")
+	}
+	now = now.Add(61 * time.Second)
+	if fetcher.inBackoff("server1") {
+		t.Errorf("Backoff should have expired")
+	}
+
+	// Then delay doubles, up to the max.
+	fetcher.recordFailure("server1")
+	now = now.Add(61 * time.Second)
+	if !fetcher.inBackoff("server1") {
+		t.Errorf("Expected longer backoff after second failure")
+	}
+	fetcher.recordFailure("server1")
+	fetcher.recordFailure("server1")
+	if got, want := fetcher.backoffs["server1"].until.Sub(now), 3*time.Minute; got != want {
+		t.Errorf("Got backoff of %v, wanted %v", got, want)
+	}
+
+	fetcher.recordSuccess("server1")
+	if fetcher.inBackoff("server1") {
+		t.Errorf("Backoff should be reset after success")
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Palats/mastopoof/backend/storage"
+	"github.com/Palats/mastopoof/backend/types"
+	stpb "github.com/Palats/mastopoof/proto/gen/mastopoof/storage"
+	"github.com/golang/glog"
+	"github.com/mattn/go-mastodon"
+)
+
+// filtersCacheDuration is how long the Mastodon filters of an account are
+// reused before being fetched again.
+const filtersCacheDuration = 15 * time.Minute
+
+// mastodonFilter is a filter, as returned by the Mastodon v2 filters API.
+// https://docs.joinmastodon.org/entities/Filter/
+type mastodonFilter struct {
+	ID           string     `json:"id"`
+	Title        string     `json:"title"`
+	Context      []string   `json:"context"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	FilterAction string     `json:"filter_action"`
+	Keywords     []struct {
+		Keyword   string `json:"keyword"`
+		WholeWord bool   `json:"whole_word"`
+	} `json:"keywords"`
+}
+
+// fetchFilters gets the filters of the account from Mastodon. go-mastodon
+// only knows about the deprecated v1 API, which does not provide filter
+// actions.
+func fetchFilters(ctx context.Context, client *mastodon.Client) ([]*stpb.MastodonFilter, error) {
+	var raw []*mastodonFilter
+	if err := callMastodonAPI(ctx, client, http.MethodGet, &raw, "/api/v2/filters"); err != nil {
+		return nil, err
+	}
+	var filters []*stpb.MastodonFilter
+	for _, f := range raw {
+		filter := &stpb.MastodonFilter{
+			Id:           f.ID,
+			Title:        f.Title,
+			Context:      f.Context,
+			FilterAction: f.FilterAction,
+		}
+		if f.ExpiresAt != nil {
+			filter.ExpiresAtSecs = f.ExpiresAt.Unix()
+		}
+		for _, kw := range f.Keywords {
+			filter.Keywords = append(filter.Keywords, &stpb.MastodonFilter_Keyword{
+				Keyword:   kw.Keyword,
+				WholeWord: kw.WholeWord,
+			})
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// accountFilters returns the Mastodon filters of the account, with their
+// keywords ready to be matched. They are fetched only if the copy kept on the
+// account is too old.
+// `accountState` is updated IN PLACE when filters are fetched.
+func (s *Server) accountFilters(ctx context.Context, accountState *stpb.AccountState, client *mastodon.Client) ([]*stpb.MastodonFilter, error) {
+	if accountState.FiltersFetchSecs == 0 || time.Since(time.Unix(accountState.FiltersFetchSecs, 0)) >= filtersCacheDuration {
+		if err := s.refreshFilters(ctx, accountState, client); err != nil {
+			return nil, err
+		}
+	}
+	storage.CompileFilters(accountState.Filters)
+	return accountState.Filters, nil
+}
+
+// refreshFilters fetches the Mastodon filters of the account, whatever the
+// age of the copy kept on the account.
+// `accountState` is updated IN PLACE.
+func (s *Server) refreshFilters(ctx context.Context, accountState *stpb.AccountState, client *mastodon.Client) error {
+	now := time.Now()
+	filters, err := fetchFilters(ctx, client)
+	if err != nil {
+		return fmt.Errorf("unable to get filters: %w", err)
+	}
+	glog.Infof("Got %d filters for asid=%d", len(filters), accountState.Asid)
+	if err := s.st.SetAccountFilters(ctx, nil, types.ASID(accountState.Asid), filters, now.Unix()); err != nil {
+		return err
+	}
+	accountState.Filters = filters
+	accountState.FiltersFetchSecs = now.Unix()
+	return nil
+}
+
+// followingCacheDuration is how long the list of accounts followed by an
+// account is reused before being fetched again.
+const followingCacheDuration = time.Hour
+
+// maxFollowingPages limits how many pages of followed accounts are fetched.
+const maxFollowingPages = 50
+
+// refreshFollowing gets the accounts followed by the account from Mastodon,
+// if the copy kept on the account is too old. It is needed only by some of
+// the local filter rules.
+func (s *Server) refreshFollowing(ctx context.Context, accountState *stpb.AccountState, client *mastodon.Client) error {
+	now := time.Now()
+	if accountState.FollowingFetchSecs != 0 && now.Sub(time.Unix(accountState.FollowingFetchSecs, 0)) < followingCacheDuration {
+		return nil
+	}
+
+	var ids []string
+	pg := &mastodon.Pagination{Limit: 80}
+	for i := 0; i < maxFollowingPages; i++ {
+		prevMaxID := pg.MaxID
+		// The pagination is updated based on the `Link` header of the answer.
+		accounts, err := client.GetAccountFollowing(ctx, mastodon.ID(accountState.AccountId), pg)
+		if err != nil {
+			return fmt.Errorf("unable to get followed accounts: %w", err)
+		}
+		for _, account := range accounts {
+			ids = append(ids, string(account.ID))
+		}
+		// Without a new position, there is nothing more to get.
+		if len(accounts) == 0 || pg.MaxID == "" || pg.MaxID == prevMaxID {
+			break
+		}
+		pg = &mastodon.Pagination{Limit: 80, MaxID: pg.MaxID}
+	}
+	glog.Infof("Got %d followed accounts for asid=%d", len(ids), accountState.Asid)
+	if err := s.st.SetAccountFollowing(ctx, nil, types.ASID(accountState.Asid), ids, now.Unix()); err != nil {
+		return err
+	}
+	accountState.FollowingIds = ids
+	accountState.FollowingFetchSecs = now.Unix()
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 	"time"
 
@@ -42,11 +43,11 @@ func validateAddress(addr string) error {
 // AppRegistry manages app registration on Mastodon servers
 // mastodon clients.
 type AppRegistry struct {
-	st     *storage.Storage
+	st     storage.Store
 	client *http.Client
 }
 
-func NewAppRegistry(st *storage.Storage) *AppRegistry {
+func NewAppRegistry(st storage.Store) *AppRegistry {
 	return &AppRegistry{
 		st:     st,
 		client: http.DefaultClient,
@@ -145,7 +146,7 @@ func (appreg *AppRegistry) callRegister(ctx context.Context, nfo *types.AppRegIn
 	}, nil
 }
 
-func NewSessionManager(st *storage.Storage) *scs.SessionManager {
+func NewSessionManager(st storage.Store) *scs.SessionManager {
 	sessionManager := scs.New()
 	sessionManager.Store = st.NewSCSStore()
 	sessionManager.Lifetime = 90 * 24 * time.Hour
@@ -162,24 +163,27 @@ type Server struct {
 	// Do not modify once it is serving.
 	FrontendConfig MastopoofConfig
 
-	st             *storage.Storage
-	inviteCode     string
+	st             storage.Store
 	autoLogin      types.UID
 	sessionManager *scs.SessionManager
 	selfURL        *url.URL
 	appRegistry    *AppRegistry
+
+	// If true, creating a user requires an invite code - see
+	// storage.CreateInviteCode.
+	requireInvite bool
 }
 
-func New(st *storage.Storage, sessionManager *scs.SessionManager, inviteCode string, autoLogin types.UID, selfURL *url.URL, appRegistry *AppRegistry) *Server {
+func New(st storage.Store, sessionManager *scs.SessionManager, requireInvite bool, autoLogin types.UID, selfURL *url.URL, appRegistry *AppRegistry) *Server {
 	s := &Server{
 		FrontendConfig: MastopoofConfig{
 			Src:       "server",
 			DefServer: "mastodon.social",
-			Invite:    inviteCode != "",
+			Invite:    requireInvite,
 		},
 		st:             st,
 		sessionManager: sessionManager,
-		inviteCode:     inviteCode,
+		requireInvite:  requireInvite,
 		autoLogin:      autoLogin,
 		selfURL:        selfURL,
 		appRegistry:    appRegistry,
@@ -190,14 +194,27 @@ func New(st *storage.Storage, sessionManager *scs.SessionManager, inviteCode str
 func (s *Server) setSessionUserID(ctx context.Context, uid types.UID) {
 	// `uid`` must be converted from `UID` to `int64`, otherwise session manager
 	// has trouble serializing it.
-	s.sessionManager.Put(ctx, "userid", int64(uid))
+	s.sessionManager.Put(ctx, storage.SessionUserIDKey, int64(uid))
 }
 
+// isLogged returns the user of the session. Sessions of disabled or deleted
+// users are refused: disabling a user revokes its sessions, but a request in
+// flight at that time might still have saved its session afterwards.
 func (s *Server) isLogged(ctx context.Context) (types.UID, error) {
-	userID := types.UID(s.sessionManager.GetInt64(ctx, "userid"))
+	userID := types.UID(s.sessionManager.GetInt64(ctx, storage.SessionUserIDKey))
 	if userID == 0 {
 		return 0, connect.NewError(connect.CodePermissionDenied, fmt.Errorf("oh noes"))
 	}
+	userState, err := s.st.UserState(ctx, nil, userID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return 0, connect.NewError(connect.CodePermissionDenied, fmt.Errorf("user %d does not exist", userID))
+	}
+	if err != nil {
+		return 0, err
+	}
+	if userState.Disabled {
+		return 0, connect.NewError(connect.CodePermissionDenied, fmt.Errorf("user %d is disabled", userID))
+	}
 	return userID, nil
 }
 
@@ -227,13 +244,20 @@ func (s *Server) verifyStID(ctx context.Context, stid types.StID) (*stpb.UserSta
 	if err != nil {
 		return nil, err
 	}
-	userState, err := s.st.UserState(ctx, nil, userID)
+	streamState, err := s.st.StreamState(ctx, nil, stid)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, connect.NewError(connect.CodePermissionDenied, errors.New("stream access denied"))
+	}
 	if err != nil {
 		return nil, err
 	}
-	if types.StID(userState.DefaultStid) != stid {
+	if types.UID(streamState.Uid) != userID {
 		return nil, connect.NewError(connect.CodePermissionDenied, errors.New("stream access denied"))
 	}
+	userState, err := s.st.UserState(ctx, nil, userID)
+	if err != nil {
+		return nil, err
+	}
 	return userState, nil
 }
 
@@ -270,7 +294,7 @@ func (s *Server) Login(ctx context.Context, req *connect.Request[pb.LoginRequest
 }
 
 func (s *Server) Logout(ctx context.Context, req *connect.Request[pb.LogoutRequest]) (*connect.Response[pb.LogoutResponse], error) {
-	s.sessionManager.Remove(ctx, "userid")
+	s.sessionManager.Remove(ctx, storage.SessionUserIDKey)
 	err := s.sessionManager.RenewToken(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unable to renew token: %w", err)
@@ -315,12 +339,18 @@ func (s *Server) UpdateSettings(ctx context.Context, req *connect.Request[pb.Upd
 }
 
 func (s *Server) Authorize(ctx context.Context, req *connect.Request[pb.AuthorizeRequest]) (*connect.Response[pb.AuthorizeResponse], error) {
-	if s.inviteCode != "" {
-		if req.Msg.InviteCode != s.inviteCode {
-			return nil, connect.NewError(connect.CodePermissionDenied, errors.New("invalid invite code"))
+	// Logged in users do not need an invite code - they are adding an account.
+	// Existing users logging in again do not need one either; the code is
+	// only used by Token when creating a user.
+	_, loggedErr := s.isLogged(ctx)
+	if s.requireInvite && loggedErr != nil && req.Msg.InviteCode != "" {
+		if err := s.st.CheckInviteCode(ctx, nil, req.Msg.InviteCode); errors.Is(err, storage.ErrInvalidInviteCode) {
+			return nil, connect.NewError(connect.CodePermissionDenied, err)
+		} else if err != nil {
+			return nil, err
 		}
 		// TODO: make it less hacky
-		s.sessionManager.Put(ctx, "invitecheck", true)
+		s.sessionManager.Put(ctx, "invitecode", req.Msg.InviteCode)
 	}
 
 	serverAddr := req.Msg.ServerAddr
@@ -354,48 +384,12 @@ func (s *Server) Authorize(ctx context.Context, req *connect.Request[pb.Authoriz
 }
 
 func (s *Server) Token(ctx context.Context, req *connect.Request[pb.TokenRequest]) (*connect.Response[pb.TokenResponse], error) {
-	if s.inviteCode != "" {
-		// TODO: make it less hacky
-		if !s.sessionManager.GetBool(ctx, "invitecheck") {
-			return nil, connect.NewError(connect.CodePermissionDenied, errors.New("missing invite code"))
-		}
-	}
-
-	// TODO: sanitization of server addr to be factorized with Authorize.
-	serverAddr := req.Msg.ServerAddr
-	if err := validateAddress(serverAddr); err != nil {
-		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unable to validate address %s: %w", serverAddr, err))
-	}
-
-	authCode := req.Msg.AuthCode
-	if authCode == "" {
-		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("missing authcode"))
-	}
-
-	// This can write to the DB. However, this is just about mastodon client registration, which is independent
-	// from the rest of the state - so even if something else fail here afterward, it is fine to keep
-	// around a successfull App registration.
-	appRegState, err := s.appRegistry.Register(ctx, serverAddr, s.selfURL)
+	client, mastodonAccount, err := s.authenticate(ctx, req.Msg.ServerAddr, req.Msg.AuthCode)
 	if err != nil {
 		return nil, err
 	}
-	client := s.appRegistry.MastodonClient(appRegState, "" /* accessToken */)
-
-	err = client.AuthenticateToken(ctx, authCode, appRegState.RedirectUri)
-	if err != nil {
-		return nil, fmt.Errorf("unable to authenticate on server %s: %w", appRegState.ServerAddr, err)
-	}
-
-	// Now get info about the mastodon mastodonAccount so we can match it
-	// to a local mastodonAccount.
-	mastodonAccount, err := client.GetAccountCurrentUser(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failure whena calling Mastodon AccountCurrentUser: %w", err)
-	}
+	serverAddr := req.Msg.ServerAddr
 	accountID := mastodonAccount.ID
-	if accountID == "" {
-		return nil, errors.New("missing account ID")
-	}
 	username := mastodonAccount.Username
 
 	var userState *stpb.UserState
@@ -406,6 +400,17 @@ func (s *Server) Token(ctx context.Context, req *connect.Request[pb.TokenRequest
 			// No mastodon account - and the way to find actual user is through the mastodon
 			// account, so it means we need to create a user and then we can create
 			// the mastodon account state.
+			if s.requireInvite {
+				inviteCode := s.sessionManager.GetString(ctx, "invitecode")
+				if inviteCode == "" {
+					return connect.NewError(connect.CodePermissionDenied, errors.New("missing invite code"))
+				}
+				if err := s.st.UseInviteCode(ctx, txn, inviteCode); errors.Is(err, storage.ErrInvalidInviteCode) {
+					return connect.NewError(connect.CodePermissionDenied, err)
+				} else if err != nil {
+					return err
+				}
+			}
 			userState, accountState, _, err = s.st.CreateUser(ctx, txn, serverAddr, accountID, username)
 			if err != nil {
 				return fmt.Errorf("failed to create user %s/%s@%s: %w", accountID, username, serverAddr, err)
@@ -420,6 +425,9 @@ func (s *Server) Token(ctx context.Context, req *connect.Request[pb.TokenRequest
 		if err != nil {
 			return fmt.Errorf("unable to load userstate for UID %d: %w", accountState.Uid, err)
 		}
+		if userState.Disabled {
+			return connect.NewError(connect.CodePermissionDenied, fmt.Errorf("user %d is disabled", userState.Uid))
+		}
 
 		// Now, let's write the access token we got in the account state.
 		accountState.AccessToken = client.Config.AccessToken
@@ -434,6 +442,7 @@ func (s *Server) Token(ctx context.Context, req *connect.Request[pb.TokenRequest
 	}
 
 	// And mark the session as logged in.
+	s.sessionManager.Remove(ctx, "invitecode")
 	err = s.sessionManager.RenewToken(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unable to renew token: %w", err)
@@ -450,6 +459,109 @@ func (s *Server) Token(ctx context.Context, req *connect.Request[pb.TokenRequest
 	}), nil
 }
 
+// authenticate finishes the oauth flow, getting an access token from the
+// authorization code. It returns a client using that token, along with the
+// Mastodon account it is for.
+func (s *Server) authenticate(ctx context.Context, serverAddr string, authCode string) (*mastodon.Client, *mastodon.Account, error) {
+	// TODO: sanitization of server addr to be factorized with Authorize.
+	if err := validateAddress(serverAddr); err != nil {
+		return nil, nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unable to validate address %s: %w", serverAddr, err))
+	}
+
+	if authCode == "" {
+		return nil, nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("missing authcode"))
+	}
+
+	// This can write to the DB. However, this is just about mastodon client registration, which is independent
+	// from the rest of the state - so even if something else fail here afterward, it is fine to keep
+	// around a successfull App registration.
+	appRegState, err := s.appRegistry.Register(ctx, serverAddr, s.selfURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	client := s.appRegistry.MastodonClient(appRegState, "" /* accessToken */)
+
+	err = client.AuthenticateToken(ctx, authCode, appRegState.RedirectUri)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to authenticate on server %s: %w", appRegState.ServerAddr, err)
+	}
+
+	// Now get info about the mastodon mastodonAccount so we can match it
+	// to a local mastodonAccount.
+	mastodonAccount, err := client.GetAccountCurrentUser(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failure whena calling Mastodon AccountCurrentUser: %w", err)
+	}
+	if mastodonAccount.ID == "" {
+		return nil, nil, errors.New("missing account ID")
+	}
+	return client, mastodonAccount, nil
+}
+
+func (s *Server) LinkAccount(ctx context.Context, req *connect.Request[pb.LinkAccountRequest]) (*connect.Response[pb.LinkAccountResponse], error) {
+	userID, err := s.isLogged(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client, mastodonAccount, err := s.authenticate(ctx, req.Msg.ServerAddr, req.Msg.AuthCode)
+	if err != nil {
+		return nil, err
+	}
+	serverAddr := req.Msg.ServerAddr
+
+	var userState *stpb.UserState
+	err = s.st.InTxnRW(ctx, func(ctx context.Context, txn storage.SQLReadWrite) error {
+		accountState, err := s.st.AccountStateByAccountID(ctx, txn, serverAddr, mastodonAccount.ID)
+		if errors.Is(err, storage.ErrNotFound) {
+			accountState, err = s.st.CreateAccountState(ctx, txn, userID, serverAddr, mastodonAccount.ID, mastodonAccount.Username)
+			if err != nil {
+				return fmt.Errorf("failed to create account %s/%s@%s: %w", mastodonAccount.ID, mastodonAccount.Username, serverAddr, err)
+			}
+		} else if err != nil {
+			return err
+		}
+
+		// An account can only be attached to a single user; linking it again
+		// to the same user just refreshes the access token.
+		if types.UID(accountState.Uid) != userID {
+			return connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("account %s@%s is already used by another user", mastodonAccount.Username, serverAddr))
+		}
+
+		accountState.AccessToken = client.Config.AccessToken
+		if err := s.st.SetAccountState(ctx, txn, accountState); err != nil {
+			return fmt.Errorf("failed to set account state %d: %w", accountState.Asid, err)
+		}
+
+		userState, err = s.st.UserState(ctx, txn, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	userInfo, err := s.getUserInfo(ctx, userState)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&pb.LinkAccountResponse{
+		UserInfo: userInfo,
+	}), nil
+}
+
+// accountProtos gets the Mastodon accounts of a user, indexed by ASID.
+func (s *Server) accountProtos(ctx context.Context, uid types.UID) (map[types.ASID]*pb.Account, error) {
+	accountStates, err := s.st.AllAccountStateByUID(ctx, nil, uid)
+	if err != nil {
+		return nil, err
+	}
+	accounts := map[types.ASID]*pb.Account{}
+	for _, accountState := range accountStates {
+		accounts[types.ASID(accountState.Asid)] = types.AccountStateToAccountProto(accountState)
+	}
+	return accounts, nil
+}
+
 func (s *Server) List(ctx context.Context, req *connect.Request[pb.ListRequest]) (*connect.Response[pb.ListResponse], error) {
 	stid := types.StID(req.Msg.Stid)
 	userState, err := s.verifyStID(ctx, stid)
@@ -457,11 +569,10 @@ func (s *Server) List(ctx context.Context, req *connect.Request[pb.ListRequest])
 		return nil, err
 	}
 
-	accountState, err := s.st.FirstAccountStateByUID(ctx, nil, types.UID(userState.Uid))
+	accounts, err := s.accountProtos(ctx, types.UID(userState.Uid))
 	if err != nil {
 		return nil, err
 	}
-	accountStateProto := types.AccountStateToAccountProto(accountState)
 
 	resp := &pb.ListResponse{}
 
@@ -503,31 +614,55 @@ func (s *Server) List(ctx context.Context, req *connect.Request[pb.ListRequest])
 	}
 
 	for _, item := range listResult.Items {
-		raw, err := json.Marshal(item.Status)
+		itemProto, err := itemToProto(item, accounts)
 		if err != nil {
 			return nil, err
 		}
-		resp.Items = append(resp.Items, &pb.Item{
-			Status:   &pb.MastodonStatus{Content: string(raw)},
-			Position: item.Position,
-			// TODO: account is potentially per status, while it is currently considered per user.
-			Account:           accountStateProto,
-			Meta:              item.StatusMeta,
-			StreamStatusState: item.StreamStatusState,
-		})
+		resp.Items = append(resp.Items, itemProto)
 	}
 
 	return connect.NewResponse(resp), nil
 }
 
+// itemToProto converts a storage item to what is sent to the frontend.
+// `accounts` are the Mastodon accounts of the user, indexed by ASID.
+func itemToProto(item *storage.Item, accounts map[types.ASID]*pb.Account) (*pb.Item, error) {
+	raw, err := json.Marshal(item.Status)
+	if err != nil {
+		return nil, err
+	}
+	var seenBy []*pb.Account
+	for _, asid := range item.StreamStatusState.GetSeenBy() {
+		if account := accounts[types.ASID(asid)]; account != nil {
+			seenBy = append(seenBy, account)
+		}
+	}
+	return &pb.Item{
+		Status:            &pb.MastodonStatus{Content: string(raw)},
+		Position:          item.Position,
+		Account:           accounts[item.ASID],
+		Meta:              item.StatusMeta,
+		StreamStatusState: item.StreamStatusState,
+		SeenBy:            seenBy,
+		Deleted:           item.StreamStatusState.GetDeleted(),
+		Edited:            item.StreamStatusState.GetEdited(),
+		FilterWarnings:    storage.FilterWarnings(item.StatusMeta),
+	}, nil
+}
+
 func (s *Server) SetRead(ctx context.Context, req *connect.Request[pb.SetReadRequest]) (*connect.Response[pb.SetReadResponse], error) {
 	stid := types.StID(req.Msg.Stid)
-	if _, err := s.verifyStID(ctx, stid); err != nil {
+	userState, err := s.verifyStID(ctx, stid)
+	if err != nil {
 		return nil, err
 	}
 
 	var streamState *stpb.StreamState
-	err := s.st.InTxnRW(ctx, func(ctx context.Context, txn storage.SQLReadWrite) error {
+	// When set, the status to report to Mastodon as read, and the account it
+	// was fetched from.
+	var markerItem *storage.Item
+	var markerAccount *stpb.AccountState
+	err = s.st.InTxnRW(ctx, func(ctx context.Context, txn storage.SQLReadWrite) error {
 		var err error
 		streamState, err = s.st.StreamState(ctx, txn, stid)
 		if err != nil {
@@ -552,9 +687,27 @@ func (s *Server) SetRead(ctx context.Context, req *connect.Request[pb.SetReadReq
 			return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid SetRead mode %v", req.Msg.Mode))
 		}
 
-		if streamState.LastRead != oldValue {
-			if err := s.st.SetStreamState(ctx, txn, streamState); err != nil {
-				return err
+		if streamState.LastRead == oldValue {
+			return nil
+		}
+		if err := s.st.SetStreamState(ctx, txn, streamState); err != nil {
+			return err
+		}
+
+		if !syncsHomeMarker(userState, streamState) || streamState.LastRead < streamState.FirstPosition {
+			return nil
+		}
+		markerItem, err = s.st.StatusAtPosition(ctx, txn, stid, streamState.LastRead)
+		if err != nil {
+			return err
+		}
+		accountStates, err := s.st.AllAccountStateByUID(ctx, txn, types.UID(userState.Uid))
+		if err != nil {
+			return err
+		}
+		for _, accountState := range accountStates {
+			if types.ASID(accountState.Asid) == markerItem.ASID {
+				markerAccount = accountState
 			}
 		}
 		return nil
@@ -563,11 +716,88 @@ func (s *Server) SetRead(ctx context.Context, req *connect.Request[pb.SetReadReq
 		return nil, err
 	}
 
+	if markerItem != nil && markerAccount != nil {
+		// Mastodon markers are per account, so only the account which provided
+		// the status can be updated.
+		// The read position is already recorded, so failing to update the
+		// marker does not fail the request; it will be updated next time.
+		if err := s.setHomeMarker(ctx, markerAccount, markerItem.Status.ID); err != nil {
+			glog.Errorf("unable to set home marker of asid=%d: %v", markerAccount.Asid, err)
+		}
+	}
+
 	return connect.NewResponse(&pb.SetReadResponse{
 		StreamInfo: types.StreamStateToStreamInfo(streamState),
 	}), nil
 }
 
+// syncsHomeMarker indicates whether the read position of the stream is kept in
+// sync with the Mastodon `home` marker.
+func syncsHomeMarker(userState *stpb.UserState, streamState *stpb.StreamState) bool {
+	return types.SettingSyncHomeMarker(userState.GetSettings()) && streamState.GetSource().GetKind() == stpb.StreamSource_HOME
+}
+
+// setHomeMarker moves the Mastodon `home` marker of the account to the
+// provided status.
+func (s *Server) setHomeMarker(ctx context.Context, accountState *stpb.AccountState, statusID mastodon.ID) error {
+	appRegState, err := s.appRegistry.Register(ctx, accountState.ServerAddr, s.selfURL)
+	if err != nil {
+		return err
+	}
+	client := s.appRegistry.MastodonClient(appRegState, accountState.AccessToken)
+	return client.SetHomeMarker(ctx, statusID)
+}
+
+// accountFetch is what was obtained from a single Mastodon account when
+// fetching for a stream.
+type accountFetch struct {
+	accountState *stpb.AccountState
+	// Position in the timeline before fetching, to detect concurrent fetches.
+	lastStatusID mastodon.ID
+	// Most recent status ID obtained.
+	newStatusID mastodon.ID
+	// Pagination, as updated by the Mastodon library.
+	pg       *mastodon.Pagination
+	timeline []*mastodon.Status
+	filters  []*stpb.MastodonFilter
+
+	// Notifications more recent than the ones already known.
+	notifs      []*mastodon.Notification
+	notifsState stpb.StreamState_NotificationsState
+	// Position of the Mastodon `notifications` marker.
+	notifsMarker mastodon.ID
+	// Position of the Mastodon `home` marker, if it is synced.
+	homeMarker mastodon.ID
+	// Whether unread notifications were listed to find the ones dismissed on
+	// Mastodon; see storage.DropDismissedNotifications for the other fields.
+	checkedUnread  bool
+	unreadNotifIDs []mastodon.ID
+	unreadSince    mastodon.ID
+	unreadUpTo     mastodon.ID
+}
+
+// done indicates whether all the available statuses have been obtained from
+// that account.
+func (af *accountFetch) done() bool {
+	// Pagination got updated.
+	if af.pg.MinID != af.newStatusID {
+		// Either there is a mismatch in the data or no `Link` was returned
+		// - in either case, we don't know enough to safely continue.
+		glog.Infof("no returned MinID / ID mismatch, stopping fetch")
+		return true
+	}
+	if af.pg.MaxID == "" || af.pg.MaxID == af.pg.MinID {
+		// We've reached the end - either nothing was fetched, or just the
+		// latest ones.
+		return true
+	}
+	if len(af.timeline) == 0 {
+		// Nothing was returned, assume it is because we've reached the end.
+		return true
+	}
+	return false
+}
+
 func (s *Server) Fetch(ctx context.Context, req *connect.Request[pb.FetchRequest]) (*connect.Response[pb.FetchResponse], error) {
 	// Check for credentials.
 	stid := types.StID(req.Msg.Stid)
@@ -575,117 +805,120 @@ func (s *Server) Fetch(ctx context.Context, req *connect.Request[pb.FetchRequest
 		return nil, err
 	}
 
+	resp, err := s.fetchStream(ctx, stid)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(resp), nil
+}
+
+func (s *Server) WatchStream(ctx context.Context, req *connect.Request[pb.WatchStreamRequest], stream *connect.ServerStream[pb.WatchStreamResponse]) error {
+	stid := types.StID(req.Msg.Stid)
+	if _, err := s.verifyStID(ctx, stid); err != nil {
+		return err
+	}
+
+	// The stream state is read again each time it is modified, and sent only
+	// if the info derived from it is different.
+	var lastInfo *pb.StreamInfo
+	for {
+		// Get the signal before reading the state, to not miss any change
+		// happening in between.
+		changed := s.st.StreamSignal(stid)
+
+		streamState, err := s.st.StreamState(ctx, nil, stid)
+		if errors.Is(err, storage.ErrNotFound) {
+			return connect.NewError(connect.CodeNotFound, fmt.Errorf("stream %d was deleted", stid))
+		}
+		if err != nil {
+			return err
+		}
+		info := types.StreamStateToStreamInfo(streamState)
+		if lastInfo == nil || !proto.Equal(info, lastInfo) {
+			if err := stream.Send(&pb.WatchStreamResponse{StreamInfo: info}); err != nil {
+				return err
+			}
+			lastInfo = info
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// streamAccounts returns the Mastodon accounts the stream fetches statuses
+// from.
+func (s *Server) streamAccounts(ctx context.Context, txn storage.SQLReadOnly, streamState *stpb.StreamState) ([]*stpb.AccountState, error) {
+	if streamState.GetSource().GetKind() == stpb.StreamSource_HOME {
+		// Home timelines of all accounts go in the same stream.
+		return s.st.AllAccountStateByUID(ctx, txn, types.UID(streamState.Uid))
+	}
+	// Lists and hashtags are only followed through the first account.
+	accountState, err := s.st.FirstAccountStateByUID(ctx, txn, types.UID(streamState.Uid))
+	if err != nil {
+		return nil, err
+	}
+	return []*stpb.AccountState{accountState}, nil
+}
+
+// fetchStream gets new statuses from Mastodon and adds them to the pool of
+// the stream. It does not verify that the caller has access to the stream.
+func (s *Server) fetchStream(ctx context.Context, stid types.StID) (*pb.FetchResponse, error) {
 	// Do a first transaction to get the state of the stream. That will serve as
 	// reference when trying to inject in the DB the statuses - while avoiding
 	// having a transaction opened while fetching.
-	var accountState *stpb.AccountState
+	var accountStates []*stpb.AccountState
+	var streamState *stpb.StreamState
+	var userState *stpb.UserState
 
 	err := s.st.InTxnRO(ctx, func(ctx context.Context, txn storage.SQLReadOnly) error {
-		streamState, err := s.st.StreamState(ctx, txn, stid)
+		var err error
+		streamState, err = s.st.StreamState(ctx, txn, stid)
 		if err != nil {
 			return err
 		}
-
-		// For support for having multiple Mastodon account, this would
-		// need to list the accounts and do the fetching from each account.
-		accountState, err = s.st.FirstAccountStateByUID(ctx, txn, types.UID(streamState.Uid))
+		userState, err = s.st.UserState(ctx, txn, types.UID(streamState.Uid))
 		if err != nil {
 			return err
 		}
 
-		return nil
+		accountStates, err = s.streamAccounts(ctx, txn, streamState)
+		return err
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	appRegState, err := s.appRegistry.Register(ctx, accountState.ServerAddr, s.selfURL)
-	if err != nil {
-		return nil, err
-	}
-	client := s.appRegistry.MastodonClient(appRegState, accountState.AccessToken)
-
 	// We've got what we wanted from the DB, now we can fetch from Mastodon outside
 	// a transaction.
-
-	// Pagination object is updated by GetTimelimeHome, based on the `Link` header
-	// returned by the API - see https://docs.joinmastodon.org/api/guidelines/#pagination .
-	// On the query:
-	//  - max_id (MaxID) is an upper bound, not included.
-	//  - min_id (MinID) will indicate to get statuses starting at that ID - aka, cursor like.
-	//  - since_id (SinceID) sets a lower bound on the results, but will prioritize recent results. I.e., it will
-	//     return the last $Limit statuses, assuming they are all more recent than SinceID.
-	// On the result, it seems:
-	//  - min_id is set to the most recent ID returned (from the "prev" Link, which is for future statuses)
-	//  - max_id is set to an older ID (from the "next" Link, which is for older statuses).
-	//    Set to 0 when no statuses are returned when having reached most recent stuff.
-	//  - since_id, Limit are empty/0.
-	// See https://github.com/mattn/go-mastodon/blob/9faaa4f0dc23d9001ccd1010a9a51f56ba8d2f9f/mastodon.go#L317
-	// It seems that if max_id and min_id are identical, it means the end has been reached and some result were given.
-	// And if there is no max_id, the end has been reached.
-	pg := &mastodon.Pagination{
-		MinID: mastodon.ID(accountState.LastHomeStatusId),
-	}
-	glog.Infof("Fetching... (max_id:%v, min_id:%v, since_id:%v)", pg.MaxID, pg.MinID, pg.SinceID)
-	timeline, err := client.GetTimelineHome(ctx, pg)
-	if err != nil {
-		glog.Errorf("unable to get timeline: %v", err)
-		return nil, err
+	var fetches []*accountFetch
+	for _, accountState := range accountStates {
+		af, err := s.fetchAccount(ctx, userState, accountState, streamState)
+		if err != nil {
+			return nil, &serverError{serverAddr: accountState.ServerAddr, err: err}
+		}
+		fetches = append(fetches, af)
 	}
 
-	filters, err := client.GetFilters(ctx)
-	if err != nil {
-		glog.Errorf("unable to get filters: %v", err)
-		return nil, err
-	}
+	// Record a timestamp for reference.
+	lastFetchSecs := time.Now().Unix()
 
-	newStatusID := mastodon.ID(accountState.LastHomeStatusId)
-	for _, status := range timeline {
-		if storage.IDNewer(status.ID, newStatusID) {
-			newStatusID = status.ID
-		}
+	// Start preparing the response.
+	resp := &pb.FetchResponse{
+		Status: pb.FetchResponse_DONE,
 	}
-
-	boundaries := ""
-	if len(timeline) > 0 {
-		boundaries = fmt.Sprintf(" (%s -- %s)", timeline[0].ID, timeline[len(timeline)-1].ID)
-	}
-	glog.Infof("Found %d new status on home timeline (LastHomeStatusID=%v) (max_id:%v, min_id:%v, since_id:%v)%s", len(timeline), newStatusID, pg.MaxID, pg.MinID, pg.SinceID, boundaries)
-
-	// Get notifications count
-	// Start by getting marker position on notifications to know what has been read.
-	markers, err := client.GetMarkers(ctx, []string{"notifications"})
-	if err != nil {
-		return nil, fmt.Errorf("unable to get notification marker: %w", err)
-	}
-	marker := markers["notifications"]
-	if marker == nil {
-		return nil, fmt.Errorf("server failed to return a 'notifications' marker; got: %v", markers)
-	}
-
-	// And do request notifications.
-	maxNotifs := int64(20)
-	notifsPg := mastodon.Pagination{
-		Limit:   maxNotifs,
-		SinceID: marker.LastReadID,
-	}
-	notifs, err := client.GetNotifications(ctx, &notifsPg)
-	if err != nil {
-		return nil, fmt.Errorf("unable to list notifications: %v", err)
-	}
-	notifsCount := int64(len(notifs))
-	notifsState := stpb.StreamState_NOTIF_EXACT
-	if notifsCount >= maxNotifs {
-		notifsState = stpb.StreamState_NOTIF_MORE
-	}
-
-	// Record a timestamp for reference.
-	lastFetchSecs := time.Now().Unix()
-
-	// Start preparing the response.
-	resp := &pb.FetchResponse{
-		Status:       pb.FetchResponse_MORE,
-		FetchedCount: int64(len(timeline)),
+	notifsState := stpb.StreamState_NOTIF_EXACT
+	for _, af := range fetches {
+		resp.FetchedCount += int64(len(af.timeline))
+		if !af.done() {
+			resp.Status = pb.FetchResponse_MORE
+		}
+		if af.notifsState == stpb.StreamState_NOTIF_MORE {
+			notifsState = stpb.StreamState_NOTIF_MORE
+		}
 	}
 
 	// Now do another transaction to update the DB - both statuses
@@ -699,23 +932,64 @@ func (s *Server) Fetch(ctx context.Context, req *connect.Request[pb.FetchRequest
 		}
 		streamState.LastFetchSecs = lastFetchSecs
 		streamState.NotificationsState = notifsState
-		streamState.NotificationsCount = notifsCount
 
-		currentAccountState, err := s.st.FirstAccountStateByUID(ctx, txn, types.UID(streamState.Uid))
-		if err != nil {
-			return fmt.Errorf("unable to verify for race conditions: %w", err)
-		}
-		if currentAccountState.LastHomeStatusId != accountState.LastHomeStatusId {
-			return connect.NewError(connect.CodeUnavailable, errors.New("concurrent fetch of Mastodon statuses - aborting"))
+		for _, af := range fetches {
+			if streamState.GetSource().GetKind() == stpb.StreamSource_HOME {
+				currentAccountState, err := s.st.AccountStateByAccountID(ctx, txn, af.accountState.ServerAddr, mastodon.ID(af.accountState.AccountId))
+				if err != nil {
+					return fmt.Errorf("unable to verify for race conditions: %w", err)
+				}
+				if currentAccountState.LastHomeStatusId != string(af.lastStatusID) {
+					return connect.NewError(connect.CodeUnavailable, errors.New("concurrent fetch of Mastodon statuses - aborting"))
+				}
+
+				currentAccountState.LastHomeStatusId = string(af.newStatusID)
+				if err := s.st.SetAccountState(ctx, txn, currentAccountState); err != nil {
+					return err
+				}
+			} else {
+				if streamState.LastStatusId != string(af.lastStatusID) {
+					return connect.NewError(connect.CodeUnavailable, errors.New("concurrent fetch of Mastodon statuses - aborting"))
+				}
+				streamState.LastStatusId = string(af.newStatusID)
+			}
+
+			if err := s.st.InsertNotifications(ctx, txn, types.ASID(af.accountState.Asid), af.notifs); err != nil {
+				return err
+			}
+			if err := s.st.SetNotificationsMarker(ctx, txn, types.ASID(af.accountState.Asid), af.notifsMarker); err != nil {
+				return err
+			}
+			if af.checkedUnread {
+				if err := s.st.DropDismissedNotifications(ctx, txn, types.ASID(af.accountState.Asid), af.unreadNotifIDs, af.unreadSince, af.unreadUpTo); err != nil {
+					return err
+				}
+			}
+
+			// InsertStatuses updates streamState IN PLACE and persists it.
+			if err := s.st.InsertStatuses(ctx, txn, types.ASID(af.accountState.Asid), streamState, af.timeline, af.filters); err != nil {
+				return err
+			}
+
+			// The `home` marker might have been moved by another Mastodon
+			// client; follow it if it is further than the current read position.
+			// Only already triaged statuses have a position to move to.
+			if af.homeMarker != "" {
+				position, err := s.st.PositionOfStatusID(ctx, txn, stid, types.ASID(af.accountState.Asid), af.homeMarker)
+				if err != nil {
+					return err
+				}
+				if position > streamState.LastRead {
+					streamState.LastRead = position
+				}
+			}
 		}
 
-		currentAccountState.LastHomeStatusId = string(newStatusID)
-		if err := s.st.SetAccountState(ctx, txn, currentAccountState); err != nil {
+		streamState.NotificationsCount, err = s.st.UnreadNotificationsCount(ctx, txn, types.UID(streamState.Uid))
+		if err != nil {
 			return err
 		}
-
-		// InsertStatuses updates streamState IN PLACE and persists it.
-		if err := s.st.InsertStatuses(ctx, txn, types.ASID(accountState.Asid), streamState, timeline, filters); err != nil {
+		if err := s.st.SetStreamState(ctx, txn, streamState); err != nil {
 			return err
 		}
 		resp.StreamInfo = types.StreamStateToStreamInfo(streamState)
@@ -725,126 +999,1233 @@ func (s *Server) Fetch(ctx context.Context, req *connect.Request[pb.FetchRequest
 		return nil, err
 	}
 
-	// Pagination got updated.
-	if pg.MinID != newStatusID {
-		// Either there is a mismatch in the data or no `Link` was returned
-		// - in either case, we don't know enough to safely continue.
-		glog.Infof("no returned MinID / ID mismatch, stopping fetch")
-		resp.Status = pb.FetchResponse_DONE
+	return resp, nil
+}
+
+// fetchAccount gets new statuses and notification state for a stream from
+// one Mastodon account. It does not modify the stream in the DB - only data
+// cached on the account, such as filters.
+func (s *Server) fetchAccount(ctx context.Context, userState *stpb.UserState, accountState *stpb.AccountState, streamState *stpb.StreamState) (*accountFetch, error) {
+	// The Mastodon `home` marker is only needed when it is synced.
+	withHomeMarker := syncsHomeMarker(userState, streamState)
+
+	appRegState, err := s.appRegistry.Register(ctx, accountState.ServerAddr, s.selfURL)
+	if err != nil {
+		return nil, err
 	}
-	if pg.MaxID == "" || pg.MaxID == pg.MinID {
-		// We've reached the end - either nothing was fetched, or just the
-		// latest ones.
-		resp.Status = pb.FetchResponse_DONE
+	client := s.appRegistry.MastodonClient(appRegState, accountState.AccessToken)
+
+	// Pagination object is updated by GetTimelimeHome, based on the `Link` header
+	// returned by the API - see https://docs.joinmastodon.org/api/guidelines/#pagination .
+	// On the query:
+	//  - max_id (MaxID) is an upper bound, not included.
+	//  - min_id (MinID) will indicate to get statuses starting at that ID - aka, cursor like.
+	//  - since_id (SinceID) sets a lower bound on the results, but will prioritize recent results. I.e., it will
+	//     return the last $Limit statuses, assuming they are all more recent than SinceID.
+	// On the result, it seems:
+	//  - min_id is set to the most recent ID returned (from the "prev" Link, which is for future statuses)
+	//  - max_id is set to an older ID (from the "next" Link, which is for older statuses).
+	//    Set to 0 when no statuses are returned when having reached most recent stuff.
+	//  - since_id, Limit are empty/0.
+	// See https://github.com/mattn/go-mastodon/blob/9faaa4f0dc23d9001ccd1010a9a51f56ba8d2f9f/mastodon.go#L317
+	// It seems that if max_id and min_id are identical, it means the end has been reached and some result were given.
+	// And if there is no max_id, the end has been reached.
+	source := streamState.GetSource()
+	af := &accountFetch{
+		accountState: accountState,
+		// The home timeline position is kept on the account, as it is shared by
+		// all streams of that account. Other sources are specific to the stream.
+		lastStatusID: mastodon.ID(streamState.LastStatusId),
 	}
-	if len(timeline) == 0 {
-		// Nothing was returned, assume it is because we've reached the end.
-		resp.Status = pb.FetchResponse_DONE
+	if source.GetKind() == stpb.StreamSource_HOME {
+		af.lastStatusID = mastodon.ID(accountState.LastHomeStatusId)
+	}
+	af.pg = &mastodon.Pagination{
+		MinID: af.lastStatusID,
+	}
+	glog.Infof("Fetching %v for asid=%d... (max_id:%v, min_id:%v, since_id:%v)", source.GetKind(), accountState.Asid, af.pg.MaxID, af.pg.MinID, af.pg.SinceID)
+	af.timeline, err = fetchTimeline(ctx, client, source, af.pg)
+	if err != nil {
+		glog.Errorf("unable to get timeline: %v", err)
+		return nil, err
+	}
+
+	af.filters, err = s.accountFilters(ctx, accountState, client)
+	if err != nil {
+		glog.Errorf("unable to get filters: %v", err)
+		return nil, err
+	}
+	if storage.RulesNeedFollowing(userState.GetFilterRules()) {
+		if err := s.refreshFollowing(ctx, accountState, client); err != nil {
+			return nil, err
+		}
+	}
+
+	af.newStatusID = af.lastStatusID
+	for _, status := range af.timeline {
+		if storage.IDNewer(status.ID, af.newStatusID) {
+			af.newStatusID = status.ID
+		}
+	}
+
+	boundaries := ""
+	if len(af.timeline) > 0 {
+		boundaries = fmt.Sprintf(" (%s -- %s)", af.timeline[0].ID, af.timeline[len(af.timeline)-1].ID)
+	}
+	glog.Infof("Found %d new status on %v timeline of asid=%d (last status ID=%v) (max_id:%v, min_id:%v, since_id:%v)%s", len(af.timeline), source.GetKind(), accountState.Asid, af.newStatusID, af.pg.MaxID, af.pg.MinID, af.pg.SinceID, boundaries)
+
+	// Get notifications.
+	// Start by getting marker position on notifications to know what has been read.
+	timelines := []string{"notifications"}
+	if withHomeMarker {
+		timelines = append(timelines, "home")
+	}
+	markers, err := client.GetMarkers(ctx, timelines)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get notification marker: %w", err)
+	}
+	marker := markers["notifications"]
+	if marker == nil {
+		return nil, fmt.Errorf("server failed to return a 'notifications' marker; got: %v", markers)
+	}
+	af.notifsMarker = marker.LastReadID
+	if homeMarker := markers["home"]; withHomeMarker && homeMarker != nil {
+		af.homeMarker = homeMarker.LastReadID
+	}
+
+	// And do request notifications which are neither known yet nor already
+	// read.
+	lastNotifID, err := s.st.LatestNotificationID(ctx, nil, types.ASID(accountState.Asid))
+	if err != nil {
+		return nil, err
+	}
+	// Local notifications newer than the marker might be unread.
+	hasUnread := storage.IDNewer(lastNotifID, marker.LastReadID)
+	if storage.IDNewer(marker.LastReadID, lastNotifID) {
+		lastNotifID = marker.LastReadID
+	}
+	maxNotifs := int64(20)
+	notifsPg := mastodon.Pagination{
+		Limit: maxNotifs,
+		MinID: lastNotifID,
+	}
+	af.notifs, err = client.GetNotifications(ctx, &notifsPg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list notifications: %v", err)
+	}
+	af.notifsState = stpb.StreamState_NOTIF_EXACT
+	if int64(len(af.notifs)) >= maxNotifs {
+		// More notifications are available; they will be obtained on the next
+		// fetch.
+		af.notifsState = stpb.StreamState_NOTIF_MORE
+	}
+
+	// Notifications dismissed on Mastodon are no longer listed there. Once all
+	// new notifications are known, list the unread ones, so the local
+	// notifications missing from it can be dropped.
+	if af.notifsState == stpb.StreamState_NOTIF_EXACT && hasUnread {
+		af.unreadUpTo = lastNotifID
+		for _, notif := range af.notifs {
+			if storage.IDNewer(notif.ID, af.unreadUpTo) {
+				af.unreadUpTo = notif.ID
+			}
+		}
+		unreadPg := mastodon.Pagination{
+			Limit:   maxNotifs,
+			SinceID: marker.LastReadID,
+		}
+		unread, err := client.GetNotifications(ctx, &unreadPg)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list unread notifications: %v", err)
+		}
+		af.checkedUnread = true
+		for _, notif := range unread {
+			af.unreadNotifIDs = append(af.unreadNotifIDs, notif.ID)
+		}
+		if int64(len(unread)) >= maxNotifs {
+			// Older unread notifications were not listed.
+			af.unreadSince = unread[len(unread)-1].ID
+		}
+	}
+	return af, nil
+}
+
+// revalidateStatuses gets again from Mastodon up to `count` statuses of the
+// account which are in the stream, recording edits and deletions. Statuses
+// are taken after `afterSID`, starting over once all have been checked. It
+// returns the sid to continue from on the next call.
+func (s *Server) revalidateStatuses(ctx context.Context, accountState *stpb.AccountState, afterSID types.SID, count int) (types.SID, error) {
+	asid := types.ASID(accountState.Asid)
+	statusIDs, lastSID, err := s.st.PositionedStatusIDs(ctx, nil, asid, afterSID, count)
+	if err != nil {
+		return afterSID, err
+	}
+	if len(statusIDs) < count {
+		// All statuses have been checked; start again from the oldest ones on
+		// the next call.
+		lastSID = 0
+	}
+	if len(statusIDs) == 0 {
+		return lastSID, nil
+	}
+
+	appRegState, err := s.appRegistry.Register(ctx, accountState.ServerAddr, s.selfURL)
+	if err != nil {
+		return afterSID, err
+	}
+	client := s.appRegistry.MastodonClient(appRegState, accountState.AccessToken)
+	filters, err := s.accountFilters(ctx, accountState, client)
+	if err != nil {
+		return afterSID, err
+	}
+
+	for _, statusID := range statusIDs {
+		status, err := client.GetStatus(ctx, statusID)
+		if isNotFound(err) {
+			glog.Infof("status %s of asid=%d was deleted", statusID, asid)
+			if err := s.st.DeleteStatus(ctx, nil, asid, statusID); err != nil {
+				return afterSID, err
+			}
+			continue
+		}
+		if err != nil {
+			return afterSID, fmt.Errorf("unable to get status %s: %w", statusID, err)
+		}
+		if err := s.st.UpdateStatus(ctx, nil, asid, status, filters); err != nil {
+			return afterSID, err
+		}
+	}
+	return lastSID, nil
+}
+
+// fetchTimeline gets statuses from the Mastodon timeline feeding a stream.
+// The pagination is updated as with the underlying Mastodon calls.
+func fetchTimeline(ctx context.Context, client *mastodon.Client, source *stpb.StreamSource, pg *mastodon.Pagination) ([]*mastodon.Status, error) {
+	switch kind := source.GetKind(); kind {
+	case stpb.StreamSource_HOME:
+		return client.GetTimelineHome(ctx, pg)
+	case stpb.StreamSource_LIST:
+		return client.GetTimelineList(ctx, mastodon.ID(source.ListId), pg)
+	case stpb.StreamSource_HASHTAG:
+		return client.GetTimelineHashtag(ctx, source.Hashtag, false /* isLocal */, pg)
+	default:
+		return nil, fmt.Errorf("unknown stream source %v", kind)
 	}
-	return connect.NewResponse(resp), nil
 }
 
+// maxSearchResults is the maximum number of statuses returned by a search.
+const maxSearchResults = 100
+
 func (s *Server) Search(ctx context.Context, req *connect.Request[pb.SearchRequest]) (*connect.Response[pb.SearchResponse], error) {
 	uid, err := s.isLogged(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	accounts, err := s.accountProtos(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := req.Msg
+	q := &storage.SearchQuery{
+		UID:           uid,
+		StID:          types.StID(msg.GetStid()),
+		StatusID:      mastodon.ID(msg.GetStatusId()),
+		Text:          strings.TrimSpace(msg.GetQuery()),
+		Author:        strings.TrimSpace(msg.GetAuthor()),
+		MinPosition:   msg.GetMinPosition(),
+		MaxPosition:   msg.GetMaxPosition(),
+		HasMedia:      msg.HasMedia,
+		HasPoll:       msg.HasPoll,
+		Favourited:    msg.Favourited,
+		Reblogged:     msg.Reblogged,
+		FilterMatched: msg.FilterMatched,
+		AlreadySeen:   msg.GetAlreadySeen(),
+		Limit:         maxSearchResults,
+	}
+	if secs := msg.GetCreatedAfterSecs(); secs != 0 {
+		q.CreatedAfter = time.Unix(secs, 0)
+	}
+	if secs := msg.GetCreatedBeforeSecs(); secs != 0 {
+		q.CreatedBefore = time.Unix(secs, 0)
+	}
+	if !q.HasConstraints() {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("missing search constraints"))
+	}
+	if q.MinPosition < 0 || q.MaxPosition < 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid position range"))
+	}
+
+	if q.StID != 0 {
+		if _, err := s.verifyStID(ctx, q.StID); err != nil {
+			return nil, err
+		}
+	}
+
 	var results []*storage.Item
-	var accountState *stpb.AccountState
 	err = s.st.InTxnRO(ctx, func(ctx context.Context, txn storage.SQLReadOnly) error {
-		var err error
-		accountState, err = s.st.FirstAccountStateByUID(ctx, txn, uid)
-		if err != nil {
-			return err
+		if q.StID == 0 {
+			userState, err := s.st.UserState(ctx, txn, uid)
+			if err != nil {
+				return err
+			}
+			q.StID = types.StID(userState.DefaultStid)
 		}
-
-		results, err = s.st.SearchByStatusID(ctx, txn, uid, mastodon.ID(req.Msg.GetStatusId()))
+		var err error
+		results, err = s.st.Search(ctx, txn, q)
 		return err
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: account is potentially per status, while it is currently considered per user.
-	accountStateProto := types.AccountStateToAccountProto(accountState)
 	resp := &pb.SearchResponse{}
 	for _, item := range results {
-		raw, err := json.Marshal(item.Status)
+		itemProto, err := itemToProto(item, accounts)
 		if err != nil {
 			return nil, err
 		}
-		resp.Items = append(resp.Items, &pb.Item{
-			Status:   &pb.MastodonStatus{Content: string(raw)},
-			Position: item.Position,
-			Account:  accountStateProto,
-			Meta:     item.StatusMeta,
-		})
+		resp.Items = append(resp.Items, itemProto)
 	}
 	return connect.NewResponse(resp), nil
 }
 
-func (s *Server) SetStatus(ctx context.Context, req *connect.Request[pb.SetStatusRequest]) (*connect.Response[pb.SetStatusResponse], error) {
+func (s *Server) GetContext(ctx context.Context, req *connect.Request[pb.GetContextRequest]) (*connect.Response[pb.GetContextResponse], error) {
 	uid, err := s.isLogged(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	var accountState *stpb.AccountState
-	err = s.st.InTxnRO(ctx, func(ctx context.Context, txn storage.SQLReadOnly) error {
-		accountState, err = s.st.FirstAccountStateByUID(ctx, txn, uid)
-		if err != nil {
-			return err
+	statusID := mastodon.ID(req.Msg.GetStatusId())
+	if statusID == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("missing status ID"))
+	}
+	stid := types.StID(req.Msg.GetStid())
+	if stid != 0 {
+		if _, err := s.verifyStID(ctx, stid); err != nil {
+			return nil, err
 		}
-		return nil
-	})
+	}
 
-	appRegState, err := s.appRegistry.Register(ctx, accountState.ServerAddr, s.selfURL)
+	accountState, client, err := s.accountClient(ctx, uid, req.Msg.GetAccount())
 	if err != nil {
 		return nil, err
 	}
-
-	client := s.appRegistry.MastodonClient(appRegState, accountState.AccessToken)
-
-	var status *mastodon.Status
-	switch action := req.Msg.GetAction(); action {
-	case pb.SetStatusRequest_FAVOURITE:
-		status, err = client.Favourite(ctx, mastodon.ID(req.Msg.StatusId))
-	case pb.SetStatusRequest_UNFAVOURITE:
-		status, err = client.Unfavourite(ctx, mastodon.ID(req.Msg.StatusId))
-	case pb.SetStatusRequest_REFRESH:
-		status, err = client.GetStatus(ctx, mastodon.ID(req.Msg.StatusId))
-	default:
-		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid action %v", action))
+	asid := types.ASID(accountState.Asid)
+	accounts, err := s.accountProtos(ctx, uid)
+	if err != nil {
+		return nil, err
 	}
 
+	// Get the status itself - from the cache if possible.
+	var item *storage.Item
+	err = s.st.InTxnRO(ctx, func(ctx context.Context, txn storage.SQLReadOnly) error {
+		if stid == 0 {
+			userState, err := s.st.UserState(ctx, txn, uid)
+			if err != nil {
+				return err
+			}
+			stid = types.StID(userState.DefaultStid)
+		}
+		var err error
+		item, err = s.st.StatusItem(ctx, txn, stid, asid, statusID)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		return err
+	})
 	if err != nil {
-		return nil, connect.NewError(connect.CodeUnknown, fmt.Errorf("unable to set favourite status for %s: %w", req.Msg.StatusId, err))
+		return nil, err
+	}
+	if item == nil {
+		status, err := client.GetStatus(ctx, statusID)
+		if isNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("status %s does not exist", statusID))
+		}
+		if err != nil {
+			return nil, connect.NewError(connect.CodeUnknown, fmt.Errorf("unable to get status %s: %w", statusID, err))
+		}
+		item = &storage.Item{ASID: asid, Status: *status}
+	}
+	// Reblogs are not part of conversations; the reblogged status is.
+	threadID := item.Status.ID
+	if item.Status.Reblog != nil {
+		threadID = item.Status.Reblog.ID
 	}
 
-	// Update status in DB.
-	filters, err := client.GetFilters(ctx)
+	resp := &pb.GetContextResponse{}
+	// The status might have been deleted, or the server might not be
+	// reachable; what is in the cache is still useful.
+	live, err := client.GetStatusContext(ctx, threadID)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get filters: %w", err)
+		glog.Errorf("unable to get context of status %s for asid=%d: %v", threadID, asid, err)
+		resp.CachedOnly = true
 	}
-	err = s.st.InTxnRW(ctx, func(ctx context.Context, txn storage.SQLReadWrite) error {
-		return s.st.UpdateStatus(ctx, txn, types.ASID(accountState.Asid), status, filters)
+
+	var ancestors, descendants []*storage.Item
+	err = s.st.InTxnRO(ctx, func(ctx context.Context, txn storage.SQLReadOnly) error {
+		var err error
+		ancestors, descendants, err = s.st.StatusContext(ctx, txn, stid, asid, threadID)
+		if err != nil {
+			return err
+		}
+		if live == nil {
+			return nil
+		}
+		ancestors, err = s.mergeContextItems(ctx, txn, stid, asid, live.Ancestors, ancestors)
+		if err != nil {
+			return err
+		}
+		descendants, err = s.mergeContextItems(ctx, txn, stid, asid, live.Descendants, descendants)
+		return err
 	})
 	if err != nil {
-		return nil, fmt.Errorf("unable to update status: %w", err)
+		return nil, err
 	}
 
-	// And return the new status.
-	raw, err := json.Marshal(status)
+	// Mastodon filters have a context of their own for conversations.
+	if filters, err := s.accountFilters(ctx, accountState, client); err != nil {
+		glog.Errorf("unable to get filters of asid=%d: %v", asid, err)
+	} else {
+		for _, item := range slices.Concat(ancestors, descendants) {
+			item.StatusMeta = storage.ThreadStatusMeta(&item.Status, item.StatusMeta, filters)
+		}
+	}
+
+	resp.Status, err = itemToProto(item, accounts)
 	if err != nil {
 		return nil, err
 	}
-	resp := &pb.SetStatusResponse{
-		Status: &pb.MastodonStatus{Content: string(raw)},
+	for _, item := range ancestors {
+		itemProto, err := itemToProto(item, accounts)
+		if err != nil {
+			return nil, err
+		}
+		resp.Ancestors = append(resp.Ancestors, itemProto)
+	}
+	for _, item := range descendants {
+		itemProto, err := itemToProto(item, accounts)
+		if err != nil {
+			return nil, err
+		}
+		resp.Descendants = append(resp.Descendants, itemProto)
 	}
 	return connect.NewResponse(resp), nil
 }
 
+// mergeContextItems combines statuses of a conversation obtained from
+// Mastodon with the ones found in the cache. Content from Mastodon is
+// preferred, as it is more recent; stream information comes from the cache.
+// Results are ordered by ID - i.e., chronologically.
+func (s *Server) mergeContextItems(ctx context.Context, txn storage.SQLReadOnly, stid types.StID, asid types.ASID, live []*mastodon.Status, cached []*storage.Item) ([]*storage.Item, error) {
+	var items []*storage.Item
+	known := map[mastodon.ID]bool{}
+	for _, status := range live {
+		item, err := s.st.StatusItem(ctx, txn, stid, asid, status.ID)
+		if errors.Is(err, storage.ErrNotFound) {
+			item = &storage.Item{ASID: asid}
+		} else if err != nil {
+			return nil, err
+		}
+		item.Status = *status
+		items = append(items, item)
+		known[status.ID] = true
+	}
+	for _, item := range cached {
+		if !known[item.Status.ID] {
+			items = append(items, item)
+		}
+	}
+	slices.SortFunc(items, func(a, b *storage.Item) int {
+		if storage.IDLess(a.Status.ID, b.Status.ID) {
+			return -1
+		}
+		if storage.IDLess(b.Status.ID, a.Status.ID) {
+			return 1
+		}
+		return 0
+	})
+	return items, nil
+}
+
+// accountClient returns the state of a Mastodon account of the user and a
+// client to access it. If account is nil, the first account of the user is
+// used.
+func (s *Server) accountClient(ctx context.Context, uid types.UID, account *pb.Account) (*stpb.AccountState, *mastodon.Client, error) {
+	var accountState *stpb.AccountState
+	err := s.st.InTxnRO(ctx, func(ctx context.Context, txn storage.SQLReadOnly) error {
+		var err error
+		if account == nil {
+			accountState, err = s.st.FirstAccountStateByUID(ctx, txn, uid)
+			return err
+		}
+		accountState, err = s.st.AccountStateByAccountID(ctx, txn, account.ServerAddr, mastodon.ID(account.AccountId))
+		if errors.Is(err, storage.ErrNotFound) {
+			return connect.NewError(connect.CodePermissionDenied, errors.New("account access denied"))
+		}
+		if err != nil {
+			return err
+		}
+		if types.UID(accountState.Uid) != uid {
+			return connect.NewError(connect.CodePermissionDenied, errors.New("account access denied"))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	appRegState, err := s.appRegistry.Register(ctx, accountState.ServerAddr, s.selfURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	return accountState, s.appRegistry.MastodonClient(appRegState, accountState.AccessToken), nil
+}
+
+func (s *Server) SetStatus(ctx context.Context, req *connect.Request[pb.SetStatusRequest]) (*connect.Response[pb.SetStatusResponse], error) {
+	uid, err := s.isLogged(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	accountState, client, err := s.accountClient(ctx, uid, req.Msg.GetAccount())
+	if err != nil {
+		return nil, err
+	}
+
+	var status *mastodon.Status
+	action := req.Msg.GetAction()
+	switch action {
+	case pb.SetStatusRequest_FAVOURITE:
+		status, err = client.Favourite(ctx, mastodon.ID(req.Msg.StatusId))
+	case pb.SetStatusRequest_UNFAVOURITE:
+		status, err = client.Unfavourite(ctx, mastodon.ID(req.Msg.StatusId))
+	case pb.SetStatusRequest_REFRESH:
+		status, err = client.GetStatus(ctx, mastodon.ID(req.Msg.StatusId))
+	case pb.SetStatusRequest_REBLOG:
+		status, err = client.Reblog(ctx, mastodon.ID(req.Msg.StatusId))
+	case pb.SetStatusRequest_UNREBLOG:
+		status, err = client.Unreblog(ctx, mastodon.ID(req.Msg.StatusId))
+	case pb.SetStatusRequest_BOOKMARK:
+		status, err = client.Bookmark(ctx, mastodon.ID(req.Msg.StatusId))
+	case pb.SetStatusRequest_UNBOOKMARK:
+		status, err = client.Unbookmark(ctx, mastodon.ID(req.Msg.StatusId))
+	case pb.SetStatusRequest_MUTE:
+		status, err = postStatusAction(ctx, client, mastodon.ID(req.Msg.StatusId), "mute")
+	case pb.SetStatusRequest_UNMUTE:
+		status, err = postStatusAction(ctx, client, mastodon.ID(req.Msg.StatusId), "unmute")
+	case pb.SetStatusRequest_PIN:
+		status, err = postStatusAction(ctx, client, mastodon.ID(req.Msg.StatusId), "pin")
+	case pb.SetStatusRequest_UNPIN:
+		status, err = postStatusAction(ctx, client, mastodon.ID(req.Msg.StatusId), "unpin")
+	default:
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid action %v", action))
+	}
+
+	// Reblogging returns the new reblog status, while unreblogging returns
+	// the original status, which might not be the one which was cached - so
+	// load it again.
+	if err == nil && (action == pb.SetStatusRequest_REBLOG || action == pb.SetStatusRequest_UNREBLOG) {
+		status, err = client.GetStatus(ctx, mastodon.ID(req.Msg.StatusId))
+	}
+
+	if action == pb.SetStatusRequest_REFRESH && isNotFound(err) {
+		// The status was deleted on Mastodon side.
+		if err := s.st.DeleteStatus(ctx, nil, types.ASID(accountState.Asid), mastodon.ID(req.Msg.StatusId)); err != nil {
+			return nil, err
+		}
+		return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("status %s was deleted", req.Msg.StatusId))
+	}
+	if err != nil {
+		return nil, connect.NewError(connect.CodeUnknown, fmt.Errorf("unable to %v status %s: %w", action, req.Msg.StatusId, err))
+	}
+
+	// Update status in DB.
+	filters, err := s.accountFilters(ctx, accountState, client)
+	if err != nil {
+		return nil, err
+	}
+	err = s.st.InTxnRW(ctx, func(ctx context.Context, txn storage.SQLReadWrite) error {
+		return s.st.UpdateStatus(ctx, txn, types.ASID(accountState.Asid), status, filters)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to update status: %w", err)
+	}
+
+	// And return the new status.
+	raw, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.SetStatusResponse{
+		Status: &pb.MastodonStatus{Content: string(raw)},
+	}
+	return connect.NewResponse(resp), nil
+}
+
+// postStatusAction calls one of the Mastodon status actions not available in
+// go-mastodon - e.g., `/api/v1/statuses/:id/pin`. It returns the updated
+// status.
+func postStatusAction(ctx context.Context, client *mastodon.Client, statusID mastodon.ID, action string) (*mastodon.Status, error) {
+	status := &mastodon.Status{}
+	if err := callMastodonAPI(ctx, client, http.MethodPost, status, "/api/v1/statuses", url.PathEscape(string(statusID)), action); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// callMastodonAPI sends a request to a Mastodon endpoint not available in
+// go-mastodon, decoding the JSON answer in `result`. The path of the endpoint
+// is built by joining `elem`.
+func callMastodonAPI(ctx context.Context, client *mastodon.Client, method string, result any, elem ...string) error {
+	u, err := url.Parse(client.Config.Server)
+	if err != nil {
+		return err
+	}
+	u = u.JoinPath(elem...)
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+client.Config.AccessToken)
+	if client.UserAgent != "" {
+		httpReq.Header.Set("User-Agent", client.UserAgent)
+	}
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return &mastodon.APIError{
+			Message:    fmt.Sprintf("bad request: %v", httpResp.Status),
+			StatusCode: httpResp.StatusCode,
+		}
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(result); err != nil {
+		return fmt.Errorf("unable to decode %s answer: %w", u.Path, err)
+	}
+	return nil
+}
+
+// checkToot verifies that a status to post is acceptable for Mastodon.
+func checkToot(toot *mastodon.Toot) error {
+	if strings.TrimSpace(toot.Status) == "" {
+		return connect.NewError(connect.CodeInvalidArgument, errors.New("missing content"))
+	}
+	switch toot.Visibility {
+	case "", "public", "unlisted", "private", "direct":
+	default:
+		return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid visibility %q", toot.Visibility))
+	}
+	return nil
+}
+
+// postStatus creates the status on Mastodon and adds it to the local cache.
+func (s *Server) postStatus(ctx context.Context, accountState *stpb.AccountState, client *mastodon.Client, toot *mastodon.Toot) (*pb.MastodonStatus, error) {
+	status, err := client.PostStatus(ctx, toot)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeUnknown, fmt.Errorf("unable to post status: %w", err))
+	}
+
+	// The status exists on Mastodon at this point; failing the call would lead
+	// to it being posted again on retry. Caching is only a convenience, so
+	// errors are just logged.
+	if filters, err := s.accountFilters(ctx, accountState, client); err != nil {
+		glog.Errorf("unable to get filters to cache posted status %s: %v", status.ID, err)
+	} else if err := s.st.CacheStatus(ctx, nil, types.ASID(accountState.Asid), status, filters); err != nil {
+		glog.Errorf("unable to cache posted status %s: %v", status.ID, err)
+	}
+
+	raw, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.MastodonStatus{Content: string(raw)}, nil
+}
+
+func (s *Server) PostStatus(ctx context.Context, req *connect.Request[pb.PostStatusRequest]) (*connect.Response[pb.PostStatusResponse], error) {
+	uid, err := s.isLogged(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	toot := &mastodon.Toot{
+		Status:      req.Msg.GetContent(),
+		SpoilerText: req.Msg.GetSpoilerText(),
+		Visibility:  req.Msg.GetVisibility(),
+		Language:    req.Msg.GetLanguage(),
+		InReplyToID: mastodon.ID(req.Msg.GetInReplyToId()),
+	}
+	if err := checkToot(toot); err != nil {
+		return nil, err
+	}
+
+	accountState, client, err := s.accountClient(ctx, uid, req.Msg.GetAccount())
+	if err != nil {
+		return nil, err
+	}
+	status, err := s.postStatus(ctx, accountState, client, toot)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&pb.PostStatusResponse{Status: status}), nil
+}
+
+func (s *Server) Reply(ctx context.Context, req *connect.Request[pb.ReplyRequest]) (*connect.Response[pb.ReplyResponse], error) {
+	uid, err := s.isLogged(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statusID := mastodon.ID(req.Msg.GetStatusId())
+	if statusID == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("missing status ID"))
+	}
+	toot := &mastodon.Toot{
+		Status:      req.Msg.GetContent(),
+		SpoilerText: req.Msg.GetSpoilerText(),
+		Visibility:  req.Msg.GetVisibility(),
+		Language:    req.Msg.GetLanguage(),
+		InReplyToID: statusID,
+	}
+	if err := checkToot(toot); err != nil {
+		return nil, err
+	}
+
+	accountState, client, err := s.accountClient(ctx, uid, req.Msg.GetAccount())
+	if err != nil {
+		return nil, err
+	}
+
+	parent, err := client.GetStatus(ctx, statusID)
+	if isNotFound(err) {
+		return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("status %s does not exist", statusID))
+	}
+	if err != nil {
+		return nil, connect.NewError(connect.CodeUnknown, fmt.Errorf("unable to get status %s: %w", statusID, err))
+	}
+
+	// Behave like Mastodon UI: mention the author of the status and keep its
+	// visibility and content warning, unless specified otherwise.
+	if parent.Account.ID != mastodon.ID(accountState.AccountId) {
+		mention := "@" + parent.Account.Acct
+		if !strings.Contains(toot.Status, mention) {
+			toot.Status = mention + " " + toot.Status
+		}
+	}
+	if toot.Visibility == "" {
+		toot.Visibility = parent.Visibility
+	}
+	if toot.SpoilerText == "" {
+		toot.SpoilerText = parent.SpoilerText
+	}
+
+	status, err := s.postStatus(ctx, accountState, client, toot)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&pb.ReplyResponse{Status: status}), nil
+}
+
+// maxNotificationsPage is the maximum number of notifications returned by a
+// single ListNotifications call.
+const maxNotificationsPage = 100
+
+func (s *Server) ListNotifications(ctx context.Context, req *connect.Request[pb.ListNotificationsRequest]) (*connect.Response[pb.ListNotificationsResponse], error) {
+	uid, err := s.isLogged(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := req.Msg.GetLimit()
+	if limit < 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid limit %d", limit))
+	}
+	if limit == 0 {
+		limit = 20
+	}
+	limit = min(limit, maxNotificationsPage)
+
+	accounts, err := s.accountProtos(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.ListNotificationsResponse{}
+	var notifs []*storage.Notification
+	err = s.st.InTxnRO(ctx, func(ctx context.Context, txn storage.SQLReadOnly) error {
+		var err error
+		notifs, err = s.st.ListNotifications(ctx, txn, &storage.NotificationsQuery{
+			UID:        uid,
+			BeforeNID:  types.NID(req.Msg.GetBeforeNid()),
+			Types:      req.Msg.GetTypes(),
+			UnreadOnly: req.Msg.GetUnreadOnly(),
+			// Get one more to know if there is a next page.
+			Limit: limit + 1,
+		})
+		if err != nil {
+			return err
+		}
+		resp.UnreadCount, err = s.st.UnreadNotificationsCount(ctx, txn, uid)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(notifs)) > limit {
+		notifs = notifs[:limit]
+		resp.NextNid = int64(notifs[len(notifs)-1].NID)
+	}
+
+	// Group notifications of the page by status. The same status can be
+	// notified through multiple accounts, so use the URI as a key.
+	groups := map[string]*pb.NotificationGroup{}
+	for _, notif := range notifs {
+		raw, err := json.Marshal(notif.Notification)
+		if err != nil {
+			return nil, err
+		}
+		notifProto := &pb.Notification{
+			Nid:     int64(notif.NID),
+			Account: accounts[notif.ASID],
+			Content: string(raw),
+			Type:    notif.Notification.Type,
+			Read:    notif.Read,
+		}
+
+		status := notif.Notification.Status
+		if status == nil {
+			resp.Groups = append(resp.Groups, &pb.NotificationGroup{Notifications: []*pb.Notification{notifProto}})
+			continue
+		}
+		if group := groups[status.URI]; group != nil {
+			group.Notifications = append(group.Notifications, notifProto)
+			continue
+		}
+		rawStatus, err := json.Marshal(status)
+		if err != nil {
+			return nil, err
+		}
+		group := &pb.NotificationGroup{
+			Status:        &pb.MastodonStatus{Content: string(rawStatus)},
+			Notifications: []*pb.Notification{notifProto},
+		}
+		groups[status.URI] = group
+		resp.Groups = append(resp.Groups, group)
+	}
+	return connect.NewResponse(resp), nil
+}
+
+func (s *Server) MarkNotificationsRead(ctx context.Context, req *connect.Request[pb.MarkNotificationsReadRequest]) (*connect.Response[pb.MarkNotificationsReadResponse], error) {
+	uid, err := s.isLogged(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.MarkNotificationsReadResponse{}
+	var markers map[types.ASID]mastodon.ID
+	var accountStates []*stpb.AccountState
+	err = s.st.InTxnRW(ctx, func(ctx context.Context, txn storage.SQLReadWrite) error {
+		var err error
+		markers, err = s.st.MarkNotificationsRead(ctx, txn, uid, types.NID(req.Msg.GetUpToNid()))
+		if err != nil {
+			return err
+		}
+		accountStates, err = s.st.AllAccountStateByUID(ctx, txn, uid)
+		if err != nil {
+			return err
+		}
+		resp.UnreadCount, err = s.updateNotificationsCount(ctx, txn, uid)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Report what was read to Mastodon, so other clients know about it.
+	for _, accountState := range accountStates {
+		lastReadID, ok := markers[types.ASID(accountState.Asid)]
+		if !ok {
+			continue
+		}
+		appRegState, err := s.appRegistry.Register(ctx, accountState.ServerAddr, s.selfURL)
+		if err != nil {
+			return nil, err
+		}
+		client := s.appRegistry.MastodonClient(appRegState, accountState.AccessToken)
+		if err := client.SetNotificationsMarker(ctx, lastReadID); err != nil {
+			return nil, &serverError{serverAddr: accountState.ServerAddr, err: fmt.Errorf("unable to set notifications marker: %w", err)}
+		}
+	}
+	return connect.NewResponse(resp), nil
+}
+
+// updateNotificationsCount sets the number of unread notifications on the
+// streams of the user which track it exactly. It returns that number.
+func (s *Server) updateNotificationsCount(ctx context.Context, txn storage.SQLReadWrite, uid types.UID) (int64, error) {
+	count, err := s.st.UnreadNotificationsCount(ctx, txn, uid)
+	if err != nil {
+		return 0, err
+	}
+	streamStates, err := s.st.StreamStatesByUID(ctx, txn, uid)
+	if err != nil {
+		return 0, err
+	}
+	for _, streamState := range streamStates {
+		// When the count is not exact, there is no point in tracking it.
+		if streamState.NotificationsState != stpb.StreamState_NOTIF_EXACT {
+			continue
+		}
+		streamState.NotificationsCount = count
+		if err := s.st.SetStreamState(ctx, txn, streamState); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// isNotFound indicates whether the error is the Mastodon server reporting that
+// the requested entity does not exist.
+func isNotFound(err error) bool {
+	var apiErr *mastodon.APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// validateStreamSource verifies that a stream source has what is needed to
+// fetch statuses.
+func validateStreamSource(source *stpb.StreamSource) error {
+	switch kind := source.GetKind(); kind {
+	case stpb.StreamSource_HOME:
+	case stpb.StreamSource_LIST:
+		if source.GetListId() == "" {
+			return errors.New("missing list ID for list stream")
+		}
+	case stpb.StreamSource_HASHTAG:
+		if source.GetHashtag() == "" {
+			return errors.New("missing hashtag for hashtag stream")
+		}
+	default:
+		return fmt.Errorf("unknown stream source %v", kind)
+	}
+	return nil
+}
+
+func (s *Server) CreateStream(ctx context.Context, req *connect.Request[pb.CreateStreamRequest]) (*connect.Response[pb.CreateStreamResponse], error) {
+	userID, err := s.isLogged(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	name := strings.TrimSpace(req.Msg.GetName())
+	if name == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("missing stream name"))
+	}
+
+	source := proto.Clone(req.Msg.GetSource()).(*stpb.StreamSource)
+	if source == nil {
+		source = &stpb.StreamSource{}
+	}
+	source.Hashtag = strings.TrimPrefix(source.Hashtag, "#")
+	if err := validateStreamSource(source); err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	var streamState *stpb.StreamState
+	err = s.st.InTxnRW(ctx, func(ctx context.Context, txn storage.SQLReadWrite) error {
+		// The home timeline progress is tracked on the account, so it cannot be
+		// shared between streams.
+		if source.Kind == stpb.StreamSource_HOME {
+			streamStates, err := s.st.StreamStatesByUID(ctx, txn, userID)
+			if err != nil {
+				return err
+			}
+			for _, other := range streamStates {
+				if other.GetSource().GetKind() == stpb.StreamSource_HOME {
+					return connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("stream %d already uses the home timeline", other.Stid))
+				}
+			}
+		}
+
+		var err error
+		streamState, err = s.st.CreateStreamState(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+		streamState.Name = name
+		streamState.Source = source
+		return s.st.SetStreamState(ctx, txn, streamState)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&pb.CreateStreamResponse{
+		StreamInfo: types.StreamStateToStreamInfo(streamState),
+	}), nil
+}
+
+func (s *Server) ListStreams(ctx context.Context, req *connect.Request[pb.ListStreamsRequest]) (*connect.Response[pb.ListStreamsResponse], error) {
+	userID, err := s.isLogged(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	streamStates, err := s.st.StreamStatesByUID(ctx, nil, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.ListStreamsResponse{}
+	for _, streamState := range streamStates {
+		resp.Streams = append(resp.Streams, types.StreamStateToStreamInfo(streamState))
+	}
+	return connect.NewResponse(resp), nil
+}
+
+func (s *Server) RenameStream(ctx context.Context, req *connect.Request[pb.RenameStreamRequest]) (*connect.Response[pb.RenameStreamResponse], error) {
+	stid := types.StID(req.Msg.Stid)
+	if _, err := s.verifyStID(ctx, stid); err != nil {
+		return nil, err
+	}
+
+	name := strings.TrimSpace(req.Msg.GetName())
+	if name == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("missing stream name"))
+	}
+
+	var streamState *stpb.StreamState
+	err := s.st.InTxnRW(ctx, func(ctx context.Context, txn storage.SQLReadWrite) error {
+		var err error
+		streamState, err = s.st.StreamState(ctx, txn, stid)
+		if err != nil {
+			return err
+		}
+		streamState.Name = name
+		return s.st.SetStreamState(ctx, txn, streamState)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&pb.RenameStreamResponse{
+		StreamInfo: types.StreamStateToStreamInfo(streamState),
+	}), nil
+}
+
+func (s *Server) DeleteStream(ctx context.Context, req *connect.Request[pb.DeleteStreamRequest]) (*connect.Response[pb.DeleteStreamResponse], error) {
+	stid := types.StID(req.Msg.Stid)
+	userState, err := s.verifyStID(ctx, stid)
+	if err != nil {
+		return nil, err
+	}
+	if types.StID(userState.DefaultStid) == stid {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, errors.New("the default stream cannot be deleted"))
+	}
+
+	if err := s.st.DeleteStreamState(ctx, nil, stid); err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&pb.DeleteStreamResponse{}), nil
+}
+
+// normalizeFilterRule cleans up user provided values of a local filter rule
+// and verifies that it is usable.
+func normalizeFilterRule(rule *stpb.FilterRule) error {
+	rule.Account = strings.TrimPrefix(strings.TrimSpace(rule.Account), "@")
+	rule.Language = strings.ToLower(strings.TrimSpace(rule.Language))
+
+	switch rule.Action {
+	case stpb.FilterRule_HIDE, stpb.FilterRule_COLLAPSE:
+	default:
+		return fmt.Errorf("invalid filter rule action %v", rule.Action)
+	}
+
+	switch rule.Kind {
+	case stpb.FilterRule_REBLOGS_FROM:
+		if rule.Account == "" {
+			return errors.New("missing account")
+		}
+	case stpb.FilterRule_LANGUAGE:
+		if rule.Language == "" {
+			return errors.New("missing language")
+		}
+	case stpb.FilterRule_TOO_MANY_HASHTAGS:
+		if rule.MaxHashtags < 0 {
+			return fmt.Errorf("invalid maximum number of hashtags %d", rule.MaxHashtags)
+		}
+	case stpb.FilterRule_REPLY_TO_UNFOLLOWED:
+	default:
+		return fmt.Errorf("unknown filter rule kind %v", rule.Kind)
+	}
+	return nil
+}
+
+// filterRuleFromRequest validates the rule provided in a request, returning a
+// copy of it.
+func filterRuleFromRequest(rule *stpb.FilterRule) (*stpb.FilterRule, error) {
+	if rule == nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("missing rule"))
+	}
+	rule = proto.Clone(rule).(*stpb.FilterRule)
+	if err := normalizeFilterRule(rule); err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	return rule, nil
+}
+
+func (s *Server) ListFilterRules(ctx context.Context, req *connect.Request[pb.ListFilterRulesRequest]) (*connect.Response[pb.ListFilterRulesResponse], error) {
+	userID, err := s.isLogged(ctx)
+	if err != nil {
+		return nil, err
+	}
+	userState, err := s.st.UserState(ctx, nil, userID)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&pb.ListFilterRulesResponse{
+		Rules: userState.FilterRules,
+	}), nil
+}
+
+func (s *Server) CreateFilterRule(ctx context.Context, req *connect.Request[pb.CreateFilterRuleRequest]) (*connect.Response[pb.CreateFilterRuleResponse], error) {
+	userID, err := s.isLogged(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rule, err := filterRuleFromRequest(req.Msg.GetRule())
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.st.InTxnRW(ctx, func(ctx context.Context, txn storage.SQLReadWrite) error {
+		userState, err := s.st.UserState(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+		// Rules are kept ordered by ID, so the last one has the largest ID.
+		rule.Id = 1
+		if n := len(userState.FilterRules); n > 0 {
+			rule.Id = userState.FilterRules[n-1].Id + 1
+		}
+		userState.FilterRules = append(userState.FilterRules, rule)
+		return s.st.SetUserState(ctx, txn, userState)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&pb.CreateFilterRuleResponse{Rule: rule}), nil
+}
+
+func (s *Server) UpdateFilterRule(ctx context.Context, req *connect.Request[pb.UpdateFilterRuleRequest]) (*connect.Response[pb.UpdateFilterRuleResponse], error) {
+	userID, err := s.isLogged(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rule, err := filterRuleFromRequest(req.Msg.GetRule())
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.st.InTxnRW(ctx, func(ctx context.Context, txn storage.SQLReadWrite) error {
+		userState, err := s.st.UserState(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+		idx := slices.IndexFunc(userState.FilterRules, func(r *stpb.FilterRule) bool { return r.Id == rule.Id })
+		if idx < 0 {
+			return connect.NewError(connect.CodeNotFound, fmt.Errorf("filter rule %d not found", rule.Id))
+		}
+		userState.FilterRules[idx] = rule
+		return s.st.SetUserState(ctx, txn, userState)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&pb.UpdateFilterRuleResponse{Rule: rule}), nil
+}
+
+func (s *Server) DeleteFilterRule(ctx context.Context, req *connect.Request[pb.DeleteFilterRuleRequest]) (*connect.Response[pb.DeleteFilterRuleResponse], error) {
+	userID, err := s.isLogged(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.st.InTxnRW(ctx, func(ctx context.Context, txn storage.SQLReadWrite) error {
+		userState, err := s.st.UserState(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+		count := len(userState.FilterRules)
+		userState.FilterRules = slices.DeleteFunc(userState.FilterRules, func(r *stpb.FilterRule) bool { return r.Id == req.Msg.Id })
+		if len(userState.FilterRules) == count {
+			return connect.NewError(connect.CodeNotFound, fmt.Errorf("filter rule %d not found", req.Msg.Id))
+		}
+		return s.st.SetUserState(ctx, txn, userState)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&pb.DeleteFilterRuleResponse{}), nil
+}
+
+func (s *Server) RecomputeMeta(ctx context.Context, req *connect.Request[pb.RecomputeMetaRequest], stream *connect.ServerStream[pb.RecomputeMetaResponse]) error {
+	userID, err := s.isLogged(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Filters are likely recomputed because they were just modified on
+	// Mastodon, so do not rely on the copy kept on the accounts.
+	accountStates, err := s.st.AllAccountStateByUID(ctx, nil, userID)
+	if err != nil {
+		return err
+	}
+	for _, accountState := range accountStates {
+		appRegState, err := s.appRegistry.Register(ctx, accountState.ServerAddr, s.selfURL)
+		if err != nil {
+			return err
+		}
+		client := s.appRegistry.MastodonClient(appRegState, accountState.AccessToken)
+		if err := s.refreshFilters(ctx, accountState, client); err != nil {
+			return err
+		}
+	}
+
+	result, err := s.st.RecomputeMeta(ctx, userID, req.Msg.IncludePositioned, func(p *storage.RecomputeMetaProgress) error {
+		return stream.Send(&pb.RecomputeMetaResponse{
+			Total:     p.Total,
+			Processed: p.Processed,
+			Updated:   p.Updated,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return stream.Send(&pb.RecomputeMetaResponse{
+		Total:     result.Total,
+		Processed: result.Processed,
+		Updated:   result.Updated,
+		Done:      true,
+	})
+}
+
+func (s *Server) ExportUser(ctx context.Context, req *connect.Request[pb.ExportUserRequest]) (*connect.Response[pb.ExportUserResponse], error) {
+	userID, err := s.isLogged(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Access tokens are only exported through the command line, as anybody
+	// getting hold of the archive could act on the Mastodon accounts.
+	archive, err := s.st.ExportUser(ctx, userID, false /* withTokens */)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&pb.ExportUserResponse{Archive: archive}), nil
+}
+
 const redirectPath = "/_redirect"
 
 func (s *Server) RedirectHandler(w http.ResponseWriter, req *http.Request) {
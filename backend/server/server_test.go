@@ -13,16 +13,21 @@ import (
 	"net/url"
 	"testing"
 
+	"connectrpc.com/connect"
 	"github.com/Palats/mastopoof/backend/mastodon/testserver"
 	"github.com/Palats/mastopoof/backend/storage"
+	"github.com/Palats/mastopoof/backend/types"
 	mpdata "github.com/Palats/mastopoof/proto/data"
 	pb "github.com/Palats/mastopoof/proto/gen/mastopoof"
+	"github.com/Palats/mastopoof/proto/gen/mastopoof/mastopoofconnect"
 	settingspb "github.com/Palats/mastopoof/proto/gen/mastopoof/settings"
 	stpb "github.com/Palats/mastopoof/proto/gen/mastopoof/storage"
+	"github.com/google/go-cmp/cmp"
 	"github.com/mattn/go-mastodon"
 	"golang.org/x/net/publicsuffix"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
 )
 
 func init() {
@@ -73,6 +78,7 @@ type TestEnv struct {
 	rpcAddr        string
 	httpServer     *httptest.Server
 	mastodonServer *testserver.Server
+	server         *Server
 }
 
 func (env *TestEnv) Init(ctx context.Context) *TestEnv {
@@ -98,10 +104,13 @@ func (env *TestEnv) Init(ctx context.Context) *TestEnv {
 	if err != nil {
 		env.t.Fatal(err)
 	}
+	if err := st.CreateInviteCode(ctx, nil, &stpb.InviteCode{Code: "invite1"}); err != nil {
+		env.t.Fatal(err)
+	}
 	appRegistry := NewAppRegistry(st)
 	appRegistry.client = env.httpServer.Client()
-	mastopoof := New(st, NewSessionManager(st), "invite1", 0 /* autoLogin */, nil, appRegistry)
-	mastopoof.RegisterOn(mux)
+	env.server = New(st, NewSessionManager(st), true /* requireInvite */, 0 /* autoLogin */, nil, appRegistry)
+	env.server.RegisterOn(mux)
 
 	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
 	if err != nil {
@@ -207,12 +216,18 @@ func TestBasic(t *testing.T) {
 	}).Init(ctx)
 	defer env.Close()
 
-	// Try authorize with no invite code.
+	// Try authorize with no invite code; that is fine for existing users, but
+	// the user cannot be created.
 	req := &pb.AuthorizeRequest{
 		ServerAddr: env.addr,
 		InviteCode: "",
 	}
-	if got, want := MustRequest(env, "Authorize", req), http.StatusForbidden; got.StatusCode != want {
+	MustCall[pb.AuthorizeResponse](env, "Authorize", req)
+	tokenReq := &pb.TokenRequest{
+		ServerAddr: env.addr,
+		AuthCode:   "foo",
+	}
+	if got, want := MustRequest(env, "Token", tokenReq), http.StatusForbidden; got.StatusCode != want {
 		t.Errorf("Got status %s, want %v", got.Status, want)
 	}
 
@@ -234,10 +249,7 @@ func TestBasic(t *testing.T) {
 	}
 
 	// Now get token
-	tokenResp := MustCall[pb.TokenResponse](env, "Token", &pb.TokenRequest{
-		ServerAddr: env.addr,
-		AuthCode:   "foo",
-	})
+	tokenResp := MustCall[pb.TokenResponse](env, "Token", tokenReq)
 	stid := tokenResp.UserInfo.DefaultStid
 
 	// Fetch a few statuses in the stream.
@@ -393,6 +405,81 @@ func TestSetRead(t *testing.T) {
 	}
 }
 
+func TestSyncHomeMarker(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t:             t,
+		StatusesCount: 10,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+	listResp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_FORWARD,
+	})
+	if got, want := len(listResp.Items), 10; got != want {
+		t.Fatalf("Got %d statuses, wanted %d", got, want)
+	}
+	statusID := func(position int64) mastodon.ID {
+		return MustUnmarshal[mastodon.Status](t, []byte(listResp.Items[position-1].Status.Content)).ID
+	}
+
+	// By default, the marker is left alone.
+	MustCall[pb.SetReadResponse](env, "SetRead", &pb.SetReadRequest{
+		Stid:     userInfo.DefaultStid,
+		LastRead: 2,
+		Mode:     pb.SetReadRequest_ADVANCE,
+	})
+	if got, want := env.mastodonServer.Marker("home").LastReadID, mastodon.ID(""); got != want {
+		t.Errorf("Got home marker %q, wanted %q", got, want)
+	}
+
+	// Once enabled, the marker follows the read position.
+	MustCall[pb.UpdateSettingsResponse](env, "UpdateSettings", &pb.UpdateSettingsRequest{Settings: &settingspb.Settings{
+		ListCount:      &settingspb.SettingInt64{Value: 10},
+		SyncHomeMarker: &settingspb.SettingBool{Value: true, Override: true},
+	}})
+	MustCall[pb.SetReadResponse](env, "SetRead", &pb.SetReadRequest{
+		Stid:     userInfo.DefaultStid,
+		LastRead: 3,
+		Mode:     pb.SetReadRequest_ADVANCE,
+	})
+	if got, want := env.mastodonServer.Marker("home").LastReadID, statusID(3); got != want {
+		t.Errorf("Got home marker %q, wanted %q", got, want)
+	}
+
+	// Another Mastodon client moves the marker further.
+	env.mastodonServer.SetMarker("home", statusID(7))
+	fetchResp := MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+	if got, want := fetchResp.StreamInfo.LastRead, int64(7); got != want {
+		t.Errorf("Got last read %d, wanted %d", got, want)
+	}
+
+	// A marker on a status which is not in the stream is ignored.
+	env.mastodonServer.SetMarker("home", "99999999")
+	fetchResp = MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+	if got, want := fetchResp.StreamInfo.LastRead, int64(7); got != want {
+		t.Errorf("Got last read %d, wanted %d", got, want)
+	}
+
+	// A marker behind the read position does not move it back.
+	env.mastodonServer.SetMarker("home", statusID(5))
+	fetchResp = MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+	if got, want := fetchResp.StreamInfo.LastRead, int64(7); got != want {
+		t.Errorf("Got last read %d, wanted %d", got, want)
+	}
+}
+
 func TestMultiFetch(t *testing.T) {
 	ctx := context.Background()
 	env := (&TestEnv{
@@ -560,203 +647,1218 @@ func TestSearchStatusID(t *testing.T) {
 	}
 }
 
-func TestNotifs(t *testing.T) {
+func TestSearchText(t *testing.T) {
 	ctx := context.Background()
 	env := (&TestEnv{
-		t: t,
+		t:             t,
+		StatusesCount: 5,
 	}).Init(ctx)
 	defer env.Close()
 	userInfo := env.FullLogin()
 
-	// Fist, no statuses.
-	resp := MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
-		Stid: userInfo.DefaultStid,
-	})
-	if got, want := resp.StreamInfo.NotificationState, stpb.StreamState_NOTIF_EXACT; got != want {
-		t.Errorf("Got notif state %v, wanted %v", got, want)
+	refStatus, err := env.mastodonServer.AddFakeStatus()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if got, want := resp.StreamInfo.NotificationsCount, int64(0); got != want {
-		t.Errorf("Got %d notifications, wanted %d", got, want)
+	if err := env.mastodonServer.SetStatusContent(refStatus.ID, "<p>A post about lighthouses</p>"); err != nil {
+		t.Fatal(err)
 	}
+	MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{Stid: userInfo.DefaultStid})
+	listResp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_FORWARD,
+	})
 
-	// Now, let's add a few statuses and see that we get them.
-	// It needs to have a status to notify about.
-	if _, err := env.mastodonServer.AddFakeStatus(); err != nil {
-		t.Fatal(err)
+	searchResp := MustCall[pb.SearchResponse](env, "Search", &pb.SearchRequest{
+		Query: "lighthouses",
+	})
+	if got, want := len(searchResp.Items), 1; got != want {
+		t.Fatalf("Got %d statuses, wanted %d; response:\n%v", got, want, searchResp)
 	}
-	for i := 0; i < 5; i++ {
-		if err := env.mastodonServer.AddFakeNotification(); err != nil {
-			t.Fatal(err)
+	status := MustUnmarshal[mastodon.Status](t, []byte(searchResp.Items[0].Status.Content))
+	if got, want := status.ID, refStatus.ID; got != want {
+		t.Errorf("Got status %s, wanted %s", got, want)
+	}
+	// The position matches the one in the stream.
+	var wantPosition int64
+	for _, item := range listResp.Items {
+		if MustUnmarshal[mastodon.Status](t, []byte(item.Status.Content)).ID == refStatus.ID {
+			wantPosition = item.Position
 		}
 	}
-	resp = MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
-		Stid: userInfo.DefaultStid,
-	})
-	if got, want := resp.StreamInfo.NotificationState, stpb.StreamState_NOTIF_EXACT; got != want {
-		t.Errorf("Got notif state %v, wanted %v", got, want)
+	if got, want := searchResp.Items[0].Position, wantPosition; got != want {
+		t.Errorf("Got position %d, wanted %d", got, want)
 	}
-	if got, want := resp.StreamInfo.NotificationsCount, int64(5); got != want {
-		t.Errorf("Got %d notifications, wanted %d", got, want)
+
+	// Nothing matching is not an error.
+	searchResp = MustCall[pb.SearchResponse](env, "Search", &pb.SearchRequest{
+		Query: "submarines",
+	})
+	if got, want := len(searchResp.Items), 0; got != want {
+		t.Errorf("Got %d statuses, wanted %d; response:\n%v", got, want, searchResp)
 	}
 
-	// Add a lot more notifications - it should not have the exact number.
-	for i := 0; i < 100; i++ {
-		if err := env.mastodonServer.AddFakeNotification(); err != nil {
-			t.Fatal(err)
-		}
+	// An empty search is rejected.
+	httpResp := MustRequest(env, "Search", &pb.SearchRequest{})
+	if got, want := httpResp.StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("Got status %v, want %v; body=%s", got, want, MustBody(t, httpResp))
 	}
-	resp = MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
-		Stid: userInfo.DefaultStid,
+}
+
+func TestSearchConstraints(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t:             t,
+		StatusesCount: 5,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{Stid: userInfo.DefaultStid})
+	MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_FORWARD,
 	})
-	if got, want := resp.StreamInfo.NotificationState, stpb.StreamState_NOTIF_MORE; got != want {
-		t.Errorf("Got notif state %v, wanted %v", got, want)
+
+	searchResp := MustCall[pb.SearchResponse](env, "Search", &pb.SearchRequest{
+		MinPosition: 2,
+		MaxPosition: 3,
+	})
+	var positions []int64
+	for _, item := range searchResp.Items {
+		positions = append(positions, item.Position)
+	}
+	if diff := cmp.Diff([]int64{2, 3}, positions); diff != "" {
+		t.Errorf("Positions mismatch (-want +got):\n%s", diff)
 	}
 
-	// And reset notifications.
-	env.mastodonServer.ClearNotifications()
-	resp = MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
-		Stid: userInfo.DefaultStid,
+	// Constraints are combined.
+	hasPoll := true
+	searchResp = MustCall[pb.SearchResponse](env, "Search", &pb.SearchRequest{
+		MinPosition: 2,
+		HasPoll:     &hasPoll,
 	})
-	if got, want := resp.StreamInfo.NotificationState, stpb.StreamState_NOTIF_EXACT; got != want {
-		t.Errorf("Got notif state %v, wanted %v", got, want)
+	if got, want := len(searchResp.Items), 0; got != want {
+		t.Errorf("Got %d statuses, wanted %d; response:\n%v", got, want, searchResp)
 	}
-	if got, want := resp.StreamInfo.NotificationsCount, int64(0); got != want {
-		t.Errorf("Got %d notifications, wanted %d", got, want)
+
+	httpResp := MustRequest(env, "Search", &pb.SearchRequest{MinPosition: -1})
+	if got, want := httpResp.StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("Got status %v, want %v; body=%s", got, want, MustBody(t, httpResp))
 	}
 }
 
-func TestSendUserInfo(t *testing.T) {
+func TestPostStatus(t *testing.T) {
 	ctx := context.Background()
 	env := (&TestEnv{
 		t: t,
 	}).Init(ctx)
 	defer env.Close()
+	env.FullLogin()
 
-	// Check user info content when initially logging in.
-	userInfo := env.FullLogin()
-	if got, want := len(userInfo.GetAccounts()), 1; got != want {
-		t.Fatalf("Got %d accounts, wanted %d", got, want)
+	resp := MustCall[pb.PostStatusResponse](env, "PostStatus", &pb.PostStatusRequest{
+		Content:    "Hello world",
+		Visibility: "unlisted",
+		Language:   "en",
+	})
+	status := MustUnmarshal[mastodon.Status](t, []byte(resp.Status.Content))
+	if got, want := status.Content, "<p>Hello world</p>"; got != want {
+		t.Errorf("Got content %q, want %q", got, want)
 	}
-	if got, want := userInfo.Accounts[0].Username, "testuser1"; got != want {
-		t.Errorf("Got username %s, wanted %s", got, want)
+	if got, want := status.Visibility, "unlisted"; got != want {
+		t.Errorf("Got visibility %q, want %q", got, want)
 	}
 
-	// Also check Login() method, which is really verifying that
-	// the cookie exists and is valid.
-	resp := MustCall[pb.LoginResponse](env, "Login", &pb.LoginRequest{})
-	userInfo = resp.UserInfo
-	if got, want := len(userInfo.GetAccounts()), 1; got != want {
-		t.Fatalf("Got %d accounts, wanted %d", got, want)
+	// The new status is available locally.
+	searchResp := MustCall[pb.SearchResponse](env, "Search", &pb.SearchRequest{
+		StatusId: string(status.ID),
+	})
+	if got, want := len(searchResp.Items), 1; got != want {
+		t.Errorf("Got %d statuses, wanted %d; response:\n%v", got, want, searchResp)
 	}
-	if got, want := userInfo.Accounts[0].Username, "testuser1"; got != want {
-		t.Errorf("Got username %s, wanted %s", got, want)
+
+	// Missing content.
+	httpResp := MustRequest(env, "PostStatus", &pb.PostStatusRequest{})
+	if got, want := httpResp.StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("Got status %v, want %v; body=%s", got, want, MustBody(t, httpResp))
 	}
 }
 
-func TestFavourite(t *testing.T) {
+func TestReply(t *testing.T) {
 	ctx := context.Background()
 	env := (&TestEnv{
 		t: t,
 	}).Init(ctx)
 	defer env.Close()
-	userInfo := env.FullLogin()
+	env.FullLogin()
 
 	refStatus, err := env.mastodonServer.AddFakeStatus()
 	if err != nil {
 		t.Fatal(err)
 	}
+	refStatus.Visibility = "private"
+	if err := env.mastodonServer.UpdateStatus(refStatus); err != nil {
+		t.Fatal(err)
+	}
 
-	MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
-		Stid: userInfo.DefaultStid,
-	})
-
-	// Set favourite
-	resp := MustCall[pb.SetStatusResponse](env, "SetStatus", &pb.SetStatusRequest{
+	resp := MustCall[pb.ReplyResponse](env, "Reply", &pb.ReplyRequest{
 		StatusId: string(refStatus.ID),
-		Action:   pb.SetStatusRequest_FAVOURITE,
+		Content:  "Nice one",
 	})
-	var gotStatus mastodon.Status
-	if err := json.Unmarshal([]byte(resp.GetStatus().GetContent()), &gotStatus); err != nil {
-		t.Fatal(err)
+	status := MustUnmarshal[mastodon.Status](t, []byte(resp.Status.Content))
+	if got, want := status.InReplyToID, any(string(refStatus.ID)); got != want {
+		t.Errorf("Got in_reply_to_id %v, want %v", got, want)
 	}
-	if got, want := gotStatus.Favourited, true; got != want {
-		t.Errorf("got favourite %v, want %v", got, want)
+	// The author of the status replied to is mentioned.
+	if got, want := status.Content, fmt.Sprintf("<p>@%s Nice one</p>", refStatus.Account.Acct); got != want {
+		t.Errorf("Got content %q, want %q", got, want)
+	}
+	// Visibility is inherited.
+	if got, want := status.Visibility, "private"; got != want {
+		t.Errorf("Got visibility %q, want %q", got, want)
 	}
 
-	// And unset
-	resp = MustCall[pb.SetStatusResponse](env, "SetStatus", &pb.SetStatusRequest{
-		StatusId: string(refStatus.ID),
-		Action:   pb.SetStatusRequest_UNFAVOURITE,
+	// Replying to an unknown status.
+	httpResp := MustRequest(env, "Reply", &pb.ReplyRequest{
+		StatusId: "999",
+		Content:  "Hello?",
 	})
-	if err := json.Unmarshal([]byte(resp.GetStatus().GetContent()), &gotStatus); err != nil {
-		t.Fatal(err)
-	}
-	if got, want := gotStatus.Favourited, false; got != want {
-		t.Errorf("got favourite %v, want %v", got, want)
+	if got, want := httpResp.StatusCode, http.StatusNotFound; got != want {
+		t.Errorf("Got status %v, want %v; body=%s", got, want, MustBody(t, httpResp))
 	}
 }
 
-func TestRefreshStatus(t *testing.T) {
+func TestGetContext(t *testing.T) {
 	ctx := context.Background()
 	env := (&TestEnv{
 		t: t,
-		// Add a few extra statuses - this way, that check that the right one is updated.
-		StatusesCount: 3,
 	}).Init(ctx)
 	defer env.Close()
 	userInfo := env.FullLogin()
 
-	// Create a status on the server.
-	refStatus, err := env.mastodonServer.AddFakeStatus()
+	root, err := env.mastodonServer.AddFakeStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply1, err := env.mastodonServer.AddReply(root.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply2, err := env.mastodonServer.AddReply(reply1.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply3, err := env.mastodonServer.AddReply(reply1.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// Make sure it is fetched and init the stream.
 	MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
 		Stid: userInfo.DefaultStid,
 	})
-	listInitResp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+	MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
 		Stid:      userInfo.DefaultStid,
-		Direction: pb.ListRequest_INITIAL,
+		Direction: pb.ListRequest_FORWARD,
 	})
-
-	// Now, change its content on Mastodon
-	newStatus := *refStatus
-	newStatus.Content = "newcontent1"
-	if err := env.mastodonServer.UpdateStatus(&newStatus); err != nil {
+	// A reply which was not fetched yet.
+	reply4, err := env.mastodonServer.AddReply(reply2.ID)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	// Test that Refresh status gets the new content
-	resp := MustCall[pb.SetStatusResponse](env, "SetStatus", &pb.SetStatusRequest{
-		StatusId: string(refStatus.ID),
-		Action:   pb.SetStatusRequest_REFRESH,
-	})
-	refreshStatus := MustUnmarshal[mastodon.Status](t, []byte(resp.GetStatus().GetContent()))
-	if got, want := refreshStatus.Content, "newcontent1"; got != want {
-		t.Errorf("Got status with content %q, wanted %q", got, want)
+	type result struct {
+		ID       mastodon.ID
+		Position int64
+	}
+	toResult := func(item *pb.Item) result {
+		return result{MustUnmarshal[mastodon.Status](t, []byte(item.Status.Content)).ID, item.Position}
 	}
 
-	// And verify that the list also gives back the refreshed status.
-	// This means that the DB was updated.
-	listResp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
-		Stid:      userInfo.DefaultStid,
-		Direction: pb.ListRequest_FORWARD,
-		Position:  listInitResp.ForwardPosition,
+	resp := MustCall[pb.GetContextResponse](env, "GetContext", &pb.GetContextRequest{
+		StatusId: string(reply1.ID),
 	})
-	var listStatus *mastodon.Status
-	for _, item := range listResp.Items {
-		s := MustUnmarshal[mastodon.Status](t, []byte(item.Status.Content))
-		if s.ID == refStatus.ID {
-			listStatus = &s
-			break
-		}
+	if diff := cmp.Diff(result{reply1.ID, 2}, toResult(resp.Status)); diff != "" {
+		t.Errorf("Status mismatch (-want +got):\n%s", diff)
 	}
-	if listStatus == nil {
-		t.Fatalf("unable to find status %q", refStatus.ID)
+	var got []result
+	for _, item := range resp.Ancestors {
+		got = append(got, toResult(item))
 	}
-	if got, want := listStatus.Content, "newcontent1"; got != want {
-		t.Errorf("Got status with content %q, wanted %q", got, want)
+	if diff := cmp.Diff([]result{{root.ID, 1}}, got); diff != "" {
+		t.Errorf("Ancestors mismatch (-want +got):\n%s", diff)
+	}
+	got = nil
+	for _, item := range resp.Descendants {
+		got = append(got, toResult(item))
+	}
+	if diff := cmp.Diff([]result{{reply2.ID, 3}, {reply3.ID, 4}, {reply4.ID, 0}}, got); diff != "" {
+		t.Errorf("Descendants mismatch (-want +got):\n%s", diff)
+	}
+	if resp.CachedOnly {
+		t.Errorf("Got cached only results")
+	}
+
+	// Unknown status.
+	httpResp := MustRequest(env, "GetContext", &pb.GetContextRequest{
+		StatusId: "999999",
+	})
+	if got, want := httpResp.StatusCode, http.StatusNotFound; got != want {
+		t.Errorf("Got status %v, want %v; body=%s", got, want, MustBody(t, httpResp))
 	}
 }
+
+func TestNotifs(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t: t,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	// Fist, no statuses.
+	resp := MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+	if got, want := resp.StreamInfo.NotificationState, stpb.StreamState_NOTIF_EXACT; got != want {
+		t.Errorf("Got notif state %v, wanted %v", got, want)
+	}
+	if got, want := resp.StreamInfo.NotificationsCount, int64(0); got != want {
+		t.Errorf("Got %d notifications, wanted %d", got, want)
+	}
+
+	// Now, let's add a few statuses and see that we get them.
+	// It needs to have a status to notify about.
+	if _, err := env.mastodonServer.AddFakeStatus(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := env.mastodonServer.AddFakeNotification(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp = MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+	if got, want := resp.StreamInfo.NotificationState, stpb.StreamState_NOTIF_EXACT; got != want {
+		t.Errorf("Got notif state %v, wanted %v", got, want)
+	}
+	if got, want := resp.StreamInfo.NotificationsCount, int64(5); got != want {
+		t.Errorf("Got %d notifications, wanted %d", got, want)
+	}
+
+	// Add a lot more notifications - it should not have the exact number.
+	for i := 0; i < 100; i++ {
+		if err := env.mastodonServer.AddFakeNotification(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp = MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+	if got, want := resp.StreamInfo.NotificationState, stpb.StreamState_NOTIF_MORE; got != want {
+		t.Errorf("Got notif state %v, wanted %v", got, want)
+	}
+
+	// And mark them all as read from another Mastodon client.
+	notif, err := env.mastodonServer.AddNotification("mention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.mastodonServer.SetMarker("notifications", notif.ID)
+	resp = MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+	if got, want := resp.StreamInfo.NotificationState, stpb.StreamState_NOTIF_EXACT; got != want {
+		t.Errorf("Got notif state %v, wanted %v", got, want)
+	}
+	if got, want := resp.StreamInfo.NotificationsCount, int64(0); got != want {
+		t.Errorf("Got %d notifications, wanted %d", got, want)
+	}
+
+	// Get a few new unread notifications.
+	for i := 0; i < 3; i++ {
+		if err := env.mastodonServer.AddFakeNotification(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp = MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+	if got, want := resp.StreamInfo.NotificationsCount, int64(3); got != want {
+		t.Errorf("Got %d notifications, wanted %d", got, want)
+	}
+
+	// And reset notifications - the dismissed ones are dropped.
+	env.mastodonServer.ClearNotifications()
+	resp = MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+	if got, want := resp.StreamInfo.NotificationState, stpb.StreamState_NOTIF_EXACT; got != want {
+		t.Errorf("Got notif state %v, wanted %v", got, want)
+	}
+	if got, want := resp.StreamInfo.NotificationsCount, int64(0); got != want {
+		t.Errorf("Got %d notifications, wanted %d", got, want)
+	}
+}
+
+func TestNotificationsInbox(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t: t,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	if _, err := env.mastodonServer.AddFakeStatus(); err != nil {
+		t.Fatal(err)
+	}
+	var notifs []*mastodon.Notification
+	for _, notifType := range []string{"favourite", "favourite", "reblog", "follow", "mention"} {
+		notif, err := env.mastodonServer.AddNotification(notifType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		notifs = append(notifs, notif)
+	}
+	fetchResp := MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+	if got, want := fetchResp.StreamInfo.NotificationsCount, int64(5); got != want {
+		t.Errorf("Got %d notifications, wanted %d", got, want)
+	}
+
+	// groupTypes describes the content of the groups, most recent first.
+	groupTypes := func(resp *pb.ListNotificationsResponse) [][]string {
+		var groups [][]string
+		for _, group := range resp.Groups {
+			var notifTypes []string
+			for _, notif := range group.Notifications {
+				notifTypes = append(notifTypes, notif.Type)
+			}
+			groups = append(groups, notifTypes)
+		}
+		return groups
+	}
+
+	// All notifications about the status are grouped together.
+	resp := MustCall[pb.ListNotificationsResponse](env, "ListNotifications", &pb.ListNotificationsRequest{})
+	want := [][]string{{"mention", "reblog", "favourite", "favourite"}, {"follow"}}
+	if diff := cmp.Diff(want, groupTypes(resp)); diff != "" {
+		t.Errorf("Groups mismatch (-want +got):\n%s", diff)
+	}
+	if resp.Groups[0].Status == nil || resp.Groups[1].Status != nil {
+		t.Errorf("Unexpected statuses in groups: %v", resp.Groups)
+	}
+	if got, want := resp.UnreadCount, int64(5); got != want {
+		t.Errorf("Got %d unread notifications, wanted %d", got, want)
+	}
+	if got, want := resp.NextNid, int64(0); got != want {
+		t.Errorf("Got next nid %d, wanted %d", got, want)
+	}
+	reblogNID := resp.Groups[0].Notifications[1].Nid
+
+	// Filter on type.
+	resp = MustCall[pb.ListNotificationsResponse](env, "ListNotifications", &pb.ListNotificationsRequest{
+		Types: []string{"follow", "reblog"},
+	})
+	want = [][]string{{"follow"}, {"reblog"}}
+	if diff := cmp.Diff(want, groupTypes(resp)); diff != "" {
+		t.Errorf("Groups mismatch (-want +got):\n%s", diff)
+	}
+
+	// Paging.
+	resp = MustCall[pb.ListNotificationsResponse](env, "ListNotifications", &pb.ListNotificationsRequest{
+		Limit: 2,
+	})
+	want = [][]string{{"mention"}, {"follow"}}
+	if diff := cmp.Diff(want, groupTypes(resp)); diff != "" {
+		t.Errorf("Groups mismatch (-want +got):\n%s", diff)
+	}
+	resp = MustCall[pb.ListNotificationsResponse](env, "ListNotifications", &pb.ListNotificationsRequest{
+		BeforeNid: resp.NextNid,
+		Limit:     2,
+	})
+	want = [][]string{{"reblog", "favourite"}}
+	if diff := cmp.Diff(want, groupTypes(resp)); diff != "" {
+		t.Errorf("Groups mismatch (-want +got):\n%s", diff)
+	}
+
+	// Mark part of the notifications as read.
+	markResp := MustCall[pb.MarkNotificationsReadResponse](env, "MarkNotificationsRead", &pb.MarkNotificationsReadRequest{
+		UpToNid: reblogNID,
+	})
+	if got, want := markResp.UnreadCount, int64(2); got != want {
+		t.Errorf("Got %d unread notifications, wanted %d", got, want)
+	}
+	if got, want := env.mastodonServer.Marker("notifications").LastReadID, notifs[2].ID; got != want {
+		t.Errorf("Got marker %q, wanted %q", got, want)
+	}
+	resp = MustCall[pb.ListNotificationsResponse](env, "ListNotifications", &pb.ListNotificationsRequest{
+		UnreadOnly: true,
+	})
+	want = [][]string{{"mention"}, {"follow"}}
+	if diff := cmp.Diff(want, groupTypes(resp)); diff != "" {
+		t.Errorf("Groups mismatch (-want +got):\n%s", diff)
+	}
+
+	// And the rest.
+	markResp = MustCall[pb.MarkNotificationsReadResponse](env, "MarkNotificationsRead", &pb.MarkNotificationsReadRequest{})
+	if got, want := markResp.UnreadCount, int64(0); got != want {
+		t.Errorf("Got %d unread notifications, wanted %d", got, want)
+	}
+	if got, want := env.mastodonServer.Marker("notifications").LastReadID, notifs[4].ID; got != want {
+		t.Errorf("Got marker %q, wanted %q", got, want)
+	}
+	fetchResp = MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+	if got, want := fetchResp.StreamInfo.NotificationsCount, int64(0); got != want {
+		t.Errorf("Got %d notifications, wanted %d", got, want)
+	}
+}
+
+func TestSendUserInfo(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t: t,
+	}).Init(ctx)
+	defer env.Close()
+
+	// Check user info content when initially logging in.
+	userInfo := env.FullLogin()
+	if got, want := len(userInfo.GetAccounts()), 1; got != want {
+		t.Fatalf("Got %d accounts, wanted %d", got, want)
+	}
+	if got, want := userInfo.Accounts[0].Username, "testuser1"; got != want {
+		t.Errorf("Got username %s, wanted %s", got, want)
+	}
+
+	// Also check Login() method, which is really verifying that
+	// the cookie exists and is valid.
+	resp := MustCall[pb.LoginResponse](env, "Login", &pb.LoginRequest{})
+	userInfo = resp.UserInfo
+	if got, want := len(userInfo.GetAccounts()), 1; got != want {
+		t.Fatalf("Got %d accounts, wanted %d", got, want)
+	}
+	if got, want := userInfo.Accounts[0].Username, "testuser1"; got != want {
+		t.Errorf("Got username %s, wanted %s", got, want)
+	}
+}
+
+func TestFavourite(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t: t,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	refStatus, err := env.mastodonServer.AddFakeStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+
+	// Set favourite
+	resp := MustCall[pb.SetStatusResponse](env, "SetStatus", &pb.SetStatusRequest{
+		StatusId: string(refStatus.ID),
+		Action:   pb.SetStatusRequest_FAVOURITE,
+	})
+	var gotStatus mastodon.Status
+	if err := json.Unmarshal([]byte(resp.GetStatus().GetContent()), &gotStatus); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := gotStatus.Favourited, true; got != want {
+		t.Errorf("got favourite %v, want %v", got, want)
+	}
+
+	// And unset
+	resp = MustCall[pb.SetStatusResponse](env, "SetStatus", &pb.SetStatusRequest{
+		StatusId: string(refStatus.ID),
+		Action:   pb.SetStatusRequest_UNFAVOURITE,
+	})
+	if err := json.Unmarshal([]byte(resp.GetStatus().GetContent()), &gotStatus); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := gotStatus.Favourited, false; got != want {
+		t.Errorf("got favourite %v, want %v", got, want)
+	}
+}
+
+func TestStatusActions(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t: t,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	refStatus, err := env.mastodonServer.AddFakeStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+
+	tests := []struct {
+		action pb.SetStatusRequest_Action
+		field  func(status *mastodon.Status) any
+		want   any
+	}{
+		{pb.SetStatusRequest_REBLOG, func(s *mastodon.Status) any { return s.Reblogged }, true},
+		{pb.SetStatusRequest_UNREBLOG, func(s *mastodon.Status) any { return s.Reblogged }, false},
+		{pb.SetStatusRequest_BOOKMARK, func(s *mastodon.Status) any { return s.Bookmarked }, true},
+		{pb.SetStatusRequest_UNBOOKMARK, func(s *mastodon.Status) any { return s.Bookmarked }, false},
+		{pb.SetStatusRequest_MUTE, func(s *mastodon.Status) any { return s.Muted }, true},
+		{pb.SetStatusRequest_UNMUTE, func(s *mastodon.Status) any { return s.Muted }, false},
+		{pb.SetStatusRequest_PIN, func(s *mastodon.Status) any { return s.Pinned }, true},
+		{pb.SetStatusRequest_UNPIN, func(s *mastodon.Status) any { return s.Pinned }, false},
+	}
+	for _, tc := range tests {
+		resp := MustCall[pb.SetStatusResponse](env, "SetStatus", &pb.SetStatusRequest{
+			StatusId: string(refStatus.ID),
+			Action:   tc.action,
+		})
+		gotStatus := MustUnmarshal[mastodon.Status](t, []byte(resp.GetStatus().GetContent()))
+		if got, want := gotStatus.ID, refStatus.ID; got != want {
+			t.Errorf("%v: got status ID %v, want %v", tc.action, got, want)
+		}
+		if got := tc.field(&gotStatus); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.action, got, tc.want)
+		}
+
+		// The cached status must have been updated as well.
+		searchResp := MustCall[pb.SearchResponse](env, "Search", &pb.SearchRequest{
+			StatusId: string(refStatus.ID),
+		})
+		if got, want := len(searchResp.Items), 1; got != want {
+			t.Fatalf("%v: got %d statuses, wanted %d", tc.action, got, want)
+		}
+		cachedStatus := MustUnmarshal[mastodon.Status](t, []byte(searchResp.Items[0].Status.Content))
+		if got := tc.field(&cachedStatus); got != tc.want {
+			t.Errorf("%v: got cached %v, want %v", tc.action, got, tc.want)
+		}
+	}
+
+	// Actions on unknown statuses fail.
+	httpResp := MustRequest(env, "SetStatus", &pb.SetStatusRequest{
+		StatusId: "999",
+		Action:   pb.SetStatusRequest_PIN,
+	})
+	if got, want := httpResp.StatusCode, http.StatusOK; got == want {
+		t.Errorf("Got status %v, expected an error", got)
+	}
+}
+
+func TestRefreshStatus(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t: t,
+		// Add a few extra statuses - this way, that check that the right one is updated.
+		StatusesCount: 3,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	// Create a status on the server.
+	refStatus, err := env.mastodonServer.AddFakeStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure it is fetched and init the stream.
+	MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+	listInitResp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_INITIAL,
+	})
+
+	// Now, change its content on Mastodon
+	newStatus := *refStatus
+	newStatus.Content = "newcontent1"
+	if err := env.mastodonServer.UpdateStatus(&newStatus); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test that Refresh status gets the new content
+	resp := MustCall[pb.SetStatusResponse](env, "SetStatus", &pb.SetStatusRequest{
+		StatusId: string(refStatus.ID),
+		Action:   pb.SetStatusRequest_REFRESH,
+	})
+	refreshStatus := MustUnmarshal[mastodon.Status](t, []byte(resp.GetStatus().GetContent()))
+	if got, want := refreshStatus.Content, "newcontent1"; got != want {
+		t.Errorf("Got status with content %q, wanted %q", got, want)
+	}
+
+	// And verify that the list also gives back the refreshed status.
+	// This means that the DB was updated.
+	listResp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_FORWARD,
+		Position:  listInitResp.ForwardPosition,
+	})
+	var listStatus *mastodon.Status
+	for _, item := range listResp.Items {
+		s := MustUnmarshal[mastodon.Status](t, []byte(item.Status.Content))
+		if s.ID == refStatus.ID {
+			listStatus = &s
+			break
+		}
+	}
+	if listStatus == nil {
+		t.Fatalf("unable to find status %q", refStatus.ID)
+	}
+	if got, want := listStatus.Content, "newcontent1"; got != want {
+		t.Errorf("Got status with content %q, wanted %q", got, want)
+	}
+}
+
+func TestFilterActions(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t: t,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	addStatus := func(content string) *mastodon.Status {
+		status, err := env.mastodonServer.AddFakeStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		updated := *status
+		updated.Content = content
+		if err := env.mastodonServer.UpdateStatus(&updated); err != nil {
+			t.Fatal(err)
+		}
+		return &updated
+	}
+
+	env.mastodonServer.AddFilter("Spoilers", "warn", "spoiler")
+	env.mastodonServer.AddFilter("Politics", "hide", "election")
+	plain := addStatus("Nothing special")
+	addStatus("About the election")
+	warned := addStatus("Big spoiler ahead")
+
+	MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+	resp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_FORWARD,
+	})
+
+	type result struct {
+		ID       mastodon.ID
+		Warnings []string
+	}
+	var got []result
+	for _, item := range resp.Items {
+		got = append(got, result{MustUnmarshal[mastodon.Status](t, []byte(item.Status.Content)).ID, item.FilterWarnings})
+	}
+	want := []result{{plain.ID, nil}, {warned.ID, []string{"Spoilers"}}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Items mismatch (-want +got):\n%s", diff)
+	}
+	if resp.StreamInfo.RemainingPool != 0 || resp.StreamInfo.FilteredPool != 1 {
+		t.Errorf("Got remaining=%d, filtered=%d; want 0, 1", resp.StreamInfo.RemainingPool, resp.StreamInfo.FilteredPool)
+	}
+
+	// Filters are cached on the account, so a new filter is not applied right
+	// away.
+	env.mastodonServer.AddFilter("Other", "hide", "again")
+	addStatus("Nothing special again")
+	MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+	resp = MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_FORWARD,
+		Position:  resp.ForwardPosition,
+	})
+	if len(resp.Items) != 1 {
+		t.Errorf("Got %d items, wanted 1", len(resp.Items))
+	}
+}
+
+func TestFilterRules(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t: t,
+	}).Init(ctx)
+	defer env.Close()
+	env.FullLogin()
+
+	// Invalid rule.
+	httpResp := MustRequest(env, "CreateFilterRule", &pb.CreateFilterRuleRequest{
+		Rule: &stpb.FilterRule{Kind: stpb.FilterRule_LANGUAGE, Action: stpb.FilterRule_HIDE},
+	})
+	if got, want := httpResp.StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("Got status %v, want %v; body=%s", got, want, MustBody(t, httpResp))
+	}
+
+	created1 := MustCall[pb.CreateFilterRuleResponse](env, "CreateFilterRule", &pb.CreateFilterRuleRequest{
+		Rule: &stpb.FilterRule{Kind: stpb.FilterRule_REBLOGS_FROM, Action: stpb.FilterRule_HIDE, Account: " @foo@example.com"},
+	})
+	created2 := MustCall[pb.CreateFilterRuleResponse](env, "CreateFilterRule", &pb.CreateFilterRuleRequest{
+		Rule: &stpb.FilterRule{Kind: stpb.FilterRule_LANGUAGE, Action: stpb.FilterRule_COLLAPSE, Language: "DE"},
+	})
+	want := []*stpb.FilterRule{
+		{Id: 1, Kind: stpb.FilterRule_REBLOGS_FROM, Action: stpb.FilterRule_HIDE, Account: "foo@example.com"},
+		{Id: 2, Kind: stpb.FilterRule_LANGUAGE, Action: stpb.FilterRule_COLLAPSE, Language: "de"},
+	}
+	if diff := cmp.Diff(want, []*stpb.FilterRule{created1.Rule, created2.Rule}, protocmp.Transform()); diff != "" {
+		t.Errorf("Created rules mismatch (-want +got):\n%s", diff)
+	}
+
+	MustCall[pb.UpdateFilterRuleResponse](env, "UpdateFilterRule", &pb.UpdateFilterRuleRequest{
+		Rule: &stpb.FilterRule{Id: 2, Kind: stpb.FilterRule_TOO_MANY_HASHTAGS, Action: stpb.FilterRule_HIDE, MaxHashtags: 5},
+	})
+	MustCall[pb.DeleteFilterRuleResponse](env, "DeleteFilterRule", &pb.DeleteFilterRuleRequest{Id: 1})
+	listResp := MustCall[pb.ListFilterRulesResponse](env, "ListFilterRules", &pb.ListFilterRulesRequest{})
+	want = []*stpb.FilterRule{
+		{Id: 2, Kind: stpb.FilterRule_TOO_MANY_HASHTAGS, Action: stpb.FilterRule_HIDE, MaxHashtags: 5},
+	}
+	if diff := cmp.Diff(want, listResp.Rules, protocmp.Transform()); diff != "" {
+		t.Errorf("Rules mismatch (-want +got):\n%s", diff)
+	}
+
+	// Unknown rules.
+	httpResp = MustRequest(env, "DeleteFilterRule", &pb.DeleteFilterRuleRequest{Id: 1})
+	if got, want := httpResp.StatusCode, http.StatusNotFound; got != want {
+		t.Errorf("Got status %v, want %v; body=%s", got, want, MustBody(t, httpResp))
+	}
+	httpResp = MustRequest(env, "UpdateFilterRule", &pb.UpdateFilterRuleRequest{
+		Rule: &stpb.FilterRule{Id: 42, Kind: stpb.FilterRule_REPLY_TO_UNFOLLOWED, Action: stpb.FilterRule_HIDE},
+	})
+	if got, want := httpResp.StatusCode, http.StatusNotFound; got != want {
+		t.Errorf("Got status %v, want %v; body=%s", got, want, MustBody(t, httpResp))
+	}
+}
+
+func TestFilterRuleReplyToUnfollowed(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t: t,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	MustCall[pb.CreateFilterRuleResponse](env, "CreateFilterRule", &pb.CreateFilterRuleRequest{
+		Rule: &stpb.FilterRule{Kind: stpb.FilterRule_REPLY_TO_UNFOLLOWED, Action: stpb.FilterRule_HIDE},
+	})
+
+	followed, err := env.mastodonServer.AddFakeStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.mastodonServer.AddFollowing(&followed.Account)
+	unfollowed, err := env.mastodonServer.AddFakeStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply1, err := env.mastodonServer.AddReply(followed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.mastodonServer.AddReply(unfollowed.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+		Stid: userInfo.DefaultStid,
+	})
+	resp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_FORWARD,
+	})
+	var got []mastodon.ID
+	for _, item := range resp.Items {
+		got = append(got, MustUnmarshal[mastodon.Status](t, []byte(item.Status.Content)).ID)
+	}
+	if diff := cmp.Diff([]mastodon.ID{followed.ID, unfollowed.ID, reply1.ID}, got); diff != "" {
+		t.Errorf("Statuses mismatch (-want +got):\n%s", diff)
+	}
+	if resp.StreamInfo.FilteredPool != 1 {
+		t.Errorf("Got %d filtered statuses, wanted 1", resp.StreamInfo.FilteredPool)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t:             t,
+		StatusesCount: 5,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	// Home timeline is already used by the default stream.
+	httpResp := MustRequest(env, "CreateStream", &pb.CreateStreamRequest{
+		Name:   "home2",
+		Source: &stpb.StreamSource{Kind: stpb.StreamSource_HOME},
+	})
+	if got, want := httpResp.StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("Got status %v, want %v; body=%s", got, want, MustBody(t, httpResp))
+	}
+
+	createResp := MustCall[pb.CreateStreamResponse](env, "CreateStream", &pb.CreateStreamRequest{
+		Name:   "friends",
+		Source: &stpb.StreamSource{Kind: stpb.StreamSource_LIST, ListId: "42"},
+	})
+	stid := createResp.StreamInfo.Stid
+	if stid == userInfo.DefaultStid {
+		t.Fatalf("New stream reused default stream ID %d", stid)
+	}
+
+	// A list stream gets its own statuses.
+	fetchResp := MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{Stid: stid})
+	if got, want := fetchResp.FetchedCount, int64(5); got != want {
+		t.Errorf("Got %d fetched statuses, wanted %d", got, want)
+	}
+	listResp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      stid,
+		Direction: pb.ListRequest_INITIAL,
+	})
+	if len(listResp.Items) == 0 {
+		t.Errorf("Got no statuses in list stream")
+	}
+
+	MustCall[pb.RenameStreamResponse](env, "RenameStream", &pb.RenameStreamRequest{
+		Stid: stid,
+		Name: "close friends",
+	})
+	streamsResp := MustCall[pb.ListStreamsResponse](env, "ListStreams", &pb.ListStreamsRequest{})
+	if got, want := len(streamsResp.Streams), 2; got != want {
+		t.Fatalf("Got %d streams, wanted %d", got, want)
+	}
+	if got, want := streamsResp.Streams[1].Name, "close friends"; got != want {
+		t.Errorf("Got stream name %q, wanted %q", got, want)
+	}
+	if got, want := streamsResp.Streams[1].Source.GetListId(), "42"; got != want {
+		t.Errorf("Got list ID %q, wanted %q", got, want)
+	}
+
+	// Default stream cannot be deleted.
+	httpResp = MustRequest(env, "DeleteStream", &pb.DeleteStreamRequest{Stid: userInfo.DefaultStid})
+	if got, want := httpResp.StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("Got status %v, want %v; body=%s", got, want, MustBody(t, httpResp))
+	}
+
+	MustCall[pb.DeleteStreamResponse](env, "DeleteStream", &pb.DeleteStreamRequest{Stid: stid})
+	httpResp = MustRequest(env, "List", &pb.ListRequest{
+		Stid:      stid,
+		Direction: pb.ListRequest_INITIAL,
+	})
+	if got, want := httpResp.StatusCode, http.StatusForbidden; got != want {
+		t.Errorf("Got status %v, want %v; body=%s", got, want, MustBody(t, httpResp))
+	}
+
+	// Default stream is still usable.
+	MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{Stid: userInfo.DefaultStid})
+}
+
+func TestLinkAccount(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t:             t,
+		StatusesCount: 4,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	env.mastodonServer.AddAccount("workcode", "777", "worker")
+
+	// Already logged in, so no invite code is needed.
+	MustCall[pb.AuthorizeResponse](env, "Authorize", &pb.AuthorizeRequest{
+		ServerAddr: env.addr,
+	})
+	linkResp := MustCall[pb.LinkAccountResponse](env, "LinkAccount", &pb.LinkAccountRequest{
+		ServerAddr: env.addr,
+		AuthCode:   "workcode",
+	})
+	if got, want := len(linkResp.UserInfo.Accounts), 2; got != want {
+		t.Fatalf("Got %d accounts, wanted %d", got, want)
+	}
+	if got, want := linkResp.UserInfo.DefaultStid, userInfo.DefaultStid; got != want {
+		t.Errorf("Got default stream %d, wanted %d", got, want)
+	}
+
+	// Both accounts see the same statuses on the test server.
+	fetched := int64(0)
+	for count := 0; ; count++ {
+		resp := MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{
+			Stid: userInfo.DefaultStid,
+		})
+		fetched += resp.FetchedCount
+		if resp.Status == pb.FetchResponse_DONE {
+			break
+		}
+		if count > 10 {
+			t.Fatal("infinite fetch detected")
+		}
+	}
+	if got, want := fetched, int64(8); got != want {
+		t.Errorf("Fetched %d statuses, wanted %d", got, want)
+	}
+
+	// ... but they appear only once in the stream.
+	listResp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_FORWARD,
+	})
+	if got, want := len(listResp.Items), 4; got != want {
+		t.Fatalf("Got %d statuses, wanted %d", got, want)
+	}
+	for _, item := range listResp.Items {
+		var seenBy []string
+		for _, account := range item.SeenBy {
+			seenBy = append(seenBy, account.AccountId)
+		}
+		if diff := cmp.Diff([]string{"14715", "777"}, seenBy); diff != "" {
+			t.Errorf("Seen by mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	// Statuses can be updated through any account which got them.
+	status := MustUnmarshal[mastodon.Status](t, []byte(listResp.Items[0].Status.Content))
+	MustCall[pb.SetStatusResponse](env, "SetStatus", &pb.SetStatusRequest{
+		StatusId: string(status.ID),
+		Action:   pb.SetStatusRequest_REFRESH,
+		Account:  listResp.Items[0].SeenBy[1],
+	})
+
+	// Accounts cannot be moved between users.
+	env.client.Jar, _ = cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	env.mastodonServer.AddAccount("othercode", "888", "other")
+	MustCall[pb.AuthorizeResponse](env, "Authorize", &pb.AuthorizeRequest{
+		ServerAddr: env.addr,
+		InviteCode: "invite1",
+	})
+	MustCall[pb.TokenResponse](env, "Token", &pb.TokenRequest{
+		ServerAddr: env.addr,
+		AuthCode:   "othercode",
+	})
+	httpResp := MustRequest(env, "LinkAccount", &pb.LinkAccountRequest{
+		ServerAddr: env.addr,
+		AuthCode:   "workcode",
+	})
+	if got, want := httpResp.StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("Got status %v, want %v; body=%s", got, want, MustBody(t, httpResp))
+	}
+}
+
+func TestRecomputeMeta(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t: t,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	status1, err := env.mastodonServer.AddFakeStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.mastodonServer.SetStatusContent(status1.ID, "<p>About the election</p>"); err != nil {
+		t.Fatal(err)
+	}
+	status2, err := env.mastodonServer.AddFakeStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{Stid: userInfo.DefaultStid})
+
+	// The filter is created after the statuses were fetched - and after
+	// filters were obtained.
+	env.mastodonServer.AddFilter("Politics", "hide", "election")
+
+	client := mastopoofconnect.NewMastopoofClient(env.client, env.addr+"/_rpc")
+	stream, err := client.RecomputeMeta(ctx, connect.NewRequest(&pb.RecomputeMetaRequest{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	var last *pb.RecomputeMetaResponse
+	for stream.Receive() {
+		last = stream.Msg()
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// The pool is already matched again when the new filters are obtained.
+	want := &pb.RecomputeMetaResponse{Total: 2, Processed: 2, Updated: 0, Done: true}
+	if diff := cmp.Diff(want, last, protocmp.Transform()); diff != "" {
+		t.Errorf("Last progress mismatch (-want +got):\n%s", diff)
+	}
+
+	resp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_FORWARD,
+	})
+	var got []mastodon.ID
+	for _, item := range resp.Items {
+		got = append(got, MustUnmarshal[mastodon.Status](t, []byte(item.Status.Content)).ID)
+	}
+	if diff := cmp.Diff([]mastodon.ID{status2.ID}, got); diff != "" {
+		t.Errorf("Statuses mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestExportUser(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t:             t,
+		StatusesCount: 3,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+	MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{Stid: userInfo.DefaultStid})
+
+	resp := MustCall[pb.ExportUserResponse](env, "ExportUser", &pb.ExportUserRequest{})
+	archive := resp.Archive
+	if got, want := archive.GetUserState().GetDefaultStid(), userInfo.DefaultStid; got != want {
+		t.Errorf("Got default stream %d, wanted %d", got, want)
+	}
+	if len(archive.AccountStates) != 1 || archive.AccountStates[0].AccessToken != "" {
+		t.Errorf("Expected a single account without access token, got %v", archive.AccountStates)
+	}
+	if got, want := len(archive.Statuses), 3; got != want {
+		t.Errorf("Got %d statuses, wanted %d", got, want)
+	}
+}
+
+// TestDisabledUserSession verifies that a session surviving the disabling of
+// its user - e.g., saved by a request in flight at that time - is refused.
+func TestDisabledUserSession(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t: t,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+	streamState, err := env.server.st.StreamState(ctx, nil, types.StID(userInfo.DefaultStid))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Disable the user, without revoking its sessions.
+	userState, err := env.server.st.UserState(ctx, nil, types.UID(streamState.Uid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	userState.Disabled = true
+	if err := env.server.st.SetUserState(ctx, nil, userState); err != nil {
+		t.Fatal(err)
+	}
+
+	listReq := &pb.ListRequest{Stid: userInfo.DefaultStid, Direction: pb.ListRequest_FORWARD}
+	if got, want := MustRequest(env, "List", listReq), http.StatusForbidden; got.StatusCode != want {
+		t.Errorf("Got status %s, want %v", got.Status, want)
+	}
+}
+
+func TestDisableUser(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t: t,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+	streamState, err := env.server.st.StreamState(ctx, nil, types.StID(userInfo.DefaultStid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := types.UID(streamState.Uid)
+
+	// Disabling the user logs it out.
+	if err := env.server.st.SetUserDisabled(ctx, uid, true); err != nil {
+		t.Fatal(err)
+	}
+	fetchReq := &pb.FetchRequest{Stid: userInfo.DefaultStid}
+	if got, want := MustRequest(env, "Fetch", fetchReq), http.StatusForbidden; got.StatusCode != want {
+		t.Errorf("Got status %s, want %v", got.Status, want)
+	}
+
+	// ... and it cannot login again.
+	MustCall[pb.AuthorizeResponse](env, "Authorize", &pb.AuthorizeRequest{
+		ServerAddr: env.addr,
+	})
+	tokenReq := &pb.TokenRequest{
+		ServerAddr: env.addr,
+		AuthCode:   "foo",
+	}
+	if got, want := MustRequest(env, "Token", tokenReq), http.StatusForbidden; got.StatusCode != want {
+		t.Errorf("Got status %s, want %v", got.Status, want)
+	}
+
+	// Until it is enabled again; no invite code is needed for an existing user.
+	if err := env.server.st.SetUserDisabled(ctx, uid, false); err != nil {
+		t.Fatal(err)
+	}
+	MustCall[pb.TokenResponse](env, "Token", tokenReq)
+	MustCall[pb.FetchResponse](env, "Fetch", fetchReq)
+}
+
+func TestWatchStream(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t:             t,
+		StatusesCount: 5,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+	MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{Stid: userInfo.DefaultStid})
+
+	// Server streaming RPCs need a real Connect client. It shares the cookies
+	// of the test client, and thus its session.
+	client := mastopoofconnect.NewMastopoofClient(env.client, env.addr+"/_rpc")
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.WatchStream(watchCtx, connect.NewRequest(&pb.WatchStreamRequest{Stid: userInfo.DefaultStid}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	// Waits for a stream info matching the condition.
+	waitInfo := func(desc string, cond func(*pb.StreamInfo) bool) {
+		t.Helper()
+		for stream.Receive() {
+			if cond(stream.Msg().StreamInfo) {
+				return
+			}
+		}
+		t.Fatalf("stream ended while waiting for %s: %v", desc, stream.Err())
+	}
+
+	// Current state is sent immediately.
+	waitInfo("initial state", func(info *pb.StreamInfo) bool { return info.RemainingPool == 5 })
+
+	// Changes done from another client are sent.
+	listResp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_FORWARD,
+	})
+	waitInfo("listed statuses", func(info *pb.StreamInfo) bool {
+		return info.LastPosition == listResp.StreamInfo.LastPosition && info.RemainingPool == 0
+	})
+
+	MustCall[pb.SetReadResponse](env, "SetRead", &pb.SetReadRequest{
+		Stid:     userInfo.DefaultStid,
+		LastRead: 3,
+		Mode:     pb.SetReadRequest_ABSOLUTE,
+	})
+	waitInfo("read marker", func(info *pb.StreamInfo) bool { return info.LastRead == 3 })
+
+	if _, err := env.mastodonServer.AddFakeStatus(); err != nil {
+		t.Fatal(err)
+	}
+	MustCall[pb.FetchResponse](env, "Fetch", &pb.FetchRequest{Stid: userInfo.DefaultStid})
+	waitInfo("new status", func(info *pb.StreamInfo) bool { return info.RemainingPool == 1 })
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/Palats/mastopoof/backend/storage"
+	"github.com/golang/glog"
+)
+
+// Snapshotter regularly writes a backup of the database in a directory,
+// keeping only the most recent ones.
+type Snapshotter struct {
+	st storage.Store
+	// Delay between two snapshots.
+	interval time.Duration
+	dir      string
+	// Number of snapshots to keep in dir.
+	keep int
+}
+
+func NewSnapshotter(st storage.Store, interval time.Duration, dir string, keep int) *Snapshotter {
+	return &Snapshotter{
+		st:       st,
+		interval: interval,
+		dir:      dir,
+		keep:     keep,
+	}
+}
+
+// Run takes snapshots regularly, until the context is cancelled. The first
+// snapshot happens after one interval, to not slow down startup.
+func (s *Snapshotter) Run(ctx context.Context) error {
+	glog.Infof("Background snapshots every %v in %s (keeping %d)", s.interval, s.dir, s.keep)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.interval):
+		}
+		s.RunOnce(ctx)
+	}
+}
+
+// RunOnce takes a single snapshot.
+func (s *Snapshotter) RunOnce(ctx context.Context) {
+	path, err := s.st.Snapshot(ctx, s.dir, s.keep)
+	if err != nil {
+		glog.Errorf("background snapshot failed: %v", err)
+		return
+	}
+	glog.Infof("Background snapshot written to %s", path)
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Palats/mastopoof/backend/storage"
+	"github.com/Palats/mastopoof/backend/types"
+	"github.com/golang/glog"
+	"github.com/mattn/go-mastodon"
+
+	pb "github.com/Palats/mastopoof/proto/gen/mastopoof"
+	stpb "github.com/Palats/mastopoof/proto/gen/mastopoof/storage"
+)
+
+// Streamer gets new statuses through the Mastodon streaming API, for all
+// accounts of all users. It is a complement to the paginated fetch, which is
+// still used to catch up when the streaming connection is (re)established.
+// Only streams following the home timeline are fed from streaming.
+type Streamer struct {
+	s *Server
+	// Delay between two checks for newly linked accounts.
+	rescanInterval time.Duration
+}
+
+func NewStreamer(s *Server, rescanInterval time.Duration) *Streamer {
+	return &Streamer{
+		s:              s,
+		rescanInterval: rescanInterval,
+	}
+}
+
+// activeStream is a streaming connection started by Run.
+type activeStream struct {
+	cancel context.CancelFunc
+	// Access token the connection was started with.
+	accessToken string
+	// Closed when the connection is over.
+	done chan struct{}
+}
+
+// Run keeps a streaming connection to Mastodon for each known account, until
+// the context is cancelled. It waits for all connections to be closed before
+// returning.
+// On each rescan, connections which stopped are started again, and those of
+// accounts which were removed, disabled or got a new access token are
+// cancelled.
+func (sr *Streamer) Run(ctx context.Context) error {
+	glog.Infof("Streaming from Mastodon (rescan every %v)", sr.rescanInterval)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	active := map[types.ASID]*activeStream{}
+	defer func() {
+		for _, as := range active {
+			as.cancel()
+		}
+	}()
+	for {
+		if err := sr.rescan(ctx, &wg, active); err != nil {
+			glog.Errorf("streaming: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sr.rescanInterval):
+		}
+	}
+}
+
+// rescan starts and cancels streaming connections, based on the accounts
+// currently in storage.
+func (sr *Streamer) rescan(ctx context.Context, wg *sync.WaitGroup, active map[types.ASID]*activeStream) error {
+	userEntries, err := sr.s.st.ListUsers(ctx)
+	if err != nil {
+		// Keep existing connections - it might just be a transient failure.
+		return fmt.Errorf("unable to list users: %w", err)
+	}
+
+	// Accounts which should be streamed, with the user they belong to.
+	wanted := map[types.ASID]*stpb.AccountState{}
+	uids := map[types.ASID]types.UID{}
+	for _, userEntry := range userEntries {
+		if userEntry.UserState.Disabled {
+			continue
+		}
+		uid := types.UID(userEntry.UserState.Uid)
+		accountStates, err := sr.s.st.AllAccountStateByUID(ctx, nil, uid)
+		if err != nil {
+			return fmt.Errorf("unable to list accounts of user %d: %w", uid, err)
+		}
+		for _, accountState := range accountStates {
+			// E.g., imported without tokens; the user must log in again.
+			if accountState.AccessToken == "" {
+				continue
+			}
+			asid := types.ASID(accountState.Asid)
+			wanted[asid] = accountState
+			uids[asid] = uid
+		}
+	}
+
+	for asid, as := range active {
+		select {
+		case <-as.done:
+			// The connection stopped by itself - e.g., it could not be
+			// established. It is restarted below.
+			delete(active, asid)
+			continue
+		default:
+		}
+		if accountState, ok := wanted[asid]; !ok || accountState.AccessToken != as.accessToken {
+			glog.Infof("streaming: stopping connection for asid=%d", asid)
+			as.cancel()
+			delete(active, asid)
+		}
+	}
+
+	for asid, accountState := range wanted {
+		if active[asid] != nil {
+			continue
+		}
+		accountCtx, cancel := context.WithCancel(ctx)
+		as := &activeStream{
+			cancel:      cancel,
+			accessToken: accountState.AccessToken,
+			done:        make(chan struct{}),
+		}
+		active[asid] = as
+		uid := uids[asid]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(as.done)
+			defer cancel()
+			sr.streamAccount(accountCtx, uid, accountState)
+		}()
+	}
+	return nil
+}
+
+// streamAccount processes events from the streaming API of a single account,
+// until the context is cancelled.
+func (sr *Streamer) streamAccount(ctx context.Context, uid types.UID, accountState *stpb.AccountState) {
+	asid := types.ASID(accountState.Asid)
+	appRegState, err := sr.s.appRegistry.Register(ctx, accountState.ServerAddr, sr.s.selfURL)
+	if err != nil {
+		glog.Errorf("streaming: unable to register app for asid=%d: %v", asid, err)
+		return
+	}
+	client := sr.s.appRegistry.MastodonClient(appRegState, accountState.AccessToken)
+
+	filters, err := sr.s.accountFilters(ctx, accountState, client)
+	if err != nil {
+		glog.Errorf("streaming: unable to get filters for asid=%d: %v", asid, err)
+		return
+	}
+
+	// The client reconnects by itself on errors, reporting them as events.
+	events, err := client.StreamingUser(ctx)
+	if err != nil {
+		glog.Errorf("streaming: unable to connect for asid=%d: %v", asid, err)
+		return
+	}
+	glog.Infof("streaming: connected for asid=%d", asid)
+
+	// Statuses published while not connected are obtained through the
+	// paginated fetch. Any overlap with streamed statuses is harmless.
+	sr.catchUp(ctx, uid)
+	needCatchUp := false
+
+	for ev := range events {
+		if e, ok := ev.(*mastodon.ErrorEvent); ok {
+			glog.Errorf("streaming: error for asid=%d: %v", asid, e.Error())
+			needCatchUp = true
+			continue
+		}
+		if needCatchUp {
+			// Getting an event means the connection is working again.
+			sr.catchUp(ctx, uid)
+			needCatchUp = false
+		}
+		// The connection can last for long; filters might have been changed on
+		// Mastodon in the meantime.
+		if f, err := sr.s.accountFilters(ctx, accountState, client); err != nil {
+			glog.Errorf("streaming: unable to refresh filters for asid=%d, keeping previous ones: %v", asid, err)
+		} else {
+			filters = f
+		}
+		if err := sr.handleEvent(ctx, uid, asid, filters, ev); err != nil {
+			glog.Errorf("streaming: unable to process event for asid=%d: %v", asid, err)
+		}
+	}
+	glog.Infof("streaming: disconnected for asid=%d", asid)
+}
+
+// handleEvent updates the storage based on a single streaming event.
+func (sr *Streamer) handleEvent(ctx context.Context, uid types.UID, asid types.ASID, filters []*stpb.MastodonFilter, ev mastodon.Event) error {
+	switch e := ev.(type) {
+	case *mastodon.UpdateEvent:
+		return sr.s.st.InTxnRW(ctx, func(ctx context.Context, txn storage.SQLReadWrite) error {
+			streamStates, err := sr.s.st.StreamStatesByUID(ctx, txn, uid)
+			if err != nil {
+				return err
+			}
+			for _, streamState := range streamStates {
+				if streamState.GetSource().GetKind() != stpb.StreamSource_HOME {
+					continue
+				}
+				// InsertStatuses updates streamState IN PLACE and persists it.
+				if err := sr.s.st.InsertStatuses(ctx, txn, asid, streamState, []*mastodon.Status{e.Status}, filters); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	case *mastodon.UpdateEditEvent:
+		err := sr.s.st.UpdateStatus(ctx, nil, asid, e.Status, filters)
+		if errors.Is(err, storage.ErrNotFound) {
+			// Edit of a status which was never fetched - nothing to update.
+			return nil
+		}
+		return err
+	case *mastodon.DeleteEvent:
+		return sr.s.st.DeleteStatus(ctx, nil, asid, e.ID)
+	case *mastodon.NotificationEvent:
+		return sr.s.st.InTxnRW(ctx, func(ctx context.Context, txn storage.SQLReadWrite) error {
+			if err := sr.s.st.InsertNotifications(ctx, txn, asid, []*mastodon.Notification{e.Notification}); err != nil {
+				return err
+			}
+			_, err := sr.s.updateNotificationsCount(ctx, txn, uid)
+			return err
+		})
+	default:
+		glog.V(1).Infof("streaming: ignoring event %T for asid=%d", ev, asid)
+		return nil
+	}
+}
+
+// catchUp fetches all home timeline streams of the user through the
+// paginated API.
+func (sr *Streamer) catchUp(ctx context.Context, uid types.UID) {
+	streamStates, err := sr.s.st.StreamStatesByUID(ctx, nil, uid)
+	if err != nil {
+		glog.Errorf("streaming: unable to list streams of user %d: %v", uid, err)
+		return
+	}
+	for _, streamState := range streamStates {
+		if streamState.GetSource().GetKind() != stpb.StreamSource_HOME {
+			continue
+		}
+		stid := types.StID(streamState.Stid)
+		if err := sr.catchUpStream(ctx, stid); err != nil {
+			glog.Errorf("streaming: unable to catch up on stream %d: %v", stid, err)
+		}
+	}
+}
+
+func (sr *Streamer) catchUpStream(ctx context.Context, stid types.StID) error {
+	for round := 0; round < maxFetchRounds; round++ {
+		resp, err := sr.s.fetchStream(ctx, stid)
+		if err != nil {
+			return err
+		}
+		if resp.Status != pb.FetchResponse_MORE {
+			return nil
+		}
+	}
+	return fmt.Errorf("still more statuses after %d rounds", maxFetchRounds)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Palats/mastopoof/backend/types"
+	"github.com/mattn/go-mastodon"
+
+	pb "github.com/Palats/mastopoof/proto/gen/mastopoof"
+)
+
+// waitFor polls until the condition is true, failing the test after a while.
+func waitFor(t testing.TB, desc string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", desc)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamer(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{
+		t:             t,
+		StatusesCount: 5,
+	}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	remaining := func() int64 {
+		resp := MustCall[pb.ListStreamsResponse](env, "ListStreams", &pb.ListStreamsRequest{})
+		return resp.Streams[0].RemainingPool
+	}
+
+	// The streaming connection must be closed before the test servers.
+	streamCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	streamer := NewStreamer(env.server, time.Minute)
+	go func() {
+		streamer.Run(streamCtx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Existing statuses are obtained by catching up.
+	waitFor(t, "streaming connection", func() bool { return env.mastodonServer.StreamingClients() > 0 })
+	waitFor(t, "catch up", func() bool { return remaining() == 5 })
+
+	// New statuses arrive without any fetch.
+	status, err := env.mastodonServer.AddFakeStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "new status", func() bool { return remaining() == 6 })
+
+	// Edits are reflected in the cache.
+	if err := env.mastodonServer.SetStatusContent(status.ID, "edited content"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "edited status", func() bool {
+		resp := MustCall[pb.SearchResponse](env, "Search", &pb.SearchRequest{StatusId: string(status.ID)})
+		if len(resp.Items) != 1 {
+			return false
+		}
+		s := MustUnmarshal[mastodon.Status](t, []byte(resp.Items[0].Status.Content))
+		return s.Content == "edited content"
+	})
+
+	// Deleted statuses are removed from the pool.
+	if err := env.mastodonServer.DeleteStatus(status.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "deleted status", func() bool { return remaining() == 5 })
+
+	listResp := MustCall[pb.ListResponse](env, "List", &pb.ListRequest{
+		Stid:      userInfo.DefaultStid,
+		Direction: pb.ListRequest_FORWARD,
+	})
+	for _, item := range listResp.Items {
+		s := MustUnmarshal[mastodon.Status](t, []byte(item.Status.Content))
+		if s.ID == status.ID {
+			t.Errorf("Deleted status %v was still listed", s.ID)
+		}
+	}
+}
+
+func TestStreamerDisabledUser(t *testing.T) {
+	ctx := context.Background()
+	env := (&TestEnv{t: t}).Init(ctx)
+	defer env.Close()
+	userInfo := env.FullLogin()
+
+	streamState, err := env.server.st.StreamState(ctx, nil, types.StID(userInfo.DefaultStid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := types.UID(streamState.Uid)
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	streamer := NewStreamer(env.server, 10*time.Millisecond)
+	go func() {
+		streamer.Run(streamCtx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	waitFor(t, "streaming connection", func() bool { return env.mastodonServer.StreamingClients() == 1 })
+
+	// Connections of disabled users are closed on next rescan...
+	if err := env.server.st.SetUserDisabled(ctx, uid, true); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "closed connection", func() bool { return env.mastodonServer.StreamingClients() == 0 })
+
+	// ... and started again once the user is enabled.
+	if err := env.server.st.SetUserDisabled(ctx, uid, false); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "new connection", func() bool { return env.mastodonServer.StreamingClients() == 1 })
+
+	// Deleted users are no longer streamed.
+	if err := env.server.st.DeleteUser(ctx, uid); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "closed connection", func() bool { return env.mastodonServer.StreamingClients() == 0 })
+}
@@ -0,0 +1,259 @@
+// This file contains the export and import of the whole state of a user -
+// e.g., to move them to another Mastopoof instance.
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Palats/mastopoof/backend/types"
+	stpb "github.com/Palats/mastopoof/proto/gen/mastopoof/storage"
+	"github.com/mattn/go-mastodon"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrAlreadyExists is returned when importing data which conflicts with what
+// is already in the database.
+var ErrAlreadyExists = errors.New("already exists")
+
+// ExportUser returns everything known about the user: its state, Mastodon
+// accounts, streams and cached statuses. Notifications are not included, as
+// they can be fetched again from Mastodon.
+// Access tokens of the accounts are only included if `withTokens` is set.
+func (st *Storage) ExportUser(ctx context.Context, uid types.UID, withTokens bool) (_ *stpb.UserArchive, retErr error) {
+	defer recordAction("export-user")(retErr)
+	archive := &stpb.UserArchive{
+		ExportSecs: time.Now().Unix(),
+	}
+	err := st.InTxnRO(ctx, func(ctx context.Context, txn SQLReadOnly) error {
+		var err error
+		archive.UserState, err = st.UserState(ctx, txn, uid)
+		if err != nil {
+			return err
+		}
+		archive.AccountStates, err = st.AllAccountStateByUID(ctx, txn, uid)
+		if err != nil {
+			return err
+		}
+		if !withTokens {
+			for _, accountState := range archive.AccountStates {
+				accountState.AccessToken = ""
+			}
+		}
+		archive.StreamStates, err = st.StreamStatesByUID(ctx, txn, uid)
+		if err != nil {
+			return err
+		}
+
+		rows, err := txn.Query(ctx, "export-user-statuses", `
+			SELECT
+				statuses.sid,
+				statuses.asid,
+				statuses.status,
+				statuses.status_meta
+			FROM
+				statuses
+				JOIN accountstate USING (asid)
+			WHERE accountstate.uid = ?
+			ORDER BY statuses.sid
+			;
+		`, uid)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			status := &stpb.UserArchive_Status{
+				StatusMeta: &stpb.StatusMeta{},
+			}
+			if err := rows.Scan(&status.Sid, &status.Asid, &status.Status, types.SQLProto{status.StatusMeta}); err != nil {
+				return err
+			}
+			archive.Statuses = append(archive.Statuses, status)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		for _, streamState := range archive.StreamStates {
+			rows, err := txn.Query(ctx, "export-user-streamcontent", `
+				SELECT
+					sid,
+					position,
+					stream_status_state
+				FROM streamcontent
+				WHERE stid = ?
+				ORDER BY sid
+				;
+			`, streamState.Stid)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				content := &stpb.UserArchive_StreamContent{
+					Stid:              streamState.Stid,
+					StreamStatusState: &stpb.StreamStatusState{},
+				}
+				var position sql.NullInt64
+				if err := rows.Scan(&content.Sid, &position, types.SQLProto{content.StreamStatusState}); err != nil {
+					rows.Close()
+					return err
+				}
+				content.Position = position.Int64
+				archive.StreamContent = append(archive.StreamContent, content)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// ImportUser creates a new user from an archive obtained with ExportUser.
+// All IDs are allocated again in this database. It fails with
+// ErrAlreadyExists if one of the Mastodon accounts of the archive is already
+// known here.
+func (st *Storage) ImportUser(ctx context.Context, archive *stpb.UserArchive) (_ *stpb.UserState, retErr error) {
+	defer recordAction("import-user")(retErr)
+	if archive.GetUserState() == nil || len(archive.AccountStates) == 0 {
+		return nil, errors.New("invalid archive: missing user or accounts")
+	}
+
+	var userState *stpb.UserState
+	err := st.InTxnRW(ctx, func(ctx context.Context, txn SQLReadWrite) error {
+		created, err := st.CreateUserState(ctx, txn)
+		if err != nil {
+			return err
+		}
+		userState = proto.Clone(archive.UserState).(*stpb.UserState)
+		userState.Uid = created.Uid
+
+		asids := map[int64]int64{}
+		for _, src := range archive.AccountStates {
+			_, err := st.AccountStateByAccountID(ctx, txn, src.ServerAddr, mastodon.ID(src.AccountId))
+			if err == nil {
+				return fmt.Errorf("account %s on %s: %w", src.AccountId, src.ServerAddr, ErrAlreadyExists)
+			}
+			if !errors.Is(err, ErrNotFound) {
+				return err
+			}
+			created, err := st.CreateAccountState(ctx, txn, types.UID(userState.Uid), src.ServerAddr, mastodon.ID(src.AccountId), src.Username)
+			if err != nil {
+				return err
+			}
+			accountState := proto.Clone(src).(*stpb.AccountState)
+			accountState.Asid = created.Asid
+			accountState.Uid = userState.Uid
+			if err := st.SetAccountState(ctx, txn, accountState); err != nil {
+				return err
+			}
+			asids[src.Asid] = accountState.Asid
+		}
+
+		stids := map[int64]int64{}
+		for _, src := range archive.StreamStates {
+			created, err := st.CreateStreamState(ctx, txn, types.UID(userState.Uid))
+			if err != nil {
+				return err
+			}
+			streamState := proto.Clone(src).(*stpb.StreamState)
+			streamState.Stid = created.Stid
+			streamState.Uid = userState.Uid
+			if err := st.SetStreamState(ctx, txn, streamState); err != nil {
+				return err
+			}
+			stids[src.Stid] = streamState.Stid
+		}
+		if stid, ok := stids[userState.DefaultStid]; ok {
+			userState.DefaultStid = stid
+		} else {
+			return fmt.Errorf("invalid archive: default stream %d not found", userState.DefaultStid)
+		}
+		if err := st.SetUserState(ctx, txn, userState); err != nil {
+			return err
+		}
+
+		type importedStatus struct {
+			sid    types.SID
+			status *mastodon.Status
+		}
+		sids := map[int64]importedStatus{}
+		for _, src := range archive.Statuses {
+			asid, ok := asids[src.Asid]
+			if !ok {
+				return fmt.Errorf("invalid archive: status %d refers to unknown asid %d", src.Sid, src.Asid)
+			}
+			statusMeta := src.GetStatusMeta()
+			if statusMeta == nil {
+				statusMeta = &stpb.StatusMeta{}
+			}
+			status := &mastodon.Status{}
+			if err := json.Unmarshal([]byte(src.Status), status); err != nil {
+				return fmt.Errorf("invalid archive: status %d: %w", src.Sid, err)
+			}
+			var sid types.SID
+			err := txn.QueryRow(ctx, "import-user-status", `
+				INSERT INTO statuses(asid, status, status_meta) VALUES(?, ?, ?) RETURNING sid;
+			`, asid, &types.SQLStatus{*status}, types.SQLProto{statusMeta}).Scan(&sid)
+			if err != nil {
+				return err
+			}
+			if err := st.indexStatus(ctx, txn, sid, status); err != nil {
+				return err
+			}
+			sids[src.Sid] = importedStatus{sid: sid, status: status}
+		}
+
+		for _, src := range archive.StreamContent {
+			stid, ok := stids[src.Stid]
+			if !ok {
+				return fmt.Errorf("invalid archive: stream content refers to unknown stid %d", src.Stid)
+			}
+			imported, ok := sids[src.Sid]
+			if !ok {
+				return fmt.Errorf("invalid archive: stream content refers to unknown sid %d", src.Sid)
+			}
+			streamStatusState := &stpb.StreamStatusState{}
+			if src.StreamStatusState != nil {
+				streamStatusState = proto.Clone(src.StreamStatusState).(*stpb.StreamStatusState)
+			}
+			for i, asid := range streamStatusState.SeenBy {
+				streamStatusState.SeenBy[i] = asids[asid]
+			}
+			var position sql.NullInt64
+			if src.Position != 0 {
+				position = sql.NullInt64{Int64: src.Position, Valid: true}
+			}
+			status := imported.status
+			var reblogID mastodon.ID
+			var reblogURI string
+			if status.Reblog != nil {
+				reblogID = status.Reblog.ID
+				reblogURI = status.Reblog.URI
+			}
+			_, err := txn.Exec(ctx, "import-user-streamcontent", `
+				INSERT INTO streamcontent(stid, sid, position, status_id, status_reblog_id, status_in_reply_to_id, status_uri, status_reblog_uri, stream_status_state)
+					VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?);
+			`, stid, imported.sid, position, status.ID, reblogID, status.InReplyToID, status.URI, reblogURI, types.SQLProto{streamStatusState})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return userState, nil
+}
@@ -0,0 +1,136 @@
+// This file contains what differs between the database engines supported by
+// Mastopoof - SQLite and PostgreSQL.
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/alexedwards/scs/sqlite3store"
+	"github.com/alexedwards/scs/v2"
+)
+
+// Names of the database engines.
+const (
+	backendSQLite   = "sqlite"
+	backendPostgres = "postgres"
+)
+
+// backend is the engine specific part of Storage. Storage logic is shared
+// between engines: statements are written in SQLite dialect and the backend
+// translates them if needed.
+type backend interface {
+	// name is one of backendSQLite or backendPostgres.
+	name() string
+	// rewrite returns the version of `query` to run on this engine. `query`
+	// is the SQLite version of the statement, whose engine specific parts come
+	// from the dialect.
+	rewrite(query string) string
+	// dialect contains the SQL fragments used to assemble statements.
+	dialect() *dialect
+	// prepare creates the schema or updates it to `targetVersion`.
+	prepare(ctx context.Context, db *sql.DB, targetVersion int) error
+	// currentVersion returns the schema version of the database.
+	currentVersion(ctx context.Context, db *sql.DB) (int, error)
+	// maxVersion is the most recent schema version known for this engine.
+	// Schema versions of different engines are unrelated.
+	maxVersion() int
+	// steps are the schema updates of this engine; steps[v] goes from
+	// version v to v+1.
+	steps() []UpdateStep
+	// revert undoes steps[version-1], to go back to the previous version.
+	revert(ctx context.Context, db *sql.DB, version int) error
+	// sessionStore keeps HTTP sessions in the database.
+	sessionStore(db *sql.DB) scs.Store
+	// rwTxOptions are the options of read-write transactions.
+	rwTxOptions() *sql.TxOptions
+	// isConflict indicates whether a transaction failed because of a
+	// concurrent one, and can be attempted again.
+	isConflict(err error) bool
+}
+
+// dialect contains SQL expressions which differ between engines and are used
+// in statements built from multiple parts.
+type dialect struct {
+	// statusHidden is the SQL equivalent of statusHidden(), for queries on the
+	// `statuses` table.
+	statusHidden string
+	// ruleHidden is true for statuses of `streamcontent` hidden by a local
+	// filter rule.
+	ruleHidden string
+	// jsonText, jsonInt and jsonBool extract the field at `path` - e.g.,
+	// `$.reblog.favourited` - of a JSON column, as TEXT, BIGINT and boolean.
+	// Missing fields and JSON nulls are NULL.
+	jsonText func(column string, path string) string
+	jsonInt  func(column string, path string) string
+	jsonBool func(column string, path string) string
+	// unixTime converts a timestamp as found in Mastodon JSON to seconds since
+	// epoch.
+	unixTime func(expr string) string
+	// indexStatus sets the full text index entry of a status - see
+	// indexStatusSQL.
+	indexStatus string
+	// search contains the expressions used by Search.
+	search searchDialect
+}
+
+// poolHidden is true for statuses of the pool which are never added to the
+// stream, either because of Mastodon filters or of local filter rules.
+func (d *dialect) poolHidden() string {
+	return `(` + d.statusHidden + ` OR ` + d.ruleHidden + `)`
+}
+
+var sqliteDialect = &dialect{
+	statusHidden: statusHiddenSQL,
+	ruleHidden:   ruleHiddenSQL,
+	jsonText: func(column string, path string) string {
+		return fmt.Sprintf("json_extract(%s, '%s')", column, path)
+	},
+	jsonInt: func(column string, path string) string {
+		// int64 are strings in protobuf JSON.
+		return fmt.Sprintf("CAST(json_extract(%s, '%s') AS INTEGER)", column, path)
+	},
+	// JSON booleans are extracted as 0 and 1.
+	jsonBool: func(column string, path string) string {
+		return fmt.Sprintf("json_extract(%s, '%s')", column, path)
+	},
+	unixTime: func(expr string) string {
+		return "unixepoch(" + expr + ")"
+	},
+	indexStatus: indexStatusSQL,
+	search:      sqliteSearch,
+}
+
+// sqliteBackend is the default backend; statements need no translation.
+type sqliteBackend struct{}
+
+func (sqliteBackend) name() string { return backendSQLite }
+
+func (sqliteBackend) rewrite(query string) string { return query }
+
+func (sqliteBackend) dialect() *dialect { return sqliteDialect }
+
+func (sqliteBackend) prepare(ctx context.Context, db *sql.DB, targetVersion int) error {
+	return prepareDB(ctx, db, targetVersion)
+}
+
+func (sqliteBackend) currentVersion(ctx context.Context, db *sql.DB) (int, error) {
+	return getCurrentVersion(ctx, db)
+}
+
+func (sqliteBackend) maxVersion() int { return maxSchemaVersion }
+
+func (sqliteBackend) steps() []UpdateStep { return allSteps }
+
+// Write transactions are already serialized by SQLite, as it locks the
+// database file.
+func (sqliteBackend) rwTxOptions() *sql.TxOptions { return nil }
+
+func (sqliteBackend) isConflict(err error) bool { return false }
+
+func (sqliteBackend) revert(ctx context.Context, db *sql.DB, version int) error {
+	return revertDBSingleStep(ctx, db, allSteps[version-1], version)
+}
+
+func (sqliteBackend) sessionStore(db *sql.DB) scs.Store { return sqlite3store.New(db) }
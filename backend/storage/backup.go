@@ -0,0 +1,254 @@
+// This file contains online backups of the database, and their restoration.
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrDBInUse is returned when restoring a database which is opened by
+// another Storage - e.g., a running server.
+var ErrDBInUse = errors.New("database is in use")
+
+// snapshotPrefix and snapshotSuffix surround the timestamp in the name of
+// snapshot files. The timestamp format sorts chronologically.
+const (
+	snapshotPrefix     = "mastopoof-"
+	snapshotSuffix     = ".db"
+	snapshotTimeFormat = "20060102-150405"
+)
+
+// Backup writes a consistent copy of the database to `path`, while the
+// database is in use. The copy is written to a temporary file first, so
+// `path` is never a partial backup. `path` must not already exist.
+// Only SQLite databases are supported.
+func (st *Storage) Backup(ctx context.Context, path string) (retErr error) {
+	defer recordAction("backup")(retErr)
+	if st.backend.name() != backendSQLite {
+		return errors.New("PostgreSQL databases must be backed up with PostgreSQL tools, e.g., pg_dump")
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("backup file %s already exists", path)
+	}
+	tmpPath := path + ".tmp"
+	// VACUUM INTO refuses to write to an existing file; it might be left over
+	// from an interrupted backup.
+	if err := os.Remove(tmpPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if _, err := st.rwDB.ExecContext(ctx, "VACUUM INTO ?;", tmpPath); err != nil {
+		return fmt.Errorf("unable to backup to %s: %w", tmpPath, err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Snapshot writes a backup of the database in `dir`, named after the current
+// time. Only the `keep` most recent snapshots of the directory are kept; older
+// ones are removed. It returns the path of the new snapshot.
+func (st *Storage) Snapshot(ctx context.Context, dir string, keep int) (string, error) {
+	if keep < 1 {
+		return "", fmt.Errorf("at least one snapshot must be kept, got %d", keep)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, snapshotPrefix+time.Now().UTC().Format(snapshotTimeFormat)+snapshotSuffix)
+	if err := st.Backup(ctx, path); err != nil {
+		return "", err
+	}
+
+	snapshots, err := ListSnapshots(dir)
+	if err != nil {
+		return "", err
+	}
+	for len(snapshots) > keep {
+		if err := os.Remove(snapshots[0]); err != nil {
+			return "", err
+		}
+		snapshots = snapshots[1:]
+	}
+	return path, nil
+}
+
+// ListSnapshots returns the paths of the snapshots found in `dir`, oldest
+// first.
+func ListSnapshots(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+		timestamp := strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix)
+		if _, err := time.Parse(snapshotTimeFormat, timestamp); err != nil {
+			continue
+		}
+		snapshots = append(snapshots, filepath.Join(dir, name))
+	}
+	slices.Sort(snapshots)
+	return snapshots, nil
+}
+
+// CheckBackup verifies that `path` is a usable Mastopoof database and returns
+// its schema version. Databases with a schema more recent than what this
+// version of Mastopoof knows are refused. Older ones are fine, as they are
+// updated when opened.
+func CheckBackup(ctx context.Context, path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	version, err := getCurrentVersion(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	if version > maxSchemaVersion {
+		return version, fmt.Errorf("%w: schema version of %s is %d, max known version is %d", ErrSchemaTooNew, path, version, maxSchemaVersion)
+	}
+	if version == 0 {
+		return version, fmt.Errorf("%s is not a Mastopoof database", path)
+	}
+	var result string
+	if err := db.QueryRowContext(ctx, "PRAGMA quick_check;").Scan(&result); err != nil {
+		return version, err
+	}
+	if result != "ok" {
+		return version, fmt.Errorf("%s is corrupted: %s", path, result)
+	}
+	return version, nil
+}
+
+// dbFilePath returns the file behind a database URI, as accepted by
+// NewStorage.
+func dbFilePath(dbURI string) (string, error) {
+	u, err := url.Parse(dbURI)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse DB URI %q: %w", dbURI, err)
+	}
+	if u.Scheme == "" {
+		return dbURI, nil
+	}
+	if u.Scheme != "file" || u.Opaque == ":memory:" || u.Query().Get("mode") == "memory" {
+		return "", fmt.Errorf("DB URI %q does not refer to a file", dbURI)
+	}
+	if u.Opaque != "" {
+		return u.Opaque, nil
+	}
+	return u.Path, nil
+}
+
+// Restore replaces the database at `dbURI` by the backup at `backupPath`,
+// after checking it with CheckBackup. The database must not be in use;
+// wrapped ErrDBInUse is returned otherwise. The previous database, if any, is
+// kept with a timestamped `.before-restore-` suffix; its path is returned.
+// Nothing is changed if a database was already kept under that name.
+func Restore(ctx context.Context, backupPath string, dbURI string) (string, error) {
+	if _, err := CheckBackup(ctx, backupPath); err != nil {
+		return "", err
+	}
+	dbPath, err := dbFilePath(dbURI)
+	if err != nil {
+		return "", err
+	}
+	lockFile, err := lockDB(dbPath, true /* exclusive */)
+	if err != nil {
+		return "", err
+	}
+	if lockFile != nil {
+		defer lockFile.Close()
+	}
+
+	// WAL files belong to the previous database, so they are moved along.
+	suffixes := []string{"", "-wal", "-shm"}
+	keptPath := dbPath + ".before-restore-" + time.Now().UTC().Format(snapshotTimeFormat)
+	for _, suffix := range suffixes {
+		_, err := os.Lstat(keptPath + suffix)
+		if err == nil {
+			return "", fmt.Errorf("%s already exists", keptPath+suffix)
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+
+	// Copy first, so the backup stays available and the database is replaced
+	// in a single rename.
+	tmpPath := dbPath + ".restore-tmp"
+	if err := copyFile(backupPath, tmpPath); err != nil {
+		return "", err
+	}
+
+	// On failure, files already moved are put back, so the previous database
+	// is not separated from its WAL.
+	var moved []string
+	rollback := func(err error) error {
+		for _, suffix := range moved {
+			if rerr := os.Rename(keptPath+suffix, dbPath+suffix); rerr != nil {
+				err = errors.Join(err, rerr)
+			}
+		}
+		if rerr := os.Remove(tmpPath); rerr != nil {
+			err = errors.Join(err, rerr)
+		}
+		return err
+	}
+	for _, suffix := range suffixes {
+		err := os.Rename(dbPath+suffix, keptPath+suffix)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", rollback(err)
+		}
+		moved = append(moved, suffix)
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		return "", rollback(err)
+	}
+	if !slices.Contains(moved, "") {
+		// There was no previous database.
+		return "", nil
+	}
+	return keptPath, nil
+}
+
+// copyFile copies `src` to `dst`, making sure the content is on disk before
+// returning.
+func copyFile(src string, dst string) (retErr error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := out.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
@@ -0,0 +1,12 @@
+//go:build !sqlite_fts5 && !fts5
+
+package storage
+
+// Search relies on SQLite FTS5 extension, which go-sqlite3 only includes with
+// the `sqlite_fts5` build tag. Without it, Storage would refuse to open any
+// SQLite database, so make the build fail instead - with an error naming the
+// missing tag:
+//
+//	go build -tags sqlite_fts5
+//	go test -tags sqlite_fts5 ./...
+var _ = build_with_tags_sqlite_fts5
@@ -0,0 +1,201 @@
+// This file contains the retention of cached statuses - i.e., dropping the
+// content of statuses which are unlikely to be looked at again.
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Palats/mastopoof/backend/types"
+	stpb "github.com/Palats/mastopoof/proto/gen/mastopoof/storage"
+	"github.com/mattn/go-mastodon"
+)
+
+// gcBatchSize is the number of statuses considered in each transaction by GC.
+const gcBatchSize = 500
+
+// RetentionPolicy indicates which statuses can have their content dropped.
+// A status is only considered once it is in all the streams it belongs to -
+// i.e., never while it is still in a pool. Zero values disable the
+// corresponding criteria.
+type RetentionPolicy struct {
+	// Statuses created more than that long ago.
+	MaxAge time.Duration
+	// Statuses at least that many positions before the last read position of
+	// the stream.
+	MaxBehindLastRead int64
+}
+
+// GCResult describes what GC did - or would do, in dry run mode.
+type GCResult struct {
+	// Number of statuses whose content was dropped.
+	Pruned int64
+	// Size of the status JSON of the pruned statuses, in bytes.
+	PrunedBytes int64
+	// Number of statuses matching the policy, but kept as they are
+	// favourited or bookmarked.
+	Kept int64
+}
+
+// prunedStatus returns a copy of the status with only what is needed to show
+// that it was there and to find it on Mastodon.
+func prunedStatus(status *mastodon.Status) *mastodon.Status {
+	pruned := &mastodon.Status{
+		ID:                 status.ID,
+		URI:                status.URI,
+		URL:                status.URL,
+		Account:            status.Account,
+		InReplyToID:        status.InReplyToID,
+		InReplyToAccountID: status.InReplyToAccountID,
+		CreatedAt:          status.CreatedAt,
+		Visibility:         status.Visibility,
+		Language:           status.Language,
+	}
+	if status.Reblog != nil {
+		pruned.Reblog = prunedStatus(status.Reblog)
+	}
+	return pruned
+}
+
+// GC drops the content of the cached statuses matching the retention policy,
+// keeping their position in the streams. Favourited and bookmarked statuses
+// are never pruned. If `uid` is not zero, only statuses of that user are
+// considered. In dry run mode, nothing is modified.
+// Dropped space is only given back to the filesystem once the database is
+// vacuumed.
+func (st *Storage) GC(ctx context.Context, uid types.UID, policy RetentionPolicy, dryRun bool) (_ *GCResult, retErr error) {
+	defer recordAction("gc")(retErr)
+	if policy.MaxAge <= 0 && policy.MaxBehindLastRead <= 0 {
+		return nil, errors.New("no retention criteria specified")
+	}
+	var cutoffSecs int64
+	if policy.MaxAge > 0 {
+		cutoffSecs = time.Now().Add(-policy.MaxAge).Unix()
+	}
+
+	d := st.backend.dialect()
+	result := &GCResult{}
+	var lastSID types.SID
+	for {
+		count := 0
+		var batch GCResult
+		batchLastSID := lastSID
+		err := st.InTxnRW(ctx, func(ctx context.Context, txn SQLReadWrite) error {
+			// The transaction might be attempted again on conflict.
+			count, batch, batchLastSID = 0, GCResult{}, lastSID
+			// A status is picked if it is in at least one stream, and if all
+			// the streams it is in have it positioned and match the policy.
+			rows, err := txn.Query(ctx, "gc-candidates", `
+				SELECT
+					statuses.sid,
+					statuses.status,
+					statuses.status_meta,
+					length(statuses.status),
+					coalesce(`+d.jsonBool("statuses.status", "$.favourited")+`, false)
+						OR coalesce(`+d.jsonBool("statuses.status", "$.bookmarked")+`, false)
+						OR coalesce(`+d.jsonBool("statuses.status", "$.reblog.favourited")+`, false)
+						OR coalesce(`+d.jsonBool("statuses.status", "$.reblog.bookmarked")+`, false)
+				FROM
+					statuses
+					JOIN accountstate USING (asid)
+				WHERE
+					statuses.sid > ?1
+					AND (accountstate.uid = ?2 OR ?2 = 0)
+					AND NOT coalesce(`+d.jsonBool("statuses.status_meta", "$.pruned")+`, false)
+					AND EXISTS (
+						SELECT 1 FROM streamcontent WHERE streamcontent.sid = statuses.sid
+					)
+					AND NOT EXISTS (
+						SELECT 1
+						FROM
+							streamcontent
+							JOIN streamstate USING (stid)
+						WHERE
+							streamcontent.sid = statuses.sid
+							AND NOT (
+								streamcontent.position IS NOT NULL
+								AND (
+									(CAST(?3 AS BIGINT) > 0 AND `+d.unixTime(d.jsonText("statuses.status", "$.created_at"))+` < ?3)
+									OR (CAST(?4 AS BIGINT) > 0 AND streamcontent.position <= coalesce(`+d.jsonInt("streamstate.state", "$.last_read")+`, 0) - ?4)
+								)
+							)
+					)
+				ORDER BY statuses.sid
+				LIMIT ?5
+				;
+			`, lastSID, uid, cutoffSecs, policy.MaxBehindLastRead, gcBatchSize)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			type entry struct {
+				sid        types.SID
+				status     *mastodon.Status
+				statusMeta *stpb.StatusMeta
+			}
+			var toPrune []entry
+			for rows.Next() {
+				var status types.SQLStatus
+				e := entry{statusMeta: &stpb.StatusMeta{}}
+				var size int64
+				var keep bool
+				if err := rows.Scan(&e.sid, &status, types.SQLProto{e.statusMeta}, &size, &keep); err != nil {
+					return err
+				}
+				count++
+				batchLastSID = e.sid
+				if keep {
+					batch.Kept++
+					continue
+				}
+				e.status = &status.Status
+				toPrune = append(toPrune, e)
+				batch.Pruned++
+				batch.PrunedBytes += size
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			rows.Close()
+
+			if dryRun {
+				return nil
+			}
+			for _, e := range toPrune {
+				e.statusMeta.Pruned = true
+				pruned := prunedStatus(e.status)
+				_, err := txn.Exec(ctx, "gc-prune", `
+					UPDATE statuses SET status = ?, status_meta = ? WHERE sid = ?;
+				`, &types.SQLStatus{*pruned}, types.SQLProto{e.statusMeta}, e.sid)
+				if err != nil {
+					return err
+				}
+				if err := st.indexStatus(ctx, txn, e.sid, pruned); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		lastSID = batchLastSID
+		result.Kept += batch.Kept
+		result.Pruned += batch.Pruned
+		result.PrunedBytes += batch.PrunedBytes
+		if count < gcBatchSize {
+			break
+		}
+	}
+	return result, nil
+}
+
+// Vacuum rebuilds the database, giving back to the filesystem the space
+// freed - e.g., by GC.
+func (st *Storage) Vacuum(ctx context.Context) (retErr error) {
+	defer recordAction("vacuum")(retErr)
+	_, err := st.rwDB.ExecContext(ctx, "VACUUM;")
+	return err
+}
@@ -0,0 +1,136 @@
+// This file contains invite codes, which restrict who can create a user.
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Palats/mastopoof/backend/types"
+	stpb "github.com/Palats/mastopoof/proto/gen/mastopoof/storage"
+)
+
+// ErrInvalidInviteCode is returned when an invite code does not exist, has
+// expired or was used too many times.
+var ErrInvalidInviteCode = errors.New("invalid invite code")
+
+// CreateInviteCode stores a new invite code. A random code is picked if
+// inviteCode.Code is empty; inviteCode is updated IN PLACE.
+// Returns wrapped ErrAlreadyExists if the code is already in use.
+func (st *Storage) CreateInviteCode(ctx context.Context, txn SQLReadWrite, inviteCode *stpb.InviteCode) (retErr error) {
+	defer recordAction("create-invite-code")(retErr)
+	if inviteCode.Code == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		inviteCode.Code = hex.EncodeToString(b)
+	}
+	inviteCode.CreatedSecs = time.Now().Unix()
+	inviteCode.Uses = 0
+
+	return st.inTxnRW(ctx, txn, func(ctx context.Context, txn SQLReadWrite) error {
+		var count int64
+		if err := txn.QueryRow(ctx, "create-invite-code-exists", `SELECT COUNT(*) FROM invitecodes WHERE code = ?`, inviteCode.Code).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("invite code %q: %w", inviteCode.Code, ErrAlreadyExists)
+		}
+		_, err := txn.Exec(ctx, "create-invite-code", `INSERT INTO invitecodes(code, state) VALUES(?, ?)`, inviteCode.Code, types.SQLProto{inviteCode})
+		return err
+	})
+}
+
+// ListInviteCodes returns all the invite codes, including those which can no
+// longer be used.
+func (st *Storage) ListInviteCodes(ctx context.Context) (_ []*stpb.InviteCode, retErr error) {
+	defer recordAction("list-invite-codes")(retErr)
+	var inviteCodes []*stpb.InviteCode
+	err := st.InTxnRO(ctx, func(ctx context.Context, txn SQLReadOnly) error {
+		rows, err := txn.Query(ctx, "list-invite-codes", `SELECT state FROM invitecodes ORDER BY code`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			inviteCode := &stpb.InviteCode{}
+			if err := rows.Scan(types.SQLProto{inviteCode}); err != nil {
+				return err
+			}
+			inviteCodes = append(inviteCodes, inviteCode)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inviteCodes, nil
+}
+
+// DeleteInviteCode removes an invite code; users created with it are kept.
+// Returns wrapped ErrNotFound if the code does not exist.
+func (st *Storage) DeleteInviteCode(ctx context.Context, code string) (retErr error) {
+	defer recordAction("delete-invite-code")(retErr)
+	return st.InTxnRW(ctx, func(ctx context.Context, txn SQLReadWrite) error {
+		res, err := txn.Exec(ctx, "delete-invite-code", `DELETE FROM invitecodes WHERE code = ?`, code)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("invite code %q: %w", code, ErrNotFound)
+		}
+		return nil
+	})
+}
+
+// CheckInviteCode verifies that the invite code can be used to create a user,
+// without using it. Returns wrapped ErrInvalidInviteCode otherwise.
+func (st *Storage) CheckInviteCode(ctx context.Context, txn SQLReadOnly, code string) (retErr error) {
+	defer recordAction("check-invite-code")(retErr)
+	return st.inTxnRO(ctx, txn, func(ctx context.Context, txn SQLReadOnly) error {
+		_, err := st.usableInviteCode(ctx, txn, code)
+		return err
+	})
+}
+
+// UseInviteCode records that a user is being created with the invite code.
+// Returns wrapped ErrInvalidInviteCode if the code cannot be used.
+func (st *Storage) UseInviteCode(ctx context.Context, txn SQLReadWrite, code string) (retErr error) {
+	defer recordAction("use-invite-code")(retErr)
+	return st.inTxnRW(ctx, txn, func(ctx context.Context, txn SQLReadWrite) error {
+		inviteCode, err := st.usableInviteCode(ctx, txn, code)
+		if err != nil {
+			return err
+		}
+		inviteCode.Uses++
+		_, err = txn.Exec(ctx, "use-invite-code", `UPDATE invitecodes SET state = ? WHERE code = ?`, types.SQLProto{inviteCode}, code)
+		return err
+	})
+}
+
+func (st *Storage) usableInviteCode(ctx context.Context, txn SQLReadOnly, code string) (*stpb.InviteCode, error) {
+	inviteCode := &stpb.InviteCode{}
+	err := txn.QueryRow(ctx, "invite-code", `SELECT state FROM invitecodes WHERE code = ?`, code).Scan(types.SQLProto{inviteCode})
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidInviteCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	if inviteCode.ExpiresAtSecs != 0 && time.Now().Unix() >= inviteCode.ExpiresAtSecs {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidInviteCode)
+	}
+	if inviteCode.MaxUses != 0 && inviteCode.Uses >= inviteCode.MaxUses {
+		return nil, fmt.Errorf("%w: already used %d times", ErrInvalidInviteCode, inviteCode.Uses)
+	}
+	return inviteCode, nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package storage
+
+import "os"
+
+// lockDB does nothing on systems without flock; the database is not
+// protected against being restored while in use. See lock_unix.go.
+func lockDB(dbPath string, exclusive bool) (*os.File, error) {
+	return nil, nil
+}
@@ -0,0 +1,34 @@
+//go:build unix
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockDB takes an advisory lock on the SQLite database at `dbPath`, through a
+// companion `.lock` file - SQLite own locks cannot be used, as they are not
+// held while connections are idle. Storage holds a shared lock as long as it
+// is open, while Restore takes an exclusive one. Returns wrapped ErrDBInUse if
+// the lock cannot be obtained.
+func lockDB(dbPath string, exclusive bool) (*os.File, error) {
+	f, err := os.OpenFile(dbPath+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s", ErrDBInUse, dbPath)
+		}
+		return nil, fmt.Errorf("unable to lock %s: %w", dbPath, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,118 @@
+// This file gives control over schema updates, which NewStorage otherwise
+// applies silently.
+package storage
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// SchemaStatus describes the schema version of a database.
+type SchemaStatus struct {
+	// Database engine - "sqlite" or "postgres". Each engine has its own schema
+	// versions.
+	Engine string
+	// Version of the database schema.
+	Current int
+	// Most recent version known for the engine.
+	Latest int
+}
+
+// MigrationStep is a single schema update, as planned by MigrationPlan.
+type MigrationStep struct {
+	// Versions before and after the step. To is lower than From when the step
+	// is reverted.
+	From int
+	To   int
+	// Name of the function doing the update - e.g., `v12Tov13`.
+	Name string
+	// Whether the step can be reverted.
+	Reversible bool
+	// Foreign keys are not enforced during the step.
+	DisableForeignKeys bool
+}
+
+// OpenForMigration opens the storage without updating the database schema,
+// unlike NewStorage. Only SchemaStatus, MigrationPlan and Migrate can be
+// relied upon, as the schema might be outdated.
+func OpenForMigration(ctx context.Context, dbURI string) (*Storage, error) {
+	return newStorageNoInit(ctx, dbURI)
+}
+
+func (st *Storage) SchemaStatus(ctx context.Context) (*SchemaStatus, error) {
+	current, err := st.backend.currentVersion(ctx, st.rwDB)
+	if err != nil {
+		return nil, err
+	}
+	return &SchemaStatus{
+		Engine:  st.backend.name(),
+		Current: current,
+		Latest:  st.backend.maxVersion(),
+	}, nil
+}
+
+// MigrationPlan lists the steps going from the current schema version to
+// `target`, in order. When `target` is older than the current version, all
+// the steps in between must be reversible.
+func (st *Storage) MigrationPlan(ctx context.Context, target int) ([]*MigrationStep, error) {
+	status, err := st.SchemaStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if status.Current > status.Latest {
+		return nil, fmt.Errorf("%w: schema version of DB is %d, max known version is %d", ErrSchemaTooNew, status.Current, status.Latest)
+	}
+	if target < 0 || target > status.Latest {
+		return nil, fmt.Errorf("target version %d is not between 0 and %d", target, status.Latest)
+	}
+
+	steps := st.backend.steps()
+	var plan []*MigrationStep
+	for v := status.Current; v < target; v++ {
+		plan = append(plan, newMigrationStep(steps[v], steps[v].Apply, v, v+1))
+	}
+	for v := status.Current; v > target; v-- {
+		step := steps[v-1]
+		if step.Revert == nil {
+			return nil, fmt.Errorf("update from version %d to version %d cannot be reverted", v-1, v)
+		}
+		plan = append(plan, newMigrationStep(step, step.Revert, v, v-1))
+	}
+	return plan, nil
+}
+
+func newMigrationStep(step UpdateStep, f updateFunc, from int, to int) *MigrationStep {
+	name := runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+	return &MigrationStep{
+		From:               from,
+		To:                 to,
+		Name:               name[strings.LastIndex(name, ".")+1:],
+		Reversible:         step.Revert != nil,
+		DisableForeignKeys: step.DisableForeignKeys,
+	}
+}
+
+// Migrate updates the database schema to `target`, reverting steps if it is
+// older than the current version - see MigrationPlan. Nothing is done if any
+// of the steps to revert is not reversible.
+func (st *Storage) Migrate(ctx context.Context, target int) error {
+	plan, err := st.MigrationPlan(ctx, target)
+	if err != nil {
+		return err
+	}
+	if len(plan) == 0 {
+		return nil
+	}
+	if plan[0].To > plan[0].From {
+		return st.backend.prepare(ctx, st.rwDB, target)
+	}
+	for _, step := range plan {
+		if err := st.backend.revert(ctx, st.rwDB, step.From); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+// This file contains the management of Mastodon notifications.
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Palats/mastopoof/backend/types"
+	"github.com/mattn/go-mastodon"
+)
+
+// Notification is a Mastodon notification, as kept by Mastopoof.
+type Notification struct {
+	NID types.NID
+	// The Mastodon account which got the notification.
+	ASID         types.ASID
+	Read         bool
+	Notification mastodon.Notification
+}
+
+// idNotNewerSQL is a SQL condition checking that the Mastodon ID in `column`
+// is older or equal to the ID provided as argument. Mastodon IDs are numbers
+// stored as strings, so they are compared first on their length. The argument
+// is cast so its type is known to PostgreSQL.
+func idNotNewerSQL(column string) string {
+	return fmt.Sprintf("(length(%[1]s) < length(CAST(?1 AS TEXT)) OR (length(%[1]s) = length(CAST(?1 AS TEXT)) AND %[1]s <= CAST(?1 AS TEXT)))", column)
+}
+
+// InsertNotifications adds notifications of an account. Notifications which
+// were already known are ignored.
+func (st *Storage) InsertNotifications(ctx context.Context, txn SQLReadWrite, asid types.ASID, notifs []*mastodon.Notification) (retErr error) {
+	defer recordAction("insert-notifications")(retErr)
+
+	// Mastodon returns most recent notifications first, while NIDs must follow
+	// chronological order.
+	sorted := slices.Clone(notifs)
+	slices.SortFunc(sorted, func(a, b *mastodon.Notification) int {
+		if IDLess(a.ID, b.ID) {
+			return -1
+		}
+		if IDLess(b.ID, a.ID) {
+			return 1
+		}
+		return 0
+	})
+
+	return st.inTxnRW(ctx, txn, func(ctx context.Context, txn SQLReadWrite) error {
+		for _, notif := range sorted {
+			raw, err := json.Marshal(notif)
+			if err != nil {
+				return err
+			}
+			_, err = txn.Exec(ctx, "insert-notifications", `
+				INSERT INTO notifications(asid, notification) VALUES(?, ?)
+					ON CONFLICT DO NOTHING;
+			`, asid, string(raw))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LatestNotificationID returns the Mastodon ID of the most recent known
+// notification of the account - or an empty ID if there is none.
+func (st *Storage) LatestNotificationID(ctx context.Context, txn SQLReadOnly, asid types.ASID) (_ mastodon.ID, retErr error) {
+	defer recordAction("latest-notification-id")(retErr)
+	var id mastodon.ID
+	err := st.inTxnRO(ctx, txn, func(ctx context.Context, txn SQLReadOnly) error {
+		err := txn.QueryRow(ctx, "latest-notification-id", `
+			SELECT notification_id FROM notifications
+			WHERE asid = ?
+			ORDER BY length(notification_id) DESC, notification_id DESC
+			LIMIT 1;
+		`, asid).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	})
+	return id, err
+}
+
+// SetNotificationsMarker marks as read all the notifications of the account
+// up to the provided Mastodon ID - typically from the Mastodon `notifications`
+// marker. Notifications are never marked back as unread.
+func (st *Storage) SetNotificationsMarker(ctx context.Context, txn SQLReadWrite, asid types.ASID, lastReadID mastodon.ID) (retErr error) {
+	defer recordAction("set-notifications-marker")(retErr)
+	if lastReadID == "" {
+		return nil
+	}
+	return st.inTxnRW(ctx, txn, func(ctx context.Context, txn SQLReadWrite) error {
+		_, err := txn.Exec(ctx, "set-notifications-marker", `
+			UPDATE notifications SET read = 1
+			WHERE asid = ?2 AND read = 0 AND `+idNotNewerSQL("notification_id")+`;
+		`, string(lastReadID), asid)
+		return err
+	})
+}
+
+// DropDismissedNotifications removes the unread notifications of the account
+// which are no longer on Mastodon - typically because they were dismissed
+// there. `unreadIDs` are the IDs of the unread notifications as listed by
+// Mastodon, most recent first. Only local notifications between `since` and
+// `upTo` included are considered: `since` is the oldest notification listed if
+// the listing might be incomplete - empty otherwise - and `upTo` is the most
+// recent notification known when the listing was done.
+func (st *Storage) DropDismissedNotifications(ctx context.Context, txn SQLReadWrite, asid types.ASID, unreadIDs []mastodon.ID, since mastodon.ID, upTo mastodon.ID) (retErr error) {
+	defer recordAction("drop-dismissed-notifications")(retErr)
+	unread := map[mastodon.ID]bool{}
+	for _, id := range unreadIDs {
+		unread[id] = true
+	}
+	return st.inTxnRW(ctx, txn, func(ctx context.Context, txn SQLReadWrite) error {
+		rows, err := txn.Query(ctx, "drop-dismissed-notifications-find", `
+			SELECT nid, notification_id FROM notifications
+			WHERE asid = ? AND read = 0;
+		`, asid)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		var nids []types.NID
+		for rows.Next() {
+			var nid types.NID
+			var id mastodon.ID
+			if err := rows.Scan(&nid, &id); err != nil {
+				return err
+			}
+			if unread[id] || IDLess(id, since) || IDNewer(id, upTo) {
+				continue
+			}
+			nids = append(nids, nid)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		for _, nid := range nids {
+			if _, err := txn.Exec(ctx, "drop-dismissed-notifications-delete", `
+				DELETE FROM notifications WHERE nid = ?;
+			`, nid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MarkNotificationsRead marks as read the notifications of the user, up to
+// `upTo` included - or all of them if zero. It returns, for each account which
+// had notifications marked as read, the Mastodon ID of the most recent one -
+// to be used for the Mastodon marker.
+func (st *Storage) MarkNotificationsRead(ctx context.Context, txn SQLReadWrite, uid types.UID, upTo types.NID) (_ map[types.ASID]mastodon.ID, retErr error) {
+	defer recordAction("mark-notifications-read")(retErr)
+	markers := map[types.ASID]mastodon.ID{}
+	err := st.inTxnRW(ctx, txn, func(ctx context.Context, txn SQLReadWrite) error {
+		rows, err := txn.Query(ctx, "mark-notifications-read-find", `
+			SELECT asid, notification_id FROM notifications
+			WHERE
+				asid IN (SELECT asid FROM accountstate WHERE uid = ?1)
+				AND (nid <= ?2 OR ?2 = 0)
+				AND read = 0
+			;
+		`, uid, upTo)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var asid types.ASID
+			var id mastodon.ID
+			if err := rows.Scan(&asid, &id); err != nil {
+				return err
+			}
+			if IDNewer(id, markers[asid]) {
+				markers[asid] = id
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		_, err = txn.Exec(ctx, "mark-notifications-read", `
+			UPDATE notifications SET read = 1
+			WHERE
+				asid IN (SELECT asid FROM accountstate WHERE uid = ?1)
+				AND (nid <= ?2 OR ?2 = 0)
+				AND read = 0
+			;
+		`, uid, upTo)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return markers, nil
+}
+
+// UnreadNotificationsCount returns the number of unread notifications across
+// all the accounts of the user.
+func (st *Storage) UnreadNotificationsCount(ctx context.Context, txn SQLReadOnly, uid types.UID) (_ int64, retErr error) {
+	defer recordAction("unread-notifications-count")(retErr)
+	var count int64
+	err := st.inTxnRO(ctx, txn, func(ctx context.Context, txn SQLReadOnly) error {
+		return txn.QueryRow(ctx, "unread-notifications-count", `
+			SELECT COUNT(*) FROM notifications
+			WHERE
+				asid IN (SELECT asid FROM accountstate WHERE uid = ?)
+				AND read = 0
+			;
+		`, uid).Scan(&count)
+	})
+	return count, err
+}
+
+// NotificationsQuery describes which notifications to list.
+type NotificationsQuery struct {
+	UID types.UID
+	// Only notifications older than that one. Zero to start from the most
+	// recent one.
+	BeforeNID types.NID
+	// Only notifications of those types - e.g., `mention`. All types if empty.
+	Types      []string
+	UnreadOnly bool
+	Limit      int64
+}
+
+// ListNotifications returns notifications of the user, most recent first.
+func (st *Storage) ListNotifications(ctx context.Context, txn SQLReadOnly, q *NotificationsQuery) (_ []*Notification, retErr error) {
+	defer recordAction("list-notifications")(retErr)
+
+	conds := []string{"asid IN (SELECT asid FROM accountstate WHERE uid = ?)"}
+	args := []any{q.UID}
+	if q.BeforeNID != 0 {
+		conds = append(conds, "nid < ?")
+		args = append(args, q.BeforeNID)
+	}
+	if len(q.Types) > 0 {
+		conds = append(conds, "notification_type IN (?"+strings.Repeat(", ?", len(q.Types)-1)+")")
+		for _, t := range q.Types {
+			args = append(args, t)
+		}
+	}
+	if q.UnreadOnly {
+		conds = append(conds, "read = 0")
+	}
+	args = append(args, q.Limit)
+
+	var results []*Notification
+	err := st.inTxnRO(ctx, txn, func(ctx context.Context, txn SQLReadOnly) error {
+		rows, err := txn.Query(ctx, "list-notifications", `
+			SELECT nid, asid, read, notification FROM notifications
+			WHERE `+strings.Join(conds, " AND ")+`
+			ORDER BY nid DESC
+			LIMIT ?;
+		`, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			notif := &Notification{}
+			var raw string
+			if err := rows.Scan(&notif.NID, &notif.ASID, &notif.Read, &raw); err != nil {
+				return err
+			}
+			if err := json.Unmarshal([]byte(raw), &notif.Notification); err != nil {
+				return fmt.Errorf("unable to decode notification %d: %w", notif.NID, err)
+			}
+			results = append(results, notif)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,306 @@
+// This file contains the PostgreSQL backend. Storage logic is the same as with
+// SQLite; statements are translated automatically, besides the parts coming
+// from postgresDialect.
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Palats/mastopoof/backend/types"
+	"github.com/alexedwards/scs/v2"
+	"github.com/golang/glog"
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// pgDriverName is the database/sql driver used for PostgreSQL. Unlike with
+// SQLite, a statement cannot run while the rows of another are being read in
+// the same transaction: rows are read entirely first in such cases.
+const pgDriverName = "pgx"
+
+// isPostgresURI indicates whether the database URI given to NewStorage
+// refers to a PostgreSQL database instead of a SQLite one.
+func isPostgresURI(dbURI string) bool {
+	return strings.HasPrefix(dbURI, "postgres://") || strings.HasPrefix(dbURI, "postgresql://")
+}
+
+func newPostgresStorageNoInit(ctx context.Context, dbURI string) (returnedSt *Storage, returnedErr error) {
+	// Make sure to cleanup everything in case of errors.
+	defer func() {
+		if returnedErr != nil {
+			returnedSt.Close()
+		}
+	}()
+
+	st := &Storage{
+		streamChs: make(map[types.StID]chan struct{}),
+		backend:   postgresBackend{},
+	}
+
+	u, err := url.Parse(dbURI)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse DB URI: %w", err)
+	}
+	// Do not log passwords.
+	glog.Infof("Storage URI, read-write: %s", u.Redacted())
+
+	// -- Write access
+	st.rwDB, err = sql.Open(pgDriverName, u.String())
+	if err != nil {
+		return nil, fmt.Errorf("unable to open storage %s: %w", u.Redacted(), err)
+	}
+	// Write transactions of this process are serialized, as with SQLite.
+	// Other processes - e.g., command line tools - might still write
+	// concurrently; see rwTxOptions.
+	st.rwDB.SetMaxOpenConns(1)
+	if err := st.rwDB.PingContext(ctx); err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %w", u.Redacted(), err)
+	}
+
+	// -- Read-only access
+	roURI := *u
+	q := roURI.Query()
+	q.Set("default_transaction_read_only", "on")
+	roURI.RawQuery = q.Encode()
+	glog.Infof("Storage URI, read-only: %s", roURI.Redacted())
+
+	st.roDB, err = sql.Open(pgDriverName, roURI.String())
+	if err != nil {
+		return nil, fmt.Errorf("unable to open storage %s: %w", u.Redacted(), err)
+	}
+	st.roDB.SetMaxOpenConns(max(4, runtime.NumCPU()))
+
+	return st, nil
+}
+
+// postgresBackend translates statements for PostgreSQL.
+type postgresBackend struct{}
+
+func (postgresBackend) name() string { return backendPostgres }
+
+// rewrittenStatements caches the result of pgPlaceholders, per query.
+var rewrittenStatements sync.Map
+
+func (postgresBackend) rewrite(query string) string {
+	if stmt, ok := rewrittenStatements.Load(query); ok {
+		return stmt.(string)
+	}
+	stmt := pgPlaceholders(query)
+	rewrittenStatements.Store(query, stmt)
+	return stmt
+}
+
+func (postgresBackend) dialect() *dialect { return postgresDialect }
+
+func (postgresBackend) prepare(ctx context.Context, db *sql.DB, targetVersion int) error {
+	return preparePostgres(ctx, db, targetVersion)
+}
+
+func (postgresBackend) currentVersion(ctx context.Context, db *sql.DB) (int, error) {
+	return getPostgresVersion(ctx, db)
+}
+
+func (postgresBackend) maxVersion() int { return maxPostgresSchemaVersion }
+
+func (postgresBackend) steps() []UpdateStep { return allPostgresSteps }
+
+func (postgresBackend) revert(ctx context.Context, db *sql.DB, version int) error {
+	return revertPostgresSingleStep(ctx, db, allPostgresSteps[version-1], version)
+}
+
+// Storage logic relies on write transactions being serialized - e.g., IDs
+// are allocated with MAX()+1. Concurrent transactions which would break that
+// fail with a serialization error instead, and are attempted again - see
+// inTxnRW.
+func (postgresBackend) rwTxOptions() *sql.TxOptions {
+	return &sql.TxOptions{Isolation: sql.LevelSerializable}
+}
+
+func (postgresBackend) isConflict(err error) bool {
+	var pgErr *pgconn.PgError
+	// serialization_failure and deadlock_detected.
+	return errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01")
+}
+
+func (postgresBackend) sessionStore(db *sql.DB) scs.Store { return newPgSessionStore(db) }
+
+// pgPlaceholders converts SQLite placeholders - `?` and `?NNN` - to
+// PostgreSQL ones. As with SQLite, a bare `?` is numbered after the largest
+// number used before it. Quoted strings, identifiers and comments are left
+// untouched.
+func pgPlaceholders(query string) string {
+	var b strings.Builder
+	largest := 0
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(query[i+1:], c)
+			if end < 0 {
+				b.WriteString(query[i:])
+				return b.String()
+			}
+			b.WriteString(query[i : i+end+2])
+			i += end + 1
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				b.WriteString(query[i:])
+				return b.String()
+			}
+			b.WriteString(query[i : i+end])
+			i += end - 1
+		case c == '?':
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			n := largest + 1
+			if j > i+1 {
+				n, _ = strconv.Atoi(query[i+1 : j])
+			}
+			largest = max(largest, n)
+			b.WriteString("$" + strconv.Itoa(n))
+			i = j - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// pgIndexStatusSQL is the equivalent of indexStatusSQL; the index is the
+// `fts` column of the status.
+const pgIndexStatusSQL = `
+	UPDATE statuses SET fts = to_tsvector('simple',
+		CAST($2 AS TEXT) || ' ' || CAST($3 AS TEXT) || ' ' || CAST($4 AS TEXT) || ' ' || CAST($5 AS TEXT)
+	) WHERE sid = $1;
+`
+
+// pgJSONPath converts a JSON path as used by SQLite - `$.reblog.favourited` -
+// to a PostgreSQL one - `{reblog,favourited}`.
+func pgJSONPath(path string) string {
+	return "{" + strings.ReplaceAll(strings.TrimPrefix(path, "$."), ".", ",") + "}"
+}
+
+// pgStatusField is the equivalent of statusField. JSON nulls are turned into
+// SQL NULL, as json_extract does.
+func pgStatusField(field string) string {
+	return fmt.Sprintf(`coalesce(nullif(statuses.status::jsonb #> '{reblog,%[1]s}', 'null'), nullif(statuses.status::jsonb -> '%[1]s', 'null'))`, field)
+}
+
+var postgresDialect = &dialect{
+	jsonText: func(column string, path string) string {
+		return fmt.Sprintf("(%s::jsonb #>> '%s')", column, pgJSONPath(path))
+	},
+	jsonInt: func(column string, path string) string {
+		return fmt.Sprintf("CAST(%s::jsonb #>> '%s' AS BIGINT)", column, pgJSONPath(path))
+	},
+	jsonBool: func(column string, path string) string {
+		return fmt.Sprintf("CAST(%s::jsonb #>> '%s' AS BOOLEAN)", column, pgJSONPath(path))
+	},
+	unixTime: func(expr string) string {
+		return "extract(epoch FROM CAST(" + expr + " AS TIMESTAMPTZ))"
+	},
+	indexStatus: pgIndexStatusSQL,
+	statusHidden: `EXISTS (
+		SELECT 1 FROM jsonb_array_elements(coalesce(statuses.status_meta::jsonb -> 'filters', '[]')) AS f(value)
+		WHERE (f.value ->> 'matched')::boolean AND f.value ->> 'action' = 'hide'
+	)`,
+	ruleHidden: `EXISTS (
+		SELECT 1 FROM jsonb_array_elements(coalesce(streamcontent.stream_status_state::jsonb -> 'rule_matches', '[]')) AS m(value)
+		WHERE m.value ->> 'action' = 'HIDE'
+	)`,
+	search: searchDialect{
+		statusID: "statuses.status_id = ?",
+		uri:      "statuses.status::jsonb ->> 'uri'",
+		textJoin: "JOIN plainto_tsquery('simple', ?) AS fts_query ON statuses.fts @@ fts_query",
+		// Unlike FTS5 rank, larger is better.
+		textOrderBy: "ts_rank(statuses.fts, fts_query) DESC",
+		// plainto_tsquery requires all the words and ignores operators.
+		textQuery: func(text string) string {
+			return strings.Join(strings.Fields(text), " ")
+		},
+		author:        "lower(CAST(? AS TEXT)) IN (lower(statuses.status::jsonb #>> '{account,acct}'), lower(statuses.status::jsonb #>> '{reblog,account,acct}'))",
+		createdAfter:  "extract(epoch FROM (statuses.status::jsonb ->> 'created_at')::timestamptz) >= ?",
+		createdBefore: "extract(epoch FROM (statuses.status::jsonb ->> 'created_at')::timestamptz) <= ?",
+		hasMedia:      "coalesce(jsonb_array_length(" + pgStatusField("media_attachments") + "), 0) > 0",
+		hasPoll:       pgStatusField("poll") + " IS NOT NULL",
+		favourited:    "coalesce((" + pgStatusField("favourited") + ")::boolean, false)",
+		reblogged:     "coalesce((" + pgStatusField("reblogged") + ")::boolean, false)",
+		filterMatched: "EXISTS (SELECT 1 FROM jsonb_array_elements(coalesce(statuses.status_meta::jsonb -> 'filters', '[]')) AS f(value) WHERE (f.value ->> 'matched')::boolean)",
+		alreadySeen:   "streamcontent.stream_status_state::jsonb ->> 'already_seen' = ?",
+	},
+}
+
+// pgSessionStore keeps HTTP sessions in PostgreSQL, as sqlite3store does with
+// SQLite.
+type pgSessionStore struct {
+	db *sql.DB
+	// Closed to stop the cleanup goroutine.
+	stopCleanup chan struct{}
+}
+
+func newPgSessionStore(db *sql.DB) *pgSessionStore {
+	s := &pgSessionStore{
+		db:          db,
+		stopCleanup: make(chan struct{}),
+	}
+	go s.cleanup(5 * time.Minute)
+	return s
+}
+
+func (s *pgSessionStore) Find(token string) ([]byte, bool, error) {
+	var b []byte
+	err := s.db.QueryRow(`SELECT data FROM sessions WHERE token = $1 AND current_timestamp < expiry`, token).Scan(&b)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+func (s *pgSessionStore) Commit(token string, b []byte, expiry time.Time) error {
+	_, err := s.db.Exec(`
+		INSERT INTO sessions(token, data, expiry) VALUES($1, $2, $3)
+		ON CONFLICT(token) DO UPDATE SET data = excluded.data, expiry = excluded.expiry
+	`, token, b, expiry)
+	return err
+}
+
+func (s *pgSessionStore) Delete(token string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE token = $1`, token)
+	return err
+}
+
+// cleanup regularly removes expired sessions, until StopCleanup is called.
+func (s *pgSessionStore) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.db.Exec(`DELETE FROM sessions WHERE expiry < current_timestamp`); err != nil {
+				glog.Errorf("unable to delete expired sessions: %v", err)
+			}
+		case <-s.stopCleanup:
+			return
+		}
+	}
+}
+
+// StopCleanup terminates the cleanup goroutine. It must be called only once.
+func (s *pgSessionStore) StopCleanup() {
+	close(s.stopCleanup)
+}
@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Palats/mastopoof/backend/types"
+	"github.com/google/go-cmp/cmp"
+)
+
+// sqliteOnlyRE matches SQL which PostgreSQL does not support; statements
+// must get it from the dialect instead.
+var sqliteOnlyRE = regexp.MustCompile(`(?i)\b(json_extract|json_each|json_array_length|json_object|json_group_array|json_set|unixepoch|ifnull|last_insert_rowid|strftime|group_concat)\s*\(|\bINSERT\s+OR\b|\bstatuses_fts\b`)
+
+// namedStatement is a statement run through sqlAdapter, as found in the
+// source of the package.
+type namedStatement struct {
+	pos   string
+	name  string
+	query string
+}
+
+// namedStatements lists the statements run through sqlAdapter by the package.
+// Only the literal parts of the queries are kept; fragments coming from the
+// dialect are checked separately.
+func namedStatements(t *testing.T) []*namedStatement {
+	t.Helper()
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	var stmts []*namedStatement
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".go") || strings.HasSuffix(entry.Name(), "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, entry.Name(), nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Body == nil {
+				continue
+			}
+			// Queries are sometimes prepared in a local variable first.
+			locals := map[string]ast.Expr{}
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				if assign, ok := n.(*ast.AssignStmt); ok && assign.Tok == token.DEFINE && len(assign.Lhs) == len(assign.Rhs) {
+					for i, lhs := range assign.Lhs {
+						if id, ok := lhs.(*ast.Ident); ok {
+							locals[id.Name] = assign.Rhs[i]
+						}
+					}
+				}
+				call, ok := n.(*ast.CallExpr)
+				if !ok || len(call.Args) < 3 {
+					return true
+				}
+				sel, ok := call.Fun.(*ast.SelectorExpr)
+				if !ok || (sel.Sel.Name != "Query" && sel.Sel.Name != "QueryRow" && sel.Sel.Name != "Exec") {
+					return true
+				}
+				lit, ok := call.Args[1].(*ast.BasicLit)
+				if !ok || lit.Kind != token.STRING {
+					return true
+				}
+				name, err := strconv.Unquote(lit.Value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				stmts = append(stmts, &namedStatement{
+					pos:   fset.Position(call.Pos()).String(),
+					name:  name,
+					query: literalParts(call.Args[2], locals, 0),
+				})
+				return true
+			})
+		}
+	}
+	return stmts
+}
+
+// literalParts concatenates the string literals of a query expression.
+func literalParts(expr ast.Expr, locals map[string]ast.Expr, depth int) string {
+	if depth > 10 {
+		return ""
+	}
+	switch e := expr.(type) {
+	case *ast.BasicLit:
+		if s, err := strconv.Unquote(e.Value); err == nil {
+			return s
+		}
+	case *ast.BinaryExpr:
+		if e.Op == token.ADD {
+			return literalParts(e.X, locals, depth+1) + " " + literalParts(e.Y, locals, depth+1)
+		}
+	case *ast.ParenExpr:
+		return literalParts(e.X, locals, depth+1)
+	case *ast.Ident:
+		if local, ok := locals[e.Name]; ok {
+			return literalParts(local, locals, depth+1)
+		}
+	}
+	return ""
+}
+
+func TestPostgresStatements(t *testing.T) {
+	stmts := namedStatements(t)
+	// Make sure the statements were actually found.
+	if len(stmts) < 50 {
+		t.Fatalf("found only %d statements", len(stmts))
+	}
+
+	for _, stmt := range stmts {
+		if m := sqliteOnlyRE.FindString(stmt.query); m != "" {
+			t.Errorf("%s: statement %q uses %q, which must come from the dialect", stmt.pos, stmt.name, m)
+		}
+	}
+}
+
+func TestPostgresDialect(t *testing.T) {
+	var check func(path string, v reflect.Value)
+	check = func(path string, v reflect.Value) {
+		switch v.Kind() {
+		case reflect.String:
+			if m := sqliteOnlyRE.FindString(v.String()); m != "" {
+				t.Errorf("postgresDialect.%s uses %q", path, m)
+			}
+		case reflect.Func:
+			if v.IsNil() {
+				t.Errorf("postgresDialect.%s is not set", path)
+				return
+			}
+			var args []reflect.Value
+			for i := 0; i < v.Type().NumIn(); i++ {
+				args = append(args, reflect.ValueOf("statuses.status"))
+			}
+			check(path, v.Call(args)[0])
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				check(strings.TrimPrefix(path+"."+v.Type().Field(i).Name, "."), v.Field(i))
+			}
+		}
+	}
+	check("", reflect.ValueOf(*postgresDialect))
+}
+
+// TestPostgresConcurrentWriters verifies that multiple processes - e.g., the
+// server and a command line tool - can write to the same database.
+func TestPostgresConcurrentWriters(t *testing.T) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backendPostgres}).Init(ctx, t)
+	defer env.Close()
+
+	u, err := url.Parse(env.pgBaseURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	q.Set("search_path", env.pgSchema)
+	u.RawQuery = q.Encode()
+	other, err := newStorageNoInit(ctx, u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	userState, _, _, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := types.UID(userState.Uid)
+
+	// IDs are allocated from the current maximum, which conflicts.
+	var wg sync.WaitGroup
+	for _, st := range []*Storage{env.st, other} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if _, err := st.CreateStreamState(ctx, nil, uid); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	streamStates, err := env.st.StreamStatesByUID(ctx, nil, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(streamStates), 21; got != want {
+		t.Errorf("Got %d streams, wanted %d", got, want)
+	}
+}
+
+func TestPostgresSQLiteVersions(t *testing.T) {
+	if got := postgresSQLiteVersions[maxPostgresSchemaVersion]; got != maxSchemaVersion {
+		t.Errorf("Latest postgres schema maps to SQLite version %d, wanted %d", got, maxSchemaVersion)
+	}
+	// Steps after the initial one each mirror a single SQLite step.
+	for v := 2; v <= maxPostgresSchemaVersion; v++ {
+		if got, want := postgresSQLiteVersions[v], postgresSQLiteVersions[v-1]+1; got != want {
+			t.Errorf("Postgres version %d maps to SQLite version %d, wanted %d", v, got, want)
+		}
+	}
+}
+
+// TestPostgresSchemaVersions verifies that each PostgreSQL schema version has
+// the same tables and columns as its SQLite version.
+func TestPostgresSchemaVersions(t *testing.T) {
+	ctx := context.Background()
+	for v := 1; v <= maxPostgresSchemaVersion; v++ {
+		t.Run(fmt.Sprintf("v%d", v), func(t *testing.T) {
+			pgEnv := (&DBTestEnv{backend: backendPostgres, targetVersion: v}).Init(ctx, t)
+			defer pgEnv.Close()
+			sqliteEnv := (&DBTestEnv{backend: backendSQLite, targetVersion: postgresSQLiteVersions[v]}).Init(ctx, t)
+			defer sqliteEnv.Close()
+
+			// Full text search is done differently - see searchDialect.
+			got := schemaColumns(ctx, t, pgEnv.rwDB, `
+				SELECT table_name, column_name
+				FROM information_schema.columns
+				WHERE
+					table_schema = current_schema()
+					AND table_name != 'schema_version'
+					AND NOT (table_name = 'statuses' AND column_name = 'fts')
+			`)
+			want := schemaColumns(ctx, t, sqliteEnv.rwDB, `
+				SELECT m.name, p.name
+				FROM sqlite_master AS m, pragma_table_info(m.name) AS p
+				WHERE
+					m.type = 'table'
+					AND m.name NOT LIKE 'sqlite_%'
+					AND m.name NOT LIKE 'statuses_fts%'
+			`)
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("Postgres schema mismatch (-SQLite v%d +postgres v%d):\n%s", postgresSQLiteVersions[v], v, diff)
+			}
+		})
+	}
+}
+
+// schemaColumns returns the sorted column names of each table, as listed by
+// `query`.
+func schemaColumns(ctx context.Context, t *testing.T, db *sql.DB, query string) map[string][]string {
+	t.Helper()
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	columns := map[string][]string{}
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			t.Fatal(err)
+		}
+		columns[table] = append(columns[table], column)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range columns {
+		sort.Strings(c)
+	}
+	return columns
+}
@@ -0,0 +1,352 @@
+// This file deals with creating/updating existing PostgreSQL databases. It
+// mirrors update.go, with its own chain of steps: schema versions of
+// PostgreSQL and SQLite databases differ - see postgresSQLiteVersions.
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+// preparePostgres creates the schema for the database or update it if needed.
+func preparePostgres(ctx context.Context, db *sql.DB, targetVersion int) error {
+	if targetVersion > maxPostgresSchemaVersion {
+		return fmt.Errorf("target version (%d) is higher than max known version (%d)", targetVersion, maxPostgresSchemaVersion)
+	}
+
+	// PostgreSQL has no equivalent of `PRAGMA user_version`, so the version is
+	// kept in a table of its own - which must exist before anything else.
+	if _, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER NOT NULL
+		);
+		INSERT INTO schema_version(version)
+			SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM schema_version);
+	`); err != nil {
+		return fmt.Errorf("unable to create version table: %w", err)
+	}
+
+	updateCount := 0
+	for {
+		version, err := getPostgresVersion(ctx, db)
+		if err != nil {
+			return err
+		}
+
+		if version > maxPostgresSchemaVersion {
+			return fmt.Errorf("%w: schema version of DB is %d, max known version is %d", ErrSchemaTooNew, version, maxPostgresSchemaVersion)
+		}
+		if version > targetVersion {
+			return fmt.Errorf("schema version of DB (%v) is higher than target schema version (%v)", version, targetVersion)
+		}
+		if version == targetVersion {
+			break
+		}
+
+		updateCount++
+		step := allPostgresSteps[version]
+		if err := preparePostgresSingleStep(ctx, db, step, version); err != nil {
+			return err
+		}
+	}
+
+	// Log ground truth about version
+	version, err := getPostgresVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	glog.Infof("postgres db is at version %d", version)
+
+	// Statistics are otherwise only refreshed by autovacuum.
+	if updateCount > 0 {
+		if _, err := db.ExecContext(ctx, `ANALYZE;`); err != nil {
+			return fmt.Errorf("unable to analyze db: %w", err)
+		}
+	}
+
+	glog.Infof("postgres db prep done.")
+	return nil
+}
+
+// preparePostgresSingleStep applies the next change on the DB.
+func preparePostgresSingleStep(ctx context.Context, db *sql.DB, step UpdateStep, expectedVersion int) error {
+	return runPostgresStep(ctx, db, step.Apply, expectedVersion, expectedVersion+1)
+}
+
+// revertPostgresSingleStep is the equivalent of revertDBSingleStep.
+func revertPostgresSingleStep(ctx context.Context, db *sql.DB, step UpdateStep, expectedVersion int) error {
+	if step.Revert == nil {
+		return fmt.Errorf("update from version %d to version %d cannot be reverted", expectedVersion-1, expectedVersion)
+	}
+	return runPostgresStep(ctx, db, step.Revert, expectedVersion, expectedVersion-1)
+}
+
+// runPostgresStep runs `f` to go from `expectedVersion` to `stepVersion`.
+func runPostgresStep(ctx context.Context, db *sql.DB, f updateFunc, expectedVersion int, stepVersion int) error {
+	// Foreign keys constraints are checked when committing the transaction;
+	// there is no need for DisableForeignKeys.
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to update DB schema: %w", err)
+	}
+	defer txn.Rollback()
+
+	// Lock the version, so concurrent updates are serialized.
+	var version int
+	if err := txn.QueryRowContext(ctx, `SELECT version FROM schema_version FOR UPDATE`).Scan(&version); err != nil {
+		return fmt.Errorf("unable to read schema version: %w", err)
+	}
+	glog.Infof("postgres schema version is %d", version)
+
+	if version != expectedVersion {
+		return fmt.Errorf("concurrency error; expected version %d, got %d", expectedVersion, version)
+	}
+
+	glog.Infof("updating postgres database schema from %d to %d...", version, stepVersion)
+
+	// Apply the actual changes.
+	if err := f(ctx, txn); err != nil {
+		return fmt.Errorf("unable to update from version %d to version %d: %w", version, stepVersion, err)
+	}
+
+	if _, err := txn.ExecContext(ctx, `UPDATE schema_version SET version = $1`, stepVersion); err != nil {
+		return fmt.Errorf("unable to set schema version: %w", err)
+	}
+
+	// And commit the change.
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("unable to update DB schema: %w", err)
+	}
+	return nil
+}
+
+// getPostgresVersion is the equivalent of getCurrentVersion. Databases
+// without version table are at version 0.
+func getPostgresVersion(ctx context.Context, txn txnInterface) (int, error) {
+	var exists bool
+	if err := txn.QueryRowContext(ctx, `SELECT to_regclass('schema_version') IS NOT NULL`).Scan(&exists); err != nil {
+		return -1, fmt.Errorf("unable to look for schema version: %w", err)
+	}
+	if !exists {
+		return 0, nil
+	}
+	var version int
+	if err := txn.QueryRowContext(ctx, `SELECT version FROM schema_version`).Scan(&version); err != nil {
+		return -1, fmt.Errorf("unable to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+var allPostgresSteps []UpdateStep
+
+// RegisterPostgresStep is the equivalent of RegisterStep for PostgreSQL.
+// If adding anything, do not forget to increment the schema version.
+func RegisterPostgresStep(step UpdateStep) UpdateStep {
+	allPostgresSteps = append(allPostgresSteps, step)
+	return step
+}
+
+// maxPostgresSchemaVersion is the equivalent of maxSchemaVersion for
+// PostgreSQL.
+const maxPostgresSchemaVersion = 2
+
+// postgresSQLiteVersions gives, for each PostgreSQL schema version, the
+// SQLite schema version with the same tables and columns. PostgreSQL support
+// started with the SQLite version 35 schema, hence the first step creating it
+// all at once; each later step must mirror exactly one SQLite step.
+// TestPostgresSchemaVersions compares the resulting schemas.
+var postgresSQLiteVersions = []int{
+	0: 0,
+	1: 35,
+	2: 36,
+}
+
+func init() {
+	if len(allPostgresSteps) != maxPostgresSchemaVersion {
+		panic(fmt.Sprintf("Got %d postgres update functions for schema version %d", len(allPostgresSteps), maxPostgresSchemaVersion))
+	}
+	if len(postgresSQLiteVersions) != maxPostgresSchemaVersion+1 {
+		panic(fmt.Sprintf("Got %d SQLite versions for postgres schema version %d", len(postgresSQLiteVersions), maxPostgresSchemaVersion))
+	}
+}
+
+var _ = RegisterPostgresStep(UpdateStep{
+	Apply:  pgV0Tov1,
+	Revert: pgV1Tov0,
+})
+
+// pgV0Tov1 creates the schema at once, as it was for SQLite version 35 - see
+// postgresSQLiteVersions.
+// JSON is stored as text, as with SQLite: it is the serialization of protobuf
+// messages, whose exact form must be kept.
+func pgV0Tov1(ctx context.Context, txn txnInterface) error {
+	sqlStmt := `
+		-- Mastopoof user information.
+		CREATE TABLE userstate (
+			-- A unique id for that user.
+			uid BIGINT PRIMARY KEY,
+			-- Protobuf mastpoof.storage.UserState as JSON
+			state TEXT NOT NULL
+		);
+
+		-- State of a Mastodon account.
+		CREATE TABLE accountstate (
+			-- Unique id.
+			asid BIGINT PRIMARY KEY,
+			-- Protobuf mastopoof.storage.AccountState as JSON
+			state TEXT NOT NULL,
+			-- The user which owns this account.
+			uid BIGINT NOT NULL REFERENCES userstate(uid)
+		);
+
+		-- Info about app registration on Mastodon servers.
+		CREATE TABLE appregstate (
+			-- Hash of redirect URI & scopes requested.
+			key TEXT NOT NULL,
+			-- Protobuf mastopoof.storage.AppRegState as JSON
+			state TEXT NOT NULL
+		);
+
+		-- Information about a stream.
+		CREATE TABLE streamstate (
+			-- Unique id for this stream.
+			stid BIGINT PRIMARY KEY,
+			-- Protobuf mastopoof.storage.StreamState as JSON
+			state TEXT NOT NULL
+		);
+
+		-- Statuses which were obtained from Mastodon.
+		CREATE TABLE statuses (
+			-- A unique ID.
+			sid BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			-- The Mastodon account that got that status.
+			asid BIGINT NOT NULL REFERENCES accountstate(asid),
+			-- The status, serialized as JSON.
+			status TEXT NOT NULL,
+			-- Protobuf mastopoof.storage.StatusMeta as JSON
+			status_meta TEXT NOT NULL DEFAULT '{}',
+
+			status_id TEXT NOT NULL GENERATED ALWAYS AS (status::jsonb ->> 'id') STORED,
+			status_reblog_id TEXT GENERATED ALWAYS AS (status::jsonb #>> '{reblog,id}') STORED,
+
+			-- Full text index of the status; equivalent of the statuses_fts
+			-- table of SQLite. Written by Storage - see indexStatus.
+			fts TSVECTOR
+		);
+
+		CREATE INDEX statuses_asid_status_id ON statuses(asid, status_id);
+		CREATE INDEX statuses_status_id ON statuses(status_id);
+		CREATE INDEX statuses_status_reblog_id ON statuses(status_reblog_id);
+		CREATE INDEX statuses_fts ON statuses USING GIN (fts);
+
+		-- The actual content of a stream - see schema.sql.
+		CREATE TABLE streamcontent (
+			stid BIGINT NOT NULL REFERENCES streamstate(stid),
+			sid BIGINT NOT NULL REFERENCES statuses(sid),
+			-- NULL as long as the status is not triaged.
+			position BIGINT,
+
+			status_id TEXT NOT NULL,
+			status_reblog_id TEXT,
+			status_in_reply_to_id TEXT,
+
+			-- Protobuf mastopoof.storage.StreamStatusState as JSON
+			stream_status_state TEXT NOT NULL DEFAULT '{}',
+
+			status_uri TEXT,
+			status_reblog_uri TEXT,
+
+			PRIMARY KEY (stid, sid)
+		);
+
+		CREATE INDEX streamcontent_sid ON streamcontent(sid);
+		CREATE INDEX streamcontent_position ON streamcontent(position);
+		CREATE INDEX streamcontent_status_id ON streamcontent(status_id);
+		CREATE INDEX streamcontent_status_reblog_id ON streamcontent(status_reblog_id);
+		CREATE INDEX streamcontent_status_uri ON streamcontent(status_uri);
+		CREATE INDEX streamcontent_status_reblog_uri ON streamcontent(status_reblog_uri);
+		CREATE INDEX streamcontent_status_in_reply_to_id ON streamcontent(status_in_reply_to_id);
+
+		-- Notifications obtained from Mastodon.
+		CREATE TABLE notifications (
+			-- A unique ID, increasing with insertion.
+			nid BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			-- The Mastodon account that got that notification.
+			asid BIGINT NOT NULL REFERENCES accountstate(asid),
+			-- The notification, serialized as JSON.
+			notification TEXT NOT NULL,
+			-- Kept as an integer, as with SQLite.
+			read INTEGER NOT NULL DEFAULT 0,
+
+			notification_id TEXT NOT NULL GENERATED ALWAYS AS (notification::jsonb ->> 'id') STORED,
+			notification_type TEXT NOT NULL GENERATED ALWAYS AS (notification::jsonb ->> 'type') STORED,
+			status_uri TEXT GENERATED ALWAYS AS (notification::jsonb #>> '{status,uri}') STORED
+		);
+
+		CREATE UNIQUE INDEX notifications_asid_notification_id ON notifications(asid, notification_id);
+
+		-- HTTP sessions - see pgSessionStore.
+		CREATE TABLE sessions (
+			token TEXT PRIMARY KEY,
+			data BYTEA NOT NULL,
+			expiry TIMESTAMPTZ NOT NULL
+		);
+
+		CREATE INDEX sessions_expiry ON sessions(expiry);
+	`
+	if _, err := txn.ExecContext(ctx, sqlStmt); err != nil {
+		return fmt.Errorf("unable to run %q: %w", sqlStmt, err)
+	}
+	return nil
+}
+
+func pgV1Tov0(ctx context.Context, txn txnInterface) error {
+	sqlStmt := `
+		DROP TABLE sessions;
+		DROP TABLE notifications;
+		DROP TABLE streamcontent;
+		DROP TABLE statuses;
+		DROP TABLE streamstate;
+		DROP TABLE appregstate;
+		DROP TABLE accountstate;
+		DROP TABLE userstate;
+	`
+	if _, err := txn.ExecContext(ctx, sqlStmt); err != nil {
+		return fmt.Errorf("unable to run %q: %w", sqlStmt, err)
+	}
+	return nil
+}
+
+var _ = RegisterPostgresStep(UpdateStep{
+	Apply:  pgV1Tov2,
+	Revert: pgV2Tov1,
+})
+
+// pgV1Tov2 is the equivalent of SQLite v35Tov36.
+func pgV1Tov2(ctx context.Context, txn txnInterface) error {
+	sqlStmt := `
+		-- Codes allowing to create new users.
+		CREATE TABLE invitecodes (
+			code TEXT PRIMARY KEY,
+			-- Protobuf mastopoof.storage.InviteCode as JSON
+			state TEXT NOT NULL
+		);
+	`
+	if _, err := txn.ExecContext(ctx, sqlStmt); err != nil {
+		return fmt.Errorf("unable to run %q: %w", sqlStmt, err)
+	}
+	return nil
+}
+
+func pgV2Tov1(ctx context.Context, txn txnInterface) error {
+	sqlStmt := `
+		DROP TABLE invitecodes;
+	`
+	if _, err := txn.ExecContext(ctx, sqlStmt); err != nil {
+		return fmt.Errorf("unable to run %q: %w", sqlStmt, err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// This file contains the rules used to decide which status of the pool
+// is picked next when adding statuses to a stream.
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Palats/mastopoof/backend/types"
+	settingspb "github.com/Palats/mastopoof/proto/gen/mastopoof/settings"
+	stpb "github.com/Palats/mastopoof/proto/gen/mastopoof/storage"
+	"github.com/mattn/go-mastodon"
+)
+
+// Ranker scores statuses from the pool. When triaging, the status with
+// the highest score is added next to the stream. Statuses with the same score
+// are picked oldest first.
+type Ranker interface {
+	Score(status *mastodon.Status, statusMeta *stpb.StatusMeta, settings *settingspb.Settings) int64
+}
+
+// RankerFunc adapts a function to the Ranker interface.
+type RankerFunc func(status *mastodon.Status, statusMeta *stpb.StatusMeta, settings *settingspb.Settings) int64
+
+func (f RankerFunc) Score(status *mastodon.Status, statusMeta *stpb.StatusMeta, settings *settingspb.Settings) int64 {
+	return f(status, statusMeta, settings)
+}
+
+// rankers contains the known ranking strategies, indexed by the setting value
+// selecting them.
+var rankers = map[settingspb.SettingRanking_Values]Ranker{}
+
+// RegisterRanker makes a ranking strategy available for the given setting
+// value.
+func RegisterRanker(value settingspb.SettingRanking_Values, ranker Ranker) {
+	if _, ok := rankers[value]; ok {
+		panic(fmt.Sprintf("ranker %v registered twice", value))
+	}
+	rankers[value] = ranker
+}
+
+// RankerForSettings returns the ranking strategy selected in the user settings.
+// It falls back to oldest first if the selected strategy is unknown.
+func RankerForSettings(settings *settingspb.Settings) Ranker {
+	if ranker, ok := rankers[types.SettingRanking(settings)]; ok {
+		return ranker
+	}
+	return rankers[settingspb.SettingRanking_OLDEST_FIRST]
+}
+
+func init() {
+	// All statuses are equal, so creation time decides.
+	RegisterRanker(settingspb.SettingRanking_OLDEST_FIRST, RankerFunc(func(status *mastodon.Status, statusMeta *stpb.StatusMeta, settings *settingspb.Settings) int64 {
+		return 0
+	}))
+
+	RegisterRanker(settingspb.SettingRanking_NEWEST_FIRST, RankerFunc(func(status *mastodon.Status, statusMeta *stpb.StatusMeta, settings *settingspb.Settings) int64 {
+		return status.CreatedAt.UnixNano()
+	}))
+
+	RegisterRanker(settingspb.SettingRanking_BOOST_AUTHORS, RankerFunc(func(status *mastodon.Status, statusMeta *stpb.StatusMeta, settings *settingspb.Settings) int64 {
+		authors := settings.GetRanking().GetBoostedAuthors()
+		match := func(acct string) bool {
+			return slices.ContainsFunc(authors, func(a string) bool {
+				return strings.EqualFold(strings.TrimPrefix(a, "@"), acct)
+			})
+		}
+		if match(status.Account.Acct) {
+			return 1
+		}
+		// Reblogs count as well when the original status is from a boosted author.
+		if status.Reblog != nil && match(status.Reblog.Account.Acct) {
+			return 1
+		}
+		return 0
+	}))
+
+	RegisterRanker(settingspb.SettingRanking_DEMOTE_REBLOGS, RankerFunc(func(status *mastodon.Status, statusMeta *stpb.StatusMeta, settings *settingspb.Settings) int64 {
+		if status.Reblog != nil {
+			return -1
+		}
+		return 0
+	}))
+}
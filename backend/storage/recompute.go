@@ -0,0 +1,241 @@
+// This file contains the recomputation of the metadata of statuses already
+// cached - e.g., after Mastodon filters were modified.
+package storage
+
+import (
+	"context"
+
+	"github.com/Palats/mastopoof/backend/types"
+	stpb "github.com/Palats/mastopoof/proto/gen/mastopoof/storage"
+	"google.golang.org/protobuf/proto"
+)
+
+// recomputeMetaBatchSize is the number of statuses processed in each
+// transaction by RecomputeMeta.
+const recomputeMetaBatchSize = 500
+
+// inPoolSQL is true for statuses of the `statuses` table which are still in
+// the pool of at least one stream.
+const inPoolSQL = `EXISTS (
+	SELECT 1 FROM streamcontent
+	WHERE streamcontent.sid = statuses.sid AND streamcontent.position IS NULL
+)`
+
+// RecomputeMetaProgress indicates how far RecomputeMeta went.
+type RecomputeMetaProgress struct {
+	// Number of statuses to process.
+	Total int64
+	// Number of statuses processed so far.
+	Processed int64
+	// Number of processed statuses for which the metadata changed.
+	Updated int64
+}
+
+// RecomputeMeta computes again the metadata of the statuses cached for the
+// user, based on the Mastodon filters currently recorded on each account.
+// By default, only statuses still in the pool of a stream are considered; with
+// `includePositioned`, statuses already in streams are updated as well - e.g.,
+// to refresh filter warnings.
+// Statuses are processed in batches, each in its own transaction, to avoid
+// blocking other operations for too long. `progress` is called after each
+// batch if not nil; an error from it stops the recomputation. Stream stats
+// are updated once all statuses were processed.
+func (st *Storage) RecomputeMeta(ctx context.Context, uid types.UID, includePositioned bool, progress func(*RecomputeMetaProgress) error) (_ *RecomputeMetaProgress, retErr error) {
+	defer recordAction("recompute-meta")(retErr)
+
+	condition := "TRUE"
+	if !includePositioned {
+		condition = inPoolSQL
+	}
+
+	result := &RecomputeMetaProgress{}
+	filters := map[types.ASID][]*stpb.MastodonFilter{}
+	err := st.InTxnRO(ctx, func(ctx context.Context, txn SQLReadOnly) error {
+		accountStates, err := st.AllAccountStateByUID(ctx, txn, uid)
+		if err != nil {
+			return err
+		}
+		for _, accountState := range accountStates {
+			filters[types.ASID(accountState.Asid)] = accountState.Filters
+		}
+		return txn.QueryRow(ctx, "recompute-meta-count", `
+			SELECT COUNT(*)
+			FROM
+				statuses
+				JOIN accountstate USING (asid)
+			WHERE
+				accountstate.uid = ?
+				AND `+condition+`
+			;
+		`, uid).Scan(&result.Total)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var lastSID types.SID
+	for {
+		count := 0
+		updated := 0
+		batchLastSID := lastSID
+		err := st.InTxnRW(ctx, func(ctx context.Context, txn SQLReadWrite) error {
+			// The transaction might be attempted again on conflict.
+			count, updated, batchLastSID = 0, 0, lastSID
+			rows, err := txn.Query(ctx, "recompute-meta-batch", `
+				SELECT
+					statuses.sid,
+					statuses.asid,
+					statuses.status,
+					statuses.status_meta
+				FROM
+					statuses
+					JOIN accountstate USING (asid)
+				WHERE
+					accountstate.uid = ?
+					AND statuses.sid > ?
+					AND `+condition+`
+				ORDER BY statuses.sid
+				LIMIT ?
+				;
+			`, uid, lastSID, recomputeMetaBatchSize)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			changed := map[types.SID]*stpb.StatusMeta{}
+			for rows.Next() {
+				var sid types.SID
+				var asid types.ASID
+				var status types.SQLStatus
+				statusMeta := &stpb.StatusMeta{}
+				if err := rows.Scan(&sid, &asid, &status, types.SQLProto{statusMeta}); err != nil {
+					return err
+				}
+				count++
+				batchLastSID = sid
+				if newMeta := recomputedStatusMeta(&status, statusMeta, filters[asid]); newMeta != nil {
+					changed[sid] = newMeta
+				}
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			rows.Close()
+
+			for sid, statusMeta := range changed {
+				_, err := txn.Exec(ctx, "recompute-meta-update", `
+					UPDATE statuses SET status_meta = ? WHERE sid = ?;
+				`, types.SQLProto{statusMeta}, sid)
+				if err != nil {
+					return err
+				}
+			}
+			updated = len(changed)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		lastSID = batchLastSID
+		result.Updated += int64(updated)
+		result.Processed += int64(count)
+		if progress != nil {
+			if err := progress(result); err != nil {
+				return nil, err
+			}
+		}
+		if count < recomputeMetaBatchSize {
+			break
+		}
+	}
+
+	// Statuses might now be hidden or visible, which changes the number of
+	// statuses available in the pools.
+	err = st.InTxnRW(ctx, func(ctx context.Context, txn SQLReadWrite) error {
+		return st.refreshPoolStats(ctx, txn, uid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// recomputedStatusMeta returns the metadata of the status based on `filters`,
+// or nil if it is the same as `statusMeta`.
+func recomputedStatusMeta(status *types.SQLStatus, statusMeta *stpb.StatusMeta, filters []*stpb.MastodonFilter) *stpb.StatusMeta {
+	newMeta := computeStatusMeta(&status.Status, filters, statusMeta.FilterContext)
+	// Pruned statuses have no content left to match.
+	if statusMeta.Pruned {
+		newMeta.Filters = statusMeta.Filters
+		newMeta.Pruned = true
+	}
+	if proto.Equal(newMeta, statusMeta) {
+		return nil
+	}
+	return newMeta
+}
+
+// refreshPoolStats updates the number of remaining and filtered statuses of
+// all the streams of the user.
+func (st *Storage) refreshPoolStats(ctx context.Context, txn SQLReadWrite, uid types.UID) error {
+	streamStates, err := st.StreamStatesByUID(ctx, txn, uid)
+	if err != nil {
+		return err
+	}
+	for _, streamState := range streamStates {
+		computed, err := st.RecomputeStreamState(ctx, txn, types.StID(streamState.Stid))
+		if err != nil {
+			return err
+		}
+		streamState.Remaining = computed.Remaining
+		streamState.Filtered = computed.Filtered
+		if err := st.SetStreamState(ctx, txn, streamState); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recomputeAccountPool computes again the metadata of the statuses of the
+// account which are still in a pool, based on `filters`. Unlike RecomputeMeta,
+// it is done in a single transaction; pools are expected to be small enough.
+func (st *Storage) recomputeAccountPool(ctx context.Context, txn SQLReadWrite, accountState *stpb.AccountState, filters []*stpb.MastodonFilter) error {
+	rows, err := txn.Query(ctx, "recompute-account-pool", `
+		SELECT sid, status, status_meta FROM statuses WHERE asid = ? AND `+inPoolSQL+`;
+	`, accountState.Asid)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	changed := map[types.SID]*stpb.StatusMeta{}
+	for rows.Next() {
+		var sid types.SID
+		var status types.SQLStatus
+		statusMeta := &stpb.StatusMeta{}
+		if err := rows.Scan(&sid, &status, types.SQLProto{statusMeta}); err != nil {
+			return err
+		}
+		if newMeta := recomputedStatusMeta(&status, statusMeta, filters); newMeta != nil {
+			changed[sid] = newMeta
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if len(changed) == 0 {
+		return nil
+	}
+	for sid, statusMeta := range changed {
+		_, err := txn.Exec(ctx, "recompute-meta-update", `
+			UPDATE statuses SET status_meta = ? WHERE sid = ?;
+		`, types.SQLProto{statusMeta}, sid)
+		if err != nil {
+			return err
+		}
+	}
+	return st.refreshPoolStats(ctx, txn, types.UID(accountState.Uid))
+}
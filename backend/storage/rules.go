@@ -0,0 +1,111 @@
+// This file contains the evaluation of Mastopoof local filter rules - i.e.,
+// filters which are not known to Mastodon.
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Palats/mastopoof/backend/types"
+	stpb "github.com/Palats/mastopoof/proto/gen/mastopoof/storage"
+	"github.com/mattn/go-mastodon"
+	"google.golang.org/protobuf/proto"
+)
+
+// ruleHiddenSQL is true for statuses of `streamcontent` hidden by a local
+// filter rule, as recorded the last time they were considered for the stream.
+const ruleHiddenSQL = `EXISTS (
+	SELECT 1 FROM json_each(streamcontent.stream_status_state, '$.rule_matches')
+	WHERE json_extract(value, '$.action') = 'HIDE'
+)`
+
+// RulesNeedFollowing indicates whether evaluating the rules requires knowing
+// which accounts are followed - see AccountState.following_ids.
+func RulesNeedFollowing(rules []*stpb.FilterRule) bool {
+	return slices.ContainsFunc(rules, func(rule *stpb.FilterRule) bool {
+		return rule.Kind == stpb.FilterRule_REPLY_TO_UNFOLLOWED
+	})
+}
+
+// RuleDescription returns a user visible explanation of the rule.
+func RuleDescription(rule *stpb.FilterRule) string {
+	switch rule.Kind {
+	case stpb.FilterRule_REBLOGS_FROM:
+		return fmt.Sprintf("reblog by @%s", strings.TrimPrefix(rule.Account, "@"))
+	case stpb.FilterRule_LANGUAGE:
+		return fmt.Sprintf("language: %s", rule.Language)
+	case stpb.FilterRule_TOO_MANY_HASHTAGS:
+		return fmt.Sprintf("more than %d hashtags", rule.MaxHashtags)
+	case stpb.FilterRule_REPLY_TO_UNFOLLOWED:
+		return "reply to an account not followed"
+	default:
+		return rule.Kind.String()
+	}
+}
+
+// ruleMatches indicates whether the rule applies to the status. The status was
+// obtained through `accountState`, which can be nil if unknown.
+func ruleMatches(rule *stpb.FilterRule, status *mastodon.Status, accountState *stpb.AccountState) bool {
+	// For most rules, what matters is the content - i.e., the reblogged status
+	// for reblogs.
+	s := status
+	if status.Reblog != nil {
+		s = status.Reblog
+	}
+
+	switch rule.Kind {
+	case stpb.FilterRule_REBLOGS_FROM:
+		return status.Reblog != nil && strings.EqualFold(strings.TrimPrefix(rule.Account, "@"), status.Account.Acct)
+	case stpb.FilterRule_LANGUAGE:
+		return s.Language != "" && strings.EqualFold(rule.Language, s.Language)
+	case stpb.FilterRule_TOO_MANY_HASHTAGS:
+		return int64(len(s.Tags)) > rule.MaxHashtags
+	case stpb.FilterRule_REPLY_TO_UNFOLLOWED:
+		replyTo, _ := s.InReplyToAccountID.(string)
+		if replyTo == "" {
+			return false
+		}
+		// Without the list of followed accounts, it is not possible to tell.
+		if accountState == nil || accountState.FollowingFetchSecs == 0 {
+			return false
+		}
+		if replyTo == accountState.AccountId {
+			return false
+		}
+		return !slices.Contains(accountState.FollowingIds, replyTo)
+	default:
+		return false
+	}
+}
+
+// evaluateRules returns the local filter rules matching a status obtained
+// through the account `asid`.
+func evaluateRules(rules []*stpb.FilterRule, status *mastodon.Status, asid types.ASID, accountStates map[types.ASID]*stpb.AccountState) []*stpb.FilterRuleMatch {
+	var matches []*stpb.FilterRuleMatch
+	for _, rule := range rules {
+		if !ruleMatches(rule, status, accountStates[asid]) {
+			continue
+		}
+		matches = append(matches, &stpb.FilterRuleMatch{
+			RuleId:      rule.Id,
+			Action:      rule.Action,
+			Description: RuleDescription(rule),
+		})
+	}
+	return matches
+}
+
+// ruleHidden indicates whether any of the matches hides the status.
+func ruleHidden(matches []*stpb.FilterRuleMatch) bool {
+	return slices.ContainsFunc(matches, func(m *stpb.FilterRuleMatch) bool {
+		return m.Action == stpb.FilterRule_HIDE
+	})
+}
+
+// sameRuleMatches indicates whether both lists of matches are identical.
+func sameRuleMatches(a, b []*stpb.FilterRuleMatch) bool {
+	return slices.EqualFunc(a, b, func(x, y *stpb.FilterRuleMatch) bool {
+		return proto.Equal(x, y)
+	})
+}
@@ -99,6 +99,12 @@ CREATE TABLE "streamcontent" (
   -- Protobuf mastopoof.storage.StreamStatusState as JSON
   stream_status_state TEXT NOT NULL DEFAULT "{}",
 
+  -- Canonical URIs of the status and of the reblogged status, if any. Unlike
+  -- IDs, those are the same across Mastodon servers - which allows to detect
+  -- statuses obtained through different accounts.
+  status_uri TEXT,
+  status_reblog_uri TEXT,
+
   PRIMARY KEY (stid, sid),
   FOREIGN KEY(stid) REFERENCES streamstate(stid),
   FOREIGN KEY(sid) REFERENCES statuses(sid)
@@ -108,4 +114,53 @@ CREATE TABLE "streamcontent" (
 CREATE INDEX streamcontent_sid ON streamcontent(sid);
 CREATE INDEX streamcontent_position ON streamcontent(position);
 CREATE INDEX streamcontent_status_id ON streamcontent(status_id);
-CREATE INDEX streamcontent_status_reblog_id ON streamcontent(status_reblog_id);
\ No newline at end of file
+CREATE INDEX streamcontent_status_reblog_id ON streamcontent(status_reblog_id);
+CREATE INDEX streamcontent_status_uri ON streamcontent(status_uri);
+CREATE INDEX streamcontent_status_reblog_uri ON streamcontent(status_reblog_uri);
+CREATE INDEX streamcontent_status_in_reply_to_id ON streamcontent(status_in_reply_to_id);
+
+-- Full text index of the cached statuses. rowid is the sid of the status.
+-- For reblogs, the content of the reblogged status is indexed, along with
+-- both accounts. Rows are written by Storage, which indexes the text of the
+-- content instead of its HTML - see indexStatus.
+CREATE VIRTUAL TABLE statuses_fts USING fts5(
+  content,
+  spoiler_text,
+  account,
+  tags
+);
+
+CREATE TRIGGER statuses_fts_delete AFTER DELETE ON statuses BEGIN
+  DELETE FROM statuses_fts WHERE rowid = old.sid;
+END;
+
+-- Notifications obtained from Mastodon.
+CREATE TABLE notifications (
+  -- A unique ID, increasing with insertion.
+  nid INTEGER PRIMARY KEY AUTOINCREMENT,
+  -- The Mastodon account that got that notification.
+  asid INTEGER NOT NULL,
+  -- The notification, serialized as JSON.
+  notification TEXT NOT NULL,
+  -- Whether the notification was read - either from Mastopoof or according to
+  -- the Mastodon notifications marker.
+  read INTEGER NOT NULL DEFAULT 0,
+
+  notification_id TEXT NOT NULL GENERATED ALWAYS AS (json_extract(notification, '$.id')) STORED,
+  notification_type TEXT NOT NULL GENERATED ALWAYS AS (json_extract(notification, '$.type')) STORED,
+  -- URI of the status the notification is about, if any. Unlike IDs, it is the
+  -- same across Mastodon servers.
+  status_uri TEXT GENERATED ALWAYS AS (json_extract(notification, '$.status.uri')) STORED,
+
+  FOREIGN KEY(asid) REFERENCES accountstate(asid)
+) STRICT;
+
+CREATE UNIQUE INDEX notifications_asid_notification_id ON notifications(asid, notification_id);
+
+-- Codes allowing to create new users.
+CREATE TABLE invitecodes (
+  -- The code itself.
+  code TEXT PRIMARY KEY,
+  -- Protobuf mastopoof.storage.InviteCode as JSON
+  state TEXT NOT NULL
+) STRICT;
@@ -0,0 +1,392 @@
+// This file contains the search over the statuses cached for a user.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Palats/mastopoof/backend/types"
+	stpb "github.com/Palats/mastopoof/proto/gen/mastopoof/storage"
+	"github.com/mattn/go-mastodon"
+	"golang.org/x/net/html"
+)
+
+// SearchQuery describes which statuses to look for. All the constraints which
+// are set must match; zero values mean no constraint.
+type SearchQuery struct {
+	// The user whose cached statuses are searched. Mandatory.
+	UID types.UID
+	// The stream used for the position of the results and for stream specific
+	// constraints. If zero, results have no position and stream specific
+	// constraints cannot be used.
+	StID types.StID
+
+	// Mastodon status ID. As status IDs are server specific, this can match
+	// unrelated statuses from different accounts.
+	StatusID mastodon.ID
+	// Full text search. All the words must be found in the content, spoiler
+	// text, author or hashtags of the status.
+	Text string
+	// Account (`acct`, e.g., `foo` or `foo@example.com`) of the author of the
+	// status. For reblogs, either the author or the rebloger can match.
+	Author string
+	// Creation time of the status, both inclusive.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Position in the stream, both inclusive. Statuses not yet triaged never
+	// match when set. Stream specific.
+	MinPosition int64
+	MaxPosition int64
+
+	HasMedia *bool
+	HasPoll  *bool
+	// Favourited and reblogged by the Mastodon account the status was fetched
+	// from.
+	Favourited *bool
+	Reblogged  *bool
+	// Whether any of the Mastodon filters matched when the status was fetched.
+	FilterMatched *bool
+	// Stream specific. UNKNOWN means no constraint.
+	AlreadySeen stpb.StreamStatusState_AlreadySeen
+
+	// Maximum number of results. Zero means no limit.
+	Limit int64
+}
+
+// HasConstraints indicates whether any constraint besides the user is set.
+func (q *SearchQuery) HasConstraints() bool {
+	return q.StatusID != "" || q.Text != "" || q.Author != "" ||
+		!q.CreatedAfter.IsZero() || !q.CreatedBefore.IsZero() ||
+		q.MinPosition != 0 || q.MaxPosition != 0 ||
+		q.HasMedia != nil || q.HasPoll != nil || q.Favourited != nil || q.Reblogged != nil || q.FilterMatched != nil ||
+		q.AlreadySeen != stpb.StreamStatusState_UNKNOWN
+}
+
+// searchBuilder assembles the SQL query of a search, one constraint at a time.
+type searchBuilder struct {
+	joins    []string
+	joinArgs []any
+	conds    []string
+	condArgs []any
+	orderBy  []string
+	// SQL expression identifying the same status across rows; only the first
+	// row of each is returned.
+	distinct string
+}
+
+// join adds a table to the query, after the base `statuses` and
+// `streamcontent` tables.
+func (b *searchBuilder) join(clause string, args ...any) {
+	b.joins = append(b.joins, clause)
+	b.joinArgs = append(b.joinArgs, args...)
+}
+
+// where adds a condition which must be true for all results.
+func (b *searchBuilder) where(cond string, args ...any) {
+	b.conds = append(b.conds, cond)
+	b.condArgs = append(b.condArgs, args...)
+}
+
+// whereBool adds a condition on a boolean SQL expression, if a value is
+// required.
+func (b *searchBuilder) whereBool(expr string, value *bool) {
+	if value == nil {
+		return
+	}
+	b.where(fmt.Sprintf("(%s) = ?", expr), *value)
+}
+
+// build returns the SQL query and its arguments.
+func (b *searchBuilder) build(stid types.StID, limit int64) (string, []any) {
+	args := []any{stid}
+	args = append(args, b.joinArgs...)
+	args = append(args, b.condArgs...)
+
+	// Duplicates are removed before the limit is applied, so the number of
+	// results is not reduced by them.
+	orderBy := strings.Join(b.orderBy, ", ")
+	query := `
+		SELECT asid, status, status_meta, position, stream_status_state
+		FROM (
+			SELECT
+				statuses.asid AS asid,
+				statuses.status AS status,
+				statuses.status_meta AS status_meta,
+				coalesce(streamcontent.position, 0) AS position,
+				coalesce(streamcontent.stream_status_state, '{}') AS stream_status_state,
+				ROW_NUMBER() OVER (ORDER BY ` + orderBy + `) AS search_order,
+				ROW_NUMBER() OVER (PARTITION BY ` + b.distinct + ` ORDER BY ` + orderBy + `) AS distinct_order
+			FROM
+				statuses
+				LEFT JOIN streamcontent ON streamcontent.sid = statuses.sid AND streamcontent.stid = ?
+	`
+	for _, j := range b.joins {
+		query += "\t\t\t\t" + j + "\n"
+	}
+	query += "\t\t\tWHERE\n\t\t\t\t" + strings.Join(b.conds, "\n\t\t\t\tAND ") + "\n"
+	query += "\t\t) AS results\n"
+	query += "\t\tWHERE distinct_order = 1\n"
+	query += "\t\tORDER BY search_order\n"
+	if limit > 0 {
+		query += "\t\tLIMIT ?\n"
+		args = append(args, limit)
+	}
+	query += "\t\t;"
+	return query, args
+}
+
+// searchDialect contains the SQL expressions of Search which depend on the
+// database engine. Expressions with an argument have a single `?`.
+type searchDialect struct {
+	// Condition on the Mastodon ID of the status.
+	statusID string
+	// URI of the status, identifying it across Mastodon servers.
+	uri string
+	// Join restricting results to statuses matching a full text search, and
+	// how to order them by relevance. textQuery converts the user provided
+	// text into the argument of the join; it is empty if there is nothing to
+	// look for.
+	textJoin    string
+	textOrderBy string
+	textQuery   func(text string) string
+	// Condition on the `acct` of the author or of the rebloger.
+	author string
+	// Conditions on the creation time of the status, as unix timestamp.
+	createdAfter  string
+	createdBefore string
+	// Boolean expressions for the corresponding fields of SearchQuery.
+	hasMedia      string
+	hasPoll       string
+	favourited    string
+	reblogged     string
+	filterMatched string
+	// Condition on the already seen state, given as its name.
+	alreadySeen string
+}
+
+var sqliteSearch = searchDialect{
+	statusID:      "json_extract(statuses.status, '$.id') = ?",
+	uri:           "json_extract(statuses.status, '$.uri')",
+	textJoin:      "JOIN (SELECT rowid, rank FROM statuses_fts WHERE statuses_fts MATCH ?) AS fts ON fts.rowid = statuses.sid",
+	textOrderBy:   "fts.rank",
+	textQuery:     ftsQuery,
+	author:        "lower(?) IN (lower(json_extract(statuses.status, '$.account.acct')), lower(json_extract(statuses.status, '$.reblog.account.acct')))",
+	createdAfter:  "unixepoch(json_extract(statuses.status, '$.created_at')) >= ?",
+	createdBefore: "unixepoch(json_extract(statuses.status, '$.created_at')) <= ?",
+	hasMedia:      "coalesce(json_array_length(" + statusField("media_attachments") + "), 0) > 0",
+	hasPoll:       statusField("poll") + " IS NOT NULL",
+	favourited:    "coalesce(" + statusField("favourited") + ", false)",
+	reblogged:     "coalesce(" + statusField("reblogged") + ", false)",
+	filterMatched: "EXISTS (SELECT 1 FROM json_each(statuses.status_meta, '$.filters') WHERE json_extract(value, '$.matched'))",
+	alreadySeen:   "json_extract(streamcontent.stream_status_state, '$.already_seen') = ?",
+}
+
+// statusField is a SQL expression extracting a field of the status. For
+// reblogs, the field of the reblogged status is used.
+func statusField(path string) string {
+	return fmt.Sprintf(`coalesce(json_extract(statuses.status, '$.reblog.%s'), json_extract(statuses.status, '$.%s'))`, path, path)
+}
+
+// ftsQuery converts user provided text into a FTS5 query. Each word must be
+// present in the status, in any of the indexed columns. Words are quoted, so
+// FTS5 operators are not interpreted.
+func ftsQuery(text string) string {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// Search looks for cached statuses of a user matching the query. Results are
+// ordered by relevance when searching for text, then by position in the
+// stream. Statuses not triaged in the stream come last.
+// A status cached through multiple accounts is returned only once.
+func (st *Storage) Search(ctx context.Context, txn SQLReadOnly, q *SearchQuery) (_ []*Item, retErr error) {
+	defer recordAction("search")(retErr)
+
+	b := &searchBuilder{}
+	b.where("statuses.asid IN (SELECT asid FROM accountstate WHERE uid = ?)", q.UID)
+
+	sd := &st.backend.dialect().search
+	if q.StatusID != "" {
+		b.where(sd.statusID, q.StatusID)
+	}
+	if q.Text != "" {
+		text := sd.textQuery(q.Text)
+		if text == "" {
+			return nil, errors.New("empty search text")
+		}
+		b.join(sd.textJoin, text)
+		b.orderBy = append(b.orderBy, sd.textOrderBy)
+	}
+	if author := strings.TrimPrefix(q.Author, "@"); author != "" {
+		b.where(sd.author, author)
+	}
+	if !q.CreatedAfter.IsZero() {
+		b.where(sd.createdAfter, q.CreatedAfter.Unix())
+	}
+	if !q.CreatedBefore.IsZero() {
+		b.where(sd.createdBefore, q.CreatedBefore.Unix())
+	}
+
+	b.whereBool(sd.hasMedia, q.HasMedia)
+	b.whereBool(sd.hasPoll, q.HasPoll)
+	b.whereBool(sd.favourited, q.Favourited)
+	b.whereBool(sd.reblogged, q.Reblogged)
+	b.whereBool(sd.filterMatched, q.FilterMatched)
+
+	streamSpecific := false
+	if q.MinPosition != 0 {
+		streamSpecific = true
+		b.where("streamcontent.position >= ?", q.MinPosition)
+	}
+	if q.MaxPosition != 0 {
+		streamSpecific = true
+		b.where("streamcontent.position <= ?", q.MaxPosition)
+	}
+	if q.AlreadySeen != stpb.StreamStatusState_UNKNOWN {
+		streamSpecific = true
+		b.where(sd.alreadySeen, q.AlreadySeen.String())
+	}
+	if streamSpecific && q.StID == 0 {
+		return nil, errors.New("stream specific search constraints require a stream")
+	}
+
+	b.orderBy = append(b.orderBy, "streamcontent.position IS NULL", "streamcontent.position", "statuses.sid")
+	// The same status can be cached through multiple accounts; only keep the
+	// first one - which is the one in the stream, if any. Statuses without URI
+	// are kept as is.
+	b.distinct = "coalesce(nullif(" + sd.uri + ", ''), CAST(statuses.sid AS TEXT))"
+
+	query, args := b.build(q.StID, q.Limit)
+	rows, err := txn.Query(ctx, "search", query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*Item
+	for rows.Next() {
+		var asid types.ASID
+		var status types.SQLStatus
+		statusMeta := &stpb.StatusMeta{}
+		var position int64
+		streamStatusState := &stpb.StreamStatusState{}
+		if err := rows.Scan(&asid, &status, types.SQLProto{statusMeta}, &position, types.SQLProto{streamStatusState}); err != nil {
+			return nil, err
+		}
+		results = append(results, &Item{
+			Position:          position,
+			ASID:              asid,
+			StreamStatusState: streamStatusState,
+			Status:            status.Status,
+			StatusMeta:        statusMeta,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ftsFields returns the text indexed for the full text search of a status:
+// its content, spoiler text, accounts and hashtags. For reblogs, the content
+// of the reblogged status is indexed, along with both accounts. The content
+// is HTML; only its text is indexed, so markup does not match searches.
+func ftsFields(status *mastodon.Status) (content string, spoilerText string, account string, tags string) {
+	original := status
+	if status.Reblog != nil {
+		original = status.Reblog
+	}
+	accounts := []string{status.Account.Acct, status.Account.DisplayName}
+	var tagNames []string
+	for _, tag := range status.Tags {
+		tagNames = append(tagNames, tag.Name)
+	}
+	if status.Reblog != nil {
+		accounts = append(accounts, status.Reblog.Account.Acct, status.Reblog.Account.DisplayName)
+		for _, tag := range status.Reblog.Tags {
+			tagNames = append(tagNames, tag.Name)
+		}
+	}
+	return htmlText(original.Content), original.SpoilerText, strings.Join(accounts, " "), strings.Join(tagNames, " ")
+}
+
+// htmlText returns the text of HTML content, with entities decoded. Elements
+// are replaced by spaces, so words of different paragraphs stay separated.
+func htmlText(content string) string {
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(content))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return b.String()
+		case html.TextToken:
+			b.Write(z.Text())
+		default:
+			b.WriteByte(' ')
+		}
+	}
+}
+
+// indexStatusSQL sets the full text index entry of a status.
+const indexStatusSQL = `
+	INSERT OR REPLACE INTO statuses_fts(rowid, content, spoiler_text, account, tags) VALUES (?, ?, ?, ?, ?);
+`
+
+// indexStatus updates the full text index after status `sid` was inserted or
+// modified. Entries of deleted statuses are removed by the database.
+func (st *Storage) indexStatus(ctx context.Context, txn SQLReadWrite, sid types.SID, status *mastodon.Status) error {
+	content, spoilerText, account, tags := ftsFields(status)
+	_, err := txn.Exec(ctx, "index-status", st.backend.dialect().indexStatus, sid, content, spoilerText, account, tags)
+	return err
+}
+
+// ftsBatchSize is how many statuses indexAllStatuses reads at once.
+const ftsBatchSize = 1000
+
+// indexAllStatuses fills the full text index from all the cached statuses,
+// for schema updates. `stmt` is the engine specific version of
+// indexStatusSQL.
+func indexAllStatuses(ctx context.Context, txn txnInterface, stmt string) error {
+	var lastSID types.SID
+	for {
+		// `$1` is understood by both SQLite and PostgreSQL.
+		rows, err := txn.QueryContext(ctx, `SELECT sid, status FROM statuses WHERE sid > $1 ORDER BY sid LIMIT $2;`, lastSID, ftsBatchSize)
+		if err != nil {
+			return err
+		}
+		type entry struct {
+			sid    types.SID
+			status types.SQLStatus
+		}
+		var entries []*entry
+		for rows.Next() {
+			e := &entry{}
+			if err := rows.Scan(&e.sid, &e.status); err != nil {
+				rows.Close()
+				return err
+			}
+			entries = append(entries, e)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		for _, e := range entries {
+			content, spoilerText, account, tags := ftsFields(&e.status.Status)
+			if _, err := txn.ExecContext(ctx, stmt, e.sid, content, spoilerText, account, tags); err != nil {
+				return fmt.Errorf("unable to index status %d: %w", e.sid, err)
+			}
+			lastSID = e.sid
+		}
+		if len(entries) < ftsBatchSize {
+			return nil
+		}
+	}
+}
@@ -9,18 +9,23 @@ import (
 	"fmt"
 	"math/rand"
 	"net/url"
+	"os"
+	"regexp"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Palats/mastopoof/backend/types"
 	settingspb "github.com/Palats/mastopoof/proto/gen/mastopoof/settings"
 	stpb "github.com/Palats/mastopoof/proto/gen/mastopoof/storage"
-	"github.com/alexedwards/scs/sqlite3store"
+	"github.com/alexedwards/scs/v2"
 	"github.com/golang/glog"
 	"github.com/mattn/go-mastodon"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/proto"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -73,8 +78,23 @@ type txnInterface interface {
 	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
 }
 
+// sqlAdapter runs statements written for SQLite, after adapting them to the
+// actual database engine.
 type sqlAdapter struct {
 	pseudoTxn txnInterface
+	backend   backend
+	// Streams whose state is modified by the transaction - see
+	// markStreamChanged. Nil when not tracked.
+	changedStreams map[types.StID]bool
+}
+
+// markStreamChanged records that the transaction modifies the state of the
+// stream, so watchers of that stream are notified once it is committed - see
+// StreamSignal.
+func markStreamChanged(txn SQLReadWrite, stid types.StID) {
+	if sa, ok := txn.(sqlAdapter); ok && sa.changedStreams != nil {
+		sa.changedStreams[stid] = true
+	}
 }
 
 func (sa sqlAdapter) QueryRow(ctx context.Context, name string, query string, args ...any) *sql.Row {
@@ -83,7 +103,7 @@ func (sa sqlAdapter) QueryRow(ctx context.Context, name string, query string, ar
 		d := time.Since(start)
 		sqlLatency.With(prometheus.Labels{"op": "query-row", "stmt": name, "code": errToCode(nil)}).Observe(d.Seconds())
 	}()
-	return sa.pseudoTxn.QueryRowContext(ctx, query, args...)
+	return sa.pseudoTxn.QueryRowContext(ctx, sa.backend.rewrite(query), args...)
 }
 
 func (sa sqlAdapter) Query(ctx context.Context, name string, query string, args ...any) (_ *sql.Rows, retErr error) {
@@ -92,7 +112,7 @@ func (sa sqlAdapter) Query(ctx context.Context, name string, query string, args
 		d := time.Since(start)
 		sqlLatency.With(prometheus.Labels{"op": "query", "stmt": name, "code": errToCode(retErr)}).Observe(d.Seconds())
 	}()
-	return sa.pseudoTxn.QueryContext(ctx, query, args...)
+	return sa.pseudoTxn.QueryContext(ctx, sa.backend.rewrite(query), args...)
 }
 
 func (sa sqlAdapter) Exec(ctx context.Context, name string, query string, args ...any) (_ sql.Result, retErr error) {
@@ -101,7 +121,7 @@ func (sa sqlAdapter) Exec(ctx context.Context, name string, query string, args .
 		d := time.Since(start)
 		sqlLatency.With(prometheus.Labels{"op": "exec", "stmt": name, "code": errToCode(retErr)}).Observe(d.Seconds())
 	}()
-	return sa.pseudoTxn.ExecContext(ctx, query, args...)
+	return sa.pseudoTxn.ExecContext(ctx, sa.backend.rewrite(query), args...)
 }
 
 var ErrNotFound = errors.New("not found")
@@ -126,16 +146,34 @@ func IDLess(id1 mastodon.ID, id2 mastodon.ID) bool {
 	return true
 }
 
+// Storage implements Store over a database. The same implementation is used
+// for SQLite and PostgreSQL; what differs between them is provided by
+// `backend`.
 type Storage struct {
 	// Readonly access to the database.
 	roDB *sql.DB
 	// Read-write access to the database.
 	rwDB *sql.DB
+	// Database engine specifics.
+	backend backend
+	// Shared lock on the SQLite database file, preventing it from being
+	// restored while in use - see lockDB. Nil for in-memory databases.
+	lockFile *os.File
+	// Session stores created by NewSCSStore, whose cleanup goroutines are
+	// stopped on Close.
+	sessionStores []interface{ StopCleanup() }
+
+	// Protects streamChs.
+	streamMu sync.Mutex
+	// Per stream, closed - and removed - when a read-write transaction
+	// modifying the state of that stream is committed.
+	streamChs map[types.StID]chan struct{}
 }
 
 // NewStorage creates a new Mastopoof abstraction layer.
 // Parameters:
-//   - `dbURL`: the connection URLs to sqlite suitable for Go sql layer.
+//   - `dbURL`: the connection URLs to sqlite suitable for Go sql layer, or a
+//     PostgreSQL URL (`postgres://...`).
 func NewStorage(ctx context.Context, dbURL string) (returnedSt *Storage, returnedErr error) {
 	// Make sure to cleanup everything in case of errors.
 	defer func() {
@@ -148,7 +186,7 @@ func NewStorage(ctx context.Context, dbURL string) (returnedSt *Storage, returne
 	if err != nil {
 		return nil, err
 	}
-	return st, st.initVersion(ctx, maxSchemaVersion)
+	return st, st.initVersion(ctx, st.backend.maxVersion())
 }
 
 // Storage setup is largely inspired from https://kerkour.com/sqlite-for-servers
@@ -176,7 +214,14 @@ func newStorageNoInit(ctx context.Context, dbURI string) (returnedSt *Storage, r
 		}
 	}()
 
-	st := &Storage{}
+	if isPostgresURI(dbURI) {
+		return newPostgresStorageNoInit(ctx, dbURI)
+	}
+
+	st := &Storage{
+		streamChs: make(map[types.StID]chan struct{}),
+		backend:   sqliteBackend{},
+	}
 
 	if dbURI == ":memory:" {
 		// Just ':memory:' is not parseable as URI, so special case it.
@@ -198,6 +243,17 @@ func newStorageNoInit(ctx context.Context, dbURI string) (returnedSt *Storage, r
 		u.RawQuery = q.Encode()
 	}
 
+	if !inMemory {
+		dbPath, err := dbFilePath(dbURI)
+		if err != nil {
+			return nil, err
+		}
+		st.lockFile, err = lockDB(dbPath, false /* exclusive */)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// -- Write access
 	rwURI := *u
 	q := rwURI.Query()
@@ -224,6 +280,18 @@ func newStorageNoInit(ctx context.Context, dbURI string) (returnedSt *Storage, r
 		return nil, fmt.Errorf("unable to configure DB connection: %w", err)
 	}
 
+	// Search relies on SQLite FTS5 extension. Builds without the
+	// `sqlite_fts5` tag fail - see fts5_missing.go - but a SQLite library
+	// from the system - `libsqlite3` tag - might lack it as well. The schema
+	// update creating the search index would then fail with an obscure error.
+	var hasFTS5 bool
+	if err := st.rwDB.QueryRowContext(ctx, "SELECT sqlite_compileoption_used('ENABLE_FTS5');").Scan(&hasFTS5); err != nil {
+		return nil, fmt.Errorf("unable to check SQLite options: %w", err)
+	}
+	if !hasFTS5 {
+		return nil, errors.New("SQLite FTS5 extension is not available; Mastopoof must be built with `-tags sqlite_fts5`")
+	}
+
 	// Read-only access
 	roURI := *u
 	q = roURI.Query()
@@ -276,6 +344,10 @@ func (st *Storage) Close() error {
 	if st == nil {
 		return nil
 	}
+	for _, store := range st.sessionStores {
+		store.StopCleanup()
+	}
+	st.sessionStores = nil
 	if st.rwDB != nil {
 		st.rwDB.Close()
 		st.rwDB = nil
@@ -284,18 +356,26 @@ func (st *Storage) Close() error {
 		st.roDB.Close()
 		st.roDB = nil
 	}
+	if st.lockFile != nil {
+		st.lockFile.Close()
+		st.lockFile = nil
+	}
 	return nil
 }
 
 func (st *Storage) initVersion(ctx context.Context, targetVersion int) error {
-	return prepareDB(ctx, st.rwDB, targetVersion)
+	return st.backend.prepare(ctx, st.rwDB, targetVersion)
 }
 
-func (st *Storage) NewSCSStore() *sqlite3store.SQLite3Store {
+func (st *Storage) NewSCSStore() scs.Store {
 	// This should probbly differentiate between read-heavy cookie management and
 	// the occasional writes. However, once that starts to be an actually issue,
 	// splitting SCS store into its own DB would probably make more sense.
-	return sqlite3store.New(st.rwDB)
+	store := st.backend.sessionStore(st.rwDB)
+	if s, ok := store.(interface{ StopCleanup() }); ok {
+		st.sessionStores = append(st.sessionStores, s)
+	}
+	return store
 }
 
 // ErrCleanAbortTxn signals that the transaction must not be committed, but that it
@@ -333,7 +413,7 @@ func (st *Storage) inTxnRO(ctx context.Context, txn SQLReadOnly, f func(ctx cont
 	}
 	defer localTxn.Rollback()
 
-	err = f(ctx, sqlAdapter{localTxn})
+	err = f(ctx, sqlAdapter{localTxn, st.backend, nil})
 	if errors.Is(err, ErrCleanAbortTxn) {
 		return nil
 	}
@@ -343,6 +423,9 @@ func (st *Storage) inTxnRO(ctx context.Context, txn SQLReadOnly, f func(ctx cont
 	return localTxn.Commit()
 }
 
+// inTxnRW is the read-write equivalent of inTxnRO. With PostgreSQL, a new
+// transaction conflicting with a concurrent one - e.g., from another process -
+// is attempted again, so `f` might be called multiple times.
 func (st *Storage) inTxnRW(ctx context.Context, txn SQLReadWrite, f func(ctx context.Context, txn SQLReadWrite) error) error {
 	if txn != nil {
 		// TODO: semantics of `CleanAbortTxn` is very dubious with those
@@ -350,22 +433,67 @@ func (st *Storage) inTxnRW(ctx context.Context, txn SQLReadWrite, f func(ctx con
 		return f(ctx, txn)
 	}
 
+	for attempt := 1; ; attempt++ {
+		err := st.attemptTxnRW(ctx, f)
+		if err == nil || !st.backend.isConflict(err) || attempt >= maxTxnAttempts {
+			return err
+		}
+		glog.Infof("transaction conflict, attempt %d: %v", attempt, err)
+	}
+}
+
+// maxTxnAttempts is how many times a read-write transaction is attempted when
+// it conflicts with concurrent ones - see backend.isConflict.
+const maxTxnAttempts = 5
+
+// attemptTxnRW runs `f` in a new read-write transaction.
+func (st *Storage) attemptTxnRW(ctx context.Context, f func(ctx context.Context, txn SQLReadWrite) error) error {
 	txnCounter.With(prometheus.Labels{"readonly": "0"}).Inc()
 
-	localTxn, err := st.rwDB.BeginTx(ctx, nil)
+	localTxn, err := st.rwDB.BeginTx(ctx, st.backend.rwTxOptions())
 	if err != nil {
 		return err
 	}
 	defer localTxn.Rollback()
 
-	err = f(ctx, sqlAdapter{localTxn})
+	changedStreams := make(map[types.StID]bool)
+	err = f(ctx, sqlAdapter{localTxn, st.backend, changedStreams})
 	if errors.Is(err, ErrCleanAbortTxn) {
 		return nil
 	}
 	if err != nil {
 		return err
 	}
-	return localTxn.Commit()
+	if err := localTxn.Commit(); err != nil {
+		return err
+	}
+	st.signalStreams(changedStreams)
+	return nil
+}
+
+// StreamSignal returns a channel which is closed the next time a read-write
+// transaction modifying the state of the stream is committed. This allows to
+// watch for changes of a stream without polling the DB.
+func (st *Storage) StreamSignal(stid types.StID) <-chan struct{} {
+	st.streamMu.Lock()
+	defer st.streamMu.Unlock()
+	ch, ok := st.streamChs[stid]
+	if !ok {
+		ch = make(chan struct{})
+		st.streamChs[stid] = ch
+	}
+	return ch
+}
+
+func (st *Storage) signalStreams(stids map[types.StID]bool) {
+	st.streamMu.Lock()
+	defer st.streamMu.Unlock()
+	for stid := range stids {
+		if ch, ok := st.streamChs[stid]; ok {
+			close(ch)
+			delete(st.streamChs, stid)
+		}
+	}
 }
 
 type ListUserEntry struct {
@@ -389,12 +517,21 @@ func (st *Storage) ListUsers(ctx context.Context) (_ []*ListUserEntry, retErr er
 		}
 		defer rows.Close()
 
+		// Rows are read entirely first, as PostgreSQL cannot run other
+		// statements while reading them.
+		var uids []types.UID
 		for rows.Next() {
 			var uid types.UID
 			if err := rows.Scan(&uid); err != nil {
 				return err
 			}
+			uids = append(uids, uid)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
 
+		for _, uid := range uids {
 			userState, err := st.UserState(ctx, txn, uid)
 			if err != nil {
 				return err
@@ -410,7 +547,7 @@ func (st *Storage) ListUsers(ctx context.Context) (_ []*ListUserEntry, retErr er
 				AccountState: accountState,
 			})
 		}
-		return rows.Err()
+		return nil
 	})
 	if err != nil {
 		return nil, err
@@ -519,12 +656,13 @@ func (st *Storage) CreateAccountState(ctx context.Context, txn SQLReadWrite, uid
 }
 
 // FirstAccountStateByUID gets a the mastodon account of a mastopoof user identified by its UID.
+// With multiple accounts, the oldest one - lowest ASID - is returned.
 // Returns wrapped ErrNotFound if no entry exists.
 func (st *Storage) FirstAccountStateByUID(ctx context.Context, txn SQLReadOnly, uid types.UID) (_ *stpb.AccountState, retErr error) {
 	defer recordAction("first-account-state-by-uid")(retErr)
 	as := &stpb.AccountState{}
 	err := st.inTxnRO(ctx, txn, func(ctx context.Context, txn SQLReadOnly) error {
-		err := txn.QueryRow(ctx, "first-account-state-by-uid", "SELECT state FROM accountstate WHERE uid=?", uid).Scan(types.SQLProto{as})
+		err := txn.QueryRow(ctx, "first-account-state-by-uid", "SELECT state FROM accountstate WHERE uid=? ORDER BY asid LIMIT 1", uid).Scan(types.SQLProto{as})
 		if err == sql.ErrNoRows {
 			return fmt.Errorf("no mastodon account for uid=%v: %w", uid, ErrNotFound)
 		}
@@ -576,14 +714,15 @@ func (st *Storage) AllAccountStateByUID(ctx context.Context, txn SQLReadOnly, ui
 // Returns wrapped ErrNotFound if no entry exists.
 func (st *Storage) AccountStateByAccountID(ctx context.Context, txn SQLReadOnly, serverAddr string, accountID mastodon.ID) (_ *stpb.AccountState, retErr error) {
 	defer recordAction("account-state-by-account-id")(retErr)
+	d := st.backend.dialect()
 	as := &stpb.AccountState{}
 	err := st.inTxnRO(ctx, txn, func(ctx context.Context, txn SQLReadOnly) error {
 		err := txn.QueryRow(ctx, "account-state-by-account-id", `
 			SELECT state
 			FROM accountstate
 			WHERE
-				json_extract(state, "$.server_addr") = ?
-				AND json_extract(state, "$.account_id") = ?
+				`+d.jsonText("state", "$.server_addr")+` = ?
+				AND `+d.jsonText("state", "$.account_id")+` = ?
 		`, serverAddr, accountID).Scan(types.SQLProto{as})
 		if err == sql.ErrNoRows {
 			return fmt.Errorf("no mastodon account for server=%q, account id=%v: %w", serverAddr, accountID, ErrNotFound)
@@ -687,7 +826,7 @@ func (st *Storage) StreamState(ctx context.Context, txn SQLReadOnly, stid types.
 	err := st.inTxnRO(ctx, txn, func(ctx context.Context, txn SQLReadOnly) error {
 		err := txn.QueryRow(ctx, "stream-state", "SELECT state FROM streamstate WHERE stid = ?", stid).Scan(types.SQLProto{streamState})
 		if err == sql.ErrNoRows {
-			return fmt.Errorf("stream with stid=%d not found", stid)
+			return fmt.Errorf("stream with stid=%d not found: %w", stid, ErrNotFound)
 		}
 		return err
 	})
@@ -697,12 +836,80 @@ func (st *Storage) StreamState(ctx context.Context, txn SQLReadOnly, stid types.
 	return streamState, nil
 }
 
+// StreamStatesByUID returns all the streams of a Mastopoof user, ordered by stream ID.
+func (st *Storage) StreamStatesByUID(ctx context.Context, txn SQLReadOnly, uid types.UID) (_ []*stpb.StreamState, retErr error) {
+	defer recordAction("stream-states-by-uid")(retErr)
+	var streamStates []*stpb.StreamState
+	err := st.inTxnRO(ctx, txn, func(ctx context.Context, txn SQLReadOnly) error {
+		rows, err := txn.Query(ctx, "stream-states-by-uid", `
+			SELECT
+				state
+			FROM streamstate
+			-- int64 are strings in protobuf JSON.
+			WHERE `+st.backend.dialect().jsonInt("state", "$.uid")+` = ?
+			ORDER BY stid
+		`, uid)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			streamState := &stpb.StreamState{}
+			if err := rows.Scan(types.SQLProto{streamState}); err != nil {
+				return err
+			}
+			streamStates = append(streamStates, streamState)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return streamStates, nil
+}
+
 func (st *Storage) SetStreamState(ctx context.Context, txn SQLReadWrite, streamState *stpb.StreamState) (retErr error) {
 	defer recordAction("set-stream-state")(retErr)
 	return st.inTxnRW(ctx, txn, func(ctx context.Context, txn SQLReadWrite) error {
 		stmt := `INSERT INTO streamstate(stid, state) VALUES(?, ?) ON CONFLICT(stid) DO UPDATE SET state = excluded.state`
 		_, err := txn.Exec(ctx, "set-stream-state", stmt, streamState.Stid, types.SQLProto{streamState})
-		return err
+		if err != nil {
+			return err
+		}
+		markStreamChanged(txn, types.StID(streamState.Stid))
+		return nil
+	})
+}
+
+// DeleteStreamState removes a stream and its content. Statuses of the user
+// which are not referenced anymore by any stream are removed from the cache.
+func (st *Storage) DeleteStreamState(ctx context.Context, txn SQLReadWrite, stid types.StID) (retErr error) {
+	defer recordAction("delete-stream-state")(retErr)
+	return st.inTxnRW(ctx, txn, func(ctx context.Context, txn SQLReadWrite) error {
+		streamState, err := st.StreamState(ctx, txn, stid)
+		if err != nil {
+			return err
+		}
+
+		if _, err := txn.Exec(ctx, "delete-stream-state-content", `DELETE FROM streamcontent WHERE stid = ?`, stid); err != nil {
+			return err
+		}
+		_, err = txn.Exec(ctx, "delete-stream-state-statuses", `
+			DELETE FROM statuses
+			WHERE
+				asid IN (SELECT asid FROM accountstate WHERE uid = ?)
+				AND sid NOT IN (SELECT sid FROM streamcontent)
+		`, streamState.Uid)
+		if err != nil {
+			return err
+		}
+		_, err = txn.Exec(ctx, "delete-stream-state", `DELETE FROM streamstate WHERE stid = ?`, stid)
+		if err != nil {
+			return err
+		}
+		markStreamChanged(txn, stid)
+		return nil
 	})
 }
 
@@ -741,17 +948,20 @@ func (st *Storage) RecomputeStreamState(ctx context.Context, txn SQLReadOnly, st
 		streamState.LastPosition = position.Int64
 	}
 
-	// Remaining
+	// Remaining & Filtered
+	poolHidden := st.backend.dialect().poolHidden()
 	err = txn.QueryRow(ctx, "recompute-stream-state-remaining", `
 		SELECT
-			COUNT(*)
+			coalesce(SUM(CASE WHEN `+poolHidden+` THEN 0 ELSE 1 END), 0),
+			coalesce(SUM(CASE WHEN `+poolHidden+` THEN 1 ELSE 0 END), 0)
 		FROM
 			streamcontent
+			JOIN statuses USING (sid)
 		WHERE
-			stid = ?
-			AND position IS NULL
+			streamcontent.stid = ?
+			AND streamcontent.position IS NULL
 		;
-	`, stid).Scan(&streamState.Remaining)
+	`, stid).Scan(&streamState.Remaining, &streamState.Filtered)
 	if err != nil {
 		return nil, err
 	}
@@ -799,6 +1009,13 @@ func (st *Storage) FixDuplicateStatuses(ctx context.Context, txn SQLReadWrite, s
 	}
 	defer rows.Close()
 
+	// Rows are read entirely first, as PostgreSQL cannot run other statements
+	// while reading them.
+	type dup struct {
+		sid         int64
+		minPosition int64
+	}
+	var dups []dup
 	for rows.Next() {
 		var sid int64
 		var minPosition int64
@@ -807,13 +1024,19 @@ func (st *Storage) FixDuplicateStatuses(ctx context.Context, txn SQLReadWrite, s
 			return err
 		}
 		fmt.Printf("Status sid=%d: %d dups\n", sid, count)
+		dups = append(dups, dup{sid, minPosition})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
 
+	for _, d := range dups {
 		result, err := txn.Exec(ctx, "fix-duplicate-statuses-delete", `
 			DELETE FROM streamcontent WHERE
 				stid = ?
 				AND sid = ?
 				AND position != ?
-		`, stid, sid, minPosition)
+		`, stid, d.sid, d.minPosition)
 		if err != nil {
 			return err
 		}
@@ -821,7 +1044,7 @@ func (st *Storage) FixDuplicateStatuses(ctx context.Context, txn SQLReadWrite, s
 		if err != nil {
 			return err
 		}
-		fmt.Printf("... deleted %d rows, kept early position %d\n", affected, minPosition)
+		fmt.Printf("... deleted %d rows, kept early position %d\n", affected, d.minPosition)
 	}
 
 	return nil
@@ -838,10 +1061,6 @@ func (st *Storage) FixCrossStatuses(ctx context.Context, txn SQLReadWrite, stid
 	if err != nil {
 		return fmt.Errorf("unable to get streamstate from DB: %w", err)
 	}
-	accountState, err := st.FirstAccountStateByUID(ctx, txn, types.UID(streamState.Uid))
-	if err != nil {
-		return err
-	}
 
 	rows, err := txn.Query(ctx, "fix-cross-statuses-read", `
 		SELECT
@@ -852,22 +1071,31 @@ func (st *Storage) FixCrossStatuses(ctx context.Context, txn SQLReadWrite, stid
 			USING (sid)
 		WHERE
 			streamcontent.stid = ?
-			AND statuses.asid != ?
+			AND statuses.asid NOT IN (SELECT asid FROM accountstate WHERE uid = ?)
 		GROUP BY
 			sid
-	`, stid, accountState.Asid)
+	`, stid, streamState.Uid)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
+	// Rows are read entirely first, as PostgreSQL cannot run other statements
+	// while reading them.
+	var sids []types.SID
 	for rows.Next() {
 		var sid types.SID
 		if err := rows.Scan(&sid); err != nil {
 			return err
 		}
 		fmt.Printf("Status sid=%d is coming from another user\n", sid)
+		sids = append(sids, sid)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
 
+	for _, sid := range sids {
 		result, err := txn.Exec(ctx, "fix-cross-statuses-delete", `
 			DELETE FROM streamcontent WHERE
 				stid = ?
@@ -917,39 +1145,45 @@ func (st *Storage) ClearStream(ctx context.Context, stid types.StID) (retErr err
 func (st *Storage) ClearPoolAndStream(ctx context.Context, uid types.UID) (retErr error) {
 	defer recordAction("clear-pool-and-stream")(retErr)
 	return st.InTxnRW(ctx, func(ctx context.Context, txn SQLReadWrite) error {
-		userState, err := st.UserState(ctx, txn, uid)
+		// Reset the fetch-from-server state.
+		accountStates, err := st.AllAccountStateByUID(ctx, txn, uid)
 		if err != nil {
 			return err
 		}
+		for _, accountState := range accountStates {
+			accountState.LastHomeStatusId = ""
+			if err := st.SetAccountState(ctx, txn, accountState); err != nil {
+				return err
+			}
+		}
 
-		// Reset the fetch-from-server state.
-		accountState, err := st.FirstAccountStateByUID(ctx, txn, uid)
+		// Remove everything from the streams of the user - statuses are shared
+		// between those.
+		streamStates, err := st.StreamStatesByUID(ctx, txn, uid)
 		if err != nil {
 			return err
 		}
-		accountState.LastHomeStatusId = ""
-		if err := st.SetAccountState(ctx, txn, accountState); err != nil {
-			return err
+		for _, streamState := range streamStates {
+			if _, err := txn.Exec(ctx, "delete-stream", `DELETE FROM streamcontent WHERE stid = ?`, streamState.Stid); err != nil {
+				return err
+			}
+			// Also reset last-read and other state keeping.
+			streamState.LastRead = 0
+			streamState.FirstPosition = 0
+			streamState.LastPosition = 0
+			streamState.Remaining = 0
+			streamState.Filtered = 0
+			streamState.LastStatusId = ""
+			if err := st.SetStreamState(ctx, txn, streamState); err != nil {
+				return err
+			}
 		}
 
 		// Remove all statuses.
-		if _, err := txn.Exec(ctx, "delete-statuses", `DELETE FROM statuses WHERE asid = ?`, accountState.Asid); err != nil {
-			return err
-		}
-		// Remove everything from the stream.
-		stid := userState.DefaultStid
-		if _, err := txn.Exec(ctx, "delete-stream", `DELETE FROM streamcontent WHERE stid = ?`, stid); err != nil {
-			return err
-		}
-		// Also reset last-read and other state keeping.
-		streamState, err := st.StreamState(ctx, txn, types.StID(stid))
-		if err != nil {
+		if _, err := txn.Exec(ctx, "delete-statuses", `DELETE FROM statuses WHERE asid IN (SELECT asid FROM accountstate WHERE uid = ?)`, uid); err != nil {
 			return err
 		}
-		streamState.LastRead = 0
-		streamState.FirstPosition = 0
-		streamState.LastPosition = 0
-		return st.SetStreamState(ctx, txn, streamState)
+		return nil
 	})
 }
 
@@ -957,7 +1191,9 @@ func (st *Storage) ClearPoolAndStream(ctx context.Context, uid types.UID) (retEr
 // in the stream.
 type Item struct {
 	// Position in the stream.
-	Position          int64
+	Position int64
+	// The Mastodon account the status was fetched from.
+	ASID              types.ASID
 	StreamStatusState *stpb.StreamStatusState
 	Status            mastodon.Status
 	StatusMeta        *stpb.StatusMeta
@@ -966,10 +1202,24 @@ type Item struct {
 // pickNextInTxn adds a new status from the pool to the stream.
 // It updates streamState IN PLACE.
 func (st *Storage) pickNextInTxn(ctx context.Context, txn SQLReadWrite, userState *stpb.UserState, streamState *stpb.StreamState) (*Item, error) {
+	rules := userState.GetFilterRules()
+	accountStates := map[types.ASID]*stpb.AccountState{}
+	if RulesNeedFollowing(rules) {
+		all, err := st.AllAccountStateByUID(ctx, txn, types.UID(userState.Uid))
+		if err != nil {
+			return nil, err
+		}
+		for _, accountState := range all {
+			accountStates[types.ASID(accountState.Asid)] = accountState
+		}
+	}
+
 	// List all statuses which do not have a position yet.
 	rows, err := txn.Query(ctx, "pick-next-statuses", `
 		SELECT
 			streamcontent.sid,
+			streamcontent.stream_status_state,
+			statuses.asid,
 			statuses.status,
 			statuses.status_meta
 		FROM
@@ -985,43 +1235,94 @@ func (st *Storage) pickNextInTxn(ctx context.Context, txn SQLReadWrite, userStat
 	}
 	defer rows.Close()
 
+	ranker := RankerForSettings(userState.Settings)
+
 	var selectedID types.SID
+	var selectedASID types.ASID
 	var selected *mastodon.Status
 	var selstatustate *stpb.StatusMeta
+	var selStreamStatusState *stpb.StreamStatusState
+	var selectedScore int64
 	var found int64
+	var filtered int64
+	// Pool statuses for which the local filter rules results changed.
+	changed := map[types.SID]*stpb.StreamStatusState{}
 	for rows.Next() {
-		found++
 		var sid types.SID
+		var asid types.ASID
 		var status types.SQLStatus
 
 		statusMeta := &stpb.StatusMeta{}
+		streamStatusState := &stpb.StreamStatusState{}
 
-		if err := rows.Scan(&sid, &status, types.SQLProto{statusMeta}); err != nil {
+		if err := rows.Scan(&sid, types.SQLProto{streamStatusState}, &asid, &status, types.SQLProto{statusMeta}); err != nil {
 			return nil, err
 		}
 
+		// Rules might have changed since the status was last considered.
+		if matches := evaluateRules(rules, &status.Status, asid, accountStates); !sameRuleMatches(matches, streamStatusState.RuleMatches) {
+			streamStatusState.RuleMatches = matches
+			changed[sid] = streamStatusState
+		}
+
+		// Statuses hidden by Mastodon filters or local rules are kept in the
+		// pool, but never picked.
+		if statusHidden(statusMeta) || ruleHidden(streamStatusState.RuleMatches) {
+			filtered++
+			continue
+		}
+		found++
+
 		// Apply the rules here - is this status better than the currently selected one?
+		score := ranker.Score(&status.Status, statusMeta, userState.Settings)
 		match := false
 		if selected == nil {
 			match = true
-			selected = &status.Status
-			selstatustate = statusMeta
-		} else {
-			// For now, just pick the oldest one.
-			if status.CreatedAt.Before(selected.CreatedAt) {
-				match = true
-			}
+		} else if score > selectedScore {
+			match = true
+		} else if score == selectedScore && status.CreatedAt.Before(selected.CreatedAt) {
+			// On equal score, pick the oldest one.
+			match = true
 		}
 
 		if match {
 			selectedID = sid
+			selectedASID = asid
 			selected = &status.Status
 			selstatustate = statusMeta
+			selStreamStatusState = streamStatusState
+			selectedScore = score
 		}
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+	rows.Close()
+	streamState.Filtered = filtered
+
+	for sid, streamStatusState := range changed {
+		if err := st.setStreamStatusState(ctx, txn, types.StID(streamState.Stid), sid, streamStatusState); err != nil {
+			return nil, err
+		}
+	}
+
+	// When threading, statuses of the conversation at the end of the stream go
+	// first, whatever their ranking.
+	threaded := false
+	if selected != nil && types.SettingThreading(userState.Settings) {
+		sid, item, err := st.threadContinuationInTxn(ctx, txn, streamState)
+		if err != nil {
+			return nil, err
+		}
+		if item != nil {
+			selectedID = sid
+			selectedASID = item.ASID
+			selected = &item.Status
+			selstatustate = item.StatusMeta
+			selStreamStatusState = item.StreamStatusState
+			threaded = true
+		}
+	}
 
 	if selected == nil {
 		fmt.Println("No next status available")
@@ -1035,16 +1336,19 @@ func (st *Storage) pickNextInTxn(ctx context.Context, txn SQLReadWrite, userStat
 		selstatustate = &stpb.StatusMeta{}
 	}
 
-	streamStatusState := &stpb.StreamStatusState{
-		AlreadySeen: stpb.StreamStatusState_UNKNOWN,
-	}
+	// Keep what was recorded when adding the status to the pool - e.g., which
+	// accounts got it.
+	streamStatusState := selStreamStatusState
+	streamStatusState.AlreadySeen = stpb.StreamStatusState_UNKNOWN
+	streamStatusState.ThreadContinuation = threaded
 
 	// We've got a status, let's check if that's a reblog of something we've seen
 	// before - assuming that's needed.
 	if types.SettingSeenReblogs(userState.Settings) == settingspb.SettingSeenReblogs_HIDE {
 		alreadySeen := false
 		if selected.Reblog != nil {
-			// Let's see if we've seen that status before.
+			// Let's see if we've seen that status before. This relies on the URI,
+			// as the status might have been seen through another account.
 			row := txn.QueryRow(ctx, "check-reblogs", `
 				SELECT
 					1
@@ -1053,11 +1357,11 @@ func (st *Storage) pickNextInTxn(ctx context.Context, txn SQLReadWrite, userStat
 				WHERE
 					stid = ?
 					AND position IS NOT NULL
-					AND (status_id = ? OR status_reblog_id = ?)
+					AND (status_uri = ? OR status_reblog_uri = ?)
 				LIMIT 1;`,
 				streamState.Stid,
-				selected.Reblog.ID,
-				selected.Reblog.ID,
+				selected.Reblog.URI,
+				selected.Reblog.URI,
 			)
 			var value int64
 			err := row.Scan(&value)
@@ -1106,6 +1410,7 @@ func (st *Storage) pickNextInTxn(ctx context.Context, txn SQLReadWrite, userStat
 
 	return &Item{
 		Position:          position,
+		ASID:              selectedASID,
 		StreamStatusState: streamStatusState,
 		Status:            *selected,
 		StatusMeta:        selstatustate,
@@ -1148,6 +1453,7 @@ func (st *Storage) ListBackward(ctx context.Context, userState *stpb.UserState,
 		rows, err := txn.Query(ctx, "list-backward", `
 			SELECT
 				streamcontent.position,
+				statuses.asid,
 				streamcontent.stream_status_state,
 				statuses.status,
 				statuses.status_meta
@@ -1171,14 +1477,16 @@ func (st *Storage) ListBackward(ctx context.Context, userState *stpb.UserState,
 		var reverseItems []*Item
 		for rows.Next() {
 			var position int64
+			var asid types.ASID
 			streamStatusState := &stpb.StreamStatusState{}
 			var status types.SQLStatus
 			statusMeta := &stpb.StatusMeta{}
-			if err := rows.Scan(&position, types.SQLProto{streamStatusState}, &status, types.SQLProto{statusMeta}); err != nil {
+			if err := rows.Scan(&position, &asid, types.SQLProto{streamStatusState}, &status, types.SQLProto{statusMeta}); err != nil {
 				return err
 			}
 			reverseItems = append(reverseItems, &Item{
 				Position:          position,
+				ASID:              asid,
 				StreamStatusState: streamStatusState,
 				Status:            status.Status,
 				StatusMeta:        statusMeta,
@@ -1214,6 +1522,8 @@ func (st *Storage) ListForward(ctx context.Context, userState *stpb.UserState, s
 
 	// TODO: Make it readonly when no update of stream is needed.
 	err := st.InTxnRW(ctx, func(ctx context.Context, txn SQLReadWrite) error {
+		// The transaction might be attempted again on conflict.
+		result.Items = nil
 		streamState, err := st.StreamState(ctx, txn, stid)
 		if err != nil {
 			return err
@@ -1245,6 +1555,7 @@ func (st *Storage) ListForward(ctx context.Context, userState *stpb.UserState, s
 		rows, err := txn.Query(ctx, "list-forward", `
 			SELECT
 				streamcontent.position,
+				statuses.asid,
 				streamcontent.stream_status_state,
 				statuses.status,
 				statuses.status_meta
@@ -1266,14 +1577,16 @@ func (st *Storage) ListForward(ctx context.Context, userState *stpb.UserState, s
 
 		for rows.Next() {
 			var position int64
+			var asid types.ASID
 			streamStatusState := &stpb.StreamStatusState{}
 			var status types.SQLStatus
 			statusMeta := &stpb.StatusMeta{}
-			if err := rows.Scan(&position, types.SQLProto{streamStatusState}, &status, types.SQLProto{statusMeta}); err != nil {
+			if err := rows.Scan(&position, &asid, types.SQLProto{streamStatusState}, &status, types.SQLProto{statusMeta}); err != nil {
 				return err
 			}
 			result.Items = append(result.Items, &Item{
 				Position:          position,
+				ASID:              asid,
 				StreamStatusState: streamStatusState,
 				Status:            status.Status,
 				StatusMeta:        statusMeta,
@@ -1309,93 +1622,629 @@ func (st *Storage) ListForward(ctx context.Context, userState *stpb.UserState, s
 	return result, nil
 }
 
+// StatusAtPosition returns the status at the given position of the stream.
+func (st *Storage) StatusAtPosition(ctx context.Context, txn SQLReadOnly, stid types.StID, position int64) (_ *Item, retErr error) {
+	defer recordAction("status-at-position")(retErr)
+	item := &Item{
+		Position:          position,
+		StreamStatusState: &stpb.StreamStatusState{},
+		StatusMeta:        &stpb.StatusMeta{},
+	}
+	err := st.inTxnRO(ctx, txn, func(ctx context.Context, txn SQLReadOnly) error {
+		var status types.SQLStatus
+		err := txn.QueryRow(ctx, "status-at-position", `
+			SELECT
+				statuses.asid,
+				streamcontent.stream_status_state,
+				statuses.status,
+				statuses.status_meta
+			FROM
+				statuses
+				INNER JOIN streamcontent
+				USING (sid)
+			WHERE
+				streamcontent.stid = ?
+				AND streamcontent.position = ?
+		`, stid, position).Scan(&item.ASID, types.SQLProto{item.StreamStatusState}, &status, types.SQLProto{item.StatusMeta})
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("no status at position %d of stream %d: %w", position, stid, ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		item.Status = status.Status
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// PositionOfStatusID returns the position in the stream of a status fetched
+// from the account - e.g., to convert a Mastodon marker to a stream position.
+// Returns 0 if the status is not known or not triaged yet.
+func (st *Storage) PositionOfStatusID(ctx context.Context, txn SQLReadOnly, stid types.StID, asid types.ASID, statusID mastodon.ID) (_ int64, retErr error) {
+	defer recordAction("position-of-status-id")(retErr)
+	var position sql.NullInt64
+	err := st.inTxnRO(ctx, txn, func(ctx context.Context, txn SQLReadOnly) error {
+		err := txn.QueryRow(ctx, "position-of-status-id", `
+			SELECT
+				streamcontent.position
+			FROM
+				statuses
+				INNER JOIN streamcontent
+				USING (sid)
+			WHERE
+				streamcontent.stid = ?
+				AND statuses.asid = ?
+				AND statuses.status_id = ?
+		`, stid, asid, statusID).Scan(&position)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return position.Int64, nil
+}
+
+// cacheStatusInTxn adds a status to the `statuses` cache of the account,
+// without adding it to any stream.
+// The status might already be in the cache for that account - e.g., when
+// multiple streams are fed from timelines containing the same status. In
+// that case, the cached version is refreshed and reused.
+// It returns the filter matches computed for the status, in `filterContext`.
+func (st *Storage) cacheStatusInTxn(ctx context.Context, txn SQLReadWrite, asid types.ASID, status *mastodon.Status, filters []*stpb.MastodonFilter, filterContext string) (types.SID, *stpb.StatusMeta, error) {
+	statusMeta := computeStatusMeta(status, filters, filterContext)
+
+	var sid types.SID
+	err := txn.QueryRow(ctx, "insert-statuses-find", `
+		SELECT sid FROM statuses WHERE asid = ? AND status_id = ?;
+	`, asid, status.ID).Scan(&sid)
+	if err == sql.ErrNoRows {
+		err = txn.QueryRow(ctx, "insert-statuses",
+			`INSERT INTO statuses(asid, status, status_meta) VALUES(?, ?, ?) RETURNING sid;`,
+			asid, &types.SQLStatus{*status}, types.SQLProto{statusMeta},
+		).Scan(&sid)
+	} else if err == nil {
+		_, err = txn.Exec(ctx, "insert-statuses-refresh",
+			`UPDATE statuses SET status = ?, status_meta = ? WHERE sid = ?;`,
+			&types.SQLStatus{*status}, types.SQLProto{statusMeta}, sid,
+		)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := st.indexStatus(ctx, txn, sid, status); err != nil {
+		return 0, nil, err
+	}
+	return sid, statusMeta, nil
+}
+
+// CacheStatus adds a status to the cache of the account, without adding it
+// to any stream - e.g., for statuses created from Mastopoof. If the status
+// is later fetched from a timeline, it is added to the stream then.
+func (st *Storage) CacheStatus(ctx context.Context, txn SQLReadWrite, asid types.ASID, status *mastodon.Status, filters []*stpb.MastodonFilter) (retErr error) {
+	defer recordAction("cache-status")(retErr)
+	return st.inTxnRW(ctx, txn, func(ctx context.Context, txn SQLReadWrite) error {
+		_, _, err := st.cacheStatusInTxn(ctx, txn, asid, status, filters, filterContextHome)
+		return err
+	})
+}
+
+// addSeenBy records that the status `sid` of the stream was also obtained
+// through account `asid`. `streamStatusState` is the current state of the
+// status in the stream.
+func (st *Storage) addSeenBy(ctx context.Context, txn SQLReadWrite, stid types.StID, sid types.SID, streamStatusState *stpb.StreamStatusState, asid types.ASID) error {
+	if slices.Contains(streamStatusState.SeenBy, int64(asid)) {
+		return nil
+	}
+	streamStatusState.SeenBy = append(streamStatusState.SeenBy, int64(asid))
+	return st.setStreamStatusState(ctx, txn, stid, sid, streamStatusState)
+}
+
 // InsertStatuses add the given statuses to the user storage.
 // It updates `streamState` IN PLACE.
-func (st *Storage) InsertStatuses(ctx context.Context, txn SQLReadWrite, asid types.ASID, streamState *stpb.StreamState, statuses []*mastodon.Status, filters []*mastodon.Filter) (retErr error) {
+func (st *Storage) InsertStatuses(ctx context.Context, txn SQLReadWrite, asid types.ASID, streamState *stpb.StreamState, statuses []*mastodon.Status, filters []*stpb.MastodonFilter) (retErr error) {
 	defer recordAction("insert-statuses")(retErr)
+	added := int64(0)
+	filtered := int64(0)
 	for _, status := range statuses {
 		// TODO: batching
 
-		// Insert in the statuses cache.
-		stmt := `
-			INSERT INTO statuses(asid, status, status_meta) VALUES(?, ?, ?);
-			INSERT INTO streamcontent(stid, sid, status_id, status_reblog_id, status_in_reply_to_id)
-				VALUES(?, last_insert_rowid(), ?, ?, ?);
-		`
-
 		// TODO move filtering out of transaction
 		var reblogID mastodon.ID
 		if status.Reblog != nil {
 			reblogID = status.Reblog.ID
 		}
-		statusMeta := computeStatusMeta(status, filters)
-		_, err := txn.Exec(ctx, "insert-statuses",
-			stmt,
-			asid, &types.SQLStatus{*status}, types.SQLProto{statusMeta},
-			streamState.Stid,
-			status.ID, reblogID, status.InReplyToID,
-		)
+		sid, statusMeta, err := st.cacheStatusInTxn(ctx, txn, asid, status, filters, streamFilterContext(streamState.Source))
 		if err != nil {
 			return err
 		}
+
+		// The same status might have already been obtained through another
+		// account. Status IDs are specific to each Mastodon server, so rely on
+		// the URI instead. In that case, just record that this account saw it
+		// as well.
+		// The `statuses` row of this account is still kept: acting on the
+		// status (favourite, reply, etc.) through this account requires the ID
+		// of the status on its server. Search collapses those rows - see
+		// Search.
+		if status.URI != "" {
+			var otherSID types.SID
+			streamStatusState := &stpb.StreamStatusState{}
+			err := txn.QueryRow(ctx, "insert-statuses-find-uri", `
+				SELECT sid, stream_status_state FROM streamcontent WHERE stid = ? AND status_uri = ? AND sid != ? LIMIT 1;
+			`, streamState.Stid, status.URI, sid).Scan(&otherSID, types.SQLProto{streamStatusState})
+			if err == nil {
+				if err := st.addSeenBy(ctx, txn, types.StID(streamState.Stid), otherSID, streamStatusState, asid); err != nil {
+					return err
+				}
+				continue
+			} else if err != sql.ErrNoRows {
+				return err
+			}
+		}
+
+		// Similarly, the original of a reblog - or another reblog of it - might
+		// have been obtained through another account. The stream then shows the
+		// original only once. Reblogs within a single account are kept as is:
+		// SettingSeenReblogs decides at pick time whether they are shown.
+		originalURI := status.URI
+		if status.Reblog != nil {
+			originalURI = status.Reblog.URI
+		}
+		if originalURI != "" {
+			var otherSID types.SID
+			streamStatusState := &stpb.StreamStatusState{}
+			err := txn.QueryRow(ctx, "insert-statuses-find-original-uri", `
+				SELECT streamcontent.sid, streamcontent.stream_status_state
+				FROM streamcontent
+					JOIN statuses USING (sid)
+				WHERE
+					streamcontent.stid = ?
+					AND (streamcontent.status_uri = ? OR streamcontent.status_reblog_uri = ?)
+					AND statuses.asid != ?
+				ORDER BY streamcontent.sid
+				LIMIT 1;
+			`, streamState.Stid, originalURI, originalURI, asid).Scan(&otherSID, types.SQLProto{streamStatusState})
+			if err == nil {
+				if err := st.addSeenBy(ctx, txn, types.StID(streamState.Stid), otherSID, streamStatusState, asid); err != nil {
+					return err
+				}
+				continue
+			} else if err != sql.ErrNoRows {
+				return err
+			}
+		}
+
+		var reblogURI string
+		if status.Reblog != nil {
+			reblogURI = status.Reblog.URI
+		}
+		streamStatusState := &stpb.StreamStatusState{
+			SeenBy: []int64{int64(asid)},
+		}
+
+		// And add it to the pool of the stream, if not already there.
+		result, err := txn.Exec(ctx, "insert-statuses-streamcontent", `
+			INSERT INTO streamcontent(stid, sid, status_id, status_reblog_id, status_in_reply_to_id, status_uri, status_reblog_uri, stream_status_state)
+				VALUES(?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT(stid, sid) DO NOTHING;
+		`, streamState.Stid, sid, status.ID, reblogID, status.InReplyToID, status.URI, reblogURI, types.SQLProto{streamStatusState})
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		// Statuses hidden by filters stay in the pool, but are not available
+		// for the stream.
+		if statusHidden(statusMeta) {
+			filtered += affected
+		} else {
+			added += affected
+		}
 	}
 
 	// Keep stats up-to-date for the stream.
-	streamState.Remaining += int64(len(statuses))
+	streamState.Remaining += added
+	streamState.Filtered += filtered
 	if err := st.SetStreamState(ctx, txn, streamState); err != nil {
 		return err
 	}
 	return nil
 }
 
+// DeleteStatus reflects the deletion of a status on Mastodon.
+// Streams which have not triaged the status yet just drop it from their pool.
+// Otherwise, the status is kept as a tombstone, so positions in the stream
+// do not change.
+func (st *Storage) DeleteStatus(ctx context.Context, txn SQLReadWrite, asid types.ASID, statusID mastodon.ID) (retErr error) {
+	defer recordAction("delete-status")(retErr)
+	return st.inTxnRW(ctx, txn, func(ctx context.Context, txn SQLReadWrite) error {
+		var status types.SQLStatus
+		var uid types.UID
+		err := txn.QueryRow(ctx, "delete-status-status", `
+			SELECT
+				statuses.status,
+				accountstate.uid
+			FROM
+				statuses
+				JOIN accountstate USING (asid)
+			WHERE
+				statuses.asid = ?
+				AND statuses.status_id = ?
+			;
+		`, asid, statusID).Scan(&status, &uid)
+		if err == sql.ErrNoRows {
+			// Status was never fetched - nothing to do.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		streamStates, err := st.StreamStatesByUID(ctx, txn, uid)
+		if err != nil {
+			return err
+		}
+
+		type entry struct {
+			stid              types.StID
+			sid               types.SID
+			position          sql.NullInt64
+			streamStatusState *stpb.StreamStatusState
+			// Hidden by filters - i.e., counted in `filtered` if in the pool.
+			hidden int64
+		}
+		var entries []entry
+		// The stream item might come from another account of the user, when the
+		// status was obtained through several of them - see InsertStatuses. So
+		// look it up by URI as well.
+		uri := sql.NullString{String: status.URI, Valid: status.URI != ""}
+		poolHidden := st.backend.dialect().poolHidden()
+		for _, streamState := range streamStates {
+			rows, err := txn.Query(ctx, "delete-status-find", `
+				SELECT
+					streamcontent.sid,
+					streamcontent.position,
+					streamcontent.stream_status_state,
+					CASE WHEN `+poolHidden+` THEN 1 ELSE 0 END
+				FROM
+					streamcontent
+					JOIN statuses USING (sid)
+				WHERE
+					streamcontent.stid = ?
+					AND (
+						(statuses.asid = ? AND statuses.status_id = ?)
+						OR streamcontent.status_uri = ?
+					)
+				;
+			`, streamState.Stid, asid, statusID, uri)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				e := entry{stid: types.StID(streamState.Stid), streamStatusState: &stpb.StreamStatusState{}}
+				if err := rows.Scan(&e.sid, &e.position, types.SQLProto{e.streamStatusState}, &e.hidden); err != nil {
+					rows.Close()
+					return err
+				}
+				entries = append(entries, e)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+		}
+
+		for _, e := range entries {
+			if e.position.Valid {
+				e.streamStatusState.Deleted = true
+				if err := st.setStreamStatusState(ctx, txn, e.stid, e.sid, e.streamStatusState); err != nil {
+					return err
+				}
+				continue
+			}
+
+			_, err := txn.Exec(ctx, "delete-status-from-pool", `DELETE FROM streamcontent WHERE stid = ? AND sid = ?`, e.stid, e.sid)
+			if err != nil {
+				return err
+			}
+			streamState, err := st.StreamState(ctx, txn, e.stid)
+			if err != nil {
+				return err
+			}
+			if e.hidden != 0 {
+				if streamState.Filtered > 0 {
+					streamState.Filtered--
+				}
+			} else if streamState.Remaining > 0 {
+				streamState.Remaining--
+			}
+			if err := st.SetStreamState(ctx, txn, streamState); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PositionedStatusIDs returns the IDs of the statuses of an account which
+// are in the stream - i.e., which have a position. Statuses are returned in
+// the order they were cached, starting after `afterSID`. It also returns the
+// sid of the last status, to continue from there.
+func (st *Storage) PositionedStatusIDs(ctx context.Context, txn SQLReadOnly, asid types.ASID, afterSID types.SID, limit int) (_ []mastodon.ID, _ types.SID, retErr error) {
+	defer recordAction("positioned-status-ids")(retErr)
+	var ids []mastodon.ID
+	lastSID := afterSID
+	err := st.inTxnRO(ctx, txn, func(ctx context.Context, txn SQLReadOnly) error {
+		rows, err := txn.Query(ctx, "positioned-status-ids", `
+			SELECT sid, status_id
+			FROM statuses
+			WHERE
+				asid = ?
+				AND sid > ?
+				AND EXISTS (
+					SELECT 1 FROM streamcontent WHERE streamcontent.sid = statuses.sid AND streamcontent.position IS NOT NULL
+				)
+			ORDER BY sid
+			LIMIT ?;
+		`, asid, afterSID, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id mastodon.ID
+			if err := rows.Scan(&lastSID, &id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return ids, lastSID, nil
+}
+
+func (st *Storage) setStreamStatusState(ctx context.Context, txn SQLReadWrite, stid types.StID, sid types.SID, streamStatusState *stpb.StreamStatusState) error {
+	_, err := txn.Exec(ctx, "set-stream-status-state", `
+		UPDATE streamcontent SET stream_status_state = ? WHERE stid = ? AND sid = ?;
+	`, types.SQLProto{streamStatusState}, stid, sid)
+	return err
+}
+
 // UpdateStatus replace the status in the statuses table with a new version.
+// If the content of the status changed - i.e., it was edited on Mastodon - it
+// is flagged as such in all the streams containing it.
 // TODO: have a race detection to avoid getting back some old status (though Mastodon
 // does not seem to have notion of a version)
-func (st *Storage) UpdateStatus(ctx context.Context, txn SQLReadWrite, asid types.ASID, status *mastodon.Status, filters []*mastodon.Filter) (retErr error) {
+func (st *Storage) UpdateStatus(ctx context.Context, txn SQLReadWrite, asid types.ASID, status *mastodon.Status, filters []*stpb.MastodonFilter) (retErr error) {
 	defer recordAction("update-status")(retErr)
+	return st.inTxnRW(ctx, txn, func(ctx context.Context, txn SQLReadWrite) error {
+		// First, find the existing status.
+		// This is done separately from the UPDATE to guarantee that one and only row exists.
+		rows, err := txn.Query(ctx, "update-status-find", `
+			SELECT sid, status, status_meta FROM statuses WHERE asid = ? AND status_id = ?;
+		`, asid, status.ID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
 
-	// First, find the existing status.
-	// This is done separately from the UPDATE to guarantee that one and only row exists.
-	rows, err := txn.Query(ctx, "update-status-find", `
-			SELECT sid FROM statuses WHERE asid = ? AND status_id = ?;
-	`, asid, status.ID)
+		found := false
+		var sid types.SID
+		var oldStatus types.SQLStatus
+		oldStatusMeta := &stpb.StatusMeta{}
+		for rows.Next() {
+			if found {
+				return fmt.Errorf("multiple rows found for asid=%v, id=%v", asid, status.ID)
+			}
+			found = true
+			if err := rows.Scan(&sid, &oldStatus, types.SQLProto{oldStatusMeta}); err != nil {
+				return err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		if !found {
+			return fmt.Errorf("no row found for asid=%v, id=%v: %w", asid, status.ID, ErrNotFound)
+		}
+
+		// We've found the row, now update it.
+
+		// TODO: make it only update the StatusMeta, not replace
+		// Filters are matched in the context of the stream the status was
+		// obtained from.
+		statusMeta := computeStatusMeta(status, filters, oldStatusMeta.FilterContext)
+
+		stmt := `
+			UPDATE statuses SET status = ?, status_meta = ? WHERE sid = ?;	`
+		if _, err := txn.Exec(ctx, "update-status", stmt, &types.SQLStatus{*status}, types.SQLProto{statusMeta}, sid); err != nil {
+			return err
+		}
+		if err := st.indexStatus(ctx, txn, sid, status); err != nil {
+			return err
+		}
+
+		// Pruned statuses no longer have their content, so there is nothing to
+		// compare with.
+		if oldStatusMeta.Pruned || !statusEdited(&oldStatus.Status, status) {
+			return nil
+		}
+		return st.markEdited(ctx, txn, sid)
+	})
+}
+
+// statusEdited indicates whether the visible content of the status changed.
+// Other changes - e.g., favourite counts - are not considered edits.
+func statusEdited(oldStatus *mastodon.Status, newStatus *mastodon.Status) bool {
+	if oldStatus.Reblog != nil && newStatus.Reblog != nil {
+		return statusEdited(oldStatus.Reblog, newStatus.Reblog)
+	}
+	return oldStatus.Content != newStatus.Content || oldStatus.SpoilerText != newStatus.SpoilerText || oldStatus.Sensitive != newStatus.Sensitive
+}
+
+// markEdited flags the status as edited in all the streams containing it.
+func (st *Storage) markEdited(ctx context.Context, txn SQLReadWrite, sid types.SID) error {
+	rows, err := txn.Query(ctx, "mark-edited-find", `
+		SELECT stid, stream_status_state FROM streamcontent WHERE sid = ?;
+	`, sid)
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
-
-	found := false
-	var sid int64
+	states := map[types.StID]*stpb.StreamStatusState{}
 	for rows.Next() {
-		if found {
-			return fmt.Errorf("multiple rows found for asid=%v, id=%v", asid, status.ID)
-		}
-		found = true
-		if err := rows.Scan(&sid); err != nil {
+		var stid types.StID
+		streamStatusState := &stpb.StreamStatusState{}
+		if err := rows.Scan(&stid, types.SQLProto{streamStatusState}); err != nil {
+			rows.Close()
 			return err
 		}
+		states[stid] = streamStatusState
 	}
+	rows.Close()
 	if err := rows.Err(); err != nil {
 		return err
 	}
 
-	if !found {
-		return fmt.Errorf("no row found for asid=%v, id=%v", asid, status.ID)
+	for stid, streamStatusState := range states {
+		streamStatusState.Edited = true
+		if err := st.setStreamStatusState(ctx, txn, stid, sid, streamStatusState); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// We've found the row, now update it.
+// filterActionHide is the action of Mastodon filters which should remove
+// matching statuses altogether, instead of just warning.
+const filterActionHide = "hide"
 
-	// TODO: make it only update the StatusMeta, not replace
-	statusMeta := computeStatusMeta(status, filters)
+// Mastodon filter contexts - where a filter applies.
+// https://docs.joinmastodon.org/entities/Filter/#context
+const (
+	filterContextHome   = "home"
+	filterContextPublic = "public"
+	filterContextThread = "thread"
+)
 
-	stmt := `
-		UPDATE statuses SET status = ?, status_meta = ? WHERE sid = ?;	`
-	_, err = txn.Exec(ctx, "update-status", stmt, &types.SQLStatus{*status}, types.SQLProto{statusMeta}, sid)
-	return err
+// streamFilterContexts are the filter contexts used for statuses of streams.
+var streamFilterContexts = []string{filterContextHome, filterContextPublic}
+
+// streamFilterContext returns the Mastodon filter context matching the
+// timeline feeding a stream. As on Mastodon, lists use the `home` context and
+// hashtags the `public` one.
+func streamFilterContext(source *stpb.StreamSource) string {
+	if source.GetKind() == stpb.StreamSource_HASHTAG {
+		return filterContextPublic
+	}
+	return filterContextHome
+}
+
+// filterApplies indicates whether a Mastodon filter is to be considered in
+// `filterContext` - i.e., it applies to that context and has not expired.
+// Filter matches are recorded per cached status, not per stream; a status
+// obtained through multiple streams uses the context of the latest one.
+func filterApplies(filter *stpb.MastodonFilter, now time.Time, filterContext string) bool {
+	if filter.ExpiresAtSecs != 0 && !now.Before(time.Unix(filter.ExpiresAtSecs, 0)) {
+		return false
+	}
+	return slices.Contains(filter.Context, filterContext)
 }
 
-// computeStatusMeta calculate whether a status matches filters or not.
-func computeStatusMeta(status *mastodon.Status, filters []*mastodon.Filter) *stpb.StatusMeta {
+// keywordMatches indicates whether a filter keyword is found in the status.
+// `content` and `spoiler` must be lower-cased.
+func keywordMatches(keyword *stpb.MastodonFilter_Keyword, content string, spoiler string, tags []mastodon.Tag) bool {
+	phrase := strings.ToLower(keyword.Keyword)
+	if phrase == "" {
+		return false
+	}
+
+	// TODO filters are actually fancier than that. but let's try this first!
+	// first we check if the phrase is, case-insensitively, in the content or the spoiler (if it is, we're done)
+	if keyword.WholeWord {
+		re := keywordPattern(phrase)
+		if re.MatchString(content) || re.MatchString(spoiler) {
+			return true
+		}
+	} else if strings.Contains(content, phrase) || strings.Contains(spoiler, phrase) {
+		return true
+	}
+
+	// otherwise we check tags; tags are formatted in the post (to add links and whatnot), which trips the
+	// stupid "let's just check for strings". if we're actually looking for a tag, we could either drop the # to
+	// look through content (meh) or do things a bit more As Intended and check against the list of tags of the post
+	// (that also drop the # in the tag name)
+	if phrase[0] == '#' {
+		for _, tag := range tags {
+			// tags are stored in the post as strings without the #
+			if strings.ToLower(tag.Name) == phrase[1:] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keywordPatterns caches the patterns of whole word keywords, indexed by
+// lower-cased keyword.
+var keywordPatterns sync.Map
+
+// CompileFilters prepares the patterns of the keywords of the filters, so
+// matching statuses does not need to compile them. It is called when filters
+// are obtained from Mastodon or from the account; keywords not prepared this
+// way are compiled on first use.
+func CompileFilters(filters []*stpb.MastodonFilter) {
+	for _, filter := range filters {
+		for _, keyword := range filter.Keywords {
+			if phrase := strings.ToLower(keyword.Keyword); keyword.WholeWord && phrase != "" {
+				keywordPattern(phrase)
+			}
+		}
+	}
+}
+
+// keywordPattern returns the regexp finding `phrase` as whole words.
+// `phrase` must be lower-cased and not empty.
+func keywordPattern(phrase string) *regexp.Regexp {
+	if re, ok := keywordPatterns.Load(phrase); ok {
+		return re.(*regexp.Regexp)
+	}
+	// Same as Mastodon: only require a word boundary on sides of the
+	// keyword which are word characters.
+	pattern := regexp.QuoteMeta(phrase)
+	if isWordChar(phrase[0]) {
+		pattern = `\b` + pattern
+	}
+	if isWordChar(phrase[len(phrase)-1]) {
+		pattern = pattern + `\b`
+	}
+	re := regexp.MustCompile(pattern)
+	keywordPatterns.Store(phrase, re)
+	return re
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// computeStatusMeta calculate whether a status matches filters or not, in
+// the given Mastodon filter context. An empty context is `home`.
+func computeStatusMeta(status *mastodon.Status, filters []*stpb.MastodonFilter, filterContext string) *stpb.StatusMeta {
+	if filterContext == "" {
+		filterContext = filterContextHome
+	}
 
 	s := status
 	if status.Reblog != nil {
@@ -1403,74 +2252,151 @@ func computeStatusMeta(status *mastodon.Status, filters []*mastodon.Filter) *stp
 	}
 
 	state := &stpb.StatusMeta{}
+	if filterContext != filterContextHome {
+		state.FilterContext = filterContext
+	}
 
 	content := strings.ToLower(s.Content)
-	tags := s.Tags
 	spoiler := strings.ToLower(s.SpoilerText)
 
 	// Note: we lower-case ALL THE THINGS (oh the irony) to normalize
+	now := time.Now()
 	for _, filter := range filters {
-		phrase := strings.ToLower(filter.Phrase)
-		// TODO filters are actually fancier than that. but let's try this first!
-		// first we check if the phrase is, case-insensitively, in the content or the spoiler (if it is, we're done)
-		matched := strings.Contains(content, phrase) || strings.Contains(spoiler, phrase)
-
-		// otherwise we check tags; tags are formatted in the post (to add links and whatnot), which trips the
-		// stupid "let's just check for strings". if we're actually looking for a tag, we could either drop the # to
-		// look through content (meh) or do things a bit more As Intended and check against the list of tags of the post
-		// (that also drop the # in the tag name)
-		if !matched && phrase[0] == '#' {
-			for _, tag := range tags {
-				// tags are stored in the post as strings without the #
-				if strings.ToLower(tag.Name) == phrase[1:] {
-					matched = true
-					break
-				}
+		if !filterApplies(filter, now, filterContext) {
+			continue
+		}
+		match := &stpb.FilterStateMatch{
+			Id:     filter.Id,
+			Action: filter.FilterAction,
+			Title:  filter.Title,
+		}
+		for _, keyword := range filter.Keywords {
+			if keywordMatches(keyword, content, spoiler, s.Tags) {
+				match.Matched = true
+				match.Phrase = strings.ToLower(keyword.Keyword)
+				break
 			}
 		}
-		state.Filters = append(state.Filters, &stpb.FilterStateMatch{Id: string(filter.ID), Matched: matched, Phrase: phrase})
+		state.Filters = append(state.Filters, match)
 	}
 	return state
 }
 
-func (st *Storage) SearchByStatusID(ctx context.Context, txn SQLReadOnly, uid types.UID, statusID mastodon.ID) (_ []*Item, retErr error) {
-	defer recordAction("search-by-status-id")(retErr)
-	accountState, err := st.FirstAccountStateByUID(ctx, txn, uid)
-	if err != nil {
-		return nil, err
+// statusHidden indicates whether a Mastodon filter with a `hide` action
+// matched the status - in which case it is never added to streams.
+func statusHidden(statusMeta *stpb.StatusMeta) bool {
+	for _, filter := range statusMeta.GetFilters() {
+		if filter.Matched && filter.Action == filterActionHide {
+			return true
+		}
 	}
+	return false
+}
 
-	rows, err := txn.Query(ctx, "search-by-status-id", `
-		SELECT
-			status
-		FROM
-			statuses
-		WHERE
-			json_extract(status, "$.id") = ?
-			AND asid = ?
-		;
-	`, statusID, accountState.Asid)
-	if err != nil {
-		return nil, err
+// statusHiddenSQL is the SQL equivalent of statusHidden, for queries on the
+// `statuses` table.
+const statusHiddenSQL = `EXISTS (
+	SELECT 1 FROM json_each(statuses.status_meta, '$.filters')
+	WHERE json_extract(value, '$.matched') AND json_extract(value, '$.action') = 'hide'
+)`
+
+// FilterWarnings returns the names of the Mastodon filters which matched the
+// status and should be shown as a warning - i.e., which do not hide it.
+func FilterWarnings(statusMeta *stpb.StatusMeta) []string {
+	var warnings []string
+	for _, filter := range statusMeta.GetFilters() {
+		if !filter.Matched || filter.Action == filterActionHide {
+			continue
+		}
+		// Matches recorded before the v2 filters API was used have no title.
+		name := filter.Title
+		if name == "" {
+			name = filter.Phrase
+		}
+		warnings = append(warnings, name)
 	}
-	defer rows.Close()
+	return warnings
+}
 
-	var results []*Item
-	for rows.Next() {
-		var status types.SQLStatus
-		if err := rows.Scan(&status); err != nil {
-			return nil, err
+// SetAccountFilters records the Mastodon filters of an account, as fetched at
+// `fetchSecs` (unix timestamp in seconds).
+// If the filters which apply changed since the previous fetch - e.g., a
+// filter was deleted or expired - the statuses of the account still in a pool
+// are matched again, so they are not hidden by a filter which no longer
+// exists. Statuses already in streams keep the filter matches computed when
+// they were obtained; see RecomputeMeta.
+func (st *Storage) SetAccountFilters(ctx context.Context, txn SQLReadWrite, asid types.ASID, filters []*stpb.MastodonFilter, fetchSecs int64) (retErr error) {
+	defer recordAction("set-account-filters")(retErr)
+	return st.inTxnRW(ctx, txn, func(ctx context.Context, txn SQLReadWrite) error {
+		var accountState *stpb.AccountState
+		var previous []*stpb.MastodonFilter
+		var previousFetchSecs int64
+		err := st.updateAccountState(ctx, txn, asid, func(as *stpb.AccountState) {
+			previous, previousFetchSecs = as.Filters, as.FiltersFetchSecs
+			as.Filters = filters
+			as.FiltersFetchSecs = fetchSecs
+			accountState = as
+		})
+		if err != nil {
+			return err
 		}
+		before := appliedFilters(previous, time.Unix(previousFetchSecs, 0))
+		after := appliedFilters(filters, time.Unix(fetchSecs, 0))
+		if slices.EqualFunc(before, after, func(a, b *stpb.MastodonFilter) bool { return proto.Equal(a, b) }) {
+			return nil
+		}
+		return st.recomputeAccountPool(ctx, txn, accountState, filters)
+	})
+}
 
-		results = append(results, &Item{
-			// TODO: do not use Item, as it has a different set of info.
-			Position:   int64(len(results)),
-			Status:     status.Status,
-			StatusMeta: &stpb.StatusMeta{},
-		})
+// appliedFilters returns the filters for which filterApplies is true at `now`,
+// in any of the contexts used for streams.
+func appliedFilters(filters []*stpb.MastodonFilter, now time.Time) []*stpb.MastodonFilter {
+	var applied []*stpb.MastodonFilter
+	for _, filter := range filters {
+		if slices.ContainsFunc(streamFilterContexts, func(filterContext string) bool {
+			return filterApplies(filter, now, filterContext)
+		}) {
+			applied = append(applied, filter)
+		}
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+	return applied
+}
+
+// ThreadStatusMeta computes the filter matches of a status shown in a
+// conversation, which uses the `thread` filter context. Pruned statuses keep
+// the matches computed when they were obtained.
+func ThreadStatusMeta(status *mastodon.Status, statusMeta *stpb.StatusMeta, filters []*stpb.MastodonFilter) *stpb.StatusMeta {
+	if statusMeta.GetPruned() {
+		return statusMeta
 	}
-	return results, nil
+	return computeStatusMeta(status, filters, filterContextThread)
+}
+
+// SetAccountFollowing records the Mastodon IDs of the accounts followed by an
+// account, as fetched at `fetchSecs` (unix timestamp in seconds).
+func (st *Storage) SetAccountFollowing(ctx context.Context, txn SQLReadWrite, asid types.ASID, followingIDs []string, fetchSecs int64) (retErr error) {
+	defer recordAction("set-account-following")(retErr)
+	return st.updateAccountState(ctx, txn, asid, func(as *stpb.AccountState) {
+		as.FollowingIds = followingIDs
+		as.FollowingFetchSecs = fetchSecs
+	})
+}
+
+// updateAccountState modifies some fields of an account. The account is
+// reloaded first, as other fields might have changed since the values to set
+// were obtained.
+func (st *Storage) updateAccountState(ctx context.Context, txn SQLReadWrite, asid types.ASID, update func(as *stpb.AccountState)) error {
+	return st.inTxnRW(ctx, txn, func(ctx context.Context, txn SQLReadWrite) error {
+		as := &stpb.AccountState{}
+		err := txn.QueryRow(ctx, "update-account-state-find", "SELECT state FROM accountstate WHERE asid = ?", asid).Scan(types.SQLProto{as})
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("no mastodon account for asid=%v: %w", asid, ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		update(as)
+		return st.SetAccountState(ctx, txn, as)
+	})
 }
@@ -4,8 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -14,11 +19,16 @@ import (
 	"github.com/Palats/mastopoof/backend/types"
 	settingspb "github.com/Palats/mastopoof/proto/gen/mastopoof/settings"
 	stpb "github.com/Palats/mastopoof/proto/gen/mastopoof/storage"
+	"github.com/alexedwards/scs/v2"
+	"github.com/google/go-cmp/cmp"
 	"github.com/mattn/go-mastodon"
+	"google.golang.org/protobuf/testing/protocmp"
 )
 
 type DBTestEnv struct {
 	// -- To be provided
+	// Database engine to use - backendSQLite if empty.
+	backend string
 	// Create the DB up to this version.
 	// If 0, uses the most recent one.
 	targetVersion int
@@ -30,6 +40,23 @@ type DBTestEnv struct {
 	rwDB *sql.DB
 	roDB *sql.DB
 	st   *Storage
+
+	// For PostgreSQL, the schema dedicated to the test.
+	pgBaseURI string
+	pgSchema  string
+}
+
+// postgresTestEnv is the environment variable providing the URL of a
+// PostgreSQL database for tests. PostgreSQL tests are skipped if it is not set.
+const postgresTestEnv = "MASTOPOOF_TEST_POSTGRES"
+
+// forEachBackend runs a storage test against each database engine.
+func forEachBackend(t *testing.T, f func(t *testing.T, backend string)) {
+	for _, backend := range []string{backendSQLite, backendPostgres} {
+		t.Run(backend, func(t *testing.T) {
+			f(t, backend)
+		})
+	}
 }
 
 // dbNameCounter makes it so that there is a unique in memory DB for each test.
@@ -47,7 +74,14 @@ func (env *DBTestEnv) Init(ctx context.Context, t testing.TB) *DBTestEnv {
 	// with env.Close() at the end of the test - otherwise the content won't
 	// be empty for the next test.
 	n := dbNameCounter.Add(1)
-	env.st, err = newStorageNoInit(ctx, fmt.Sprintf("file:memdb%d?mode=memory&cache=shared", n))
+	switch env.backend {
+	case "", backendSQLite:
+		env.st, err = newStorageNoInit(ctx, fmt.Sprintf("file:memdb%d?mode=memory&cache=shared", n))
+	case backendPostgres:
+		env.st, err = env.newPostgresStorage(ctx, n)
+	default:
+		err = fmt.Errorf("unknown backend %q", env.backend)
+	}
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -56,7 +90,7 @@ func (env *DBTestEnv) Init(ctx context.Context, t testing.TB) *DBTestEnv {
 
 	v := env.targetVersion
 	if v == 0 {
-		v = maxSchemaVersion
+		v = env.st.backend.maxVersion()
 	}
 	if err := env.st.initVersion(ctx, v); err != nil {
 		t.Fatal(err)
@@ -71,10 +105,52 @@ func (env *DBTestEnv) Init(ctx context.Context, t testing.TB) *DBTestEnv {
 	return env
 }
 
+// newPostgresStorage creates a storage in a new schema of the test database.
+func (env *DBTestEnv) newPostgresStorage(ctx context.Context, n int64) (*Storage, error) {
+	env.pgBaseURI = os.Getenv(postgresTestEnv)
+	if env.pgBaseURI == "" {
+		env.t.Skipf("%s is not set", postgresTestEnv)
+	}
+	db, err := sql.Open(pgDriverName, env.pgBaseURI)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	schema := fmt.Sprintf("mastopoof_test_%d_%d", os.Getpid(), n)
+	if _, err := db.ExecContext(ctx, "CREATE SCHEMA "+schema); err != nil {
+		return nil, err
+	}
+	env.pgSchema = schema
+
+	u, err := url.Parse(env.pgBaseURI)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	return newStorageNoInit(ctx, u.String())
+}
+
 func (env *DBTestEnv) Close() {
 	if env.st != nil {
 		env.st.Close()
 	}
+	if env.pgSchema != "" {
+		db, err := sql.Open(pgDriverName, env.pgBaseURI)
+		if err != nil {
+			env.t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.ExecContext(context.Background(), "DROP SCHEMA "+env.pgSchema+" CASCADE"); err != nil {
+			env.t.Error(err)
+		}
+	}
+}
+
+// txn gives access to the database outside of a transaction.
+func (env *DBTestEnv) txn() sqlAdapter {
+	return sqlAdapter{env.rwDB, env.st.backend, nil}
 }
 
 func (env *DBTestEnv) pickNext(ctx context.Context, userState *stpb.UserState, streamState *stpb.StreamState) (*Item, error) {
@@ -98,9 +174,11 @@ func (env *DBTestEnv) mustPickNext(ctx context.Context, userState *stpb.UserStat
 
 // TestNoCrossUserStatuses verifies that fetching statuses for a new users does not pick
 // statuses from another user.
-func TestNoCrossUserStatuses(t *testing.T) {
+func TestNoCrossUserStatuses(t *testing.T) { forEachBackend(t, testNoCrossUserStatuses) }
+
+func testNoCrossUserStatuses(t *testing.T, backend string) {
 	ctx := context.Background()
-	env := (&DBTestEnv{}).Init(ctx, t)
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
 	defer env.Close()
 
 	// Create a user and add some statuses.
@@ -113,7 +191,7 @@ func TestNoCrossUserStatuses(t *testing.T) {
 	for i := int64(0); i < 10; i++ {
 		statuses = append(statuses, testserver.NewFakeStatus(mastodon.ID(strconv.FormatInt(i+10, 10)), "123"))
 	}
-	env.st.InsertStatuses(ctx, sqlAdapter{env.rwDB}, types.ASID(accountState1.Asid), streamState1, statuses, []*mastodon.Filter{})
+	env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState1.Asid), streamState1, statuses, []*stpb.MastodonFilter{})
 
 	// Create a second user
 	userState2, _, streamState2, err := env.st.CreateUser(ctx, nil, "localhost", "456", "user2")
@@ -128,9 +206,11 @@ func TestNoCrossUserStatuses(t *testing.T) {
 	}
 }
 
-func TestPick(t *testing.T) {
+func TestPick(t *testing.T) { forEachBackend(t, testPick) }
+
+func testPick(t *testing.T, backend string) {
 	ctx := context.Background()
-	env := (&DBTestEnv{}).Init(ctx, t)
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
 	defer env.Close()
 
 	userState1, accountState1, streamState1, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
@@ -141,7 +221,7 @@ func TestPick(t *testing.T) {
 	for i := int64(0); i < 4; i++ {
 		statuses = append(statuses, testserver.NewFakeStatus(mastodon.ID(strconv.FormatInt(i+10, 10)), "123"))
 	}
-	env.st.InsertStatuses(ctx, sqlAdapter{env.rwDB}, types.ASID(accountState1.Asid), streamState1, statuses, []*mastodon.Filter{})
+	env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState1.Asid), streamState1, statuses, []*stpb.MastodonFilter{})
 
 	// Make sure the statuses that were inserted are available.
 	foundIDs := map[mastodon.ID]int{}
@@ -166,13 +246,209 @@ func TestPick(t *testing.T) {
 	}
 }
 
+// TestPickRanking verifies that statuses are picked following the ranking
+// strategy selected in the settings.
+func TestPickRanking(t *testing.T) { forEachBackend(t, testPickRanking) }
+
+func testPickRanking(t *testing.T, backend string) {
+	testCases := []struct {
+		name    string
+		ranking *settingspb.SettingRanking
+		want    []mastodon.ID
+	}{
+		{
+			name: "default",
+			want: []mastodon.ID{"101", "102", "103", "104"},
+		},
+		{
+			name:    "newest-first",
+			ranking: &settingspb.SettingRanking{Value: settingspb.SettingRanking_NEWEST_FIRST, Override: true},
+			want:    []mastodon.ID{"104", "103", "102", "101"},
+		},
+		{
+			name:    "demote-reblogs",
+			ranking: &settingspb.SettingRanking{Value: settingspb.SettingRanking_DEMOTE_REBLOGS, Override: true},
+			want:    []mastodon.ID{"101", "103", "102", "104"},
+		},
+		{
+			name: "boost-authors",
+			ranking: &settingspb.SettingRanking{
+				Value:          settingspb.SettingRanking_BOOST_AUTHORS,
+				Override:       true,
+				BoostedAuthors: []string{"@fakeuser-456@example.com"},
+			},
+			want: []mastodon.ID{"103", "104", "101", "102"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+			defer env.Close()
+
+			userState1, accountState1, streamState1, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			userState1.Settings.Ranking = tc.ranking
+
+			ref := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			status1 := testserver.NewFakeStatus("101", "123")
+			status2 := testserver.NewFakeStatus("102", "123")
+			status2.Reblog = testserver.NewFakeStatus("991", "789")
+			status3 := testserver.NewFakeStatus("103", "456")
+			status4 := testserver.NewFakeStatus("104", "123")
+			status4.Reblog = testserver.NewFakeStatus("992", "456")
+			statuses := []*mastodon.Status{status1, status2, status3, status4}
+			for i, status := range statuses {
+				status.CreatedAt = ref.Add(time.Duration(i) * time.Minute)
+			}
+
+			err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState1.Asid), streamState1, statuses, []*stpb.MastodonFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []mastodon.ID
+			for {
+				item := env.mustPickNext(ctx, userState1, streamState1)
+				if item == nil {
+					break
+				}
+				got = append(got, item.Status.ID)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("pick order mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestPickThreading verifies that statuses of the same conversation are
+// picked together when threading is enabled.
+func TestPickThreading(t *testing.T) { forEachBackend(t, testPickThreading) }
+
+func testPickThreading(t *testing.T, backend string) {
+	type pick struct {
+		ID           mastodon.ID
+		Continuation bool
+	}
+	testCases := []struct {
+		name      string
+		threading bool
+		ranking   *settingspb.SettingRanking
+		want      []pick
+	}{
+		{
+			name: "disabled",
+			want: []pick{{"101", false}, {"102", false}, {"103", false}, {"104", false}, {"105", false}, {"106", false}},
+		},
+		{
+			name:      "enabled",
+			threading: true,
+			want:      []pick{{"101", false}, {"103", true}, {"104", true}, {"102", false}, {"106", true}, {"105", false}},
+		},
+		{
+			// Parents still in the pool are also part of the conversation.
+			name:      "newest-first",
+			threading: true,
+			ranking:   &settingspb.SettingRanking{Value: settingspb.SettingRanking_NEWEST_FIRST, Override: true},
+			want:      []pick{{"106", false}, {"102", true}, {"105", false}, {"104", false}, {"103", true}, {"101", true}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+			defer env.Close()
+
+			userState1, accountState1, streamState1, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			userState1.Settings.Threading = &settingspb.SettingBool{Value: tc.threading, Override: true}
+			userState1.Settings.Ranking = tc.ranking
+
+			ref := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			parents := map[mastodon.ID]mastodon.ID{
+				"103": "101",
+				"104": "103",
+				"106": "102",
+			}
+			var statuses []*mastodon.Status
+			for i, id := range []mastodon.ID{"101", "102", "103", "104", "105", "106"} {
+				status := testserver.NewFakeStatus(id, "123")
+				status.CreatedAt = ref.Add(time.Duration(i) * time.Minute)
+				if parent, ok := parents[id]; ok {
+					status.InReplyToID = string(parent)
+				}
+				statuses = append(statuses, status)
+			}
+
+			err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState1.Asid), streamState1, statuses, []*stpb.MastodonFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []pick
+			for {
+				item := env.mustPickNext(ctx, userState1, streamState1)
+				if item == nil {
+					break
+				}
+				got = append(got, pick{item.Status.ID, item.StreamStatusState.GetThreadContinuation()})
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("pick order mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestPickThreadingNoPositioned verifies that threading works when the stream
+// has a position but no positioned statuses - e.g., after an import.
+func TestPickThreadingNoPositioned(t *testing.T) { forEachBackend(t, testPickThreadingNoPositioned) }
+
+func testPickThreadingNoPositioned(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	userState, accountState, streamState, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userState.Settings.Threading = &settingspb.SettingBool{Value: true, Override: true}
+	streamState.FirstPosition = 5
+	streamState.LastPosition = 5
+	if err := env.st.SetStreamState(ctx, env.txn(), streamState); err != nil {
+		t.Fatal(err)
+	}
+
+	err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState.Asid), streamState, []*mastodon.Status{testserver.NewFakeStatus("101", "123")}, []*stpb.MastodonFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := env.mustPickNext(ctx, userState, streamState)
+	if item == nil {
+		t.Fatal("no status picked")
+	}
+	if item.StreamStatusState.GetThreadContinuation() {
+		t.Error("status should not be a thread continuation")
+	}
+}
+
 // TestCreateStateStateIncreases verifies that stream IDs
 // are not accidently reused.
-func TestCreateStreamStateIncreases(t *testing.T) {
+func TestCreateStreamStateIncreases(t *testing.T) { forEachBackend(t, testCreateStreamStateIncreases) }
+
+func testCreateStreamStateIncreases(t *testing.T, backend string) {
 	ctx := context.Background()
 
 	// Prepare at version 14
-	env := (&DBTestEnv{}).Init(ctx, t)
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
 	defer env.Close()
 
 	seenUIDs := map[types.UID]bool{}
@@ -201,9 +477,88 @@ func TestCreateStreamStateIncreases(t *testing.T) {
 	}
 }
 
-func TestSearchStatusID(t *testing.T) {
+// TestStreamStatesByUID verifies that the streams of a user are found, and
+// only those.
+func TestStreamStatesByUID(t *testing.T) { forEachBackend(t, testStreamStatesByUID) }
+
+func testStreamStatesByUID(t *testing.T, backend string) {
 	ctx := context.Background()
-	env := (&DBTestEnv{}).Init(ctx, t)
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	userState1, _, streamState1, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userState2, _, streamState2, err := env.st.CreateUser(ctx, nil, "localhost", "456", "user2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamState3, err := env.st.CreateStreamState(ctx, nil, types.UID(userState1.Uid))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for uid, want := range map[types.UID][]int64{
+		types.UID(userState1.Uid):     {streamState1.Stid, streamState3.Stid},
+		types.UID(userState2.Uid):     {streamState2.Stid},
+		types.UID(userState2.Uid + 1): nil,
+	} {
+		streamStates, err := env.st.StreamStatesByUID(ctx, nil, uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int64
+		for _, streamState := range streamStates {
+			got = append(got, streamState.Stid)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("streams of uid=%d mismatch (-want +got):\n%s", uid, diff)
+		}
+	}
+}
+
+// TestStreamSignal verifies that watchers of a stream are notified of changes
+// of that stream only.
+func TestStreamSignal(t *testing.T) { forEachBackend(t, testStreamSignal) }
+
+func testStreamSignal(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	_, _, streamState1, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, streamState2, err := env.st.CreateUser(ctx, nil, "localhost", "456", "user2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signal1 := env.st.StreamSignal(types.StID(streamState1.Stid))
+	signal2 := env.st.StreamSignal(types.StID(streamState2.Stid))
+
+	streamState1.LastRead = 1
+	if err := env.st.SetStreamState(ctx, nil, streamState1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-signal1:
+	default:
+		t.Errorf("stream %d was modified, but its signal was not closed", streamState1.Stid)
+	}
+	select {
+	case <-signal2:
+		t.Errorf("stream %d was not modified, but its signal was closed", streamState2.Stid)
+	default:
+	}
+}
+
+func TestSearchStatusID(t *testing.T) { forEachBackend(t, testSearchStatusID) }
+
+func testSearchStatusID(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
 	defer env.Close()
 
 	// Prep the environment with users and statuses.
@@ -211,11 +566,11 @@ func TestSearchStatusID(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = env.st.InsertStatuses(ctx, sqlAdapter{env.rwDB}, types.ASID(accountState1.Asid), streamState1, []*mastodon.Status{
+	err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState1.Asid), streamState1, []*mastodon.Status{
 		testserver.NewFakeStatus(mastodon.ID("100"), "123"),
 		testserver.NewFakeStatus(mastodon.ID("101"), "123"),
 		testserver.NewFakeStatus(mastodon.ID("102"), "123"),
-	}, []*mastodon.Filter{})
+	}, []*stpb.MastodonFilter{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -224,17 +579,17 @@ func TestSearchStatusID(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = env.st.InsertStatuses(ctx, sqlAdapter{env.rwDB}, types.ASID(accountState2.Asid), streamState2, []*mastodon.Status{
+	err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState2.Asid), streamState2, []*mastodon.Status{
 		testserver.NewFakeStatus(mastodon.ID("200"), "456"),
 		testserver.NewFakeStatus(mastodon.ID("201"), "456"),
-	}, []*mastodon.Filter{})
+	}, []*stpb.MastodonFilter{})
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	err = env.st.InTxnRO(ctx, func(ctx context.Context, txn SQLReadOnly) error {
 		// Make sure the statuses that were inserted are available.
-		results, err := env.st.SearchByStatusID(ctx, txn, types.UID(userState1.Uid), "101")
+		results, err := env.st.Search(ctx, txn, &SearchQuery{UID: types.UID(userState1.Uid), StatusID: "101"})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -246,7 +601,7 @@ func TestSearchStatusID(t *testing.T) {
 		}
 
 		// Search for an unknown status.
-		results, err = env.st.SearchByStatusID(ctx, txn, types.UID(userState1.Uid), "199")
+		results, err = env.st.Search(ctx, txn, &SearchQuery{UID: types.UID(userState1.Uid), StatusID: "199"})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -255,7 +610,7 @@ func TestSearchStatusID(t *testing.T) {
 		}
 
 		// Check that searchs look only for the provided user statuses.
-		results, err = env.st.SearchByStatusID(ctx, txn, types.UID(userState2.Uid), "101")
+		results, err = env.st.Search(ctx, txn, &SearchQuery{UID: types.UID(userState2.Uid), StatusID: "101"})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -270,160 +625,1915 @@ func TestSearchStatusID(t *testing.T) {
 	}
 }
 
-func TestFilters(t *testing.T) {
+func TestSearchText(t *testing.T) { forEachBackend(t, testSearchText) }
+
+func testSearchText(t *testing.T, backend string) {
 	ctx := context.Background()
-	env := (&DBTestEnv{}).Init(ctx, t)
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
 	defer env.Close()
 
-	_, accountState1, streamState1, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	userState1, accountState1, streamState1, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status1 := testserver.NewFakeStatus(mastodon.ID("100"), "123")
+	status1.Content = `<p>Looking at some kittens with <span class="h-card"><a href="https://example.com/@bob" class="u-url mention">@<span>bob</span></a></span> &amp; co</p>`
+	status2 := testserver.NewFakeStatus(mastodon.ID("101"), "123")
+	status2.Content = "<p>Nothing to see</p>"
+	status2.Tags = []mastodon.Tag{{Name: "caturday"}}
+	// Reblogs are found through the reblogged content.
+	status3 := testserver.NewFakeStatus(mastodon.ID("102"), "123")
+	status3.Reblog = testserver.NewFakeStatus(mastodon.ID("900"), "789")
+	status3.Reblog.Content = "<p>More kittens</p>"
+	err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState1.Asid), streamState1, []*mastodon.Status{status1, status2, status3}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	// Triage the first one, to have a position.
+	env.mustPickNext(ctx, userState1, streamState1)
 
-	f1 := mastodon.Filter{"123", "content", []string{"home"}, false, time.Unix(0, 0), true}
-	f2 := mastodon.Filter{"456", "smurf", []string{"home"}, false, time.Unix(0, 0), true}
-	err = env.st.InsertStatuses(ctx, sqlAdapter{env.rwDB}, types.ASID(accountState1.Asid), streamState1, []*mastodon.Status{
-		testserver.NewFakeStatus(mastodon.ID("100"), "123"),
-		testserver.NewFakeStatus(mastodon.ID("101"), "123"),
-		testserver.NewFakeStatus(mastodon.ID("102"), "123"),
-	}, []*mastodon.Filter{&f1, &f2})
+	_, accountState2, streamState2, err := env.st.CreateUser(ctx, nil, "localhost", "456", "user2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status4 := testserver.NewFakeStatus(mastodon.ID("200"), "456")
+	status4.Content = "<p>Kittens of another user</p>"
+	err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState2.Asid), streamState2, []*mastodon.Status{status4}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	var got string
-	var num uint64
-	err = env.roDB.QueryRowContext(ctx, `SELECT DISTINCT status_meta, count(DISTINCT status_meta) from statuses`).Scan(&got, &num)
-	if err == sql.ErrNoRows {
+	search := func(text string) map[mastodon.ID]int64 {
+		t.Helper()
+		var results []*Item
+		err := env.st.InTxnRO(ctx, func(ctx context.Context, txn SQLReadOnly) error {
+			var err error
+			results, err = env.st.Search(ctx, txn, &SearchQuery{
+				UID:   types.UID(userState1.Uid),
+				StID:  types.StID(streamState1.Stid),
+				Text:  text,
+				Limit: 10,
+			})
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		positions := map[mastodon.ID]int64{}
+		for _, item := range results {
+			positions[item.Status.ID] = item.Position
+		}
+		return positions
+	}
+
+	if diff := cmp.Diff(map[mastodon.ID]int64{"100": 1, "102": 0}, search("kittens")); diff != "" {
+		t.Errorf("Search mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[mastodon.ID]int64{"101": 0}, search("caturday")); diff != "" {
+		t.Errorf("Search mismatch (-want +got):\n%s", diff)
+	}
+	// Authors are indexed.
+	if diff := cmp.Diff(map[mastodon.ID]int64{"102": 0}, search("fakeuser-789")); diff != "" {
+		t.Errorf("Search mismatch (-want +got):\n%s", diff)
+	}
+	// All words must match.
+	if diff := cmp.Diff(map[mastodon.ID]int64{"102": 0}, search("more kittens")); diff != "" {
+		t.Errorf("Search mismatch (-want +got):\n%s", diff)
+	}
+	// FTS syntax is not interpreted.
+	if diff := cmp.Diff(map[mastodon.ID]int64{}, search(`kittens" OR "nothing`)); diff != "" {
+		t.Errorf("Search mismatch (-want +got):\n%s", diff)
+	}
+	// Only the text of the content is indexed, not its markup.
+	if diff := cmp.Diff(map[mastodon.ID]int64{"100": 1}, search("bob")); diff != "" {
+		t.Errorf("Search mismatch (-want +got):\n%s", diff)
+	}
+	for _, word := range []string{"span", "href", "class", "mention", "https", "amp"} {
+		if diff := cmp.Diff(map[mastodon.ID]int64{}, search(word)); diff != "" {
+			t.Errorf("Search %q mismatch (-want +got):\n%s", word, diff)
+		}
+	}
+
+	// Updates are reflected in the index.
+	edited := *status2
+	edited.Content = "<p>Now with kittens</p>"
+	if err := env.st.UpdateStatus(ctx, nil, types.ASID(accountState1.Asid), &edited, nil); err != nil {
 		t.Fatal(err)
 	}
-	if num != 1 {
-		t.Errorf("Got %d lines, expected1", num)
+	if diff := cmp.Diff(map[mastodon.ID]int64{"100": 1, "101": 0, "102": 0}, search("kittens")); diff != "" {
+		t.Errorf("Search mismatch (-want +got):\n%s", diff)
 	}
-	status := &stpb.StatusMeta{}
-	err = json.Unmarshal([]byte(got), &status)
+}
+
+func TestSearchConstraints(t *testing.T) { forEachBackend(t, testSearchConstraints) }
+
+func testSearchConstraints(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	userState, accountState, streamState, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(status.Filters) != 2 {
-		t.Errorf("Got %d filters, wanted 2", len(status.Filters))
+	refTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	status1 := testserver.NewFakeStatus(mastodon.ID("100"), "123")
+	status1.CreatedAt = refTime
+	status1.MediaAttachments = []mastodon.Attachment{{ID: "m1", Type: "image"}}
+	status1.Favourited = true
+
+	status2 := testserver.NewFakeStatus(mastodon.ID("101"), "456")
+	status2.CreatedAt = refTime.Add(time.Hour)
+	status2.Poll = &mastodon.Poll{ID: "p1"}
+	status2.Content = "<p>Something about foxes</p>"
+
+	status3 := testserver.NewFakeStatus(mastodon.ID("102"), "123")
+	status3.CreatedAt = refTime.Add(2 * time.Hour)
+	status3.Reblog = testserver.NewFakeStatus(mastodon.ID("900"), "789")
+	status3.Reblog.Reblogged = true
+	status3.Reblog.MediaAttachments = []mastodon.Attachment{{ID: "m2", Type: "image"}}
+
+	err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState.Asid), streamState, []*mastodon.Status{status1, status2, status3}, []*stpb.MastodonFilter{
+		{Id: "1", Context: []string{"home"}, Keywords: []*stpb.MastodonFilter_Keyword{{Keyword: "foxes"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
-	if status.Filters[0].Id != "123" || !status.Filters[0].Matched {
-		t.Errorf("Got filter %#v, wanted {123, true}", status.Filters[0])
+	// Triage the 2 oldest statuses, getting positions 1 and 2.
+	env.mustPickNext(ctx, userState, streamState)
+	env.mustPickNext(ctx, userState, streamState)
+
+	yes := true
+	no := false
+	tests := []struct {
+		name  string
+		query SearchQuery
+		want  []mastodon.ID
+	}{
+		{
+			name:  "author",
+			query: SearchQuery{Author: "fakeuser-456"},
+			want:  []mastodon.ID{"101"},
+		},
+		{
+			name:  "author of reblog",
+			query: SearchQuery{Author: "@FakeUser-789"},
+			want:  []mastodon.ID{"102"},
+		},
+		{
+			name:  "created after",
+			query: SearchQuery{CreatedAfter: refTime.Add(time.Hour)},
+			want:  []mastodon.ID{"101", "102"},
+		},
+		{
+			name:  "created range",
+			query: SearchQuery{CreatedAfter: refTime, CreatedBefore: refTime.Add(time.Hour)},
+			want:  []mastodon.ID{"100", "101"},
+		},
+		{
+			name:  "has media",
+			query: SearchQuery{HasMedia: &yes},
+			want:  []mastodon.ID{"100", "102"},
+		},
+		{
+			name:  "no media",
+			query: SearchQuery{HasMedia: &no},
+			want:  []mastodon.ID{"101"},
+		},
+		{
+			name:  "has poll",
+			query: SearchQuery{HasPoll: &yes},
+			want:  []mastodon.ID{"101"},
+		},
+		{
+			name:  "favourited",
+			query: SearchQuery{Favourited: &yes},
+			want:  []mastodon.ID{"100"},
+		},
+		{
+			name:  "reblogged",
+			query: SearchQuery{Reblogged: &yes},
+			want:  []mastodon.ID{"102"},
+		},
+		{
+			name:  "filter matched",
+			query: SearchQuery{FilterMatched: &yes},
+			want:  []mastodon.ID{"101"},
+		},
+		{
+			name:  "position range",
+			query: SearchQuery{MinPosition: 2, MaxPosition: 2},
+			want:  []mastodon.ID{"101"},
+		},
+		{
+			// Statuses without a position are excluded.
+			name:  "min position",
+			query: SearchQuery{MinPosition: 1},
+			want:  []mastodon.ID{"100", "101"},
+		},
+		{
+			name:  "combined",
+			query: SearchQuery{HasMedia: &yes, CreatedAfter: refTime.Add(time.Minute)},
+			want:  []mastodon.ID{"102"},
+		},
 	}
-	if status.Filters[1].Id != "456" || status.Filters[1].Matched {
-		t.Errorf("Got filter %#v, wanted {456, false}", status.Filters[1])
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var results []*Item
+			err := env.st.InTxnRO(ctx, func(ctx context.Context, txn SQLReadOnly) error {
+				q := tc.query
+				q.UID = types.UID(userState.Uid)
+				q.StID = types.StID(streamState.Stid)
+				var err error
+				results, err = env.st.Search(ctx, txn, &q)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []mastodon.ID
+			for _, item := range results {
+				got = append(got, item.Status.ID)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Search mismatch (-want +got):\n%s", diff)
+			}
+		})
 	}
 }
 
-func TestComputeState(t *testing.T) {
-	status := mastodon.Status{
-		Content: "Here is some text to be able to filter <span>#</span>filter #<span>NoFilter</span>",
-		Tags:    make([]mastodon.Tag, 0),
+func TestStatusContext(t *testing.T) { forEachBackend(t, testStatusContext) }
+
+func testStatusContext(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	userState, accountState, streamState, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
 	}
-	status.Tags = append(status.Tags, mastodon.Tag{Name: "filter"})
-	status.Tags = append(status.Tags, mastodon.Tag{Name: "nofilter"})
+	asid := types.ASID(accountState.Asid)
+	stid := types.StID(streamState.Stid)
 
-	f1 := mastodon.Filter{ID: "1", Phrase: "#nofilter"}
-	f2 := mastodon.Filter{ID: "2", Phrase: "Filters"}
-	f3 := mastodon.Filter{ID: "3", Phrase: "smurf"}
-	f4 := mastodon.Filter{ID: "3", Phrase: "text"}
+	reply := func(id mastodon.ID, parent mastodon.ID) *mastodon.Status {
+		status := testserver.NewFakeStatus(id, "123")
+		if parent != "" {
+			status.InReplyToID = string(parent)
+		}
+		return status
+	}
+	// The root of the thread is only cached, not in the stream.
+	if err := env.st.CacheStatus(ctx, nil, asid, reply("100", ""), nil); err != nil {
+		t.Fatal(err)
+	}
+	err = env.st.InsertStatuses(ctx, env.txn(), asid, streamState, []*mastodon.Status{
+		reply("101", "100"),
+		reply("102", "101"),
+		reply("103", "102"),
+		reply("104", "103"),
+		reply("105", ""),
+		reply("106", "102"),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.mustPickNext(ctx, userState, streamState)
+	env.mustPickNext(ctx, userState, streamState)
 
-	statusMeta := computeStatusMeta(&status, []*mastodon.Filter{&f1, &f2, &f3, &f4})
-	if len(statusMeta.Filters) != 4 {
-		t.Errorf("Got %d filters, wanted 1", len(statusMeta.Filters))
+	type result struct {
+		ID       mastodon.ID
+		Position int64
 	}
-	if !statusMeta.Filters[0].Matched ||
-		statusMeta.Filters[1].Matched ||
-		statusMeta.Filters[2].Matched ||
-		!statusMeta.Filters[3].Matched {
-		t.Errorf("Got filter %#v, wanted {true, false, false, true}", statusMeta.Filters)
+	toResults := func(items []*Item) []result {
+		var results []result
+		for _, item := range items {
+			results = append(results, result{item.Status.ID, item.Position})
+		}
+		return results
 	}
 
-}
+	ancestors, descendants, err := env.st.StatusContext(ctx, nil, stid, asid, "102")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]result{{"100", 0}, {"101", 1}}, toResults(ancestors)); diff != "" {
+		t.Errorf("Ancestors mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]result{{"103", 0}, {"104", 0}, {"106", 0}}, toResults(descendants)); diff != "" {
+		t.Errorf("Descendants mismatch (-want +got):\n%s", diff)
+	}
 
-func getStreamStatusState(ctx context.Context, env *DBTestEnv, withID string) *stpb.StreamStatusState {
-	streamStatusState := &stpb.StreamStatusState{}
-	row := env.roDB.QueryRowContext(ctx, `
-		SELECT stream_status_state FROM streamcontent WHERE status_id = ?
-	`, withID)
-	if err := row.Scan(types.SQLProto{streamStatusState}); err != nil {
-		env.t.Fatal(err)
+	item, err := env.st.StatusItem(ctx, nil, stid, asid, "102")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := item.Position, int64(2); got != want {
+		t.Errorf("Got position %d, wanted %d", got, want)
+	}
+	if _, err := env.st.StatusItem(ctx, nil, stid, asid, "999"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Got error %v, wanted ErrNotFound", err)
 	}
-	return streamStatusState
 }
 
-// Verify that the feature hiding already-seen status detects things properly.
-func TestAlreadySeenActive(t *testing.T) {
+func TestNotifications(t *testing.T) { forEachBackend(t, testNotifications) }
+
+func testNotifications(t *testing.T, backend string) {
 	ctx := context.Background()
-	env := (&DBTestEnv{}).Init(ctx, t)
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
 	defer env.Close()
 
-	// Prep the environment with users and statuses.
-	userState1, accountState1, streamState1, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	userState, accountState, _, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
 	if err != nil {
 		t.Fatal(err)
 	}
+	asid := types.ASID(accountState.Asid)
+	uid := types.UID(userState.Uid)
+	status := testserver.NewFakeStatus(mastodon.ID("100"), "123")
 
-	// Activate the feature.
-	userState1.Settings.SeenReblogs = &settingspb.SettingSeenReblogs{
-		Value:    settingspb.SettingSeenReblogs_HIDE,
-		Override: true,
+	// Provided in Mastodon order - i.e., most recent first.
+	err = env.st.InsertNotifications(ctx, nil, asid, []*mastodon.Notification{
+		testserver.NewFakeNotification("10", "mention", "456", status),
+		testserver.NewFakeNotification("9", "follow", "456", nil),
+		testserver.NewFakeNotification("8", "favourite", "456", status),
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	// A basic status
-	status1 := testserver.NewFakeStatus(mastodon.ID("101"), "123")
-	// Another basic status
-	status2 := testserver.NewFakeStatus(mastodon.ID("102"), "123")
-	// A reblog of the first status.
-	status3 := testserver.NewFakeStatus(mastodon.ID("103"), "123")
-	status3.Reblog = status2
-	// A reblog of a never seen before status
-	status4 := testserver.NewFakeStatus(mastodon.ID("104"), "123")
-	status4.Reblog = testserver.NewFakeStatus(mastodon.ID("991"), "123")
-	// A reblog of a reblog
-	status5 := testserver.NewFakeStatus(mastodon.ID("105"), "123")
-	status5.Reblog = status4
-
-	err = env.st.InsertStatuses(ctx, sqlAdapter{env.rwDB}, types.ASID(accountState1.Asid), streamState1, []*mastodon.Status{
-		status1, status2, status3, status4, status5,
-	}, []*mastodon.Filter{})
+	// Already known notifications are ignored.
+	err = env.st.InsertNotifications(ctx, nil, asid, []*mastodon.Notification{
+		testserver.NewFakeNotification("11", "reblog", "456", status),
+		testserver.NewFakeNotification("10", "mention", "456", status),
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	env.mustPickNext(ctx, userState1, streamState1)
-	if got, want := getStreamStatusState(ctx, env, "101").AlreadySeen, stpb.StreamStatusState_NO; got != want {
-		t.Errorf("Got AlreadySeen = %v, wanted %v", got, want)
+	list := func(q *NotificationsQuery) []mastodon.ID {
+		t.Helper()
+		q.UID = uid
+		if q.Limit == 0 {
+			q.Limit = 10
+		}
+		notifs, err := env.st.ListNotifications(ctx, nil, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []mastodon.ID
+		for _, notif := range notifs {
+			ids = append(ids, notif.Notification.ID)
+		}
+		return ids
 	}
 
-	env.mustPickNext(ctx, userState1, streamState1)
-	if got, want := getStreamStatusState(ctx, env, "102").AlreadySeen, stpb.StreamStatusState_NO; got != want {
-		t.Errorf("Got AlreadySeen = %v, wanted %v", got, want)
+	if diff := cmp.Diff([]mastodon.ID{"11", "10", "9", "8"}, list(&NotificationsQuery{})); diff != "" {
+		t.Errorf("Notifications mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]mastodon.ID{"11", "8"}, list(&NotificationsQuery{Types: []string{"favourite", "reblog"}})); diff != "" {
+		t.Errorf("Notifications mismatch (-want +got):\n%s", diff)
 	}
 
-	env.mustPickNext(ctx, userState1, streamState1)
-	if got, want := getStreamStatusState(ctx, env, "103").AlreadySeen, stpb.StreamStatusState_YES; got != want {
-		t.Errorf("Got AlreadySeen = %v, wanted %v", got, want)
+	// Paging.
+	notifs, err := env.st.ListNotifications(ctx, nil, &NotificationsQuery{UID: uid, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]mastodon.ID{"9", "8"}, list(&NotificationsQuery{BeforeNID: notifs[1].NID})); diff != "" {
+		t.Errorf("Notifications mismatch (-want +got):\n%s", diff)
 	}
 
-	env.mustPickNext(ctx, userState1, streamState1)
-	if got, want := getStreamStatusState(ctx, env, "104").AlreadySeen, stpb.StreamStatusState_NO; got != want {
-		t.Errorf("Got AlreadySeen = %v, wanted %v", got, want)
+	if got, err := env.st.LatestNotificationID(ctx, nil, asid); err != nil || got != "11" {
+		t.Errorf("Got latest notification %q [err: %v], want 11", got, err)
 	}
 
-	env.mustPickNext(ctx, userState1, streamState1)
-	if got, want := getStreamStatusState(ctx, env, "105").AlreadySeen, stpb.StreamStatusState_YES; got != want {
-		t.Errorf("Got AlreadySeen = %v, wanted %v", got, want)
+	// Read on another Mastodon client.
+	if err := env.st.SetNotificationsMarker(ctx, nil, asid, "9"); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]mastodon.ID{"11", "10"}, list(&NotificationsQuery{UnreadOnly: true})); diff != "" {
+		t.Errorf("Notifications mismatch (-want +got):\n%s", diff)
+	}
+	if got, err := env.st.UnreadNotificationsCount(ctx, nil, uid); err != nil || got != 2 {
+		t.Errorf("Got %d unread notifications [err: %v], want 2", got, err)
 	}
-}
 
-// Verify that the feature hiding already-seen does not try thing when not active.
-func TestAlreadySeenInactive(t *testing.T) {
+	// Read from Mastopoof.
+	markers, err := env.st.MarkNotificationsRead(ctx, nil, uid, notifs[1].NID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[types.ASID]mastodon.ID{asid: "10"}, markers); diff != "" {
+		t.Errorf("Markers mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]mastodon.ID{"11"}, list(&NotificationsQuery{UnreadOnly: true})); diff != "" {
+		t.Errorf("Notifications mismatch (-want +got):\n%s", diff)
+	}
+	markers, err = env.st.MarkNotificationsRead(ctx, nil, uid, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[types.ASID]mastodon.ID{asid: "11"}, markers); diff != "" {
+		t.Errorf("Markers mismatch (-want +got):\n%s", diff)
+	}
+	if got, err := env.st.UnreadNotificationsCount(ctx, nil, uid); err != nil || got != 0 {
+		t.Errorf("Got %d unread notifications [err: %v], want 0", got, err)
+	}
+
+	// Dismissed on Mastodon.
+	err = env.st.InsertNotifications(ctx, nil, asid, []*mastodon.Notification{
+		testserver.NewFakeNotification("15", "mention", "456", status),
+		testserver.NewFakeNotification("14", "mention", "456", status),
+		testserver.NewFakeNotification("13", "mention", "456", status),
+		testserver.NewFakeNotification("12", "mention", "456", status),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only notifications within the listed range are dropped.
+	if err := env.st.DropDismissedNotifications(ctx, nil, asid, []mastodon.ID{"15", "13"}, "13", "14"); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]mastodon.ID{"15", "13", "12"}, list(&NotificationsQuery{UnreadOnly: true})); diff != "" {
+		t.Errorf("Notifications mismatch (-want +got):\n%s", diff)
+	}
+	if err := env.st.DropDismissedNotifications(ctx, nil, asid, []mastodon.ID{"15"}, "", "15"); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]mastodon.ID{"15"}, list(&NotificationsQuery{UnreadOnly: true})); diff != "" {
+		t.Errorf("Notifications mismatch (-want +got):\n%s", diff)
+	}
+	// Read notifications are kept.
+	if diff := cmp.Diff([]mastodon.ID{"15", "11", "10", "9", "8"}, list(&NotificationsQuery{})); diff != "" {
+		t.Errorf("Notifications mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestFilters(t *testing.T) { forEachBackend(t, testFilters) }
+
+func testFilters(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	_, accountState1, streamState1, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f1 := &stpb.MastodonFilter{Id: "123", Context: []string{"home"}, Keywords: []*stpb.MastodonFilter_Keyword{{Keyword: "content"}}}
+	f2 := &stpb.MastodonFilter{Id: "456", Context: []string{"home"}, Keywords: []*stpb.MastodonFilter_Keyword{{Keyword: "smurf"}}}
+	err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState1.Asid), streamState1, []*mastodon.Status{
+		testserver.NewFakeStatus(mastodon.ID("100"), "123"),
+		testserver.NewFakeStatus(mastodon.ID("101"), "123"),
+		testserver.NewFakeStatus(mastodon.ID("102"), "123"),
+	}, []*stpb.MastodonFilter{f1, f2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	var num uint64
+	err = env.txn().QueryRow(ctx, "test-filters", `SELECT min(status_meta), count(DISTINCT status_meta) from statuses`).Scan(&got, &num)
+	if err == sql.ErrNoRows {
+		t.Fatal(err)
+	}
+	if num != 1 {
+		t.Errorf("Got %d lines, expected1", num)
+	}
+	status := &stpb.StatusMeta{}
+	err = json.Unmarshal([]byte(got), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Filters) != 2 {
+		t.Errorf("Got %d filters, wanted 2", len(status.Filters))
+	}
+	if status.Filters[0].Id != "123" || !status.Filters[0].Matched {
+		t.Errorf("Got filter %#v, wanted {123, true}", status.Filters[0])
+	}
+	if status.Filters[1].Id != "456" || status.Filters[1].Matched {
+		t.Errorf("Got filter %#v, wanted {456, false}", status.Filters[1])
+	}
+}
+
+func TestComputeState(t *testing.T) { forEachBackend(t, testComputeState) }
+
+func testComputeState(t *testing.T, backend string) {
+	status := mastodon.Status{
+		Content: "Here is some text to be able to filter <span>#</span>filter #<span>NoFilter</span>",
+		Tags:    make([]mastodon.Tag, 0),
+	}
+	status.Tags = append(status.Tags, mastodon.Tag{Name: "filter"})
+	status.Tags = append(status.Tags, mastodon.Tag{Name: "nofilter"})
+
+	filter := func(id string, keyword string, wholeWord bool) *stpb.MastodonFilter {
+		return &stpb.MastodonFilter{
+			Id:       id,
+			Context:  []string{"home"},
+			Keywords: []*stpb.MastodonFilter_Keyword{{Keyword: keyword, WholeWord: wholeWord}},
+		}
+	}
+	f1 := filter("1", "#nofilter", false)
+	f2 := filter("2", "Filters", false)
+	f3 := filter("3", "smurf", false)
+	f4 := filter("4", "text", false)
+	f5 := filter("5", "tex", true)
+	f6 := filter("6", "some text", true)
+	// Not applicable to the home timeline.
+	f7 := filter("7", "text", false)
+	f7.Context = []string{"notifications"}
+	// Expired.
+	f8 := filter("8", "text", false)
+	f8.ExpiresAtSecs = 1
+
+	statusMeta := computeStatusMeta(&status, []*stpb.MastodonFilter{f1, f2, f3, f4, f5, f6, f7, f8}, filterContextHome)
+	type result struct {
+		ID      string
+		Matched bool
+	}
+	var got []result
+	for _, f := range statusMeta.Filters {
+		got = append(got, result{f.Id, f.Matched})
+	}
+	want := []result{{"1", true}, {"2", false}, {"3", false}, {"4", true}, {"5", false}, {"6", true}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Filters mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestFilterContexts(t *testing.T) { forEachBackend(t, testFilterContexts) }
+
+func testFilterContexts(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	userState, accountState, homeState, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashtagState, err := env.st.CreateStreamState(ctx, env.txn(), types.UID(userState.Uid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashtagState.Source = &stpb.StreamSource{Kind: stpb.StreamSource_HASHTAG, Hashtag: "news"}
+	if err := env.st.SetStreamState(ctx, env.txn(), hashtagState); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only for public timelines - i.e., hashtag streams.
+	filters := []*stpb.MastodonFilter{
+		{Id: "1", Title: "Politics", Context: []string{"public"}, FilterAction: "hide", Keywords: []*stpb.MastodonFilter_Keyword{{Keyword: "election"}}},
+	}
+	status := func(id mastodon.ID) *mastodon.Status {
+		s := testserver.NewFakeStatus(id, "123")
+		s.Content = "About the election"
+		return s
+	}
+	asid := types.ASID(accountState.Asid)
+	if err := env.st.InsertStatuses(ctx, env.txn(), asid, homeState, []*mastodon.Status{status("100")}, filters); err != nil {
+		t.Fatal(err)
+	}
+	if homeState.Remaining != 1 || homeState.Filtered != 0 {
+		t.Errorf("Got home remaining=%d, filtered=%d; want 1, 0", homeState.Remaining, homeState.Filtered)
+	}
+	if err := env.st.InsertStatuses(ctx, env.txn(), asid, hashtagState, []*mastodon.Status{status("101")}, filters); err != nil {
+		t.Fatal(err)
+	}
+	if hashtagState.Remaining != 0 || hashtagState.Filtered != 1 {
+		t.Errorf("Got hashtag remaining=%d, filtered=%d; want 0, 1", hashtagState.Remaining, hashtagState.Filtered)
+	}
+
+	// Conversations have a context of their own.
+	filters[0].Context = []string{"thread"}
+	statusMeta := ThreadStatusMeta(status("102"), nil, filters)
+	if len(statusMeta.Filters) != 1 || !statusMeta.Filters[0].Matched {
+		t.Errorf("Got filter matches %v, wanted a match", statusMeta.Filters)
+	}
+}
+
+func TestFilterActions(t *testing.T) { forEachBackend(t, testFilterActions) }
+
+func testFilterActions(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	userState, accountState, streamState, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := func(id mastodon.ID, content string) *mastodon.Status {
+		s := testserver.NewFakeStatus(id, "123")
+		s.Content = content
+		return s
+	}
+	filters := []*stpb.MastodonFilter{
+		{Id: "1", Title: "Spoilers", Context: []string{"home"}, FilterAction: "warn", Keywords: []*stpb.MastodonFilter_Keyword{{Keyword: "spoiler"}}},
+		{Id: "2", Title: "Politics", Context: []string{"home"}, FilterAction: "hide", Keywords: []*stpb.MastodonFilter_Keyword{{Keyword: "election"}}},
+	}
+	err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState.Asid), streamState, []*mastodon.Status{
+		status("100", "Nothing special"),
+		status("101", "About the election"),
+		status("102", "Big spoiler ahead"),
+	}, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamState.Remaining != 2 || streamState.Filtered != 1 {
+		t.Errorf("Got remaining=%d, filtered=%d; want 2, 1", streamState.Remaining, streamState.Filtered)
+	}
+
+	item := env.mustPickNext(ctx, userState, streamState)
+	if item.Status.ID != "100" {
+		t.Errorf("Got status %s, wanted 100", item.Status.ID)
+	}
+	if got := FilterWarnings(item.StatusMeta); len(got) != 0 {
+		t.Errorf("Got filter warnings %v, wanted none", got)
+	}
+
+	// The hidden status is skipped.
+	item = env.mustPickNext(ctx, userState, streamState)
+	if item.Status.ID != "102" {
+		t.Errorf("Got status %s, wanted 102", item.Status.ID)
+	}
+	if diff := cmp.Diff([]string{"Spoilers"}, FilterWarnings(item.StatusMeta)); diff != "" {
+		t.Errorf("Filter warnings mismatch (-want +got):\n%s", diff)
+	}
+
+	// And is never picked, but stays in the pool.
+	item, err = env.pickNext(ctx, userState, streamState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item != nil {
+		t.Errorf("Got status %s, wanted none", item.Status.ID)
+	}
+	if streamState.Remaining != 0 || streamState.Filtered != 1 {
+		t.Errorf("Got remaining=%d, filtered=%d; want 0, 1", streamState.Remaining, streamState.Filtered)
+	}
+
+	err = env.st.InTxnRO(ctx, func(ctx context.Context, txn SQLReadOnly) error {
+		recomputed, err := env.st.RecomputeStreamState(ctx, txn, types.StID(streamState.Stid))
+		if err != nil {
+			return err
+		}
+		if recomputed.Remaining != 0 || recomputed.Filtered != 1 {
+			t.Errorf("Got recomputed remaining=%d, filtered=%d; want 0, 1", recomputed.Remaining, recomputed.Filtered)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting the hidden status updates the filtered count.
+	if err := env.st.DeleteStatus(ctx, nil, types.ASID(accountState.Asid), "101"); err != nil {
+		t.Fatal(err)
+	}
+	streamState, err = env.st.StreamState(ctx, nil, types.StID(streamState.Stid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamState.Remaining != 0 || streamState.Filtered != 0 {
+		t.Errorf("Got remaining=%d, filtered=%d; want 0, 0", streamState.Remaining, streamState.Filtered)
+	}
+}
+
+func TestSetAccountFilters(t *testing.T) { forEachBackend(t, testSetAccountFilters) }
+
+func testSetAccountFilters(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	_, accountState, _, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters := []*stpb.MastodonFilter{
+		{Id: "1", Title: "Spoilers", Context: []string{"home"}, FilterAction: "warn", Keywords: []*stpb.MastodonFilter_Keyword{{Keyword: "spoiler"}}},
+	}
+	if err := env.st.SetAccountFilters(ctx, nil, types.ASID(accountState.Asid), filters, 1234); err != nil {
+		t.Fatal(err)
+	}
+	got, err := env.st.FirstAccountStateByUID(ctx, nil, types.UID(accountState.Uid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(filters, got.Filters, protocmp.Transform()); diff != "" {
+		t.Errorf("Filters mismatch (-want +got):\n%s", diff)
+	}
+	if got.FiltersFetchSecs != 1234 {
+		t.Errorf("Got fetch time %d, wanted 1234", got.FiltersFetchSecs)
+	}
+	// Other fields are kept.
+	if got.Username != "user1" {
+		t.Errorf("Got username %q, wanted user1", got.Username)
+	}
+
+	if err := env.st.SetAccountFilters(ctx, nil, 999, filters, 1234); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Got error %v, wanted not found", err)
+	}
+}
+
+func TestSetAccountFiltersPool(t *testing.T) { forEachBackend(t, testSetAccountFiltersPool) }
+
+func testSetAccountFiltersPool(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	userState, accountState, streamState, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	asid := types.ASID(accountState.Asid)
+	filters := []*stpb.MastodonFilter{
+		{Id: "1", Title: "Politics", Context: []string{"home"}, FilterAction: "hide", Keywords: []*stpb.MastodonFilter_Keyword{{Keyword: "election"}}},
+	}
+	if err := env.st.SetAccountFilters(ctx, nil, asid, filters, 1000); err != nil {
+		t.Fatal(err)
+	}
+	status := testserver.NewFakeStatus("101", "123")
+	status.Content = "About the election"
+	if err := env.st.InsertStatuses(ctx, env.txn(), asid, streamState, []*mastodon.Status{status}, filters); err != nil {
+		t.Fatal(err)
+	}
+	if streamState.Remaining != 0 || streamState.Filtered != 1 {
+		t.Errorf("Got remaining=%d, filtered=%d; want 0, 1", streamState.Remaining, streamState.Filtered)
+	}
+
+	// The filter was deleted on Mastodon - or expired: the status is no longer
+	// hidden.
+	if err := env.st.SetAccountFilters(ctx, nil, asid, nil, 2000); err != nil {
+		t.Fatal(err)
+	}
+	streamState, err = env.st.StreamState(ctx, nil, types.StID(streamState.Stid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamState.Remaining != 1 || streamState.Filtered != 0 {
+		t.Errorf("Got remaining=%d, filtered=%d; want 1, 0", streamState.Remaining, streamState.Filtered)
+	}
+	if item := env.mustPickNext(ctx, userState, streamState); item.Status.ID != "101" {
+		t.Errorf("Got status %s, wanted 101", item.Status.ID)
+	}
+}
+
+func TestFilterRules(t *testing.T) { forEachBackend(t, testFilterRules) }
+
+func testFilterRules(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	userState, accountState, streamState, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userState.FilterRules = []*stpb.FilterRule{
+		{Id: 1, Kind: stpb.FilterRule_REBLOGS_FROM, Action: stpb.FilterRule_HIDE, Account: "booster@example.com"},
+		{Id: 2, Kind: stpb.FilterRule_LANGUAGE, Action: stpb.FilterRule_COLLAPSE, Language: "de"},
+		{Id: 3, Kind: stpb.FilterRule_TOO_MANY_HASHTAGS, Action: stpb.FilterRule_HIDE, MaxHashtags: 2},
+		{Id: 4, Kind: stpb.FilterRule_REPLY_TO_UNFOLLOWED, Action: stpb.FilterRule_HIDE},
+	}
+	if err := env.st.SetAccountFollowing(ctx, nil, types.ASID(accountState.Asid), []string{"111"}, 1234); err != nil {
+		t.Fatal(err)
+	}
+
+	baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	status := func(id mastodon.ID, offset int) *mastodon.Status {
+		s := testserver.NewFakeStatus(id, "123")
+		s.CreatedAt = baseTime.Add(time.Duration(offset) * time.Minute)
+		return s
+	}
+	plain := status("100", 0)
+	reblog := status("101", 1)
+	reblog.Account.Acct = "booster@example.com"
+	reblog.Reblog = status("90", 0)
+	german := status("102", 2)
+	german.Language = "de"
+	tagged := status("103", 3)
+	tagged.Tags = []mastodon.Tag{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+	replyUnfollowed := status("104", 4)
+	replyUnfollowed.InReplyToID = "50"
+	replyUnfollowed.InReplyToAccountID = "222"
+	replyFollowed := status("105", 5)
+	replyFollowed.InReplyToID = "51"
+	replyFollowed.InReplyToAccountID = "111"
+
+	err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState.Asid), streamState, []*mastodon.Status{
+		plain, reblog, german, tagged, replyUnfollowed, replyFollowed,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item := env.mustPickNext(ctx, userState, streamState)
+	if item.Status.ID != "100" {
+		t.Errorf("Got status %s, wanted 100", item.Status.ID)
+	}
+	if len(item.StreamStatusState.RuleMatches) != 0 {
+		t.Errorf("Got rule matches %v, wanted none", item.StreamStatusState.RuleMatches)
+	}
+
+	// Collapsed statuses are still picked, with the match recorded.
+	item = env.mustPickNext(ctx, userState, streamState)
+	if item.Status.ID != "102" {
+		t.Errorf("Got status %s, wanted 102", item.Status.ID)
+	}
+	want := []*stpb.FilterRuleMatch{
+		{RuleId: 2, Action: stpb.FilterRule_COLLAPSE, Description: "language: de"},
+	}
+	if diff := cmp.Diff(want, item.StreamStatusState.RuleMatches, protocmp.Transform()); diff != "" {
+		t.Errorf("Rule matches mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want, getStreamStatusState(ctx, env, "102").RuleMatches, protocmp.Transform()); diff != "" {
+		t.Errorf("Stored rule matches mismatch (-want +got):\n%s", diff)
+	}
+
+	item = env.mustPickNext(ctx, userState, streamState)
+	if item.Status.ID != "105" {
+		t.Errorf("Got status %s, wanted 105", item.Status.ID)
+	}
+
+	// Hidden statuses stay in the pool.
+	item, err = env.pickNext(ctx, userState, streamState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item != nil {
+		t.Errorf("Got status %s, wanted none", item.Status.ID)
+	}
+	if streamState.Remaining != 0 || streamState.Filtered != 3 {
+		t.Errorf("Got remaining=%d, filtered=%d; want 0, 3", streamState.Remaining, streamState.Filtered)
+	}
+	if diff := cmp.Diff([]*stpb.FilterRuleMatch{
+		{RuleId: 4, Action: stpb.FilterRule_HIDE, Description: "reply to an account not followed"},
+	}, getStreamStatusState(ctx, env, "104").RuleMatches, protocmp.Transform()); diff != "" {
+		t.Errorf("Stored rule matches mismatch (-want +got):\n%s", diff)
+	}
+	err = env.st.InTxnRO(ctx, func(ctx context.Context, txn SQLReadOnly) error {
+		recomputed, err := env.st.RecomputeStreamState(ctx, txn, types.StID(streamState.Stid))
+		if err != nil {
+			return err
+		}
+		if recomputed.Remaining != 0 || recomputed.Filtered != 3 {
+			t.Errorf("Got recomputed remaining=%d, filtered=%d; want 0, 3", recomputed.Remaining, recomputed.Filtered)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once a rule is removed, the statuses it was hiding are available again.
+	userState.FilterRules = userState.FilterRules[1:]
+	item = env.mustPickNext(ctx, userState, streamState)
+	if item.Status.ID != "101" {
+		t.Errorf("Got status %s, wanted 101", item.Status.ID)
+	}
+	if streamState.Remaining != 0 || streamState.Filtered != 2 {
+		t.Errorf("Got remaining=%d, filtered=%d; want 0, 2", streamState.Remaining, streamState.Filtered)
+	}
+}
+
+func TestRecomputeMeta(t *testing.T) { forEachBackend(t, testRecomputeMeta) }
+
+func testRecomputeMeta(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	userState, accountState, streamState, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := func(id mastodon.ID, content string) *mastodon.Status {
+		s := testserver.NewFakeStatus(id, "123")
+		s.Content = content
+		return s
+	}
+	err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState.Asid), streamState, []*mastodon.Status{
+		status("100", "About the election"),
+		status("101", "The election again"),
+		status("102", "Nothing special"),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item := env.mustPickNext(ctx, userState, streamState); item.Status.ID != "100" {
+		t.Errorf("Got status %s, wanted 100", item.Status.ID)
+	}
+
+	// Filters are modified after the statuses were fetched.
+	filters := []*stpb.MastodonFilter{
+		{Id: "1", Title: "Politics", Context: []string{"home"}, FilterAction: "hide", Keywords: []*stpb.MastodonFilter_Keyword{{Keyword: "election"}}},
+	}
+	if err := env.st.SetAccountFilters(ctx, nil, types.ASID(accountState.Asid), filters, 1234); err != nil {
+		t.Fatal(err)
+	}
+	// The pool is matched again as the filters changed.
+	got, err := env.st.StreamState(ctx, nil, types.StID(streamState.Stid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Remaining != 1 || got.Filtered != 1 {
+		t.Errorf("Got remaining=%d, filtered=%d; want 1, 1", got.Remaining, got.Filtered)
+	}
+
+	// By default, only the pool is updated - which is already up to date.
+	var progress []RecomputeMetaProgress
+	result, err := env.st.RecomputeMeta(ctx, types.UID(userState.Uid), false, func(p *RecomputeMetaProgress) error {
+		progress = append(progress, *p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RecomputeMetaProgress{Total: 2, Processed: 2, Updated: 0}
+	if diff := cmp.Diff(want, *result); diff != "" {
+		t.Errorf("Result mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]RecomputeMetaProgress{want}, progress); diff != "" {
+		t.Errorf("Progress mismatch (-want +got):\n%s", diff)
+	}
+
+	got, err = env.st.StreamState(ctx, nil, types.StID(streamState.Stid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Remaining != 1 || got.Filtered != 1 {
+		t.Errorf("Got remaining=%d, filtered=%d; want 1, 1", got.Remaining, got.Filtered)
+	}
+	if item := env.mustPickNext(ctx, userState, got); item.Status.ID != "102" {
+		t.Errorf("Got status %s, wanted 102", item.Status.ID)
+	}
+
+	// Statuses already in the stream can be included.
+	result, err = env.st.RecomputeMeta(ctx, types.UID(userState.Uid), true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(RecomputeMetaProgress{Total: 3, Processed: 3, Updated: 1}, *result); diff != "" {
+		t.Errorf("Result mismatch (-want +got):\n%s", diff)
+	}
+	item, err := env.st.StatusAtPosition(ctx, nil, types.StID(streamState.Stid), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !statusHidden(item.StatusMeta) {
+		t.Errorf("Status at position 1 should now match the filter")
+	}
+}
+
+func TestGC(t *testing.T) { forEachBackend(t, testGC) }
+
+func testGC(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	userState, accountState, streamState, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	status := func(id mastodon.ID, createdAt time.Time) *mastodon.Status {
+		s := testserver.NewFakeStatus(id, "123")
+		s.CreatedAt = createdAt
+		return s
+	}
+	favourited := status("102", oldTime.Add(2*time.Minute))
+	favourited.Favourited = true
+	err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState.Asid), streamState, []*mastodon.Status{
+		status("100", oldTime),
+		status("101", oldTime.Add(time.Minute)),
+		favourited,
+		status("103", time.Now().Add(-time.Hour)),
+		status("104", time.Now()),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []mastodon.ID{"100", "101", "102", "103"} {
+		if item := env.mustPickNext(ctx, userState, streamState); item.Status.ID != want {
+			t.Errorf("Got status %s, wanted %s", item.Status.ID, want)
+		}
+	}
+
+	if _, err := env.st.GC(ctx, 0, RetentionPolicy{}, false); err == nil {
+		t.Errorf("Expected an error without retention criteria")
+	}
+
+	// Statuses in the pool, recent ones and favourited ones are kept.
+	policy := RetentionPolicy{MaxAge: 30 * 24 * time.Hour}
+	result, err := env.st.GC(ctx, 0, policy, true /* dryRun */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Pruned != 2 || result.Kept != 1 || result.PrunedBytes == 0 {
+		t.Errorf("Got dry run result %+v, wanted 2 pruned and 1 kept", result)
+	}
+	item, err := env.st.StatusAtPosition(ctx, nil, types.StID(streamState.Stid), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.StatusMeta.Pruned || item.Status.Content == "" {
+		t.Errorf("Dry run should not modify statuses")
+	}
+
+	result, err = env.st.GC(ctx, 0, policy, false /* dryRun */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Pruned != 2 || result.Kept != 1 {
+		t.Errorf("Got result %+v, wanted 2 pruned and 1 kept", result)
+	}
+	item, err = env.st.StatusAtPosition(ctx, nil, types.StID(streamState.Stid), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !item.StatusMeta.Pruned || item.Status.Content != "" {
+		t.Errorf("Status at position 1 should be pruned; meta=%v content=%q", item.StatusMeta, item.Status.Content)
+	}
+	if item.Status.ID != "100" || item.Status.URI == "" {
+		t.Errorf("Pruned status should keep its identity, got ID=%q URI=%q", item.Status.ID, item.Status.URI)
+	}
+	item, err = env.st.StatusAtPosition(ctx, nil, types.StID(streamState.Stid), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.StatusMeta.Pruned {
+		t.Errorf("Favourited status should not be pruned")
+	}
+
+	// Pruned statuses are not considered again.
+	result, err = env.st.GC(ctx, 0, policy, false /* dryRun */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Pruned != 0 || result.Kept != 1 {
+		t.Errorf("Got result %+v, wanted 0 pruned and 1 kept", result)
+	}
+
+	// Based on the read position.
+	if item := env.mustPickNext(ctx, userState, streamState); item.Status.ID != "104" {
+		t.Errorf("Got status %s, wanted 104", item.Status.ID)
+	}
+	streamState.LastRead = 5
+	if err := env.st.SetStreamState(ctx, nil, streamState); err != nil {
+		t.Fatal(err)
+	}
+	result, err = env.st.GC(ctx, types.UID(userState.Uid), RetentionPolicy{MaxBehindLastRead: 1}, false /* dryRun */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Pruned != 1 || result.Kept != 1 {
+		t.Errorf("Got result %+v, wanted 1 pruned and 1 kept", result)
+	}
+	item, err = env.st.StatusAtPosition(ctx, nil, types.StID(streamState.Stid), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !item.StatusMeta.Pruned {
+		t.Errorf("Status at position 4 should be pruned")
+	}
+
+	// Getting the full status back is not an edit.
+	if err := env.st.UpdateStatus(ctx, nil, types.ASID(accountState.Asid), status("100", oldTime), nil); err != nil {
+		t.Fatal(err)
+	}
+	if getStreamStatusState(ctx, env, "100").Edited {
+		t.Errorf("Update of a pruned status should not be considered an edit")
+	}
+}
+
+func TestExportImportUser(t *testing.T) { forEachBackend(t, testExportImportUser) }
+
+func testExportImportUser(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	userState, accountState, streamState, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userState.FilterRules = []*stpb.FilterRule{
+		{Id: 1, Kind: stpb.FilterRule_LANGUAGE, Action: stpb.FilterRule_COLLAPSE, Language: "de"},
+	}
+	if err := env.st.SetUserState(ctx, nil, userState); err != nil {
+		t.Fatal(err)
+	}
+	accountState.AccessToken = "secret"
+	if err := env.st.SetAccountState(ctx, nil, accountState); err != nil {
+		t.Fatal(err)
+	}
+	err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState.Asid), streamState, []*mastodon.Status{
+		testserver.NewFakeStatus("100", "123"),
+		testserver.NewFakeStatus("101", "123"),
+		testserver.NewFakeStatus("102", "123"),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.mustPickNext(ctx, userState, streamState)
+	env.mustPickNext(ctx, userState, streamState)
+
+	archive, err := env.st.ExportUser(ctx, types.UID(userState.Uid), false /* withTokens */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := archive.AccountStates[0].AccessToken; got != "" {
+		t.Errorf("Got access token %q, wanted none", got)
+	}
+	if len(archive.Statuses) != 3 || len(archive.StreamContent) != 3 {
+		t.Errorf("Got %d statuses and %d stream content, wanted 3 of each", len(archive.Statuses), len(archive.StreamContent))
+	}
+
+	// The same Mastodon account cannot be imported twice.
+	if _, err := env.st.ImportUser(ctx, archive); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Got error %v, wanted already exists", err)
+	}
+
+	// Import in another database, where IDs are already used.
+	env2 := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env2.Close()
+	otherUserState, otherAccountState, otherStreamState, err := env2.st.CreateUser(ctx, nil, "localhost", "456", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env2.st.InsertStatuses(ctx, env2.txn(), types.ASID(otherAccountState.Asid), otherStreamState, []*mastodon.Status{
+		testserver.NewFakeStatus("900", "456"),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env2.mustPickNext(ctx, otherUserState, otherStreamState)
+
+	imported, err := env2.st.ImportUser(ctx, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Uid == otherUserState.Uid || imported.DefaultStid == otherStreamState.Stid {
+		t.Errorf("Imported user reuses existing IDs: %v", imported)
+	}
+	if diff := cmp.Diff(userState.FilterRules, imported.FilterRules, protocmp.Transform()); diff != "" {
+		t.Errorf("Filter rules mismatch (-want +got):\n%s", diff)
+	}
+	importedAccount, err := env2.st.FirstAccountStateByUID(ctx, nil, types.UID(imported.Uid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if importedAccount.Asid == otherAccountState.Asid || importedAccount.Username != "user1" {
+		t.Errorf("Unexpected imported account %v", importedAccount)
+	}
+
+	importedStream, err := env2.st.StreamState(ctx, nil, types.StID(imported.DefaultStid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if importedStream.LastPosition != 2 || importedStream.Remaining != 1 || importedStream.Uid != imported.Uid {
+		t.Errorf("Unexpected imported stream %v", importedStream)
+	}
+	item, err := env2.st.StatusAtPosition(ctx, nil, types.StID(imported.DefaultStid), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Status.ID != "101" || item.ASID != types.ASID(importedAccount.Asid) {
+		t.Errorf("Got status %s of asid %d at position 2, wanted 101 of asid %d", item.Status.ID, item.ASID, importedAccount.Asid)
+	}
+	if diff := cmp.Diff([]int64{importedAccount.Asid}, item.StreamStatusState.SeenBy); diff != "" {
+		t.Errorf("Seen by mismatch (-want +got):\n%s", diff)
+	}
+
+	// The pool is imported as well.
+	if item := env2.mustPickNext(ctx, imported, importedStream); item.Status.ID != "102" {
+		t.Errorf("Got status %s, wanted 102", item.Status.ID)
+	}
+}
+
+func TestDeleteUser(t *testing.T) { forEachBackend(t, testDeleteUser) }
+
+func testDeleteUser(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	// Fill up 2 users, to verify that only one is deleted.
+	var uids []types.UID
+	for _, accountID := range []mastodon.ID{"123", "456"} {
+		userState, accountState, streamState, err := env.st.CreateUser(ctx, nil, "localhost", accountID, "user"+string(accountID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		asid := types.ASID(accountState.Asid)
+		err = env.st.InsertStatuses(ctx, env.txn(), asid, streamState, []*mastodon.Status{
+			testserver.NewFakeStatus(accountID+"1", accountID),
+			testserver.NewFakeStatus(accountID+"2", accountID),
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.mustPickNext(ctx, userState, streamState)
+		err = env.st.InsertNotifications(ctx, nil, asid, []*mastodon.Notification{
+			testserver.NewFakeNotification("10", "follow", "789", nil),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		uids = append(uids, types.UID(userState.Uid))
+	}
+
+	if err := env.st.DeleteUser(ctx, uids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.st.UserState(ctx, nil, uids[0]); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Got error %v, wanted not found", err)
+	}
+	if err := env.st.DeleteUser(ctx, uids[0]); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Got error %v, wanted not found", err)
+	}
+
+	count := func(table string) int {
+		t.Helper()
+		var n int
+		if err := env.roDB.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	for table, want := range map[string]int{
+		"userstate":     1,
+		"accountstate":  1,
+		"streamstate":   1,
+		"statuses":      2,
+		"streamcontent": 2,
+		"notifications": 1,
+	} {
+		if got := count(table); got != want {
+			t.Errorf("Got %d rows in %s, wanted %d", got, table, want)
+		}
+	}
+
+	// The other user is untouched.
+	archive, err := env.st.ExportUser(ctx, uids[1], false /* withTokens */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archive.Statuses) != 2 || len(archive.StreamContent) != 2 {
+		t.Errorf("Got %d statuses and %d stream content, wanted 2 of each", len(archive.Statuses), len(archive.StreamContent))
+	}
+}
+
+func TestRevokeSessions(t *testing.T) { forEachBackend(t, testRevokeSessions) }
+
+func testRevokeSessions(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	userState, _, _, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := types.UID(userState.Uid)
+
+	// Sessions as written by the session manager of the server.
+	store := env.st.NewSCSStore()
+	expiry := time.Now().Add(time.Hour)
+	for token, values := range map[string]map[string]any{
+		"session1":  {SessionUserIDKey: int64(uid)},
+		"session2":  {SessionUserIDKey: int64(uid), "invitecode": "foo"},
+		"other":     {SessionUserIDKey: int64(uid + 1)},
+		"anonymous": {"invitecode": "foo"},
+	} {
+		data, err := scs.GobCodec{}.Encode(expiry, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Commit(token, data, expiry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Data which cannot be decoded is ignored.
+	if err := store.Commit("corrupted", []byte("garbage"), expiry); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := env.st.RevokeSessions(ctx, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("Got %d revoked sessions, wanted 2", count)
+	}
+	for token, want := range map[string]bool{"session1": false, "session2": false, "other": true, "anonymous": true, "corrupted": true} {
+		_, found, err := store.Find(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != want {
+			t.Errorf("Session %s found=%v, wanted %v", token, found, want)
+		}
+	}
+
+	// Disabling a user also revokes its sessions.
+	if err := env.st.SetUserDisabled(ctx, uid+1, true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Got error %v, wanted not found", err)
+	}
+	data, err := scs.GobCodec{}.Encode(expiry, map[string]any{SessionUserIDKey: int64(uid)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Commit("session3", data, expiry); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.st.SetUserDisabled(ctx, uid, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := store.Find("session3"); err != nil || found {
+		t.Errorf("Got found=%v, err=%v; wanted session to be revoked", found, err)
+	}
+	userState, err = env.st.UserState(ctx, nil, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !userState.Disabled {
+		t.Errorf("User should be disabled")
+	}
+}
+
+func TestInviteCodes(t *testing.T) { forEachBackend(t, testInviteCodes) }
+
+func testInviteCodes(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	// Random code.
+	random := &stpb.InviteCode{MaxUses: 2}
+	if err := env.st.CreateInviteCode(ctx, nil, random); err != nil {
+		t.Fatal(err)
+	}
+	if random.Code == "" {
+		t.Errorf("No code was picked")
+	}
+	if err := env.st.CreateInviteCode(ctx, nil, &stpb.InviteCode{Code: random.Code}); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Got error %v, wanted already exists", err)
+	}
+	expired := &stpb.InviteCode{Code: "expired", ExpiresAtSecs: time.Now().Add(-time.Hour).Unix()}
+	if err := env.st.CreateInviteCode(ctx, nil, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.st.CheckInviteCode(ctx, nil, "unknown"); !errors.Is(err, ErrInvalidInviteCode) {
+		t.Errorf("Got error %v, wanted invalid invite code", err)
+	}
+	if err := env.st.CheckInviteCode(ctx, nil, "expired"); !errors.Is(err, ErrInvalidInviteCode) {
+		t.Errorf("Got error %v, wanted invalid invite code", err)
+	}
+
+	// Usage limit.
+	for i := 0; i < 2; i++ {
+		if err := env.st.UseInviteCode(ctx, env.txn(), random.Code); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := env.st.UseInviteCode(ctx, env.txn(), random.Code); !errors.Is(err, ErrInvalidInviteCode) {
+		t.Errorf("Got error %v, wanted invalid invite code", err)
+	}
+
+	codes, err := env.st.ListInviteCodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int64{}
+	for _, code := range codes {
+		got[code.Code] = code.Uses
+	}
+	if diff := cmp.Diff(map[string]int64{random.Code: 2, "expired": 0}, got); diff != "" {
+		t.Errorf("Invite codes mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := env.st.DeleteInviteCode(ctx, "expired"); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.st.DeleteInviteCode(ctx, "expired"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Got error %v, wanted not found", err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "mastopoof.db")
+
+	st, err := NewStorage(ctx, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := st.CreateUser(ctx, nil, "localhost", "123", "user1"); err != nil {
+		t.Fatal(err)
+	}
+	backupPath := filepath.Join(dir, "backup.db")
+	if err := st.Backup(ctx, backupPath); err != nil {
+		t.Fatal(err)
+	}
+	// Backups never overwrite existing files.
+	if err := st.Backup(ctx, backupPath); err == nil {
+		t.Error("backup to an existing file should have failed")
+	}
+	if _, _, _, err := st.CreateUser(ctx, nil, "localhost", "456", "user2"); err != nil {
+		t.Fatal(err)
+	}
+	// The database cannot be replaced while in use.
+	if _, err := Restore(ctx, backupPath, dbPath); !errors.Is(err, ErrDBInUse) {
+		t.Errorf("Got error %v, wanted database in use", err)
+	}
+	st.Close()
+
+	version, err := CheckBackup(ctx, backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != maxSchemaVersion {
+		t.Errorf("got version %d, wanted %d", version, maxSchemaVersion)
+	}
+
+	keptPath, err := Restore(ctx, backupPath, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(keptPath, dbPath+".before-restore-") {
+		t.Errorf("got kept path %q, wanted a %s.before-restore- prefix", keptPath, dbPath)
+	}
+	if _, err := os.Stat(keptPath); err != nil {
+		t.Errorf("previous database was not kept: %v", err)
+	}
+
+	st, err = NewStorage(ctx, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	users, err := st.ListUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].AccountState.Username != "user1" {
+		t.Errorf("expected only user1 after restore, got %v", users)
+	}
+}
+
+func TestRestoreNewerSchema(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	backupPath := filepath.Join(dir, "backup.db")
+	db, err := sql.Open("sqlite3", backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d;", maxSchemaVersion+1)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	dbPath := filepath.Join(dir, "mastopoof.db")
+	if err := os.WriteFile(dbPath, []byte("current"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Restore(ctx, backupPath, dbPath); err == nil {
+		t.Fatal("restore of a newer schema should have failed")
+	}
+	data, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "current" {
+		t.Error("database was modified by a failed restore")
+	}
+}
+
+func TestRestoreKeptExists(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	st, err := NewStorage(ctx, filepath.Join(dir, "source.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backupPath := filepath.Join(dir, "backup.db")
+	if err := st.Backup(ctx, backupPath); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+
+	dbPath := filepath.Join(dir, "mastopoof.db")
+	if err := os.WriteFile(dbPath, []byte("current"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Occupy the names a previous database would be kept under during the
+	// next minute.
+	now := time.Now().UTC()
+	for i := -1; i < 60; i++ {
+		keptPath := dbPath + ".before-restore-" + now.Add(time.Duration(i)*time.Second).Format(snapshotTimeFormat)
+		if err := os.WriteFile(keptPath+"-wal", []byte("kept"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := Restore(ctx, backupPath, dbPath); err == nil {
+		t.Fatal("restore over a kept database should have failed")
+	}
+	data, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "current" {
+		t.Error("database was modified by a failed restore")
+	}
+}
+
+func TestSnapshotRotation(t *testing.T) {
 	ctx := context.Background()
 	env := (&DBTestEnv{}).Init(ctx, t)
 	defer env.Close()
 
+	dir := t.TempDir()
+	// Older snapshots, and unrelated files which must be left alone.
+	for _, name := range []string{
+		"mastopoof-20200101-000000.db",
+		"mastopoof-20200102-000000.db",
+		"mastopoof-20200103-000000.db",
+		"mastopoof-notadate.db",
+		"other.db",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path, err := env.st.Snapshot(ctx, dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CheckBackup(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Name())
+	}
+	want := []string{
+		"mastopoof-20200103-000000.db",
+		filepath.Base(path),
+		"mastopoof-notadate.db",
+		"other.db",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("snapshots mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func getStreamStatusState(ctx context.Context, env *DBTestEnv, withID string) *stpb.StreamStatusState {
+	streamStatusState := &stpb.StreamStatusState{}
+	row := env.txn().QueryRow(ctx, "test-stream-status-state", `
+		SELECT stream_status_state FROM streamcontent WHERE status_id = ?
+	`, withID)
+	if err := row.Scan(types.SQLProto{streamStatusState}); err != nil {
+		env.t.Fatal(err)
+	}
+	return streamStatusState
+}
+
+// Verify that the feature hiding already-seen status detects things properly.
+func TestAlreadySeenActive(t *testing.T) { forEachBackend(t, testAlreadySeenActive) }
+
+func testAlreadySeenActive(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	// Prep the environment with users and statuses.
+	userState1, accountState1, streamState1, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Activate the feature.
+	userState1.Settings.SeenReblogs = &settingspb.SettingSeenReblogs{
+		Value:    settingspb.SettingSeenReblogs_HIDE,
+		Override: true,
+	}
+
+	// A basic status
+	status1 := testserver.NewFakeStatus(mastodon.ID("101"), "123")
+	// Another basic status
+	status2 := testserver.NewFakeStatus(mastodon.ID("102"), "123")
+	// A reblog of the first status.
+	status3 := testserver.NewFakeStatus(mastodon.ID("103"), "123")
+	status3.Reblog = status2
+	// A reblog of a never seen before status
+	status4 := testserver.NewFakeStatus(mastodon.ID("104"), "123")
+	status4.Reblog = testserver.NewFakeStatus(mastodon.ID("991"), "123")
+	// A reblog of a reblog
+	status5 := testserver.NewFakeStatus(mastodon.ID("105"), "123")
+	status5.Reblog = status4
+
+	err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState1.Asid), streamState1, []*mastodon.Status{
+		status1, status2, status3, status4, status5,
+	}, []*stpb.MastodonFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env.mustPickNext(ctx, userState1, streamState1)
+	if got, want := getStreamStatusState(ctx, env, "101").AlreadySeen, stpb.StreamStatusState_NO; got != want {
+		t.Errorf("Got AlreadySeen = %v, wanted %v", got, want)
+	}
+
+	env.mustPickNext(ctx, userState1, streamState1)
+	if got, want := getStreamStatusState(ctx, env, "102").AlreadySeen, stpb.StreamStatusState_NO; got != want {
+		t.Errorf("Got AlreadySeen = %v, wanted %v", got, want)
+	}
+
+	env.mustPickNext(ctx, userState1, streamState1)
+	if got, want := getStreamStatusState(ctx, env, "103").AlreadySeen, stpb.StreamStatusState_YES; got != want {
+		t.Errorf("Got AlreadySeen = %v, wanted %v", got, want)
+	}
+
+	env.mustPickNext(ctx, userState1, streamState1)
+	if got, want := getStreamStatusState(ctx, env, "104").AlreadySeen, stpb.StreamStatusState_NO; got != want {
+		t.Errorf("Got AlreadySeen = %v, wanted %v", got, want)
+	}
+
+	env.mustPickNext(ctx, userState1, streamState1)
+	if got, want := getStreamStatusState(ctx, env, "105").AlreadySeen, stpb.StreamStatusState_YES; got != want {
+		t.Errorf("Got AlreadySeen = %v, wanted %v", got, want)
+	}
+}
+
+// Verify that statuses obtained through multiple accounts are added only once.
+func TestCrossAccountDedup(t *testing.T) { forEachBackend(t, testCrossAccountDedup) }
+
+func testCrossAccountDedup(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	userState1, accountState1, streamState1, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountState2, err := env.st.CreateAccountState(ctx, env.txn(), types.UID(userState1.Uid), "otherhost", "456", "user1work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A status as seen from the first account.
+	status1 := testserver.NewFakeStatus(mastodon.ID("101"), "789")
+	err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState1.Asid), streamState1, []*mastodon.Status{status1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same status, from the other server - it has another ID, but the
+	// same URI.
+	status2 := *status1
+	status2.ID = "901"
+	// A reblog of that status, also from the other server. With default
+	// settings, it is not shown either.
+	status3 := testserver.NewFakeStatus(mastodon.ID("902"), "456")
+	status3.Reblog = &status2
+	err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState2.Asid), streamState1, []*mastodon.Status{&status2, status3}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := streamState1.Remaining, int64(1); got != want {
+		t.Errorf("Got %d remaining statuses, wanted %d", got, want)
+	}
+
+	// Search also returns the status only once - without counting the
+	// duplicate in the limit.
+	items, err := env.st.Search(ctx, env.txn(), &SearchQuery{UID: types.UID(userState1.Uid), StID: types.StID(streamState1.Stid), Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []mastodon.ID
+	for _, item := range items {
+		ids = append(ids, item.Status.ID)
+	}
+	if diff := cmp.Diff([]mastodon.ID{"101", "902"}, ids); diff != "" {
+		t.Errorf("Search results mismatch (-want +got):\n%s", diff)
+	}
+
+	item := env.mustPickNext(ctx, userState1, streamState1)
+	if got, want := item.Status.ID, mastodon.ID("101"); got != want {
+		t.Errorf("Got status %v, wanted %v", got, want)
+	}
+	if diff := cmp.Diff([]int64{accountState1.Asid, accountState2.Asid}, item.StreamStatusState.SeenBy); diff != "" {
+		t.Errorf("Seen by mismatch (-want +got):\n%s", diff)
+	}
+
+	item, err = env.pickNext(ctx, userState1, streamState1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item != nil {
+		t.Errorf("Got status %v, wanted none", item.Status.ID)
+	}
+}
+
+// Verify that a reblog and its original, obtained through different accounts,
+// are shown once - with default settings.
+func TestCrossAccountReblogDedup(t *testing.T) { forEachBackend(t, testCrossAccountReblogDedup) }
+
+func testCrossAccountReblogDedup(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	userState1, accountState1, streamState1, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountState2, err := env.st.CreateAccountState(ctx, env.txn(), types.UID(userState1.Uid), "otherhost", "456", "user1work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	asid1 := types.ASID(accountState1.Asid)
+	asid2 := types.ASID(accountState2.Asid)
+
+	// A reblog seen from the second account...
+	original := testserver.NewFakeStatus(mastodon.ID("901"), "789")
+	reblog := testserver.NewFakeStatus(mastodon.ID("902"), "456")
+	reblog.Reblog = original
+	if err := env.st.InsertStatuses(ctx, env.txn(), asid2, streamState1, []*mastodon.Status{reblog}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// ... then its original, from the first account - with a server specific
+	// ID. Fetching the reblog again does not change anything either.
+	original1 := *original
+	original1.ID = "101"
+	if err := env.st.InsertStatuses(ctx, env.txn(), asid1, streamState1, []*mastodon.Status{&original1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.st.InsertStatuses(ctx, env.txn(), asid2, streamState1, []*mastodon.Status{reblog}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := streamState1.Remaining, int64(1); got != want {
+		t.Errorf("Got %d remaining statuses, wanted %d", got, want)
+	}
+
+	item := env.mustPickNext(ctx, userState1, streamState1)
+	if got, want := item.Status.ID, mastodon.ID("902"); got != want {
+		t.Errorf("Got status %v, wanted %v", got, want)
+	}
+	if diff := cmp.Diff([]int64{accountState2.Asid, accountState1.Asid}, item.StreamStatusState.SeenBy); diff != "" {
+		t.Errorf("Seen by mismatch (-want +got):\n%s", diff)
+	}
+	item, err = env.pickNext(ctx, userState1, streamState1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item != nil {
+		t.Errorf("Got status %v, wanted none", item.Status.ID)
+	}
+
+	// Another reblog of the same original through the same account is left
+	// to SettingSeenReblogs.
+	reblog2 := testserver.NewFakeStatus(mastodon.ID("903"), "457")
+	reblog2.Reblog = original
+	if err := env.st.InsertStatuses(ctx, env.txn(), asid2, streamState1, []*mastodon.Status{reblog2}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := streamState1.Remaining, int64(1); got != want {
+		t.Errorf("Got %d remaining statuses, wanted %d", got, want)
+	}
+}
+
+func TestDeleteAndEditStatus(t *testing.T) { forEachBackend(t, testDeleteAndEditStatus) }
+
+func testDeleteAndEditStatus(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	userState1, accountState1, streamState1, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	asid := types.ASID(accountState1.Asid)
+	status1 := testserver.NewFakeStatus(mastodon.ID("101"), "123")
+	status2 := testserver.NewFakeStatus(mastodon.ID("102"), "123")
+	err = env.st.InsertStatuses(ctx, env.txn(), asid, streamState1, []*mastodon.Status{status1, status2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Triage the first status.
+	item := env.mustPickNext(ctx, userState1, streamState1)
+	if got, want := item.Status.ID, mastodon.ID("101"); got != want {
+		t.Errorf("Got status %v, wanted %v", got, want)
+	}
+
+	// A triaged status is kept as a tombstone.
+	if err := env.st.DeleteStatus(ctx, nil, asid, "101"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := getStreamStatusState(ctx, env, "101").Deleted, true; got != want {
+		t.Errorf("Got deleted=%v, wanted %v", got, want)
+	}
+
+	// Edits are recorded.
+	edited := *status2
+	edited.Content = "some new content"
+	if err := env.st.UpdateStatus(ctx, nil, asid, &edited, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := getStreamStatusState(ctx, env, "102").Edited, true; got != want {
+		t.Errorf("Got edited=%v, wanted %v", got, want)
+	}
+
+	// A status still in the pool is just removed.
+	if err := env.st.DeleteStatus(ctx, nil, asid, "102"); err != nil {
+		t.Fatal(err)
+	}
+	streamState1, err = env.st.StreamState(ctx, nil, types.StID(streamState1.Stid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := streamState1.Remaining, int64(0); got != want {
+		t.Errorf("Got %d remaining statuses, wanted %d", got, want)
+	}
+	item, err = env.pickNext(ctx, userState1, streamState1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item != nil {
+		t.Errorf("Got status %v, expected none", item.Status.ID)
+	}
+}
+
+// Verify that a status deleted on Mastodon is marked as such even when only
+// seen as deleted through another account than the one it was added with.
+func TestCrossAccountDelete(t *testing.T) { forEachBackend(t, testCrossAccountDelete) }
+
+func testCrossAccountDelete(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
+	userState1, accountState1, streamState1, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountState2, err := env.st.CreateAccountState(ctx, env.txn(), types.UID(userState1.Uid), "otherhost", "456", "user1work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	asid2 := types.ASID(accountState2.Asid)
+
+	status1 := testserver.NewFakeStatus(mastodon.ID("101"), "789")
+	if err := env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState1.Asid), streamState1, []*mastodon.Status{status1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	status2 := *status1
+	status2.ID = "901"
+	if err := env.st.InsertStatuses(ctx, env.txn(), asid2, streamState1, []*mastodon.Status{&status2}, nil); err != nil {
+		t.Fatal(err)
+	}
+	item := env.mustPickNext(ctx, userState1, streamState1)
+	if got, want := item.Status.ID, mastodon.ID("101"); got != want {
+		t.Errorf("Got status %v, wanted %v", got, want)
+	}
+
+	// The deletion is only known from the second account.
+	if err := env.st.DeleteStatus(ctx, nil, asid2, "901"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := getStreamStatusState(ctx, env, "101").Deleted, true; got != want {
+		t.Errorf("Got deleted=%v, wanted %v", got, want)
+	}
+}
+
+// Verify that the feature hiding already-seen does not try thing when not active.
+func TestAlreadySeenInactive(t *testing.T) { forEachBackend(t, testAlreadySeenInactive) }
+
+func testAlreadySeenInactive(t *testing.T, backend string) {
+	ctx := context.Background()
+	env := (&DBTestEnv{backend: backend}).Init(ctx, t)
+	defer env.Close()
+
 	// Prep the environment with users and statuses.
 	userState1, accountState1, streamState1, err := env.st.CreateUser(ctx, nil, "localhost", "123", "user1")
 	if err != nil {
@@ -448,9 +2558,9 @@ func TestAlreadySeenInactive(t *testing.T) {
 	status4 := testserver.NewFakeStatus(mastodon.ID("104"), "123")
 	status4.Reblog = status3
 
-	err = env.st.InsertStatuses(ctx, sqlAdapter{env.rwDB}, types.ASID(accountState1.Asid), streamState1, []*mastodon.Status{
+	err = env.st.InsertStatuses(ctx, env.txn(), types.ASID(accountState1.Asid), streamState1, []*mastodon.Status{
 		status1, status2, status3, status4,
-	}, []*mastodon.Filter{})
+	}, []*stpb.MastodonFilter{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,104 @@
+// This file defines Store, the interface through which the rest of Mastopoof
+// accesses the storage.
+package storage
+
+import (
+	"context"
+
+	"github.com/Palats/mastopoof/backend/types"
+	stpb "github.com/Palats/mastopoof/proto/gen/mastopoof/storage"
+	"github.com/alexedwards/scs/v2"
+	"github.com/mattn/go-mastodon"
+)
+
+// Store is the set of public operations on Mastopoof storage. Callers outside
+// of this package should depend on it rather than on `*Storage`, which is its
+// implementation for both SQLite and PostgreSQL.
+type Store interface {
+	// Lifecycle & transactions.
+	Close() error
+	NewSCSStore() scs.Store
+	InTxnRO(ctx context.Context, f func(ctx context.Context, txn SQLReadOnly) error) error
+	InTxnRW(ctx context.Context, f func(ctx context.Context, txn SQLReadWrite) error) error
+	StreamSignal(stid types.StID) <-chan struct{}
+
+	// Schema.
+	SchemaStatus(ctx context.Context) (*SchemaStatus, error)
+	MigrationPlan(ctx context.Context, target int) ([]*MigrationStep, error)
+	Migrate(ctx context.Context, target int) error
+
+	// Maintenance.
+	Backup(ctx context.Context, path string) error
+	Snapshot(ctx context.Context, dir string, keep int) (string, error)
+	GC(ctx context.Context, uid types.UID, policy RetentionPolicy, dryRun bool) (*GCResult, error)
+	Vacuum(ctx context.Context) error
+	ExportUser(ctx context.Context, uid types.UID, withTokens bool) (*stpb.UserArchive, error)
+	ImportUser(ctx context.Context, archive *stpb.UserArchive) (*stpb.UserState, error)
+	RecomputeMeta(ctx context.Context, uid types.UID, includePositioned bool, progress func(*RecomputeMetaProgress) error) (*RecomputeMetaProgress, error)
+	FixDuplicateStatuses(ctx context.Context, txn SQLReadWrite, stid types.StID) error
+	FixCrossStatuses(ctx context.Context, txn SQLReadWrite, stid types.StID) error
+	ClearApp(ctx context.Context) error
+	ClearStream(ctx context.Context, stid types.StID) error
+	ClearPoolAndStream(ctx context.Context, uid types.UID) error
+
+	// Invite codes.
+	CreateInviteCode(ctx context.Context, txn SQLReadWrite, inviteCode *stpb.InviteCode) error
+	ListInviteCodes(ctx context.Context) ([]*stpb.InviteCode, error)
+	DeleteInviteCode(ctx context.Context, code string) error
+	CheckInviteCode(ctx context.Context, txn SQLReadOnly, code string) error
+	UseInviteCode(ctx context.Context, txn SQLReadWrite, code string) error
+
+	// Users.
+	ListUsers(ctx context.Context) ([]*ListUserEntry, error)
+	CreateUser(ctx context.Context, txn SQLReadWrite, serverAddr string, accountID mastodon.ID, username string) (*stpb.UserState, *stpb.AccountState, *stpb.StreamState, error)
+	CreateUserState(ctx context.Context, txn SQLReadWrite) (*stpb.UserState, error)
+	UserState(ctx context.Context, txn SQLReadOnly, uid types.UID) (*stpb.UserState, error)
+	SetUserState(ctx context.Context, txn SQLReadWrite, userState *stpb.UserState) error
+	DeleteUser(ctx context.Context, uid types.UID) error
+	SetUserDisabled(ctx context.Context, uid types.UID, disabled bool) error
+	RevokeSessions(ctx context.Context, uid types.UID) (int, error)
+
+	// Apps & accounts.
+	CreateAppRegState(ctx context.Context, txn SQLReadWrite, src *stpb.AppRegState) error
+	AppRegState(ctx context.Context, txn SQLReadOnly, nfo *types.AppRegInfo) (*stpb.AppRegState, error)
+	CreateAccountState(ctx context.Context, txn SQLReadWrite, uid types.UID, serverAddr string, accountID mastodon.ID, username string) (*stpb.AccountState, error)
+	FirstAccountStateByUID(ctx context.Context, txn SQLReadOnly, uid types.UID) (*stpb.AccountState, error)
+	AllAccountStateByUID(ctx context.Context, txn SQLReadOnly, uid types.UID) ([]*stpb.AccountState, error)
+	AccountStateByAccountID(ctx context.Context, txn SQLReadOnly, serverAddr string, accountID mastodon.ID) (*stpb.AccountState, error)
+	SetAccountState(ctx context.Context, txn SQLReadWrite, as *stpb.AccountState) error
+	SetAccountFilters(ctx context.Context, txn SQLReadWrite, asid types.ASID, filters []*stpb.MastodonFilter, fetchSecs int64) error
+	SetAccountFollowing(ctx context.Context, txn SQLReadWrite, asid types.ASID, followingIDs []string, fetchSecs int64) error
+
+	// Streams.
+	CreateStreamState(ctx context.Context, txn SQLReadWrite, uid types.UID) (*stpb.StreamState, error)
+	StreamState(ctx context.Context, txn SQLReadOnly, stid types.StID) (*stpb.StreamState, error)
+	StreamStatesByUID(ctx context.Context, txn SQLReadOnly, uid types.UID) ([]*stpb.StreamState, error)
+	SetStreamState(ctx context.Context, txn SQLReadWrite, streamState *stpb.StreamState) error
+	DeleteStreamState(ctx context.Context, txn SQLReadWrite, stid types.StID) error
+	RecomputeStreamState(ctx context.Context, txn SQLReadOnly, stid types.StID) (*stpb.StreamState, error)
+	ListBackward(ctx context.Context, userState *stpb.UserState, stid types.StID, refPosition int64) (*ListResult, error)
+	ListForward(ctx context.Context, userState *stpb.UserState, stid types.StID, refPosition int64, isInitial bool) (*ListResult, error)
+	StatusAtPosition(ctx context.Context, txn SQLReadOnly, stid types.StID, position int64) (*Item, error)
+	PositionOfStatusID(ctx context.Context, txn SQLReadOnly, stid types.StID, asid types.ASID, statusID mastodon.ID) (int64, error)
+	StatusItem(ctx context.Context, txn SQLReadOnly, stid types.StID, asid types.ASID, statusID mastodon.ID) (*Item, error)
+	StatusContext(ctx context.Context, txn SQLReadOnly, stid types.StID, asid types.ASID, statusID mastodon.ID) ([]*Item, []*Item, error)
+	Search(ctx context.Context, txn SQLReadOnly, q *SearchQuery) ([]*Item, error)
+
+	// Statuses.
+	CacheStatus(ctx context.Context, txn SQLReadWrite, asid types.ASID, status *mastodon.Status, filters []*stpb.MastodonFilter) error
+	InsertStatuses(ctx context.Context, txn SQLReadWrite, asid types.ASID, streamState *stpb.StreamState, statuses []*mastodon.Status, filters []*stpb.MastodonFilter) error
+	UpdateStatus(ctx context.Context, txn SQLReadWrite, asid types.ASID, status *mastodon.Status, filters []*stpb.MastodonFilter) error
+	DeleteStatus(ctx context.Context, txn SQLReadWrite, asid types.ASID, statusID mastodon.ID) error
+	PositionedStatusIDs(ctx context.Context, txn SQLReadOnly, asid types.ASID, afterSID types.SID, limit int) ([]mastodon.ID, types.SID, error)
+
+	// Notifications.
+	InsertNotifications(ctx context.Context, txn SQLReadWrite, asid types.ASID, notifs []*mastodon.Notification) error
+	LatestNotificationID(ctx context.Context, txn SQLReadOnly, asid types.ASID) (mastodon.ID, error)
+	SetNotificationsMarker(ctx context.Context, txn SQLReadWrite, asid types.ASID, lastReadID mastodon.ID) error
+	DropDismissedNotifications(ctx context.Context, txn SQLReadWrite, asid types.ASID, unreadIDs []mastodon.ID, since mastodon.ID, upTo mastodon.ID) error
+	MarkNotificationsRead(ctx context.Context, txn SQLReadWrite, uid types.UID, upTo types.NID) (map[types.ASID]mastodon.ID, error)
+	UnreadNotificationsCount(ctx context.Context, txn SQLReadOnly, uid types.UID) (int64, error)
+	ListNotifications(ctx context.Context, txn SQLReadOnly, q *NotificationsQuery) ([]*Notification, error)
+}
+
+var _ Store = (*Storage)(nil)
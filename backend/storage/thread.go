@@ -0,0 +1,267 @@
+// This file contains the management of conversations - i.e., ancestors and
+// descendants of a status - among cached statuses and in streams.
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/Palats/mastopoof/backend/types"
+	stpb "github.com/Palats/mastopoof/proto/gen/mastopoof/storage"
+	"github.com/mattn/go-mastodon"
+)
+
+// maxThreadDepth limits how far ancestors and descendants are followed. This
+// also protects against reply loops.
+const maxThreadDepth = 100
+
+// threadItemColumns are the columns scanned by scanThreadItems. They expect
+// `statuses` and `streamcontent` - possibly left joined.
+const threadItemColumns = `
+	statuses.asid,
+	statuses.status,
+	statuses.status_meta,
+	coalesce(streamcontent.position, 0),
+	coalesce(streamcontent.stream_status_state, '{}')
+`
+
+// scanThreadItems reads rows with threadItemColumns.
+func scanThreadItems(rows *sql.Rows) ([]*Item, error) {
+	defer rows.Close()
+	var items []*Item
+	for rows.Next() {
+		item := &Item{
+			StreamStatusState: &stpb.StreamStatusState{},
+			StatusMeta:        &stpb.StatusMeta{},
+		}
+		var status types.SQLStatus
+		if err := rows.Scan(&item.ASID, &status, types.SQLProto{item.StatusMeta}, &item.Position, types.SQLProto{item.StreamStatusState}); err != nil {
+			return nil, err
+		}
+		item.Status = status.Status
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// StatusItem returns a status cached for the account, along with its state in
+// the stream. Position is zero if the status has not been triaged in the
+// stream.
+func (st *Storage) StatusItem(ctx context.Context, txn SQLReadOnly, stid types.StID, asid types.ASID, statusID mastodon.ID) (_ *Item, retErr error) {
+	defer recordAction("status-item")(retErr)
+	var items []*Item
+	err := st.inTxnRO(ctx, txn, func(ctx context.Context, txn SQLReadOnly) error {
+		rows, err := txn.Query(ctx, "status-item", `
+			SELECT `+threadItemColumns+`
+			FROM
+				statuses
+				LEFT JOIN streamcontent ON streamcontent.sid = statuses.sid AND streamcontent.stid = ?
+			WHERE
+				statuses.asid = ?
+				AND statuses.status_id = ?
+			;
+		`, stid, asid, statusID)
+		if err != nil {
+			return err
+		}
+		items, err = scanThreadItems(rows)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("status %s of asid %d not found: %w", statusID, asid, ErrNotFound)
+	}
+	return items[0], nil
+}
+
+// StatusContext returns the ancestors and descendants of a status among the
+// statuses cached for the account. Ancestors are ordered from the root of the
+// conversation, descendants by ID - i.e., chronologically.
+// Ancestors are looked up in all cached statuses, while descendants can only
+// be found among the statuses of the stream.
+func (st *Storage) StatusContext(ctx context.Context, txn SQLReadOnly, stid types.StID, asid types.ASID, statusID mastodon.ID) (_ []*Item, _ []*Item, retErr error) {
+	defer recordAction("status-context")(retErr)
+	d := st.backend.dialect()
+	var ancestors, descendants []*Item
+	err := st.inTxnRO(ctx, txn, func(ctx context.Context, txn SQLReadOnly) error {
+		rows, err := txn.Query(ctx, "status-context-ancestors", `
+			WITH RECURSIVE ancestors(sid, parent_id, depth) AS (
+				SELECT sid, `+d.jsonText("status", "$.in_reply_to_id")+`, 0
+				FROM statuses
+				WHERE asid = ?1 AND status_id = ?2
+				UNION
+				SELECT statuses.sid, `+d.jsonText("statuses.status", "$.in_reply_to_id")+`, ancestors.depth + 1
+				FROM
+					ancestors
+					JOIN statuses ON statuses.asid = ?1 AND statuses.status_id = ancestors.parent_id
+				WHERE ancestors.depth < ?4
+			)
+			SELECT `+threadItemColumns+`
+			FROM
+				ancestors
+				JOIN statuses USING (sid)
+				LEFT JOIN streamcontent ON streamcontent.sid = statuses.sid AND streamcontent.stid = ?3
+			WHERE ancestors.depth > 0
+			ORDER BY ancestors.depth DESC
+			;
+		`, asid, statusID, stid, maxThreadDepth)
+		if err != nil {
+			return err
+		}
+		ancestors, err = scanThreadItems(rows)
+		if err != nil {
+			return err
+		}
+
+		rows, err = txn.Query(ctx, "status-context-descendants", `
+			WITH RECURSIVE descendants(sid, status_id, depth) AS (
+				-- Types are explicit for PostgreSQL.
+				SELECT CAST(NULL AS BIGINT), CAST(?2 AS TEXT), 0
+				UNION
+				SELECT streamcontent.sid, streamcontent.status_id, descendants.depth + 1
+				FROM
+					descendants
+					JOIN streamcontent ON streamcontent.stid = ?3 AND streamcontent.status_in_reply_to_id = descendants.status_id
+					JOIN statuses ON statuses.sid = streamcontent.sid AND statuses.asid = ?1
+				WHERE descendants.depth < ?4
+			)
+			SELECT `+threadItemColumns+`
+			FROM
+				descendants
+				JOIN statuses USING (sid)
+				LEFT JOIN streamcontent ON streamcontent.sid = statuses.sid AND streamcontent.stid = ?3
+			WHERE descendants.depth > 0
+			ORDER BY length(statuses.status_id), statuses.status_id
+			;
+		`, asid, statusID, stid, maxThreadDepth)
+		if err != nil {
+			return err
+		}
+		descendants, err = scanThreadItems(rows)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return ancestors, descendants, nil
+}
+
+// threadContinuationInTxn looks for a status of the pool which is part of the
+// conversation at the end of the stream - i.e., replying to or replied to by
+// the last status which is not a continuation, or any of the continuations
+// after it. The oldest one is returned, along with its SID. Returns a nil item
+// if there is none.
+func (st *Storage) threadContinuationInTxn(ctx context.Context, txn SQLReadWrite, streamState *stpb.StreamState) (types.SID, *Item, error) {
+	if streamState.LastPosition == 0 {
+		return 0, nil, nil
+	}
+
+	// Gather the IDs of the statuses of the conversation at the end of the
+	// stream. IDs are specific to a Mastodon server, so only the statuses of
+	// the same account are considered.
+	rows, err := txn.Query(ctx, "thread-continuation-block", `
+		SELECT
+			statuses.asid,
+			streamcontent.status_id,
+			streamcontent.status_reblog_id,
+			streamcontent.status_in_reply_to_id,
+			streamcontent.stream_status_state
+		FROM
+			streamcontent
+			JOIN statuses USING (sid)
+		WHERE
+			streamcontent.stid = ?
+			AND streamcontent.position IS NOT NULL
+		ORDER BY streamcontent.position DESC
+		LIMIT ?
+		;
+	`, streamState.Stid, maxThreadDepth)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	var asid types.ASID
+	var ids []any
+	for rows.Next() {
+		var rowASID types.ASID
+		var statusID string
+		var reblogID, inReplyToID sql.NullString
+		streamStatusState := &stpb.StreamStatusState{}
+		if err := rows.Scan(&rowASID, &statusID, &reblogID, &inReplyToID, types.SQLProto{streamStatusState}); err != nil {
+			return 0, nil, err
+		}
+		if asid == 0 {
+			asid = rowASID
+		}
+		if rowASID == asid {
+			ids = append(ids, statusID)
+			for _, id := range []sql.NullString{reblogID, inReplyToID} {
+				if id.Valid {
+					ids = append(ids, id.String)
+				}
+			}
+		}
+		if !streamStatusState.GetThreadContinuation() {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	rows.Close()
+	// No positioned statuses, e.g., after an import or pruning.
+	if len(ids) == 0 {
+		return 0, nil, nil
+	}
+
+	placeholders := "?" + strings.Repeat(", ?", len(ids)-1)
+	args := []any{streamState.Stid, asid}
+	args = append(args, ids...)
+	args = append(args, ids...)
+
+	var sid types.SID
+	var status types.SQLStatus
+	item := &Item{
+		StreamStatusState: &stpb.StreamStatusState{},
+		StatusMeta:        &stpb.StatusMeta{},
+	}
+	err = txn.QueryRow(ctx, "thread-continuation", `
+		SELECT
+			streamcontent.sid,
+			streamcontent.stream_status_state,
+			statuses.asid,
+			statuses.status,
+			statuses.status_meta
+		FROM
+			streamcontent
+			JOIN statuses USING (sid)
+		WHERE
+			streamcontent.stid = ?
+			AND streamcontent.position IS NULL
+			AND statuses.asid = ?
+			AND (
+				streamcontent.status_in_reply_to_id IN (`+placeholders+`)
+				OR streamcontent.status_id IN (`+placeholders+`)
+			)
+			AND NOT `+st.backend.dialect().poolHidden()+`
+		ORDER BY length(streamcontent.status_id), streamcontent.status_id
+		LIMIT 1
+		;
+	`, args...).Scan(&sid, types.SQLProto{item.StreamStatusState}, &item.ASID, &status, types.SQLProto{item.StatusMeta})
+	if err == sql.ErrNoRows {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	item.Status = status.Status
+	return sid, item, nil
+}
@@ -6,6 +6,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/golang/glog"
@@ -19,6 +20,11 @@ import (
 //go:embed schema.sql
 var refSchema string
 
+// ErrSchemaTooNew is returned when the database schema was updated by a more
+// recent version of Mastopoof. Such databases are never opened, as the
+// changes are unknown.
+var ErrSchemaTooNew = errors.New("database schema is more recent than supported")
+
 // prepareDB creates the schema for the database or update
 // it if needed.
 func prepareDB(ctx context.Context, db *sql.DB, targetVersion int) error {
@@ -34,6 +40,9 @@ func prepareDB(ctx context.Context, db *sql.DB, targetVersion int) error {
 			return err
 		}
 
+		if version > maxSchemaVersion {
+			return fmt.Errorf("%w: user_version of DB is %d, max known version is %d", ErrSchemaTooNew, version, maxSchemaVersion)
+		}
 		if version > targetVersion {
 			return fmt.Errorf("user_version of DB (%v) is higher than target schema version (%v)", version, targetVersion)
 		}
@@ -82,9 +91,22 @@ func prepareDB(ctx context.Context, db *sql.DB, targetVersion int) error {
 }
 
 // prepareDBSingleStep applies the next change on the DB.
-// Return true if there is no more changes needed.
-func prepareDBSingleStep(ctx context.Context, db *sql.DB, step UpdateStep, expectedVersion int) (returnedErr error) {
-	if step.DisableForeignKeys {
+func prepareDBSingleStep(ctx context.Context, db *sql.DB, step UpdateStep, expectedVersion int) error {
+	return runDBStep(ctx, db, step.Apply, step.DisableForeignKeys, expectedVersion, expectedVersion+1)
+}
+
+// revertDBSingleStep undoes the change which led to `expectedVersion`, using
+// the Revert function of the step.
+func revertDBSingleStep(ctx context.Context, db *sql.DB, step UpdateStep, expectedVersion int) error {
+	if step.Revert == nil {
+		return fmt.Errorf("update from version %d to version %d cannot be reverted", expectedVersion-1, expectedVersion)
+	}
+	return runDBStep(ctx, db, step.Revert, step.DisableForeignKeys, expectedVersion, expectedVersion-1)
+}
+
+// runDBStep runs `f` to go from `expectedVersion` to `stepVersion`.
+func runDBStep(ctx context.Context, db *sql.DB, f updateFunc, disableForeignKeys bool, expectedVersion int, stepVersion int) (returnedErr error) {
+	if disableForeignKeys {
 		// Prepare update of the database schema.
 		// See https://www.sqlite.org/lang_altertable.html,
 		//   "Making Other Kinds Of Table Schema Changes"
@@ -119,12 +141,10 @@ func prepareDBSingleStep(ctx context.Context, db *sql.DB, step UpdateStep, expec
 		return fmt.Errorf("concurrency error; expected version %d, got %d", expectedVersion, version)
 	}
 
-	stepVersion := version + 1
-
 	glog.Infof("updating database schema from %d to %d...", version, stepVersion)
 
 	// Apply the actual changes.
-	if err := step.Apply(ctx, txn); err != nil {
+	if err := f(ctx, txn); err != nil {
 		return fmt.Errorf("unable to update from version %d to version %d: %w", version, stepVersion, err)
 	}
 
@@ -162,6 +182,10 @@ func getCurrentVersion(ctx context.Context, txn txnInterface) (int, error) {
 type UpdateStep struct {
 	Apply              updateFunc
 	DisableForeignKeys bool
+	// Revert undoes Apply, if set. It is only used through the `migrate`
+	// command - e.g., to test rollbacks. Data specific to the newer version
+	// is lost.
+	Revert updateFunc
 }
 
 var allSteps []UpdateStep
@@ -176,7 +200,7 @@ type updateFunc func(context.Context, txnInterface) error
 
 // maxSchemaVersion indicates up to which version the database schema was configured.
 // It is incremented everytime a change is made.
-const maxSchemaVersion = 31
+const maxSchemaVersion = 36
 
 func init() {
 	if len(allSteps) != maxSchemaVersion {
@@ -1097,3 +1121,171 @@ func v30Tov31(ctx context.Context, txn txnInterface) error {
 	}
 	return nil
 }
+
+var _ = RegisterStep(UpdateStep{
+	Apply: v31Tov32,
+})
+
+func v31Tov32(ctx context.Context, txn txnInterface) error {
+	// Add status URIs in the stream table, to detect statuses seen through
+	// different accounts.
+	sqlStmt := `
+		ALTER TABLE streamcontent ADD COLUMN status_uri TEXT;
+		ALTER TABLE streamcontent ADD COLUMN status_reblog_uri TEXT;
+
+		UPDATE streamcontent SET
+			status_uri = (SELECT json_extract(status, "$.uri") FROM statuses WHERE statuses.sid = streamcontent.sid),
+			status_reblog_uri = (SELECT json_extract(status, "$.reblog.uri") FROM statuses WHERE statuses.sid = streamcontent.sid)
+		;
+
+		CREATE INDEX streamcontent_status_uri ON streamcontent(status_uri);
+		CREATE INDEX streamcontent_status_reblog_uri ON streamcontent(status_reblog_uri);
+	`
+	if _, err := txn.ExecContext(ctx, sqlStmt); err != nil {
+		return fmt.Errorf("unable to run %q: %w", sqlStmt, err)
+	}
+	return nil
+}
+
+var _ = RegisterStep(UpdateStep{
+	Apply:  v32Tov33,
+	Revert: v33Tov32,
+})
+
+func v32Tov33(ctx context.Context, txn txnInterface) error {
+	// Add a full text index of the statuses. Rows are written by Storage, which
+	// indexes the text of the content instead of its HTML - see indexStatus.
+	// Deleted statuses are removed from the index by a trigger.
+	sqlStmt := `
+		-- Full text index of the cached statuses. rowid is the sid of the status.
+		-- For reblogs, the content of the reblogged status is indexed, along with
+		-- both accounts.
+		CREATE VIRTUAL TABLE statuses_fts USING fts5(
+			content,
+			spoiler_text,
+			account,
+			tags
+		);
+
+		CREATE TRIGGER statuses_fts_delete AFTER DELETE ON statuses BEGIN
+			DELETE FROM statuses_fts WHERE rowid = old.sid;
+		END;
+	`
+	if _, err := txn.ExecContext(ctx, sqlStmt); err != nil {
+		return fmt.Errorf("unable to run %q: %w", sqlStmt, err)
+	}
+	// Index what is already there.
+	return indexAllStatuses(ctx, txn, indexStatusSQL)
+}
+
+func v33Tov32(ctx context.Context, txn txnInterface) error {
+	sqlStmt := `
+		DROP TRIGGER statuses_fts_delete;
+		DROP TABLE statuses_fts;
+	`
+	if _, err := txn.ExecContext(ctx, sqlStmt); err != nil {
+		return fmt.Errorf("unable to run %q: %w", sqlStmt, err)
+	}
+	return nil
+}
+
+var _ = RegisterStep(UpdateStep{
+	Apply:  v33Tov34,
+	Revert: v34Tov33,
+})
+
+func v33Tov34(ctx context.Context, txn txnInterface) error {
+	// Keep notifications, instead of just counting them.
+	sqlStmt := `
+		-- Notifications obtained from Mastodon.
+		CREATE TABLE notifications (
+			-- A unique ID, increasing with insertion.
+			nid INTEGER PRIMARY KEY AUTOINCREMENT,
+			-- The Mastodon account that got that notification.
+			asid INTEGER NOT NULL,
+			-- The notification, serialized as JSON.
+			notification TEXT NOT NULL,
+			-- Whether the notification was read - either from Mastopoof or according to
+			-- the Mastodon notifications marker.
+			read INTEGER NOT NULL DEFAULT 0,
+
+			notification_id TEXT NOT NULL GENERATED ALWAYS AS (json_extract(notification, '$.id')) STORED,
+			notification_type TEXT NOT NULL GENERATED ALWAYS AS (json_extract(notification, '$.type')) STORED,
+			-- URI of the status the notification is about, if any. Unlike IDs, it is the
+			-- same across Mastodon servers.
+			status_uri TEXT GENERATED ALWAYS AS (json_extract(notification, '$.status.uri')) STORED,
+
+			FOREIGN KEY(asid) REFERENCES accountstate(asid)
+		) STRICT;
+
+		CREATE UNIQUE INDEX notifications_asid_notification_id ON notifications(asid, notification_id);
+	`
+	if _, err := txn.ExecContext(ctx, sqlStmt); err != nil {
+		return fmt.Errorf("unable to run %q: %w", sqlStmt, err)
+	}
+	return nil
+}
+
+func v34Tov33(ctx context.Context, txn txnInterface) error {
+	sqlStmt := `
+		DROP TABLE notifications;
+	`
+	if _, err := txn.ExecContext(ctx, sqlStmt); err != nil {
+		return fmt.Errorf("unable to run %q: %w", sqlStmt, err)
+	}
+	return nil
+}
+
+var _ = RegisterStep(UpdateStep{
+	Apply:  v34Tov35,
+	Revert: v35Tov34,
+})
+
+func v34Tov35(ctx context.Context, txn txnInterface) error {
+	// Find replies to a status, to show threads.
+	sqlStmt := `
+		CREATE INDEX streamcontent_status_in_reply_to_id ON streamcontent(status_in_reply_to_id);
+	`
+	if _, err := txn.ExecContext(ctx, sqlStmt); err != nil {
+		return fmt.Errorf("unable to run %q: %w", sqlStmt, err)
+	}
+	return nil
+}
+
+func v35Tov34(ctx context.Context, txn txnInterface) error {
+	sqlStmt := `
+		DROP INDEX streamcontent_status_in_reply_to_id;
+	`
+	if _, err := txn.ExecContext(ctx, sqlStmt); err != nil {
+		return fmt.Errorf("unable to run %q: %w", sqlStmt, err)
+	}
+	return nil
+}
+
+var _ = RegisterStep(UpdateStep{
+	Apply:  v35Tov36,
+	Revert: v36Tov35,
+})
+
+func v35Tov36(ctx context.Context, txn txnInterface) error {
+	sqlStmt := `
+		CREATE TABLE invitecodes (
+			code TEXT PRIMARY KEY,
+			state TEXT NOT NULL
+		) STRICT;
+	`
+	if _, err := txn.ExecContext(ctx, sqlStmt); err != nil {
+		return fmt.Errorf("unable to run %q: %w", sqlStmt, err)
+	}
+	return nil
+}
+
+func v36Tov35(ctx context.Context, txn txnInterface) error {
+	sqlStmt := `
+		DROP TABLE invitecodes;
+	`
+	if _, err := txn.ExecContext(ctx, sqlStmt); err != nil {
+		return fmt.Errorf("unable to run %q: %w", sqlStmt, err)
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
@@ -802,3 +803,199 @@ func TestV30ToV31(t *testing.T) {
 		t.Errorf("data mismatch (-want +got):\n%s", diff)
 	}
 }
+
+func TestV31ToV32(t *testing.T) {
+	ctx := context.Background()
+
+	env := (&DBTestEnv{
+		targetVersion: 31,
+		sqlInit: `
+			INSERT INTO userstate (uid, state) VALUES (47, "");
+			INSERT INTO accountstate (asid, state, uid) VALUES (2, "", 47);
+			INSERT INTO streamstate (stid, state) VALUES (3, "");
+			INSERT INTO statuses (sid, asid, status) VALUES
+				(4, 2, '{"id": "a", "uri": "https://example.com/a"}'),
+				(5, 2, '{"id": "b", "uri": "https://example.com/b", "reblog": {"id": "c", "uri": "https://example.com/c"}}');
+			INSERT INTO streamcontent (stid, sid, status_id) VALUES
+				(3, 4, "a"),
+				(3, 5, "b");
+		`,
+	}).Init(ctx, t)
+	defer env.Close()
+
+	if err := prepareDB(ctx, env.rwDB, 32); err != nil {
+		t.Fatal(err)
+	}
+
+	type Row struct {
+		SID             int64
+		StatusURI       sql.NullString
+		StatusReblogURI sql.NullString
+	}
+
+	got := []*Row{}
+	rows, err := env.roDB.QueryContext(ctx, `SELECT sid, status_uri, status_reblog_uri FROM streamcontent ORDER BY sid;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		row := &Row{}
+		if err := rows.Scan(&row.SID, &row.StatusURI, &row.StatusReblogURI); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, row)
+	}
+
+	want := []*Row{
+		{SID: 4, StatusURI: sql.NullString{String: "https://example.com/a", Valid: true}},
+		{SID: 5, StatusURI: sql.NullString{String: "https://example.com/b", Valid: true}, StatusReblogURI: sql.NullString{String: "https://example.com/c", Valid: true}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("data mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestV32ToV33(t *testing.T) {
+	ctx := context.Background()
+
+	env := (&DBTestEnv{
+		targetVersion: 32,
+		sqlInit: `
+			INSERT INTO userstate (uid, state) VALUES (47, "");
+			INSERT INTO accountstate (asid, state, uid) VALUES (2, "", 47);
+			INSERT INTO statuses (sid, asid, status) VALUES
+				(4, 2, '{"id": "a", "content": "<p>Some <span class=\"kittens\">cats</span></p>"}'),
+				(5, 2, '{"id": "b", "content": "<p>Reblog</p>", "reblog": {"id": "c", "content": "<p>More cats</p>"}}');
+		`,
+	}).Init(ctx, t)
+	defer env.Close()
+
+	if err := prepareDB(ctx, env.rwDB, 33); err != nil {
+		t.Fatal(err)
+	}
+
+	match := func(text string) []int64 {
+		t.Helper()
+		got := []int64{}
+		rows, err := env.roDB.QueryContext(ctx, `SELECT rowid FROM statuses_fts WHERE statuses_fts MATCH ? ORDER BY rowid;`, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var sid int64
+			if err := rows.Scan(&sid); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, sid)
+		}
+		return got
+	}
+
+	if diff := cmp.Diff([]int64{4, 5}, match("cats")); diff != "" {
+		t.Errorf("match mismatch (-want +got):\n%s", diff)
+	}
+	// Markup is not indexed.
+	for _, text := range []string{"span", "kittens"} {
+		if diff := cmp.Diff([]int64{}, match(text)); diff != "" {
+			t.Errorf("match %q mismatch (-want +got):\n%s", text, diff)
+		}
+	}
+}
+
+// TestMigrateRevert verifies that reverting steps leads to the same schema as
+// a DB created at that version, and that steps can then be applied again.
+func TestMigrateRevert(t *testing.T) {
+	ctx := context.Background()
+
+	// Oldest version which can be reached by reverting steps.
+	oldest := maxSchemaVersion
+	for oldest > 0 && allSteps[oldest-1].Revert != nil {
+		oldest--
+	}
+
+	env := (&DBTestEnv{}).Init(ctx, t)
+	defer env.Close()
+
+	for _, v := range []int{oldest, maxSchemaVersion} {
+		if err := env.st.Migrate(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+		got, err := env.st.SchemaStatus(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Current != v {
+			t.Errorf("got version %d, wanted %d", got.Current, v)
+		}
+
+		sch, err := canonicalSchema(ctx, env.roDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refEnv := (&DBTestEnv{targetVersion: v}).Init(ctx, t)
+		refSch, err := canonicalSchema(ctx, refEnv.roDB)
+		refEnv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(refSch, sch); diff != "" {
+			t.Errorf("DB schema mismatch at version %d (-ref +got):\n%s", v, diff)
+		}
+	}
+
+	if oldest > 0 {
+		if _, err := env.st.MigrationPlan(ctx, oldest-1); err == nil {
+			t.Errorf("expected error when reverting an irreversible step")
+		}
+	}
+}
+
+func TestMigrationPlan(t *testing.T) {
+	ctx := context.Background()
+
+	env := (&DBTestEnv{targetVersion: maxSchemaVersion - 2}).Init(ctx, t)
+	defer env.Close()
+
+	plan, err := env.st.MigrationPlan(ctx, maxSchemaVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, step := range plan {
+		got = append(got, fmt.Sprintf("%d->%d %s", step.From, step.To, step.Name))
+	}
+	want := []string{
+		fmt.Sprintf("%d->%d v%dTov%d", maxSchemaVersion-2, maxSchemaVersion-1, maxSchemaVersion-2, maxSchemaVersion-1),
+		fmt.Sprintf("%d->%d v%dTov%d", maxSchemaVersion-1, maxSchemaVersion, maxSchemaVersion-1, maxSchemaVersion),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("plan mismatch (-want +got):\n%s", diff)
+	}
+
+	// Planning does not change the DB.
+	status, err := env.st.SchemaStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Current != maxSchemaVersion-2 {
+		t.Errorf("got version %d, wanted %d", status.Current, maxSchemaVersion-2)
+	}
+}
+
+func TestSchemaTooNew(t *testing.T) {
+	ctx := context.Background()
+
+	env := (&DBTestEnv{}).Init(ctx, t)
+	defer env.Close()
+
+	if _, err := env.rwDB.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", maxSchemaVersion+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := prepareDB(ctx, env.rwDB, maxSchemaVersion); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("got error %v, wanted ErrSchemaTooNew", err)
+	}
+	if _, err := env.st.MigrationPlan(ctx, maxSchemaVersion); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("got error %v, wanted ErrSchemaTooNew", err)
+	}
+}
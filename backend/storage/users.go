@@ -0,0 +1,142 @@
+// This file contains the administration of users - deletion, disabling and
+// revocation of their sessions.
+package storage
+
+import (
+	"context"
+
+	"github.com/Palats/mastopoof/backend/types"
+	"github.com/alexedwards/scs/v2"
+	"github.com/golang/glog"
+)
+
+// SessionUserIDKey is the key of the session data containing the logged in
+// user.
+const SessionUserIDKey = "userid"
+
+// DeleteUser removes a user and everything attached to it: Mastodon accounts,
+// streams, cached statuses, notifications and HTTP sessions.
+// A running Streamer stops following its accounts on its next rescan.
+func (st *Storage) DeleteUser(ctx context.Context, uid types.UID) (retErr error) {
+	defer recordAction("delete-user")(retErr)
+	return st.InTxnRW(ctx, func(ctx context.Context, txn SQLReadWrite) error {
+		// Fails if the user does not exist.
+		if _, err := st.UserState(ctx, txn, uid); err != nil {
+			return err
+		}
+		streamStates, err := st.StreamStatesByUID(ctx, txn, uid)
+		if err != nil {
+			return err
+		}
+
+		for _, streamState := range streamStates {
+			if _, err := txn.Exec(ctx, "delete-user-stream-content", `DELETE FROM streamcontent WHERE stid = ?`, streamState.Stid); err != nil {
+				return err
+			}
+			if _, err := txn.Exec(ctx, "delete-user-stream", `DELETE FROM streamstate WHERE stid = ?`, streamState.Stid); err != nil {
+				return err
+			}
+			markStreamChanged(txn, types.StID(streamState.Stid))
+		}
+		// Statuses are not supposed to be in streams of other users - but that
+		// happened in the past; see FixCrossStatuses.
+		_, err = txn.Exec(ctx, "delete-user-cross-content", `
+			DELETE FROM streamcontent
+			WHERE sid IN (
+				SELECT sid FROM statuses WHERE asid IN (SELECT asid FROM accountstate WHERE uid = ?)
+			)
+		`, uid)
+		if err != nil {
+			return err
+		}
+		if _, err := txn.Exec(ctx, "delete-user-statuses", `DELETE FROM statuses WHERE asid IN (SELECT asid FROM accountstate WHERE uid = ?)`, uid); err != nil {
+			return err
+		}
+		if _, err := txn.Exec(ctx, "delete-user-notifications", `DELETE FROM notifications WHERE asid IN (SELECT asid FROM accountstate WHERE uid = ?)`, uid); err != nil {
+			return err
+		}
+		if _, err := txn.Exec(ctx, "delete-user-accounts", `DELETE FROM accountstate WHERE uid = ?`, uid); err != nil {
+			return err
+		}
+		if _, err := txn.Exec(ctx, "delete-user", `DELETE FROM userstate WHERE uid = ?`, uid); err != nil {
+			return err
+		}
+		_, err = st.revokeSessions(ctx, txn, uid)
+		return err
+	})
+}
+
+// SetUserDisabled disables or re-enables a user. Disabling a user also
+// revokes its sessions; a running Streamer stops following its accounts on its
+// next rescan.
+func (st *Storage) SetUserDisabled(ctx context.Context, uid types.UID, disabled bool) (retErr error) {
+	defer recordAction("set-user-disabled")(retErr)
+	return st.InTxnRW(ctx, func(ctx context.Context, txn SQLReadWrite) error {
+		userState, err := st.UserState(ctx, txn, uid)
+		if err != nil {
+			return err
+		}
+		userState.Disabled = disabled
+		if err := st.SetUserState(ctx, txn, userState); err != nil {
+			return err
+		}
+		if disabled {
+			_, err = st.revokeSessions(ctx, txn, uid)
+		}
+		return err
+	})
+}
+
+// RevokeSessions logs out the user from all its browsers. It returns the
+// number of sessions which were removed.
+func (st *Storage) RevokeSessions(ctx context.Context, uid types.UID) (_ int, retErr error) {
+	defer recordAction("revoke-sessions")(retErr)
+	count := 0
+	err := st.InTxnRW(ctx, func(ctx context.Context, txn SQLReadWrite) error {
+		var err error
+		count, err = st.revokeSessions(ctx, txn, uid)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (st *Storage) revokeSessions(ctx context.Context, txn SQLReadWrite, uid types.UID) (int, error) {
+	// The user is only known from the session data, as encoded by the session
+	// manager - so all sessions need to be looked at.
+	rows, err := txn.Query(ctx, "revoke-sessions-list", `SELECT token, data FROM sessions`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var tokens []string
+	for rows.Next() {
+		var token string
+		var data []byte
+		if err := rows.Scan(&token, &data); err != nil {
+			return 0, err
+		}
+		_, values, err := scs.GobCodec{}.Decode(data)
+		if err != nil {
+			// Not worth preventing the revocation of other sessions.
+			glog.Errorf("unable to decode data of session, skipping: %v", err)
+			continue
+		}
+		if v, ok := values[SessionUserIDKey].(int64); ok && types.UID(v) == uid {
+			tokens = append(tokens, token)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	for _, token := range tokens {
+		if _, err := txn.Exec(ctx, "revoke-sessions-delete", `DELETE FROM sessions WHERE token = ?`, token); err != nil {
+			return 0, err
+		}
+	}
+	return len(tokens), nil
+}
@@ -27,6 +27,9 @@ type ASID int64
 // StID is a StreamState ID.
 type StID int64
 
+// NID is the ID of a notification in the `notifications` database.
+type NID int64
+
 func SettingListCount(s *settingspb.Settings) int64 {
 	if s.GetListCount().GetOverride() {
 		return s.GetListCount().GetValue()
@@ -41,6 +44,27 @@ func SettingSeenReblogs(s *settingspb.Settings) settingspb.SettingSeenReblogs_Va
 	return mpdata.SettingsInfo().GetSeenReblogs().Default
 }
 
+func SettingRanking(s *settingspb.Settings) settingspb.SettingRanking_Values {
+	if s.GetRanking().GetOverride() {
+		return s.GetRanking().Value
+	}
+	return mpdata.SettingsInfo().GetRanking().Default
+}
+
+func SettingSyncHomeMarker(s *settingspb.Settings) bool {
+	if s.GetSyncHomeMarker().GetOverride() {
+		return s.GetSyncHomeMarker().GetValue()
+	}
+	return mpdata.SettingsInfo().GetSyncHomeMarker().GetDefault()
+}
+
+func SettingThreading(s *settingspb.Settings) bool {
+	if s.GetThreading().GetOverride() {
+		return s.GetThreading().GetValue()
+	}
+	return mpdata.SettingsInfo().GetThreading().GetDefault()
+}
+
 func AccountStateToAccountProto(accountState *stpb.AccountState) *pb.Account {
 	return &pb.Account{
 		ServerAddr: accountState.ServerAddr,
@@ -74,9 +98,12 @@ func StreamStateToStreamInfo(ss *stpb.StreamState) *pb.StreamInfo {
 		FirstPosition:      ss.FirstPosition,
 		LastPosition:       ss.LastPosition,
 		RemainingPool:      ss.Remaining,
+		FilteredPool:       ss.Filtered,
 		LastFetchSecs:      ss.LastFetchSecs,
 		NotificationState:  ss.NotificationsState,
 		NotificationsCount: ss.NotificationsCount,
+		Name:               ss.Name,
+		Source:             ss.Source,
 	}
 }
 
@@ -3,6 +3,7 @@ import { ConnectError, createClient, Client, Code, Transport } from "@connectrpc
 import { Mastopoof } from "mastopoof-proto/gen/mastopoof/mastopoof_pb";
 import * as pb from "mastopoof-proto/gen/mastopoof/mastopoof_pb";
 import * as settingspb from "mastopoof-proto/gen/mastopoof/settings/settings_pb";
+import * as storagepb from "mastopoof-proto/gen/mastopoof/storage/storage_pb";
 
 
 // Return a random value around [ref-delta, ref+delta[, where
@@ -133,14 +134,97 @@ export class Backend {
     return resp.status === pb.FetchResponse_Status.DONE
   }
 
-  public async search(statusID: string): Promise<pb.SearchResponse> {
-    return await this.client.search({ statusId: statusID });
+  // Keep stream info up-to-date with changes happening on the server - e.g.,
+  // from another device - until the signal is aborted.
+  public async watchStream(stid: bigint, signal: AbortSignal) {
+    while (!signal.aborted) {
+      try {
+        for await (const resp of this.client.watchStream({ stid: stid }, { signal: signal })) {
+          this.updateStreamInfo(resp.streamInfo);
+        }
+      } catch (err) {
+        if (signal.aborted) {
+          break;
+        }
+        console.log("watch stream failed:", err);
+      }
+      // Do not hammer the server when the connection keeps failing.
+      await new Promise(resolve => setTimeout(resolve, fuzzy(10_000, 0.1)));
+    }
+  }
+
+  // Search for statuses. Numbers are looked up as status IDs, anything else
+  // is a full text search.
+  public async search(value: string): Promise<pb.SearchResponse> {
+    if (/^\d+$/.test(value)) {
+      return await this.client.search({ statusId: value });
+    }
+    return await this.client.search({ query: value });
   }
 
   public async setStatus(statusID: string, action: pb.SetStatusRequest_Action): Promise<pb.SetStatusResponse> {
     return await this.client.setStatus({ statusId: statusID, action: action });
   }
 
+  public async postStatus(content: string, spoilerText: string, visibility: string): Promise<pb.PostStatusResponse> {
+    return await this.client.postStatus({ content: content, spoilerText: spoilerText, visibility: visibility });
+  }
+
+  public async reply(statusID: string, content: string, account?: pb.Account): Promise<pb.ReplyResponse> {
+    return await this.client.reply({ statusId: statusID, content: content, account: account });
+  }
+
+  // Get the conversation around a status - ancestors and replies.
+  public async getContext(stid: bigint, statusID: string, account?: pb.Account): Promise<pb.GetContextResponse> {
+    return await this.client.getContext({ stid: stid, statusId: statusID, account: account });
+  }
+
+  // List notifications, most recent first. `beforeNID` is the `nextNid` of
+  // the previous page, or zero for the first page.
+  public async listNotifications(beforeNID: bigint, types: string[] = []): Promise<pb.ListNotificationsResponse> {
+    return await this.client.listNotifications({ beforeNid: beforeNID, types: types });
+  }
+
+  // Mark notifications as read, up to `upToNID` - or all of them if zero.
+  public async markNotificationsRead(upToNID: bigint): Promise<pb.MarkNotificationsReadResponse> {
+    return await this.client.markNotificationsRead({ upToNid: upToNID });
+  }
+
+  // Mastopoof local filter rules - those are never sent to Mastodon.
+  public async listFilterRules(): Promise<storagepb.FilterRule[]> {
+    const resp = await this.client.listFilterRules({});
+    return resp.rules;
+  }
+
+  public async createFilterRule(rule: storagepb.FilterRule): Promise<storagepb.FilterRule> {
+    const resp = await this.client.createFilterRule({ rule: rule });
+    return resp.rule!;
+  }
+
+  public async updateFilterRule(rule: storagepb.FilterRule): Promise<storagepb.FilterRule> {
+    const resp = await this.client.updateFilterRule({ rule: rule });
+    return resp.rule!;
+  }
+
+  public async deleteFilterRule(id: bigint) {
+    await this.client.deleteFilterRule({ id: id });
+  }
+
+  // Apply the current Mastodon filters to statuses already fetched.
+  // `onProgress` is called with each progress update from the server. Changes
+  // to the pool stats are reported by `watchStream`.
+  public async recomputeMeta(includePositioned: boolean, onProgress: (resp: pb.RecomputeMetaResponse) => void) {
+    for await (const resp of this.client.recomputeMeta({ includePositioned: includePositioned })) {
+      onProgress(resp);
+    }
+  }
+
+  // Get everything the server knows about the user, as a self-contained archive.
+  public async exportUser(): Promise<storagepb.UserArchive> {
+    const resp = await this.client.exportUser({});
+    return resp.archive!;
+  }
+
   public async updateSettings(settings: settingspb.Settings): Promise<pb.UpdateSettingsResponse> {
     return await this.client.updateSettings({ settings: settings });
   }
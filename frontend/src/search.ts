@@ -40,6 +40,7 @@ export class MastSearch extends LitElement {
         account: item.account!,
         statusMeta: item.meta!,    // TODO: check presence
         streamStatusState: item.streamStatusState!,
+        filterWarnings: item.filterWarnings,
       });
     }
 
@@ -52,7 +53,7 @@ export class MastSearch extends LitElement {
         <div slot="list">
           <div class="search-form">
             <form @submit=${(e: Event) => { e.preventDefault(); this.doSearch() }}>
-              <label for="search-box">Status ID</label>
+              <label for="search-box">Text or status ID</label>
               <input type="text" id="search-box" ${ref(this.searchBoxRef)} value="" required autofocus></input>
               <button type="submit">Search</button>
             </form>
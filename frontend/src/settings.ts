@@ -4,12 +4,30 @@ import { LoginUpdateEvent } from './backend';
 import * as common from "./common";
 import * as pb from "mastopoof-proto/gen/mastopoof/mastopoof_pb";
 import * as settingspb from "mastopoof-proto/gen/mastopoof/settings/settings_pb";
+import * as storagepb from "mastopoof-proto/gen/mastopoof/storage/storage_pb";
 import { createRef, ref, Ref } from 'lit/directives/ref.js';
 import { ifDefined } from 'lit/directives/if-defined.js';
 import * as protobuf from '@bufbuild/protobuf';
 import { tsEnum } from '@bufbuild/protobuf/codegenv1';
 
 const enumInfo = tsEnum(settingspb.SettingSeenReblogs_ValuesSchema);
+const ruleKindInfo = tsEnum(storagepb.FilterRule_KindSchema);
+const ruleActionInfo = tsEnum(storagepb.FilterRule_ActionSchema);
+
+// User visible explanation of a local filter rule.
+function describeRule(rule: storagepb.FilterRule): string {
+  switch (rule.kind) {
+    case storagepb.FilterRule_Kind.REBLOGS_FROM:
+      return `reblogs by @${rule.account}`;
+    case storagepb.FilterRule_Kind.LANGUAGE:
+      return `statuses in language "${rule.language}"`;
+    case storagepb.FilterRule_Kind.TOO_MANY_HASHTAGS:
+      return `statuses with more than ${rule.maxHashtags} hashtags`;
+    case storagepb.FilterRule_Kind.REPLY_TO_UNFOLLOWED:
+      return "replies to accounts not followed";
+  }
+  return ruleKindInfo[rule.kind] as string;
+}
 
 @customElement('mast-settings')
 export class MastSettings extends LitElement {
@@ -24,6 +42,22 @@ export class MastSettings extends LitElement {
   private seenReblogsInputRef: Ref<HTMLSelectElement> = createRef();
   private seenReblogsCheckBoxRef: Ref<HTMLInputElement> = createRef();
 
+  private syncHomeMarkerInputRef: Ref<HTMLInputElement> = createRef();
+  private syncHomeMarkerCheckBoxRef: Ref<HTMLInputElement> = createRef();
+
+  private threadingInputRef: Ref<HTMLInputElement> = createRef();
+  private threadingCheckBoxRef: Ref<HTMLInputElement> = createRef();
+
+  // Local filter rules, as last obtained from the backend. Unlike settings,
+  // they are saved as soon as they are added or removed.
+  @state() private filterRules: storagepb.FilterRule[] = [];
+  private ruleKindInputRef: Ref<HTMLSelectElement> = createRef();
+  private ruleActionInputRef: Ref<HTMLSelectElement> = createRef();
+  private ruleValueInputRef: Ref<HTMLInputElement> = createRef();
+
+  // Progress of re-applying Mastodon filters, if started.
+  @state() private recomputeProgress = "";
+  private recomputePositionedCheckBoxRef: Ref<HTMLInputElement> = createRef();
 
   connectedCallback(): void {
     super.connectedCallback();
@@ -33,6 +67,77 @@ export class MastSettings extends LitElement {
     common.backend.onEvent.addEventListener("login-update", ((evt: LoginUpdateEvent) => {
       this.userInfoUpdate(evt.userInfo);
     }) as EventListener);
+
+    this.loadFilterRules();
+  }
+
+  async loadFilterRules() {
+    this.loadingBarUsers++;
+    this.filterRules = await common.backend.listFilterRules();
+    this.loadingBarUsers--;
+  }
+
+  async addFilterRule() {
+    const rule = protobuf.create(storagepb.FilterRuleSchema, {
+      kind: ruleKindInfo[this.ruleKindInputRef.value?.value || ""] as number,
+      action: ruleActionInfo[this.ruleActionInputRef.value?.value || ""] as number,
+    });
+    const value = this.ruleValueInputRef.value?.value || "";
+    switch (rule.kind) {
+      case storagepb.FilterRule_Kind.REBLOGS_FROM:
+        rule.account = value;
+        break;
+      case storagepb.FilterRule_Kind.LANGUAGE:
+        rule.language = value;
+        break;
+      case storagepb.FilterRule_Kind.TOO_MANY_HASHTAGS:
+        rule.maxHashtags = BigInt(parseInt(value) || 0);
+        break;
+    }
+
+    this.loadingBarUsers++;
+    await common.backend.createFilterRule(rule);
+    this.loadingBarUsers--;
+    await this.loadFilterRules();
+  }
+
+  async deleteFilterRule(id: bigint) {
+    this.loadingBarUsers++;
+    await common.backend.deleteFilterRule(id);
+    this.loadingBarUsers--;
+    await this.loadFilterRules();
+  }
+
+  async recomputeMeta() {
+    const includePositioned = this.recomputePositionedCheckBoxRef.value?.checked ?? false;
+    this.loadingBarUsers++;
+    try {
+      await common.backend.recomputeMeta(includePositioned, resp => {
+        this.recomputeProgress = resp.done
+          ? `Done, ${resp.updated} statuses updated.`
+          : `${resp.processed}/${resp.total} statuses...`;
+      });
+    } finally {
+      this.loadingBarUsers--;
+    }
+  }
+
+  // Download everything the server knows about the user, as a JSON file
+  // suitable for `import-user`. Access tokens are not included.
+  async exportUser() {
+    this.loadingBarUsers++;
+    try {
+      const archive = await common.backend.exportUser();
+      const content = protobuf.toJsonString(storagepb.UserArchiveSchema, archive);
+      const url = URL.createObjectURL(new Blob([content], { type: "application/json" }));
+      const link = document.createElement("a");
+      link.href = url;
+      link.download = "mastopoof-export.json";
+      link.click();
+      URL.revokeObjectURL(url);
+    } finally {
+      this.loadingBarUsers--;
+    }
   }
 
   userInfoUpdate(userInfo?: pb.UserInfo) {
@@ -53,6 +158,14 @@ export class MastSettings extends LitElement {
       value: v,
       override: this.seenReblogsCheckBoxRef.value?.checked || false,
     });
+    this.currentSettings.syncHomeMarker = protobuf.create(settingspb.SettingBoolSchema, {
+      value: this.syncHomeMarkerInputRef.value?.checked || false,
+      override: this.syncHomeMarkerCheckBoxRef.value?.checked || false,
+    });
+    this.currentSettings.threading = protobuf.create(settingspb.SettingBoolSchema, {
+      value: this.threadingInputRef.value?.checked || false,
+      override: this.threadingCheckBoxRef.value?.checked || false,
+    });
     this.requestUpdate();
   }
 
@@ -126,6 +239,119 @@ export class MastSettings extends LitElement {
               </span>
             </div>
           </div>
+
+          <div>
+            Keep the read position in sync with other Mastodon apps
+            <div class="inputs">
+              <span>
+                Default: ${common.settingsInfo.syncHomeMarker?.default ? "enabled" : "disabled"}
+              </span>
+              <span>
+                <label for="s-sync-home-marker-override">Override</label>
+                <input
+                  type="checkbox"
+                  id="s-sync-home-marker-override"
+                  ?checked=${this.currentSettings?.syncHomeMarker?.override}
+                  @change=${this.updateCurrentSettings}
+                  ${ref(this.syncHomeMarkerCheckBoxRef)}>
+                </input>
+                <label for="s-sync-home-marker-input">Enabled</label>
+                <input
+                  type="checkbox"
+                  id="s-sync-home-marker-input"
+                  ?checked=${this.currentSettings?.syncHomeMarker?.value}
+                  @change=${this.updateCurrentSettings}
+                  ${ref(this.syncHomeMarkerInputRef)}>
+                </input>
+              </span>
+            </div>
+          </div>
+
+          <div>
+            Show replies right after the status they reply to
+            <div class="inputs">
+              <span>
+                Default: ${common.settingsInfo.threading?.default ? "enabled" : "disabled"}
+              </span>
+              <span>
+                <label for="s-threading-override">Override</label>
+                <input
+                  type="checkbox"
+                  id="s-threading-override"
+                  ?checked=${this.currentSettings?.threading?.override}
+                  @change=${this.updateCurrentSettings}
+                  ${ref(this.threadingCheckBoxRef)}>
+                </input>
+                <label for="s-threading-input">Enabled</label>
+                <input
+                  type="checkbox"
+                  id="s-threading-input"
+                  ?checked=${this.currentSettings?.threading?.value}
+                  @change=${this.updateCurrentSettings}
+                  ${ref(this.threadingInputRef)}>
+                </input>
+              </span>
+            </div>
+          </div>
+
+          <div>
+            Local filter rules - those are applied by Mastopoof only, not by Mastodon.
+            ${this.filterRules.map(rule => html`
+              <div class="inputs">
+                <span>${ruleActionInfo[rule.action]} ${describeRule(rule)}</span>
+                <span>
+                  <button @click=${() => this.deleteFilterRule(rule.id)}>Delete</button>
+                </span>
+              </div>
+            `)}
+            <div class="inputs">
+              <span>
+                <select id="s-rule-action-input" ${ref(this.ruleActionInputRef)}>
+                  <option value="HIDE">HIDE</option>
+                  <option value="COLLAPSE">COLLAPSE</option>
+                </select>
+                <select id="s-rule-kind-input" ${ref(this.ruleKindInputRef)}>
+                  ${storagepb.FilterRule_KindSchema.values.filter(opt => opt.number !== 0).map(opt => html`
+                    <option value=${opt.name}>${opt.name}</option>
+                  `)}
+                </select>
+                <input
+                  type="text"
+                  id="s-rule-value-input"
+                  placeholder="account, language or count"
+                  ${ref(this.ruleValueInputRef)}>
+                </input>
+              </span>
+              <span>
+                <button @click=${this.addFilterRule}>Add</button>
+              </span>
+            </div>
+          </div>
+
+          <div>
+            Apply Mastodon filters again to statuses already fetched
+            <div class="inputs">
+              <span>${this.recomputeProgress}</span>
+              <span>
+                <label for="s-recompute-positioned">Include statuses already in the stream</label>
+                <input
+                  type="checkbox"
+                  id="s-recompute-positioned"
+                  ${ref(this.recomputePositionedCheckBoxRef)}>
+                </input>
+                <button @click=${this.recomputeMeta}>Apply</button>
+              </span>
+            </div>
+          </div>
+
+          <div>
+            Export all Mastopoof data - streams, cached statuses and settings
+            <div class="inputs">
+              <span>
+                <button @click=${this.exportUser}>Download</button>
+              </span>
+            </div>
+          </div>
         </div>
         <div slot="footer" class="centered">
           <button @click=${this.save} id="save">Save</button>
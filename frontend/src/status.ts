@@ -20,6 +20,9 @@ export interface StatusData {
   account: pb.Account;
   statusMeta?: storagepb.StatusMeta;
   streamStatusState?: storagepb.StreamStatusState;
+  // Names of the Mastodon filters warning about this status, as reported by
+  // the backend.
+  filterWarnings?: string[];
 }
 
 function qualifiedAccount(account: mastodon.Account): string {
@@ -164,6 +167,22 @@ export class MastStatus extends LitElement {
     this.runSetStatus(action);
   }
 
+  toggleReblog() {
+    let action = pb.SetStatusRequest_Action.REBLOG;
+    if (this.data?.status.reblogged) {
+      action = pb.SetStatusRequest_Action.UNREBLOG;
+    }
+    this.runSetStatus(action);
+  }
+
+  toggleBookmark() {
+    let action = pb.SetStatusRequest_Action.BOOKMARK;
+    if (this.data?.status.bookmarked) {
+      action = pb.SetStatusRequest_Action.UNBOOKMARK;
+    }
+    this.runSetStatus(action);
+  }
+
   copyRaw(status: mastodon.Status) {
     navigator.clipboard.writeText(JSON.stringify(status, null, "  "));
     console.log("JSON status copied to clipboard.");
@@ -175,14 +194,27 @@ export class MastStatus extends LitElement {
     var filteredAr: string[] = [];
     for (const filter of this.data.statusMeta?.filters ?? []) {
       if (filter.matched == true) {
-        filteredAr.push(filter.phrase);
+        filteredAr.push(filter.title || filter.phrase);
       }
     }
-    const filtered = filteredAr.join(", ");
+    const filtered = (this.data.filterWarnings ?? filteredAr).join(", ");
+
+    // Local filter rules asking to collapse the status.
+    const collapsedBy = (this.data.streamStatusState?.ruleMatches ?? [])
+      .filter(m => m.action === storagepb.FilterRule_Action.COLLAPSE)
+      .map(m => m.description)
+      .join(", ");
 
     const alreadySeen = this.data.streamStatusState?.alreadySeen === storagepb.StreamStatusState_AlreadySeen.YES;
 
-    const isOpen = this.forceShow === undefined ? (!filtered && !alreadySeen) : this.forceShow;
+    const deleted = !!this.data.streamStatusState?.deleted;
+    const edited = !!this.data.streamStatusState?.edited;
+    // Content was dropped from the cache by the retention policy.
+    const pruned = !!this.data.statusMeta?.pruned;
+    // Placed right after another status of the same conversation.
+    const threaded = !!this.data.streamStatusState?.threadContinuation;
+
+    const isOpen = this.forceShow === undefined ? (!filtered && !collapsedBy && !alreadySeen && !deleted) : this.forceShow;
 
     // This actual status - i.e., the reblogged one when it is a reblog, or
     // the basic one.
@@ -202,7 +234,7 @@ export class MastStatus extends LitElement {
     const openTarget = localStatusURL(this.data);
 
     return html`
-      <div class="status ${classMap({ read: this.isRead, unread: !this.isRead, hiddenstatus: !isOpen })}">
+      <div class="status ${classMap({ read: this.isRead, unread: !this.isRead, hiddenstatus: !isOpen, threaded: threaded })}">
         <div class="account">
           <span class="centered">
             <img class="avatar" src=${s.account.avatar}></img>
@@ -231,11 +263,15 @@ export class MastStatus extends LitElement {
           </div>
         ` : nothing}
 
-        ${s.sensitive || !!filtered || alreadySeen ? html`
+        ${s.sensitive || !!filtered || !!collapsedBy || alreadySeen || deleted || edited || pruned ? html`
           <div class=${classMap({ "spoilerbar": true, "sb-default": !isOpen || !s.sensitive, "sb-open-sensitive": isOpen && s.sensitive })}>
             <div>
               ${!!filtered ? html`<span class="tag-filter">filter(${filtered})</span>` : nothing}
+              ${!!collapsedBy ? html`<span class="tag-filter">rule(${collapsedBy})</span>` : nothing}
               ${alreadySeen ? html`<span class="tag-reblog">reblog</span>` : nothing}
+              ${deleted ? html`<span class="tag-deleted">deleted</span>` : nothing}
+              ${edited ? html`<span class="tag-edited">edited</span>` : nothing}
+              ${pruned ? html`<span class="tag-pruned">pruned</span>` : nothing}
               ${(!filtered || isOpen) && s.sensitive ? expandEmojis(s.spoiler_text) : nothing}
             </div>
             <div>
@@ -252,7 +288,9 @@ export class MastStatus extends LitElement {
 
         ${isOpen ? html`
             <div class="content">
-              ${expandEmojis(s.content, s.emojis)}
+              ${pruned ? html`
+                Content is no longer kept by Mastopoof - <a href=${s.url ?? ""} target="_blank">see it on the original server</a>.
+              ` : expandEmojis(s.content, s.emojis)}
             </div>
             ${this.renderQuote(s)}
             ${this.renderPoll(s)}
@@ -373,8 +411,8 @@ export class MastStatus extends LitElement {
           </div>
 
           <div>
-            <button disabled>
-              <span class="material-symbols-outlined" title="Boost">repeat</span>
+            <button @click=${() => this.toggleReblog()}>
+              <span class="material-symbols-outlined ${classMap({ "symbol-filled": !!this.data.status.reblogged })}" title="Boost">repeat</span>
             </button>
             <span class="count">${s.reblogs_count}</span>
           </div>
@@ -405,6 +443,13 @@ export class MastStatus extends LitElement {
             <span class="count">Refresh</span>
           </div>
 
+          <div>
+            <button @click="${() => this.toggleBookmark()}" title="Bookmark this status on Mastodon">
+              <span class="material-symbols-outlined ${classMap({ "symbol-filled": !!this.data.status.bookmarked })}">bookmark</span>
+            </button>
+            <span class="count">Bookmark</span>
+          </div>
+
           <div>
             <button @click="${() => this.markUnread()}" title="Mark as unread and move read-marker above">
               <span class="material-symbols-outlined">mark_as_unread</span>
@@ -523,12 +568,34 @@ export class MastStatus extends LitElement {
         padding: 2px;
       }
 
+      .threaded {
+        margin-left: 24px;
+      }
+
       .tag-reblog {
         border-radius: 8px;
         background-color: var(--color-grey-300);
         padding: 2px;
       }
 
+      .tag-deleted {
+        border-radius: 8px;
+        background-color: var(--color-grey-300);
+        padding: 2px;
+      }
+
+      .tag-edited {
+        border-radius: 8px;
+        background-color: var(--color-grey-300);
+        padding: 2px;
+      }
+
+      .tag-pruned {
+        border-radius: 8px;
+        background-color: var(--color-grey-300);
+        padding: 2px;
+      }
+
       .reblog {
         display: flex;
         align-items: center;
@@ -63,6 +63,9 @@ export class MastStream extends LitElement {
   private triggerFetchWaiters: (() => void)[] = [];
   private clearBackgroundFetch: (() => void) | undefined;
 
+  // Stops watching changes of the stream info.
+  private watchAbort?: AbortController;
+
   connectedCallback(): void {
     super.connectedCallback();
     this.observer = new IntersectionObserver(
@@ -78,6 +81,12 @@ export class MastStream extends LitElement {
       }
     }) as EventListener);
 
+    // Follow changes done elsewhere - e.g., read marker moved on another device.
+    if (this.stid) {
+      this.watchAbort = new AbortController();
+      common.backend.watchStream(this.stid, this.watchAbort.signal);
+    }
+
     // Start background fetching.
     this.backgroundFetch();
     // ... and request an initial fetch.
@@ -90,6 +99,7 @@ export class MastStream extends LitElement {
   disconnectedCallback() {
     super.disconnectedCallback();
     this.observer?.disconnect();
+    this.watchAbort?.abort();
     if (this.clearBackgroundFetch) {
       this.clearBackgroundFetch();
     }
@@ -256,6 +266,7 @@ export class MastStream extends LitElement {
           account: item.account!,
           statusMeta: item.meta!,   // TODO: check presence
           streamStatusState: item.streamStatusState!,
+          filterWarnings: item.filterWarnings,
         },
         isVisible: false,
         wasSeen: false,
@@ -318,6 +329,7 @@ export class MastStream extends LitElement {
           account: item.account!,
           statusMeta: item.meta!,  // TODO: check presence
           streamStatusState: item.streamStatusState!,
+          filterWarnings: item.filterWarnings,
         },
         isVisible: false,
         wasSeen: false,